@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/eventtime"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	metaBucket    = "__meta__"
+	eventsBucket  = "__events__"
+	firedBucket   = "__fired__"
+	watermarkKey  = "watermark"
+	processorName = "aggregator"
+	outputTable   = "aggregator"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Aggregate stream messages grouped by key over time windows",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to aggregate",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "extract the json field as group key in stream messages, all messages in one group if not set, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "fields",
+				Value: "",
+				Usage: "comma separated json fields to compute sum/min/max/avg of, messages are counted per group anyway",
+			},
+			&cli.StringFlag{
+				Name:  "percentiles",
+				Value: "",
+				Usage: "comma separated percentiles of the fields to estimate with t-digests, e.g.: 50,90,99",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Value: time.Minute,
+				Usage: "size of the windows, windows are emitted when the timestamps of the messages pass their end",
+			},
+			&cli.StringFlag{
+				Name:  "window-type",
+				Value: "tumbling",
+				Usage: "tumbling: consecutive windows, hopping: windows starting every advance, sliding: a window ending at each message",
+			},
+			&cli.DurationFlag{
+				Name:  "advance",
+				Usage: "interval between the starts of hopping windows, at most window",
+			},
+			&cli.StringFlag{
+				Name:  "event-time-path",
+				Value: "",
+				Usage: "extract the json field as event time of stream messages, the timestamps of kafka messages if not set",
+			},
+			&cli.StringFlag{
+				Name:  "event-time-format",
+				Value: "rfc3339",
+				Usage: "format of event times, rfc3339, unix, unix_ms, unix_us, unix_ns or a layout such as \"2006-01-02 15:04:05\"",
+			},
+			&cli.DurationFlag{
+				Name:  "max-out-of-orderness",
+				Value: 0,
+				Usage: "delay of the watermark behind the greatest event time seen, messages out of order within it are aggregated into their windows",
+			},
+			&cli.DurationFlag{
+				Name:  "allowed-lateness",
+				Value: 0,
+				Usage: "keep fired windows for the duration past the watermark, late messages within it update the windows and the results are emitted again, with late-policy update",
+			},
+			&cli.StringFlag{
+				Name:  "late-policy",
+				Value: "drop",
+				Usage: "handling of the messages later than their windows, drop: discard, update: emit updated results within allowed-lateness, topic: route to late-topic",
+			},
+			&cli.StringFlag{
+				Name:  "late-topic",
+				Value: "",
+				Usage: "topic of the late messages with late-policy topic, default: aggregator-{stream-topic}-late",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: aggregator-{stream-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of windows and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	key_path := c.String("key")
+	var fields []string
+	if f := c.String("fields"); f != "" {
+		fields = strings.Split(f, ",")
+	}
+	var percentiles []float64
+	if ps := c.String("percentiles"); ps != "" {
+		for _, p := range strings.Split(ps, ",") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(p), "p"), 64)
+			if err != nil || v < 0 || v > 100 {
+				log.Fatalln("invalid percentile:", p)
+			}
+			percentiles = append(percentiles, v)
+		}
+	}
+	window_size := c.Duration("window")
+	window_type := c.String("window-type")
+	advance := c.Duration("advance")
+	event_time_path := c.String("event-time-path")
+	event_time_format := c.String("event-time-format")
+	max_out_of_orderness := c.Duration("max-out-of-orderness")
+	allowed_lateness := c.Duration("allowed-lateness")
+	late_policy := c.String("late-policy")
+	late_topic := c.String("late-topic")
+	if late_topic == "" {
+		late_topic = fmt.Sprintf("aggregator-%v-late", stream_topic)
+	}
+	format_name := c.String("format")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("aggregator-%v", stream_topic)
+	}
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("key:", key_path)
+	log.Println("fields:", fields)
+	log.Println("percentiles:", percentiles)
+	log.Println("window:", window_size)
+	log.Println("window-type:", window_type)
+	log.Println("advance:", advance)
+	log.Println("event-time-path:", event_time_path)
+	log.Println("event-time-format:", event_time_format)
+	log.Println("max-out-of-orderness:", max_out_of_orderness)
+	log.Println("allowed-lateness:", allowed_lateness)
+	log.Println("late-policy:", late_policy)
+	log.Println("late-topic:", late_topic)
+	log.Println("format:", format_name)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".aggregator-%v-%v.cache", stream_topic, output_topic)
+	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	log.Println("cache file:", cachefile)
+	log.Println("instanceId:", instanceId)
+
+	if window_size <= 0 {
+		log.Fatalln("window must be positive")
+	}
+	switch window_type {
+	case "tumbling", "sliding":
+	case "hopping":
+		if advance <= 0 || advance > window_size {
+			log.Fatalln("advance of hopping windows must be positive and at most window")
+		}
+	default:
+		log.Fatalln("unsupported window-type:", window_type)
+	}
+
+	if len(percentiles) > 0 && len(fields) == 0 {
+		log.Fatalln("percentiles need fields")
+	}
+	if max_out_of_orderness < 0 {
+		log.Fatalln("max-out-of-orderness must not be negative")
+	}
+	if allowed_lateness < 0 {
+		log.Fatalln("allowed-lateness must not be negative")
+	}
+	switch late_policy {
+	case "drop", "topic":
+		if allowed_lateness > 0 {
+			log.Fatalln("allowed-lateness needs late-policy update")
+		}
+	case "update":
+		if window_type == "sliding" {
+			log.Fatalln("late-policy update needs tumbling or hopping windows")
+		}
+	default:
+		log.Fatalln("unsupported late-policy:", late_policy)
+	}
+	eventTime, err := eventtime.NewExtractor(event_time_path, event_time_format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// window results in flight, offsets are only committed after all
+	// results produced before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	ws := newWindows(store, processorName, window_type, window_size, advance, max_out_of_orderness, allowed_lateness, percentiles)
+	ws.load()
+	log.Printf("consuming from stream offsets:%v open windows:%v fired windows:%v watermark:%v", streamOffsets, len(ws.open), len(ws.fired), ws.watermark)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numAggregated, numLate, numInvalid, numEmitted := 0, 0, 0, 0
+
+	// parameters
+	host, _ := os.Hostname()
+
+	emit := func(w *window) {
+		data, err := json.Marshal(w)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		wal := &sp.WAL{}
+		wal.Type = "AGGREGATE"
+		wal.InstanceId = instanceId
+		wal.Table = outputTable
+		wal.Host = host
+		wal.Data = data
+		wal.Key = fmt.Sprintf("%v-%v", w.Key, w.Start.UnixNano()) // one result per key and window
+		wal.CreatedAt = time.Now()
+		bts, err := json.Marshal(wal)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Key: sarama.StringEncoder(w.Key), Value: sarama.ByteEncoder(bts)}
+		numEmitted++
+	}
+
+	// late routes the messages of closed windows unchanged to the late topic
+	late := func(msg *sarama.ConsumerMessage) {
+		numLate++
+		if late_policy != "topic" {
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- &sarama.ProducerMessage{Topic: late_topic, Key: sarama.ByteEncoder(msg.Key), Value: sarama.ByteEncoder(msg.Value)}
+	}
+
+	aggregate := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		jsonParsed, err := gabs.ParseJSON(value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		key := ""
+		if key_path != "" {
+			v := jsonParsed.Path(key_path).Data()
+			if v == nil {
+				numInvalid++
+				return
+			}
+			key = fmt.Sprint(v)
+		}
+		ts, err := eventTime.Time(msg, jsonParsed)
+		if err != nil {
+			numInvalid++
+			return
+		}
+
+		if ws.add(key, ts, fieldValues(jsonParsed, fields)) {
+			numAggregated++
+		} else {
+			late(msg)
+		}
+		for _, w := range ws.close() {
+			emit(w)
+		}
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		if err := ws.flush(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("aggregated:", numAggregated, "late:", numLate, "invalid:", numInvalid, "emitted:", numEmitted, "open windows:", len(ws.open), "fired windows:", len(ws.fired), "watermark:", ws.watermark, "stream offsets:", streamOffsets)
+		numAggregated, numLate, numInvalid, numEmitted = 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			aggregate(msg)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// compression of the digests, more compression keeps more centroids for
+// more accurate percentiles
+const compression = 100
+
+// centroid is the mean of Count values
+type centroid struct {
+	Mean  float64 `json:"mean"`
+	Count float64 `json:"count"`
+}
+
+// tdigest estimates the quantiles of a field with a merging t-digest:
+// values are merged into centroids, small near the tails so that extreme
+// quantiles like p99 stay accurate, at most about compression centroids
+type tdigest struct {
+	Compression float64    `json:"compression"`
+	Centroids   []centroid `json:"centroids"`
+	unmerged    []centroid
+}
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{Compression: compression}
+}
+
+func (d *tdigest) add(v float64) {
+	d.unmerged = append(d.unmerged, centroid{v, 1})
+	if len(d.unmerged) >= int(5*d.Compression) {
+		d.compress()
+	}
+}
+
+// MarshalJSON merges the values added before marshaling the centroids
+func (d *tdigest) MarshalJSON() ([]byte, error) {
+	d.compress()
+	type plain tdigest
+	return json.Marshal((*plain)(d))
+}
+
+// merge adds the centroids of another digest
+func (d *tdigest) merge(o *tdigest) {
+	o.compress()
+	d.unmerged = append(d.unmerged, o.Centroids...)
+	d.compress()
+}
+
+// compress merges the values added into the centroids, a centroid covering
+// the quantiles around q holds at most 4*n*q*(1-q)/compression values
+func (d *tdigest) compress() {
+	if len(d.unmerged) == 0 {
+		return
+	}
+	all := append(d.Centroids, d.unmerged...)
+	d.unmerged = nil
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+	n := 0.0
+	for _, c := range all {
+		n += c.Count
+	}
+
+	merged := all[:1:1]
+	seen := 0.0 // values before the last centroid
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		q := (seen + (last.Count+c.Count)/2) / n
+		if last.Count+c.Count <= math.Max(1, 4*n*q*(1-q)/d.Compression) {
+			last.Mean += (c.Mean - last.Mean) * c.Count / (last.Count + c.Count)
+			last.Count += c.Count
+			continue
+		}
+		seen += last.Count
+		merged = append(merged, c)
+	}
+	d.Centroids = merged
+}
+
+// quantile estimates the value at quantile q in [0, 1], interpolating
+// between the means of the centroids
+func (d *tdigest) quantile(q float64) float64 {
+	d.compress()
+	cs := d.Centroids
+	if len(cs) == 0 {
+		return math.NaN()
+	}
+	if len(cs) == 1 || q <= 0 {
+		return cs[0].Mean
+	}
+	n := 0.0
+	for _, c := range cs {
+		n += c.Count
+	}
+	if q >= 1 {
+		return cs[len(cs)-1].Mean
+	}
+
+	// the centers of the centroids are at the middle of their values
+	target := q * n
+	center := cs[0].Count / 2
+	if target <= center {
+		return cs[0].Mean
+	}
+	for i := 1; i < len(cs); i++ {
+		next := center + (cs[i-1].Count+cs[i].Count)/2
+		if target <= next {
+			f := (target - center) / (next - center)
+			return cs[i-1].Mean + f*(cs[i].Mean-cs[i-1].Mean)
+		}
+		center = next
+	}
+	return cs[len(cs)-1].Mean
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTDigestQuantile(t *testing.T) {
+	uniform := func(i int, rnd *rand.Rand) float64 { return rnd.Float64() * 1000 }
+	sequence := func(i int, rnd *rand.Rand) float64 { return float64(i) }
+	exponential := func(i int, rnd *rand.Rand) float64 { return rnd.ExpFloat64() }
+
+	tests := []struct {
+		name   string
+		n      int
+		value  func(i int, rnd *rand.Rand) float64
+		q      float64
+		want   float64
+		within float64
+	}{
+		{"single", 1, sequence, 0.5, 0, 0},
+		{"sequence min", 10000, sequence, 0, 0, 0},
+		{"sequence max", 10000, sequence, 1, 9999, 0},
+		{"sequence median", 10000, sequence, 0.5, 5000, 50},
+		{"sequence p99", 10000, sequence, 0.99, 9900, 10},
+		{"uniform p50", 100000, uniform, 0.5, 500, 10},
+		{"uniform p90", 100000, uniform, 0.9, 900, 10},
+		{"uniform p999", 100000, uniform, 0.999, 999, 2},
+		{"exponential p50", 100000, exponential, 0.5, math.Ln2, 0.02},
+		{"exponential p99", 100000, exponential, 0.99, math.Log(100), 0.1},
+	}
+	for _, tt := range tests {
+		rnd := rand.New(rand.NewSource(1))
+		d := newTDigest(compression)
+		for i := 0; i < tt.n; i++ {
+			d.add(tt.value(i, rnd))
+		}
+		if got := d.quantile(tt.q); math.Abs(got-tt.want) > tt.within {
+			t.Fatalf("%v: quantile %v = %v, want %v ± %v", tt.name, tt.q, got, tt.want, tt.within)
+		}
+	}
+
+	if !math.IsNaN(newTDigest(compression).quantile(0.5)) {
+		t.Fatal("quantile of an empty digest is not NaN")
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	a, b := newTDigest(compression), newTDigest(compression)
+	for i := 0; i < 5000; i++ {
+		a.add(float64(i))
+		b.add(float64(i + 5000))
+	}
+	a.merge(b)
+	count := 0.0
+	for _, c := range a.Centroids {
+		count += c.Count
+	}
+	if count != 10000 {
+		t.Fatalf("merged count %v", count)
+	}
+	if got := a.quantile(0.5); math.Abs(got-5000) > 50 {
+		t.Fatalf("merged median %v", got)
+	}
+}
+
+func TestTDigestJSON(t *testing.T) {
+	d := newTDigest(compression)
+	for i := 0; i < 1000; i++ {
+		d.add(float64(i)) // unmerged values are merged by MarshalJSON
+	}
+	bts, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tdigest
+	if err := json.Unmarshal(bts, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []float64{0, 0.25, 0.5, 0.99, 1} {
+		if got, want := decoded.quantile(q), d.quantile(q); got != want {
+			t.Fatalf("decoded quantile %v = %v, want %v", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fieldStats aggregates the numeric values of a field within a window
+type fieldStats struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+
+	// the digest of open windows estimates the percentiles emitted
+	Digest      *tdigest           `json:"digest,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+func (s *fieldStats) add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+	s.Avg = s.Sum / float64(s.Count)
+	if s.Digest != nil {
+		s.Digest.add(v)
+	}
+}
+
+// percentiles replaces the digest by the percentiles ps, e.g. 99 as p99
+func (s *fieldStats) percentiles(ps []float64) {
+	if s.Digest == nil {
+		return
+	}
+	s.Percentiles = make(map[string]float64, len(ps))
+	for _, p := range ps {
+		s.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = s.Digest.quantile(p / 100)
+	}
+	s.Digest = nil
+}
+
+// window aggregates the messages of a key within [Start, End)
+type window struct {
+	Key    string                 `json:"key"`
+	Start  time.Time              `json:"window_start"`
+	End    time.Time              `json:"window_end"`
+	Count  int64                  `json:"count"`
+	Fields map[string]*fieldStats `json:"fields,omitempty"`
+}
+
+// add aggregates the field values of a message, with digests of the
+// values if digest
+func (w *window) add(values map[string]float64, digest bool) {
+	w.Count++
+	for field, v := range values {
+		if w.Fields == nil {
+			w.Fields = make(map[string]*fieldStats)
+		}
+		s, ok := w.Fields[field]
+		if !ok {
+			s = &fieldStats{}
+			if digest {
+				s.Digest = newTDigest(compression)
+			}
+			w.Fields[field] = s
+		}
+		s.add(v)
+	}
+}
+
+// result copies the window with the percentiles ps estimated by the digests
+// of its fields, the digests are kept for the updates of late messages
+func (w *window) result(ps []float64) *window {
+	r := *w
+	if w.Fields != nil {
+		r.Fields = make(map[string]*fieldStats, len(w.Fields))
+		for field, s := range w.Fields {
+			c := *s
+			c.percentiles(ps)
+			r.Fields[field] = &c
+		}
+	}
+	return &r
+}
+
+// fieldValues extracts the fields of a message, fields missing or not
+// numeric are not aggregated
+func fieldValues(data *gabs.Container, fields []string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, field := range fields {
+		if v, ok := number(data.Path(field).Data()); ok {
+			values[field] = v
+		}
+	}
+	return values
+}
+
+// event is a message kept for sliding windows
+type event struct {
+	Timestamp time.Time          `json:"ts"`
+	Values    map[string]float64 `json:"values,omitempty"`
+}
+
+// storeKey is the start of the window followed by the key, so that windows
+// are stored in the order of their start
+func (w *window) storeKey() string {
+	k := make([]byte, 8, 8+len(w.Key))
+	binary.BigEndian.PutUint64(k, uint64(w.Start.UnixNano()))
+	return string(append(k, w.Key...))
+}
+
+// number converts json numbers and numeric strings
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, !math.IsNaN(v)
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+// windows are the open windows, stored in a bucket of the state store on
+// checkpoint; windows close when the watermark, the greatest timestamp of
+// the messages minus the out-of-orderness lag, passes their end.
+//
+// fired windows are kept until the watermark passes their end by the
+// allowed lateness, late messages are aggregated into them and the updated
+// windows fired again.
+//
+// tumbling windows are aligned to the epoch and don't overlap, hopping
+// windows start every advance and overlap if advance is less than size,
+// sliding windows end at each message and aggregate the messages of the key
+// within size before it.
+type windows struct {
+	store    state.Store
+	bucket   string
+	kind     string
+	size     time.Duration
+	advance  time.Duration
+	lag      time.Duration // of the watermark behind the greatest timestamp
+	lateness time.Duration // fired windows are kept for
+
+	percentiles []float64 // estimated of each field if set
+
+	events      map[string][]event // messages of the keys within size, sliding windows only
+	dirtyEvents map[string]bool
+
+	open      map[string]*window
+	dirty     map[string]bool // windows changed since last checkpoint
+	nextClose time.Time       // earliest end of the open windows
+	watermark time.Time
+
+	fired      map[string]*window // kept within the allowed lateness
+	dirtyFired map[string]bool
+	updated    map[string]bool // fired windows changed by late messages
+	nextPurge  time.Time       // earliest end of the fired windows
+}
+
+func newWindows(store state.Store, bucket, kind string, size, advance, lag, lateness time.Duration, percentiles []float64) *windows {
+	return &windows{
+		store:       store,
+		bucket:      bucket,
+		kind:        kind,
+		size:        size,
+		advance:     advance,
+		lag:         lag,
+		lateness:    lateness,
+		percentiles: percentiles,
+		events:      make(map[string][]event),
+		dirtyEvents: make(map[string]bool),
+		open:        make(map[string]*window),
+		dirty:       make(map[string]bool),
+		fired:       make(map[string]*window),
+		dirtyFired:  make(map[string]bool),
+		updated:     make(map[string]bool),
+	}
+}
+
+// starts returns the starts of the tumbling or hopping windows containing ts
+func (ws *windows) starts(ts time.Time) []time.Time {
+	if ws.kind != "hopping" {
+		return []time.Time{ts.Truncate(ws.size)}
+	}
+	var starts []time.Time
+	for start := ts.Truncate(ws.advance); start.Add(ws.size).After(ts); start = start.Add(-ws.advance) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// add aggregates a message of key at ts into its windows, returns false if
+// the message is late for all its windows, which are already fired and
+// beyond the allowed lateness
+func (ws *windows) add(key string, ts time.Time, values map[string]float64) bool {
+	if wm := ts.Add(-ws.lag); wm.After(ws.watermark) {
+		ws.watermark = wm
+	}
+	if ws.kind == "sliding" {
+		return ws.slide(key, ts, values)
+	}
+
+	added := false
+	for _, start := range ws.starts(ts) {
+		w := &window{Key: key, Start: start, End: start.Add(ws.size)}
+		if !ws.watermark.Before(w.End.Add(ws.lateness)) { // closed
+			continue
+		}
+		added = true
+		id := w.storeKey()
+		if !ws.watermark.Before(w.End) { // fired, updated within the allowed lateness
+			if fired, ok := ws.fired[id]; ok {
+				w = fired
+			} else {
+				ws.fired[id] = w
+				if ws.nextPurge.IsZero() || w.End.Before(ws.nextPurge) {
+					ws.nextPurge = w.End
+				}
+			}
+			w.add(values, len(ws.percentiles) > 0)
+			ws.dirtyFired[id] = true
+			ws.updated[id] = true
+			continue
+		}
+		if open, ok := ws.open[id]; ok {
+			w = open
+		} else {
+			ws.open[id] = w
+			if ws.nextClose.IsZero() || w.End.Before(ws.nextClose) {
+				ws.nextClose = w.End
+			}
+		}
+		w.add(values, len(ws.percentiles) > 0)
+		ws.dirty[id] = true
+	}
+	return added
+}
+
+// slide opens the window of key ending at ts with the messages of key
+// within size before, messages older than size before the watermark are
+// late
+func (ws *windows) slide(key string, ts time.Time, values map[string]float64) bool {
+	if ts.Before(ws.watermark.Add(-ws.size)) {
+		return false
+	}
+	events := ws.events[key]
+	i := sort.Search(len(events), func(i int) bool { return events[i].Timestamp.After(ts) })
+	events = append(events, event{})
+	copy(events[i+1:], events[i:])
+	events[i] = event{ts, values}
+	ws.events[key] = events
+	ws.dirtyEvents[key] = true
+
+	w := &window{Key: key, Start: ts.Add(-ws.size), End: ts}
+	for _, e := range events {
+		if !e.Timestamp.Before(w.Start) && !e.Timestamp.After(w.End) {
+			w.add(e.Values, len(ws.percentiles) > 0)
+		}
+	}
+	id := w.storeKey()
+	ws.open[id] = w
+	ws.dirty[id] = true
+	if ws.nextClose.IsZero() || w.End.Before(ws.nextClose) {
+		ws.nextClose = w.End
+	}
+	return true
+}
+
+// expire drops the messages kept for sliding windows older than size
+// before the watermark
+func (ws *windows) expire() {
+	deadline := ws.watermark.Add(-ws.size)
+	for key, events := range ws.events {
+		i := sort.Search(len(events), func(i int) bool { return !events[i].Timestamp.Before(deadline) })
+		if i == 0 {
+			continue
+		}
+		if i == len(events) {
+			delete(ws.events, key)
+		} else {
+			ws.events[key] = append([]event(nil), events[i:]...)
+		}
+		ws.dirtyEvents[key] = true
+	}
+}
+
+// close fires the windows ended at the watermark and the fired windows
+// updated by late messages, returned in the order of their end
+func (ws *windows) close() []*window {
+	watermark := ws.watermark
+	ws.purge()
+	if len(ws.updated) == 0 && (ws.nextClose.IsZero() || watermark.Before(ws.nextClose)) {
+		return nil
+	}
+
+	var closed []*window
+	for id := range ws.updated {
+		closed = append(closed, ws.fired[id].result(ws.percentiles))
+	}
+	ws.updated = make(map[string]bool)
+	if ws.nextClose.IsZero() || watermark.Before(ws.nextClose) {
+		return sortWindows(closed)
+	}
+
+	ws.nextClose = time.Time{}
+	for id, w := range ws.open {
+		if !watermark.Before(w.End) {
+			closed = append(closed, w.result(ws.percentiles))
+			delete(ws.open, id)
+			delete(ws.dirty, id)
+			if err := ws.store.Delete(ws.bucket, []byte(id)); err != nil {
+				log.Fatalln(err)
+			}
+			if watermark.Before(w.End.Add(ws.lateness)) {
+				ws.fired[id] = w
+				ws.dirtyFired[id] = true
+				if ws.nextPurge.IsZero() || w.End.Before(ws.nextPurge) {
+					ws.nextPurge = w.End
+				}
+			}
+		} else if ws.nextClose.IsZero() || w.End.Before(ws.nextClose) {
+			ws.nextClose = w.End
+		}
+	}
+	return sortWindows(closed)
+}
+
+// purge removes the fired windows beyond the allowed lateness at the
+// watermark
+func (ws *windows) purge() {
+	if ws.nextPurge.IsZero() || ws.watermark.Before(ws.nextPurge.Add(ws.lateness)) {
+		return
+	}
+	ws.nextPurge = time.Time{}
+	for id, w := range ws.fired {
+		if !ws.watermark.Before(w.End.Add(ws.lateness)) {
+			delete(ws.fired, id)
+			delete(ws.dirtyFired, id)
+			if err := ws.store.Delete(firedBucket, []byte(id)); err != nil {
+				log.Fatalln(err)
+			}
+		} else if ws.nextPurge.IsZero() || w.End.Before(ws.nextPurge) {
+			ws.nextPurge = w.End
+		}
+	}
+}
+
+// sortWindows sorts windows by end and key
+func sortWindows(closed []*window) []*window {
+	sort.Slice(closed, func(i, j int) bool {
+		if !closed[i].End.Equal(closed[j].End) {
+			return closed[i].End.Before(closed[j].End)
+		}
+		return closed[i].Key < closed[j].Key
+	})
+	return closed
+}
+
+// flush puts the windows changed since the last checkpoint and the
+// watermark to the store
+func (ws *windows) flush() error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(ws.watermark.UnixNano()))
+	if err := ws.store.Put(metaBucket, []byte(watermarkKey), v); err != nil {
+		return err
+	}
+	for id := range ws.dirty {
+		bts, err := json.Marshal(ws.open[id])
+		if err != nil {
+			return err
+		}
+		if err := ws.store.Put(ws.bucket, []byte(id), bts); err != nil {
+			return err
+		}
+	}
+	ws.dirty = make(map[string]bool)
+	for id := range ws.dirtyFired {
+		bts, err := json.Marshal(ws.fired[id])
+		if err != nil {
+			return err
+		}
+		if err := ws.store.Put(firedBucket, []byte(id), bts); err != nil {
+			return err
+		}
+	}
+	ws.dirtyFired = make(map[string]bool)
+
+	ws.expire()
+	for key := range ws.dirtyEvents {
+		events, ok := ws.events[key]
+		if !ok {
+			if err := ws.store.Delete(eventsBucket, []byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		bts, err := json.Marshal(events)
+		if err != nil {
+			return err
+		}
+		if err := ws.store.Put(eventsBucket, []byte(key), bts); err != nil {
+			return err
+		}
+	}
+	ws.dirtyEvents = make(map[string]bool)
+	return nil
+}
+
+// load reads the open and fired windows and the watermark
+func (ws *windows) load() {
+	if v, err := ws.store.Get(metaBucket, []byte(watermarkKey)); err != nil {
+		log.Fatalln(err)
+	} else if len(v) == 8 {
+		ws.watermark = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	if err := ws.store.Iterate(ws.bucket, func(k, v []byte) error {
+		w := &window{}
+		if err := json.Unmarshal(v, w); err != nil {
+			return fmt.Errorf("window %q: %v", k, err)
+		}
+		ws.open[string(k)] = w
+		if ws.nextClose.IsZero() || w.End.Before(ws.nextClose) {
+			ws.nextClose = w.End
+		}
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	if err := ws.store.Iterate(firedBucket, func(k, v []byte) error {
+		w := &window{}
+		if err := json.Unmarshal(v, w); err != nil {
+			return fmt.Errorf("fired window %q: %v", k, err)
+		}
+		ws.fired[string(k)] = w
+		if ws.nextPurge.IsZero() || w.End.Before(ws.nextPurge) {
+			ws.nextPurge = w.End
+		}
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	if err := ws.store.Iterate(eventsBucket, func(k, v []byte) error {
+		var events []event
+		if err := json.Unmarshal(v, &events); err != nil {
+			return fmt.Errorf("events %q: %v", k, err)
+		}
+		ws.events[string(k)] = events
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
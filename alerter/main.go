@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	metaBucket    = "__meta__"
+	alertsBucket  = "__alerts__"
+	watermarkKey  = "watermark"
+	processorName = "alerter"
+	outputTable   = "alerter"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Alert on rules over the aggregates of stream messages in time windows",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to alert on",
+			},
+			&cli.StringFlag{
+				Name:  "group",
+				Value: "",
+				Usage: "extract the json field as group in stream messages, e.g. the service, rules are evaluated per group, all messages in one group if not set, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringSliceFlag{
+				Name:  "count-if",
+				Usage: "name=predicate counting the messages satisfying the predicate in each window, e.g.: --count-if 'errors=status == \"error\"'",
+			},
+			&cli.StringFlag{
+				Name:  "fields",
+				Value: "",
+				Usage: "comma separated json fields to compute count/sum/min/max/avg of in each window",
+			},
+			&cli.StringSliceFlag{
+				Name:  "rule",
+				Usage: "name=predicate over count, the counters and the fields of a window firing an alert while satisfied, e.g.: --rule 'error_rate=errors / count > 0.05'",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Value: 5 * time.Minute,
+				Usage: "size of the tumbling windows rules are evaluated on, when the timestamps of the messages pass their end",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: alerter-{stream-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "webhook",
+				Value: "",
+				Usage: "url to post alerts to as json, besides output-topic",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of windows, alerts firing and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	group_path := c.String("group")
+	count_if := c.StringSlice("count-if")
+	var fields []string
+	if f := c.String("fields"); f != "" {
+		fields = strings.Split(f, ",")
+	}
+	rule_flags := c.StringSlice("rule")
+	window_size := c.Duration("window")
+	format_name := c.String("format")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("alerter-%v", stream_topic)
+	}
+	webhook := c.String("webhook")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("group:", group_path)
+	log.Println("count-if:", count_if)
+	log.Println("fields:", fields)
+	log.Println("rule:", rule_flags)
+	log.Println("window:", window_size)
+	log.Println("format:", format_name)
+	log.Println("output-topic:", output_topic)
+	log.Println("webhook:", webhook)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".alerter-%v-%v.cache", stream_topic, output_topic)
+	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	log.Println("cache file:", cachefile)
+	log.Println("instanceId:", instanceId)
+
+	if window_size <= 0 {
+		log.Fatalln("window must be positive")
+	}
+	counters, err := parseNamed("count-if", count_if)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rules, err := parseNamed("rule", rule_flags)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(rules) == 0 {
+		log.Fatalln("rule must be set")
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// alerts in flight, offsets are only committed after all alerts
+	// produced before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	ws := newWindows(store, processorName, window_size)
+	ws.load()
+	as := newAlerts(store, alertsBucket, rules)
+	as.load()
+	log.Printf("consuming from stream offsets:%v open windows:%v alerts firing:%v watermark:%v", streamOffsets, len(ws.open), len(as.firing), ws.watermark)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numAggregated, numLate, numInvalid, numFiring, numResolved := 0, 0, 0, 0, 0
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	// parameters
+	host, _ := os.Hostname()
+
+	emit := func(a *Alert) {
+		data, err := json.Marshal(a)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if a.Status == "firing" {
+			numFiring++
+		} else {
+			numResolved++
+		}
+		log.Printf("alert %v: rule:%v group:%v window:%v", a.Status, a.Rule, a.Group, a.WindowEnd)
+
+		wal := &sp.WAL{}
+		wal.Type = "ALERT"
+		wal.InstanceId = instanceId
+		wal.Table = outputTable
+		wal.Host = host
+		wal.Data = data
+		wal.Key = fmt.Sprintf("%v-%v-%v-%v", a.Rule, a.Group, a.Status, a.WindowEnd.UnixNano())
+		wal.CreatedAt = time.Now()
+		bts, err := json.Marshal(wal)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Key: sarama.StringEncoder(a.Rule + "-" + a.Group), Value: sarama.ByteEncoder(bts)}
+
+		if webhook != "" {
+			resp, err := client.Post(webhook, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Println("webhook:", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Println("webhook:", resp.Status)
+			}
+		}
+	}
+
+	aggregate := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		jsonParsed, err := gabs.ParseJSON(value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		doc, ok := jsonParsed.Data().(map[string]interface{})
+		if !ok {
+			numInvalid++
+			return
+		}
+		group := ""
+		if group_path != "" {
+			v := jsonParsed.Path(group_path).Data()
+			if v == nil {
+				numInvalid++
+				return
+			}
+			group = fmt.Sprint(v)
+		}
+		ts := msg.Timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+
+		if ws.add(group, ts, doc, counters, fields) {
+			numAggregated++
+		} else {
+			numLate++
+		}
+		for _, closed := range ws.close() {
+			alerts, err := as.evaluate(closed, closed[0].Start, closed[0].End)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			for _, a := range alerts {
+				emit(a)
+			}
+		}
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		if err := ws.flush(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("aggregated:", numAggregated, "late:", numLate, "invalid:", numInvalid, "firing:", numFiring, "resolved:", numResolved, "alerts firing:", len(as.firing), "open windows:", len(ws.open), "watermark:", ws.watermark, "stream offsets:", streamOffsets)
+		numAggregated, numLate, numInvalid, numFiring, numResolved = 0, 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			aggregate(msg)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// named is a name=expression flag, the name of a counter or a rule
+type named struct {
+	name string
+	expr *expr.Expr
+}
+
+func parseNamed(flag string, values []string) ([]named, error) {
+	var ns []named
+	for _, v := range values {
+		i := strings.IndexByte(v, '=')
+		if i <= 0 || i == len(v)-1 || v[i+1] == '=' {
+			return nil, fmt.Errorf("%v %q: expect name=expression", flag, v)
+		}
+		e, err := expr.Compile(v[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%v %q: %v", flag, v, err)
+		}
+		ns = append(ns, named{strings.TrimSpace(v[:i]), e})
+	}
+	return ns, nil
+}
+
+// Alert is the event of a rule starting or stopping to fire for a group
+type Alert struct {
+	Rule        string                 `json:"rule"`
+	Group       string                 `json:"group"`
+	Status      string                 `json:"status"` // firing or resolved
+	Since       time.Time              `json:"since"`  // end of the first window firing
+	WindowStart time.Time              `json:"window_start"`
+	WindowEnd   time.Time              `json:"window_end"`
+	Values      map[string]interface{} `json:"values"` // aggregates of the window
+}
+
+// alerts tracks the rules firing of each group in a bucket of the state
+// store, so that alerts fire and resolve once across restarts
+type alerts struct {
+	store  state.Store
+	bucket string
+	rules  []named
+	firing map[string]*Alert // by alertKey
+}
+
+func newAlerts(store state.Store, bucket string, rules []named) *alerts {
+	return &alerts{store: store, bucket: bucket, rules: rules, firing: make(map[string]*Alert)}
+}
+
+func alertKey(rule, group string) string { return rule + "\x00" + group }
+
+// evaluate applies the rules to the closed windows, groups firing without
+// messages in these windows are evaluated on empty windows; returns the
+// alerts changing status
+func (as *alerts) evaluate(closed []*window, start, end time.Time) ([]*Alert, error) {
+	groups := make(map[string]bool)
+	for _, w := range closed {
+		groups[w.Group] = true
+	}
+	var missing []string
+	for _, a := range as.firing {
+		if !groups[a.Group] {
+			groups[a.Group] = true
+			missing = append(missing, a.Group)
+		}
+	}
+	sort.Strings(missing)
+	for _, group := range missing {
+		closed = append(closed, &window{Group: group, Start: start, End: end})
+	}
+
+	var changed []*Alert
+	for _, w := range closed {
+		env := w.env()
+		for _, rule := range as.rules {
+			ok, err := rule.expr.Bool(env)
+			fires := err == nil && ok // e.g. divisions by a zero count don't fire
+			id := alertKey(rule.name, w.Group)
+			a, firing := as.firing[id]
+			switch {
+			case fires && !firing:
+				a = &Alert{Rule: rule.name, Group: w.Group, Status: "firing", Since: w.End}
+				as.firing[id] = a
+			case !fires && firing:
+				delete(as.firing, id)
+				a.Status = "resolved"
+			default:
+				continue
+			}
+			a.WindowStart, a.WindowEnd, a.Values = w.Start, w.End, env
+
+			if a.Status == "firing" {
+				bts, err := json.Marshal(a)
+				if err != nil {
+					return nil, err
+				}
+				if err := as.store.Put(as.bucket, []byte(id), bts); err != nil {
+					return nil, err
+				}
+			} else if err := as.store.Delete(as.bucket, []byte(id)); err != nil {
+				return nil, err
+			}
+			changed = append(changed, a)
+		}
+	}
+	return changed, nil
+}
+
+// load reads the alerts firing
+func (as *alerts) load() {
+	if err := as.store.Iterate(as.bucket, func(k, v []byte) error {
+		a := &Alert{}
+		if err := json.Unmarshal(v, a); err != nil {
+			return fmt.Errorf("alert %q: %v", k, err)
+		}
+		as.firing[string(k)] = a
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
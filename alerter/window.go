@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fieldStats aggregates the numeric values of a field within a window
+type fieldStats struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+func (s *fieldStats) add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+	s.Avg = s.Sum / float64(s.Count)
+}
+
+// window aggregates the messages of a group within [Start, End)
+type window struct {
+	Group    string                 `json:"group"`
+	Start    time.Time              `json:"window_start"`
+	End      time.Time              `json:"window_end"`
+	Count    int64                  `json:"count"`
+	Counters map[string]int64       `json:"counters,omitempty"`
+	Fields   map[string]*fieldStats `json:"fields,omitempty"`
+}
+
+// add aggregates a message, counters are incremented by the messages
+// satisfying their predicate
+func (w *window) add(msg map[string]interface{}, counters []named, fields []string) {
+	w.Count++
+	for _, c := range counters {
+		if w.Counters == nil {
+			w.Counters = make(map[string]int64)
+		}
+		if ok, err := c.expr.Bool(msg); err == nil && ok {
+			w.Counters[c.name]++
+		} else if _, ok := w.Counters[c.name]; !ok {
+			w.Counters[c.name] = 0
+		}
+	}
+	for _, field := range fields {
+		v, ok := number(expr.Lookup(msg, field))
+		if !ok {
+			continue
+		}
+		if w.Fields == nil {
+			w.Fields = make(map[string]*fieldStats)
+		}
+		s, ok := w.Fields[field]
+		if !ok {
+			s = &fieldStats{}
+			w.Fields[field] = s
+		}
+		s.add(v)
+	}
+}
+
+// env is the environment of rules: group, count, the counters by name and
+// the stats of the fields by path, e.g.: errors / count > 0.05 or
+// latency_ms.avg > 500
+func (w *window) env() map[string]interface{} {
+	env := map[string]interface{}{"group": w.Group, "count": float64(w.Count)}
+	for name, n := range w.Counters {
+		env[name] = float64(n)
+	}
+	for field, s := range w.Fields {
+		setPath(env, strings.Split(field, "."), map[string]interface{}{
+			"count": float64(s.Count), "sum": s.Sum, "min": s.Min, "max": s.Max, "avg": s.Avg,
+		})
+	}
+	return env
+}
+
+// storeKey is the start of the window followed by the group, so that
+// windows are stored in the order of their start
+func (w *window) storeKey() string {
+	k := make([]byte, 8, 8+len(w.Group))
+	binary.BigEndian.PutUint64(k, uint64(w.Start.UnixNano()))
+	return string(append(k, w.Group...))
+}
+
+// number converts json numbers and numeric strings
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, !math.IsNaN(v)
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+// setPath sets v in nested objects along path
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[seg] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
+
+// windows are the open tumbling windows of the groups, aligned to the
+// epoch and stored in a bucket of the state store on checkpoint; windows
+// close when the watermark, the greatest timestamp of the messages, passes
+// their end
+type windows struct {
+	store     state.Store
+	bucket    string
+	size      time.Duration
+	open      map[string]*window
+	dirty     map[string]bool // windows changed since last checkpoint
+	watermark time.Time
+}
+
+func newWindows(store state.Store, bucket string, size time.Duration) *windows {
+	return &windows{store: store, bucket: bucket, size: size, open: make(map[string]*window), dirty: make(map[string]bool)}
+}
+
+// add aggregates a message of group at ts, returns false if its window is
+// already closed
+func (ws *windows) add(group string, ts time.Time, msg map[string]interface{}, counters []named, fields []string) bool {
+	if ts.After(ws.watermark) {
+		ws.watermark = ts
+	}
+	start := ts.Truncate(ws.size)
+	w := &window{Group: group, Start: start, End: start.Add(ws.size)}
+	if !ws.watermark.Before(w.End) {
+		return false
+	}
+	id := w.storeKey()
+	if open, ok := ws.open[id]; ok {
+		w = open
+	} else {
+		ws.open[id] = w
+	}
+	w.add(msg, counters, fields)
+	ws.dirty[id] = true
+	return true
+}
+
+// close removes the windows ended at the watermark, grouped by their end
+// in the order of their end
+func (ws *windows) close() [][]*window {
+	var closed []*window
+	for id, w := range ws.open {
+		if !ws.watermark.Before(w.End) {
+			closed = append(closed, w)
+			delete(ws.open, id)
+			delete(ws.dirty, id)
+			if err := ws.store.Delete(ws.bucket, []byte(id)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		if !closed[i].End.Equal(closed[j].End) {
+			return closed[i].End.Before(closed[j].End)
+		}
+		return closed[i].Group < closed[j].Group
+	})
+
+	var byEnd [][]*window
+	for i, w := range closed {
+		if i == 0 || !w.End.Equal(closed[i-1].End) {
+			byEnd = append(byEnd, nil)
+		}
+		byEnd[len(byEnd)-1] = append(byEnd[len(byEnd)-1], w)
+	}
+	return byEnd
+}
+
+// flush puts the windows changed since the last checkpoint and the
+// watermark to the store
+func (ws *windows) flush() error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(ws.watermark.UnixNano()))
+	if err := ws.store.Put(metaBucket, []byte(watermarkKey), v); err != nil {
+		return err
+	}
+	for id := range ws.dirty {
+		bts, err := json.Marshal(ws.open[id])
+		if err != nil {
+			return err
+		}
+		if err := ws.store.Put(ws.bucket, []byte(id), bts); err != nil {
+			return err
+		}
+	}
+	ws.dirty = make(map[string]bool)
+	return nil
+}
+
+// load reads the open windows and the watermark
+func (ws *windows) load() {
+	if v, err := ws.store.Get(metaBucket, []byte(watermarkKey)); err != nil {
+		log.Fatalln(err)
+	} else if len(v) == 8 {
+		ws.watermark = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	if err := ws.store.Iterate(ws.bucket, func(k, v []byte) error {
+		w := &window{}
+		if err := json.Unmarshal(v, w); err != nil {
+			return fmt.Errorf("window %q: %v", k, err)
+		}
+		ws.open[string(k)] = w
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
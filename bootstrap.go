@@ -0,0 +1,103 @@
+package sp
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/kafka"
+)
+
+// CatchUpIdle is the time without message of a topic being caught up after
+// which the partitions behind their high-watermark are caught up: the last
+// offsets of transactional or compacted topics may be control records or
+// removed messages, which are never delivered
+const CatchUpIdle = 10 * time.Second
+
+// PendingOffsets returns the partitions of topic with messages to consume
+// from the recorded offsets, mapped to their high-watermark at the time of
+// the call; partitions without recorded offset are consumed from the oldest
+// message
+func PendingOffsets(brokers []string, topic string, offs Offsets) (Offsets, error) {
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return pendingOffsets(client, topic, offs)
+}
+
+func pendingOffsets(client sarama.Client, topic string, offs Offsets) (Offsets, error) {
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(Offsets)
+	for _, partition := range partitions {
+		hwm, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		offset, ok := offs[partition]
+		if !ok {
+			if offset, err = client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+				return nil, err
+			}
+		}
+		if offset < hwm {
+			pending[partition] = hwm
+		}
+	}
+	return pending, nil
+}
+
+// CatchUp tracks the partitions of a topic consumed up to their
+// high-watermark, e.g. to build a table before processing a stream; it is
+// not safe for concurrent use
+type CatchUp struct {
+	pending   Offsets // high-watermarks of the partitions behind
+	consumers map[int32]sarama.PartitionConsumer
+	last      time.Time // of the last message consumed
+}
+
+// NewCatchUp tracks the partitions of pending, see PendingOffsets, consumed
+// by consumers, whose high-watermarks are the latest known
+func NewCatchUp(pending Offsets, consumers map[int32]sarama.PartitionConsumer) *CatchUp {
+	return &CatchUp{pending: pending, consumers: consumers, last: time.Now()}
+}
+
+// Len returns the number of partitions behind
+func (c *CatchUp) Len() int { return len(c.pending) }
+
+// Pending returns the partitions behind mapped to their high-watermark at
+// start
+func (c *CatchUp) Pending() Offsets { return c.pending }
+
+// Consumed records a message of the topic, it returns whether its
+// partition is caught up by it
+func (c *CatchUp) Consumed(msg *sarama.ConsumerMessage) bool {
+	c.last = time.Now()
+	hwm, ok := c.pending[msg.Partition]
+	if !ok {
+		return false
+	}
+	if msg.Offset+1 < hwm {
+		if pc, ok := c.consumers[msg.Partition]; !ok || msg.Offset+1 < pc.HighWaterMarkOffset() {
+			return false
+		}
+	}
+	delete(c.pending, msg.Partition)
+	return true
+}
+
+// Settle ends the catch up once no message arrived for CatchUpIdle, it
+// returns the partitions left, caught up without reaching their
+// high-watermark
+func (c *CatchUp) Settle() Offsets {
+	if len(c.pending) == 0 || time.Since(c.last) < CatchUpIdle {
+		return nil
+	}
+	settled := c.pending
+	c.pending = make(Offsets)
+	return settled
+}
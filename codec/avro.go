@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avro values are framed with a magic byte and the schema id:
+// 0x00 | schema id (4 bytes big endian) | avro binary
+const avroHeaderSize = 5
+
+var errAvroFrame = errors.New("codec: not a schema registry framed avro value")
+
+type avroDecoder struct {
+	registry *Registry
+}
+
+// Decode converts a framed avro value to json, unions are not wrapped with
+// their type so that fields are addressed the same way as in json messages
+func (d *avroDecoder) Decode(value []byte) ([]byte, error) {
+	if len(value) < avroHeaderSize || value[0] != 0 {
+		return nil, errAvroFrame
+	}
+	c, err := d.registry.Codec(int(binary.BigEndian.Uint32(value[1:])))
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := c.NativeFromBinary(value[avroHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	return c.TextualFromNative(nil, native)
+}
+
+type avroEncoder struct {
+	codec  *goavro.Codec
+	header []byte
+}
+
+// newAvroEncoder registers schema under subject
+func newAvroEncoder(registry *Registry, subject, schema string) (*avroEncoder, error) {
+	c, err := goavro.NewCodecForStandardJSONFull(schema)
+	if err != nil {
+		return nil, err
+	}
+	id, err := registry.Register(subject, schema)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, avroHeaderSize)
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	return &avroEncoder{codec: c, header: header}, nil
+}
+
+// Encode converts a json document to a framed avro value
+func (e *avroEncoder) Encode(doc []byte) ([]byte, error) {
+	native, _, err := e.codec.NativeFromTextual(doc)
+	if err != nil {
+		return nil, err
+	}
+	return e.codec.BinaryFromNative(append([]byte(nil), e.header...), native)
+}
@@ -0,0 +1,79 @@
+// Package codec converts kafka message values between their wire format and
+// the json documents handled by stream processors.
+//
+// Supported formats are:
+//
+//	json      values are passed through
+//	avro      confluent framed avro, schemas are resolved with a schema registry
+//	protobuf  messages of a type described by a compiled descriptor set
+//	msgpack   messagepack documents
+package codec
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// Decoder converts message values to json
+type Decoder interface {
+	Decode(value []byte) ([]byte, error)
+}
+
+// Encoder converts json documents to message values
+type Encoder interface {
+	Encode(doc []byte) ([]byte, error)
+}
+
+// Options configures the decoders and encoders of a format
+type Options struct {
+	SchemaRegistryURL string // avro: schema registry base url
+	SchemaFile        string // avro: schema of encoded values
+	Subject           string // avro: subject the schema is registered under
+	ProtoDescriptor   string // protobuf: descriptor set file
+	ProtoMessage      string // protobuf: full name of the message type
+}
+
+type passthrough struct{}
+
+func (passthrough) Decode(value []byte) ([]byte, error) { return value, nil }
+func (passthrough) Encode(doc []byte) ([]byte, error)   { return doc, nil }
+
+// NewDecoder creates the decoder of format
+func NewDecoder(format string, opts Options) (Decoder, error) {
+	switch format {
+	case "", "json":
+		return passthrough{}, nil
+	case "avro":
+		if opts.SchemaRegistryURL == "" {
+			return nil, fmt.Errorf("codec: avro requires a schema registry url")
+		}
+		return &avroDecoder{registry: NewRegistry(opts.SchemaRegistryURL)}, nil
+	case "protobuf":
+		return newProtoCodec(opts)
+	case "msgpack":
+		return msgpackCodec{}, nil
+	}
+	return nil, fmt.Errorf("codec: unsupported format %q", format)
+}
+
+// NewEncoder creates the encoder of format
+func NewEncoder(format string, opts Options) (Encoder, error) {
+	switch format {
+	case "", "json":
+		return passthrough{}, nil
+	case "avro":
+		if opts.SchemaRegistryURL == "" || opts.SchemaFile == "" {
+			return nil, fmt.Errorf("codec: avro requires a schema registry url and a schema file")
+		}
+		schema, err := ioutil.ReadFile(opts.SchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		return newAvroEncoder(NewRegistry(opts.SchemaRegistryURL), opts.Subject, string(schema))
+	case "protobuf":
+		return newProtoCodec(opts)
+	case "msgpack":
+		return msgpackCodec{}, nil
+	}
+	return nil, fmt.Errorf("codec: unsupported format %q", format)
+}
@@ -0,0 +1,74 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type msgpackCodec struct{}
+
+// Decode converts a msgpack value to json, binary strings are encoded as
+// base64 as by encoding/json
+func (msgpackCodec) Decode(value []byte) ([]byte, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(value, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// Encode converts a json document to msgpack, integers are kept as integers
+func (msgpackCodec) Encode(doc []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(msgpackValue(v))
+}
+
+// jsonValue converts the maps with non string keys decoded by msgpack
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// msgpackValue converts json numbers to integers or floats
+func msgpackValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = msgpackValue(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = msgpackValue(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,74 @@
+package codec
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoMessage finds the descriptor of message in a descriptor set file, as
+// generated by: protoc --include_imports --descriptor_set_out=FILE
+func protoMessage(descriptorFile, message string) (protoreflect.MessageDescriptor, error) {
+	bts, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(bts, set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("codec: %v is not a message", message)
+	}
+	return md, nil
+}
+
+type protoCodec struct {
+	desc protoreflect.MessageDescriptor
+}
+
+func newProtoCodec(opts Options) (*protoCodec, error) {
+	if opts.ProtoDescriptor == "" || opts.ProtoMessage == "" {
+		return nil, fmt.Errorf("codec: protobuf requires a descriptor set and a message name")
+	}
+	desc, err := protoMessage(opts.ProtoDescriptor, opts.ProtoMessage)
+	if err != nil {
+		return nil, err
+	}
+	return &protoCodec{desc: desc}, nil
+}
+
+// Decode converts a protobuf message to json, fields are named as in the
+// .proto file
+func (c *protoCodec) Decode(value []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.desc)
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return nil, err
+	}
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+}
+
+// Encode converts a json document to a protobuf message, fields missing in
+// the message are dropped
+func (c *protoCodec) Encode(doc []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.desc)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(doc, msg); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
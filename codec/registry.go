@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+const registryContentType = "application/vnd.schemaregistry.v1+json"
+
+// Registry is a client of a confluent schema registry, schemas are cached
+// by id as they never change once registered
+type Registry struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	codecs map[int]*goavro.Codec
+}
+
+// NewRegistry creates a client of the schema registry at url
+func NewRegistry(url string) *Registry {
+	return &Registry{
+		url:    strings.TrimRight(url, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+		codecs: make(map[int]*goavro.Codec),
+	}
+}
+
+// Codec returns the codec of the schema registered as id
+func (r *Registry) Codec(id int) (*goavro.Codec, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.codecs[id]; ok {
+		return c, nil
+	}
+
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+	if err := r.do("GET", fmt.Sprintf("/schemas/ids/%v", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	c, err := goavro.NewCodecForStandardJSONFull(resp.Schema)
+	if err != nil {
+		return nil, err
+	}
+	r.codecs[id] = c
+	return c, nil
+}
+
+// Register registers schema under subject, returning its id
+func (r *Registry) Register(subject, schema string) (int, error) {
+	req := struct {
+		Schema string `json:"schema"`
+	}{schema}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := r.do("POST", fmt.Sprintf("/subjects/%v/versions", subject), req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+func (r *Registry) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		bts, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(bts)
+	}
+
+	req, err := http.NewRequest(method, r.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", registryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("codec: schema registry %v %v: %v %s", method, path, resp.Status, bts)
+	}
+	return json.Unmarshal(bts, out)
+}
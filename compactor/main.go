@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// buckets of the state file of the joiner, rows of a table are stored in
+// the bucket joiner/{table}
+const (
+	offsetWAL     = "__offset_wal__"
+	joinerBucket  = "joiner"
+	processorName = "compactor"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Materialize the latest row of each key of a table topic into the state file of the joiner",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "table-topic",
+				Value: "WAL",
+				Usage: "topic name that contains the table",
+			},
+			&cli.StringSliceFlag{
+				Name:  "table",
+				Value: cli.NewStringSlice("user_updates"),
+				Usage: "table name in WAL to materialize, repeat for the tables joined by a joiner",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "stream topic of the joiner, names the default state file",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Value: "",
+				Usage: "state file to write, default: the cache file of the joiner .joiner-{table-topic}-{table}-{stream-topic}.cache; an existing file is updated from its offsets",
+			},
+			&cli.StringFlag{
+				Name:  "key-source",
+				Value: "body",
+				Usage: "body: row keys are the WAL keys, kafka-key: row keys are the kafka message keys, as set on the joiner",
+			},
+			&cli.StringFlag{
+				Name:  "key-normalize",
+				Value: "",
+				Usage: "comma separated normalizations of table keys, as set on the joiner: lowercase, trim, numeric",
+			},
+			&cli.StringFlag{
+				Name:  "tombstone-field",
+				Value: "",
+				Usage: "json field of WAL messages marking the row as deleted, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "tombstone-value",
+				Value: "delete",
+				Usage: "value of tombstone-field which deletes the row",
+			},
+			&cli.BoolFlag{
+				Name:  "tombstone-on-null-value",
+				Value: true,
+				Usage: "delete the row of the kafka message key when the WAL message value is null",
+			},
+			&cli.StringFlag{
+				Name:  "table-format",
+				Value: "json",
+				Usage: "encoding of WAL messages, json, avro or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "wal-format",
+				Value: "wal",
+				Usage: "envelope of table topic messages, wal, debezium: change events of a debezium connector, maxwell: change events of maxwell's daemon",
+			},
+			&cli.StringFlag{
+				Name:  "database",
+				Value: "",
+				Usage: "only apply the change events of this database with debezium or maxwell wal-format",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Value: "",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:    "state-encryption-key",
+				EnvVars: []string{"STATE_ENCRYPTION_KEY"},
+				Usage:   "hex encoded AES key encrypting the values of the state, as set on the joiner",
+			},
+			&cli.StringFlag{
+				Name:  "state-compression",
+				Usage: "compression of the values of the state, snappy, zstd or none, as set on the joiner",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	table_topic := c.String("table-topic")
+	table_names := c.StringSlice("table")
+	stream_topic := c.String("stream-topic")
+	output := c.String("output")
+	if output == "" {
+		output = fmt.Sprintf(".joiner-%v-%v-%v.cache", table_topic, strings.Join(table_names, "+"), stream_topic)
+	}
+	key_source := c.String("key-source")
+	key_normalize := c.String("key-normalize")
+	tombstone_field := c.String("tombstone-field")
+	tombstone_value := c.String("tombstone-value")
+	tombstone_on_null := c.Bool("tombstone-on-null-value")
+	table_format := c.String("table-format")
+	wal_format := c.String("wal-format")
+	database := c.String("database")
+	state_encryption_key := c.String("state-encryption-key")
+	state_compression := c.String("state-compression")
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("table-topic:", table_topic)
+	log.Println("table:", table_names)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("output:", output)
+	log.Println("key-source:", key_source)
+	log.Println("key-normalize:", key_normalize)
+	log.Println("tombstone-field:", tombstone_field)
+	log.Println("tombstone-value:", tombstone_value)
+	log.Println("tombstone-on-null-value:", tombstone_on_null)
+	log.Println("table-format:", table_format)
+	log.Println("wal-format:", wal_format)
+	log.Println("database:", database)
+	log.Println("state-encryption:", state_encryption_key != "")
+	log.Println("state-compression:", state_compression)
+	log.Println("write-interval:", write_interval)
+
+	var kafka_key bool
+	switch key_source {
+	case "body":
+	case "kafka-key":
+		kafka_key = true
+	default:
+		log.Fatalln("unsupported key-source:", key_source)
+	}
+
+	normalize, err := sp.NewKeyNormalizer(strings.Split(key_normalize, ","))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tables := make(map[string]bool)
+	for _, name := range table_names {
+		tables[name] = true
+	}
+
+	tableDecoder, err := codec.NewDecoder(table_format, codec.Options{SchemaRegistryURL: c.String("schema-registry-url")})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	parseWAL, err := sp.NewWALDecoder(wal_format, database)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var store state.Store
+	if store, err = state.Open("bolt", output, state.Options{}); err != nil {
+		log.Fatalln(err)
+	}
+	if state_encryption_key != "" {
+		if store, err = state.NewEncrypted(store, state_encryption_key); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if state_compression != "" { // compressed before encryption
+		if store, err = state.NewCompressed(store, state_compression); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	tableOffsets := make(sp.Offsets)
+	if err := tableOffsets.Load(store, offsetWAL); err != nil {
+		log.Fatalln(err)
+	}
+	pending, err := sp.PendingOffsets(brokers, table_topic, tableOffsets)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from table offsets:%v up to offsets:%v", tableOffsets, pending)
+
+	tableMessages, tableConsumers, err := sp.ConsumeAll(consumer, table_topic, tableOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range tableConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	start := time.Now()
+	ticker := time.NewTicker(write_interval)
+	numUpdated, numRemoved, numInvalid := 0, 0, 0
+
+	put := func(table, key string, row []byte) {
+		if err := store.Put(joinerBucket+"/"+table, []byte(key), row); err != nil {
+			log.Fatalln(err)
+		}
+		numUpdated++
+	}
+
+	remove := func(table, key string) {
+		if err := store.Delete(joinerBucket+"/"+table, []byte(key)); err != nil {
+			log.Fatalln(err)
+		}
+		numRemoved++
+	}
+
+	// apply applies a message of the table topic like the joiner does
+	apply := func(msg *sarama.ConsumerMessage) {
+		if msg.Value == nil || string(msg.Value) == "null" {
+			if tombstone_on_null && msg.Key != nil {
+				for _, name := range table_names {
+					remove(name, normalize(string(msg.Key)))
+				}
+			}
+			return
+		}
+
+		value, err := tableDecoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		wal, row, removed, err := parseWAL(msg.Key, value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		if wal == nil || !tables[wal.Table] { // skipped change events or table filter
+			return
+		}
+
+		key := normalize(wal.Key)
+		if kafka_key {
+			if msg.Key == nil {
+				numInvalid++
+				return
+			}
+			key = normalize(string(msg.Key))
+		}
+		if removed {
+			remove(wal.Table, key)
+			return
+		}
+		if tombstone_field != "" {
+			if jsonParsed, err := gabs.ParseJSON(row); err == nil {
+				if v := jsonParsed.Path(tombstone_field).Data(); v != nil && fmt.Sprint(v) == tombstone_value {
+					remove(wal.Table, key)
+					return
+				}
+			}
+		}
+		put(wal.Table, key, row)
+	}
+
+	checkpoint := func() {
+		if err := tableOffsets.Store(store, offsetWAL); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("updated:", numUpdated, "removed:", numRemoved, "invalid:", numInvalid, "table offsets:", tableOffsets)
+		numUpdated, numRemoved, numInvalid = 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	catchUp := sp.NewCatchUp(pending, tableConsumers)
+	idle := time.NewTicker(time.Second)
+	defer idle.Stop()
+	for catchUp.Len() > 0 {
+		select {
+		case <-idle.C:
+			for partition, hwm := range catchUp.Settle() {
+				log.Printf("partition %d of the table topic caught up at offset %d, idle before high-watermark %d", partition, tableOffsets[partition], hwm)
+			}
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-tableMessages:
+			tableOffsets[msg.Partition] = msg.Offset + 1
+			apply(msg)
+			catchUp.Consumed(msg)
+		}
+	}
+	checkpoint()
+	log.Println("compacted table in", time.Since(start), "into", output)
+	return nil
+}
@@ -0,0 +1,37 @@
+// Package debug serves the runtime profiles of net/http/pprof under
+// /debug/pprof/ and the variables of expvar under /debug/vars, to profile
+// the memory of large tables or find leaking goroutines in running
+// processors:
+//
+//	go tool pprof http://localhost:6060/debug/pprof/heap
+//	curl http://localhost:6060/debug/pprof/goroutine?debug=1
+package debug
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Serve starts serving the profiles and variables on addr in the
+// background, nothing is served if addr is empty
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+	log.Println("debug endpoints on:", addr)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	expiryBucket  = "__expiry__"
+	processorName = "deduper"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Drop the messages of a stream with an id already seen within a time window",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to deduplicate",
+			},
+			&cli.StringFlag{
+				Name:  "id",
+				Value: "",
+				Usage: "extract the json field as message id in stream messages, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Value: time.Hour,
+				Usage: "messages with an id seen within window before their timestamp are dropped, ids are forgotten after window",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: deduper-{stream-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of seen ids and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing, ids expired are removed on each write",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	id_path := c.String("id")
+	window := c.Duration("window")
+	format_name := c.String("format")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("deduper-%v", stream_topic)
+	}
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("id:", id_path)
+	log.Println("window:", window)
+	log.Println("format:", format_name)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".deduper-%v-%v.cache", stream_topic, output_topic)
+	log.Println("cache file:", cachefile)
+
+	if id_path == "" {
+		log.Fatalln("id must be set")
+	}
+	if window <= 0 {
+		log.Fatalln("window must be positive")
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, offsets are only committed after all messages
+	// forwarded before have been acknowledged; messages forwarded after the
+	// last checkpoint are forwarded again if the deduper crashes, as their
+	// ids are forgotten with the uncommitted state
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	seen := newSeenSet(store, processorName, window)
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numForwarded, numDuplicates, numInvalid := 0, 0, 0
+	var watermark time.Time // greatest timestamp of the messages
+
+	dedupe := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		jsonParsed, err := gabs.ParseJSON(value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		id := jsonParsed.Path(id_path).Data()
+		if id == nil {
+			numInvalid++
+			return
+		}
+		ts := msg.Timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		if ts.After(watermark) {
+			watermark = ts
+		}
+
+		added, err := seen.add(fmt.Sprint(id), ts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !added {
+			numDuplicates++
+			return
+		}
+		out := &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(msg.Value)}
+		if msg.Key != nil {
+			out.Key = sarama.ByteEncoder(msg.Key)
+		}
+		inflight.Add(1)
+		producer.Input() <- out
+		numForwarded++
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		numExpired, err := seen.expire(watermark)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("forwarded:", numForwarded, "duplicates:", numDuplicates, "invalid:", numInvalid, "expired:", numExpired, "watermark:", watermark, "stream offsets:", streamOffsets)
+		numForwarded, numDuplicates, numInvalid = 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			dedupe(msg)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/xtaci/sp/state"
+)
+
+// errStop stops an iteration early
+var errStop = errors.New("stop")
+
+// seenSet records the ids of the messages seen within ttl, in two buckets of
+// the state store: bucket maps ids to the timestamp they were first seen at,
+// and expiry indexes the ids by timestamp so that expired ids are removed
+// without scanning the whole set
+type seenSet struct {
+	store  state.Store
+	bucket string
+	expiry string
+	ttl    time.Duration
+}
+
+func newSeenSet(store state.Store, bucket string, ttl time.Duration) *seenSet {
+	return &seenSet{store: store, bucket: bucket, expiry: expiryBucket, ttl: ttl}
+}
+
+// add records id seen at ts, returns false if id was already seen within ttl
+// before ts
+func (s *seenSet) add(id string, ts time.Time) (bool, error) {
+	v, err := s.store.Get(s.bucket, []byte(id))
+	if err != nil {
+		return false, err
+	}
+	if len(v) == 8 {
+		seen := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		if ts.Sub(seen) < s.ttl {
+			return false, nil
+		}
+		// expired but not yet removed, seen again from ts
+		if err := s.store.Delete(s.expiry, expiryKey(seen, id)); err != nil {
+			return false, err
+		}
+	}
+
+	v = make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(ts.UnixNano()))
+	if err := s.store.Put(s.bucket, []byte(id), v); err != nil {
+		return false, err
+	}
+	if err := s.store.Put(s.expiry, expiryKey(ts, id), v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// expire removes the ids seen ttl or longer before now, returns the number
+// of ids removed
+func (s *seenSet) expire(now time.Time) (int, error) {
+	if now.IsZero() { // no message yet
+		return 0, nil
+	}
+	deadline := uint64(now.Add(-s.ttl).UnixNano())
+	n := 0
+	err := s.store.Iterate(s.expiry, func(k, v []byte) error {
+		if len(k) < 8 {
+			return s.store.Delete(s.expiry, k)
+		}
+		if binary.BigEndian.Uint64(k) > deadline {
+			return errStop
+		}
+		if err := s.store.Delete(s.bucket, k[8:]); err != nil {
+			return err
+		}
+		n++
+		return s.store.Delete(s.expiry, k)
+	})
+	if err == errStop {
+		err = nil
+	}
+	return n, err
+}
+
+// expiryKey is the timestamp followed by the id, so that ids are indexed in
+// the order they expire
+func expiryKey(ts time.Time, id string) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(ts.UnixNano()))
+	return append(k, id...)
+}
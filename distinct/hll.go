@@ -0,0 +1,77 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hll is a HyperLogLog sketch estimating the number of distinct values
+// added, with 2^precision registers of one byte and a standard error of
+// about 1.04/sqrt(2^precision)
+type hll struct {
+	Registers []byte `json:"registers"`
+}
+
+func newHLL(precision uint) *hll {
+	return &hll{Registers: make([]byte, 1<<precision)}
+}
+
+func (h *hll) precision() uint {
+	return uint(bits.TrailingZeros(uint(len(h.Registers))))
+}
+
+// add adds a value, the first precision bits of its hash select a register
+// which keeps the max rank of the first 1 bit of the remaining bits
+func (h *hll) add(value string) {
+	x := hash64(value)
+	p := h.precision()
+	i := x >> (64 - p)
+	rank := byte(bits.LeadingZeros64(x<<p|1<<(p-1)) + 1)
+	if rank > h.Registers[i] {
+		h.Registers[i] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct values, with linear
+// counting for small cardinalities
+func (h *hll) estimate() float64 {
+	m := float64(len(h.Registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+// hash64 hashes with fnv-1a and mixes the bits with the splitmix64
+// finalizer, as fnv alone doesn't spread short values over the high bits
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
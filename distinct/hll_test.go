@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHLLEstimate(t *testing.T) {
+	tests := []struct {
+		precision uint
+		distinct  int
+		repeats   int
+	}{
+		{4, 10, 1},
+		{10, 0, 1},
+		{10, 1, 3},
+		{10, 100, 1},
+		{12, 1000, 5},
+		{14, 100000, 1},
+		{14, 20000, 3},
+	}
+	for _, tt := range tests {
+		h := newHLL(tt.precision)
+		for r := 0; r < tt.repeats; r++ {
+			for i := 0; i < tt.distinct; i++ {
+				h.add(fmt.Sprintf("value-%v", i))
+			}
+		}
+		// within 4 standard errors, and exact enough for tiny counts
+		stderr := 1.04 / math.Sqrt(float64(len(h.Registers)))
+		got := h.estimate()
+		if diff := math.Abs(got - float64(tt.distinct)); diff > math.Max(4*stderr*float64(tt.distinct), 1) {
+			t.Fatalf("precision %v, %v distinct: estimated %v", tt.precision, tt.distinct, got)
+		}
+	}
+}
+
+func TestHLLJSON(t *testing.T) {
+	h := newHLL(8)
+	for i := 0; i < 500; i++ {
+		h.add(fmt.Sprint(i))
+	}
+	bts, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded hll
+	if err := json.Unmarshal(bts, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.precision() != 8 || decoded.estimate() != h.estimate() {
+		t.Fatalf("decoded precision %v estimate %v, want 8 %v", decoded.precision(), decoded.estimate(), h.estimate())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// window estimates the distinct values of a group within [Start, End)
+type window struct {
+	Group  string    `json:"group"`
+	Start  time.Time `json:"window_start"`
+	End    time.Time `json:"window_end"`
+	Count  int64     `json:"count"`
+	Sketch *hll      `json:"sketch"`
+}
+
+// storeKey is the start of the window followed by the group, so that
+// windows are stored in the order of their start
+func (w *window) storeKey() string {
+	k := make([]byte, 8, 8+len(w.Group))
+	binary.BigEndian.PutUint64(k, uint64(w.Start.UnixNano()))
+	return string(append(k, w.Group...))
+}
+
+// windows are the open tumbling windows, aligned to the epoch and stored in
+// a bucket of the state store on checkpoint; windows close when the
+// watermark, the greatest timestamp of the messages, passes their end
+type windows struct {
+	store     state.Store
+	bucket    string
+	size      time.Duration
+	precision uint
+	open      map[string]*window
+	dirty     map[string]bool // windows changed since last checkpoint
+	watermark time.Time
+}
+
+func newWindows(store state.Store, bucket string, size time.Duration, precision uint) *windows {
+	return &windows{store: store, bucket: bucket, size: size, precision: precision, open: make(map[string]*window), dirty: make(map[string]bool)}
+}
+
+// add adds value to the window of group at ts, returns false if the window
+// is already closed
+func (ws *windows) add(group, value string, ts time.Time) bool {
+	if ts.After(ws.watermark) {
+		ws.watermark = ts
+	}
+	start := ts.Truncate(ws.size)
+	w := &window{Group: group, Start: start, End: start.Add(ws.size)}
+	if !ws.watermark.Before(w.End) {
+		return false
+	}
+	id := w.storeKey()
+	if open, ok := ws.open[id]; ok {
+		w = open
+	} else {
+		w.Sketch = newHLL(ws.precision)
+		ws.open[id] = w
+	}
+	w.Count++
+	w.Sketch.add(value)
+	ws.dirty[id] = true
+	return true
+}
+
+// close removes the windows ended at the watermark, returned in the order
+// of their end
+func (ws *windows) close() []*window {
+	var closed []*window
+	for id, w := range ws.open {
+		if !ws.watermark.Before(w.End) {
+			closed = append(closed, w)
+			delete(ws.open, id)
+			delete(ws.dirty, id)
+			if err := ws.store.Delete(ws.bucket, []byte(id)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		if !closed[i].End.Equal(closed[j].End) {
+			return closed[i].End.Before(closed[j].End)
+		}
+		return closed[i].Group < closed[j].Group
+	})
+	return closed
+}
+
+// flush puts the windows changed since the last checkpoint and the
+// watermark to the store
+func (ws *windows) flush() error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(ws.watermark.UnixNano()))
+	if err := ws.store.Put(metaBucket, []byte(watermarkKey), v); err != nil {
+		return err
+	}
+	for id := range ws.dirty {
+		bts, err := json.Marshal(ws.open[id])
+		if err != nil {
+			return err
+		}
+		if err := ws.store.Put(ws.bucket, []byte(id), bts); err != nil {
+			return err
+		}
+	}
+	ws.dirty = make(map[string]bool)
+	return nil
+}
+
+// load reads the open windows and the watermark
+func (ws *windows) load() {
+	if v, err := ws.store.Get(metaBucket, []byte(watermarkKey)); err != nil {
+		log.Fatalln(err)
+	} else if len(v) == 8 {
+		ws.watermark = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	if err := ws.store.Iterate(ws.bucket, func(k, v []byte) error {
+		w := &window{}
+		if err := json.Unmarshal(v, w); err != nil {
+			return fmt.Errorf("window %q: %v", k, err)
+		}
+		if w.Sketch == nil || w.Sketch.precision() != ws.precision {
+			return fmt.Errorf("window %q: sketch precision differs from %v", k, ws.precision)
+		}
+		ws.open[string(k)] = w
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,54 @@
+package sp
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// DeadLetter wraps a message which could not be processed with the reason
+// and the coordinates of its source, the original key and value are kept
+// as is and its headers are copied to the dead letter
+type DeadLetter struct {
+	Error     string    `json:"error"`
+	ErrorType string    `json:"error_type"`
+	Processor string    `json:"processor"`
+	Host      string    `json:"host"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"` // of the message
+	Key       []byte    `json:"key,omitempty"`
+	Value     []byte    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewDeadLetter builds the message sent to the dead letter topic dlq by
+// processor on host
+func NewDeadLetter(dlq, processor, host string, msg *sarama.ConsumerMessage, errorType string, reason error) (*sarama.ProducerMessage, error) {
+	bts, err := json.Marshal(DeadLetter{
+		Error:     reason.Error(),
+		ErrorType: errorType,
+		Processor: processor,
+		Host:      host,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: msg.Timestamp,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &sarama.ProducerMessage{Topic: dlq, Value: sarama.ByteEncoder(bts)}
+	if msg.Key != nil {
+		out.Key = sarama.ByteEncoder(msg.Key)
+	}
+	for _, h := range msg.Headers {
+		out.Headers = append(out.Headers, *h)
+	}
+	return out, nil
+}
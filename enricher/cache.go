@@ -0,0 +1,68 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cache holds up to max lookup results for ttl, the least recently used
+// results are evicted first; nil results cache lookups finding nothing
+type cache struct {
+	mu    sync.Mutex
+	max   int
+	ttl   time.Duration
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+
+	hits, misses int64
+}
+
+type cacheItem struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newCache(max int, ttl time.Duration) *cache {
+	return &cache{max: max, ttl: ttl, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *cache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*cacheItem)
+		if c.ttl <= 0 || time.Now().Before(item.expires) {
+			c.ll.MoveToFront(e)
+			c.hits++
+			return item.value, true
+		}
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *cache) add(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+	}
+	c.items[key] = c.ll.PushFront(&cacheItem{key, value, time.Now().Add(c.ttl)})
+	for c.ll.Len() > c.max {
+		item := c.ll.Remove(c.ll.Back()).(*cacheItem)
+		delete(c.items, item.key)
+	}
+}
+
+// stats returns and resets the hit and miss counts
+func (c *cache) stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits, misses = c.hits, c.misses
+	c.hits, c.misses = 0, 0
+	return
+}
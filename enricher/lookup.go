@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/expr"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// query is the lookup of a message, rendered from its fields
+type query struct {
+	key  string // identifies the query in the cache
+	url  string
+	body string
+	args []interface{}
+}
+
+// lookup fetches the data enriching messages
+type lookup interface {
+	// query renders the query of a message
+	query(fields map[string]interface{}) (*query, error)
+	// fetch returns the json data found by q, nil if none
+	fetch(ctx context.Context, q *query) ([]byte, error)
+}
+
+// permanent marks errors not worth retrying
+type permanent struct {
+	err error
+}
+
+func (e permanent) Error() string { return e.err.Error() }
+
+// fetchRetry fetches q, retrying failures but permanent ones up to retries
+// times with exponential backoff; each attempt is bounded by timeout
+func fetchRetry(lk lookup, q *query, timeout time.Duration, retries int, backoff time.Duration) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		data, err := lk.fetch(ctx, q)
+		cancel()
+		if err == nil {
+			return data, nil
+		}
+		if _, ok := err.(permanent); ok || attempt >= retries {
+			return nil, err
+		}
+		time.Sleep(backoff << uint(attempt))
+	}
+}
+
+// newTemplate parses templates of queries executed on the fields of
+// messages, fields missing fail the query
+func newTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"path":  url.PathEscape,
+		"query": url.QueryEscape,
+		"json": func(v interface{}) (string, error) {
+			bts, err := json.Marshal(v)
+			return string(bts), err
+		},
+	}).Parse(text)
+}
+
+// httpLookup requests a url templated from the fields of messages, e.g.:
+// http://users/api/{{path .user_id}}, with an optional templated body
+type httpLookup struct {
+	client  *http.Client
+	method  string
+	header  http.Header
+	url     *template.Template
+	body    *template.Template
+	maxBody int64
+}
+
+// newHTTPLookup creates an http lookup, headers are like "Name: value"
+func newHTTPLookup(method, urlTemplate, bodyTemplate string, headers []string) (*httpLookup, error) {
+	lk := &httpLookup{client: &http.Client{}, method: method, header: make(http.Header), maxBody: 1 << 20}
+	var err error
+	if lk.url, err = newTemplate("url", urlTemplate); err != nil {
+		return nil, err
+	}
+	if bodyTemplate != "" {
+		if lk.body, err = newTemplate("body", bodyTemplate); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range headers {
+		i := strings.IndexByte(h, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("header %q: expect name: value", h)
+		}
+		lk.header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return lk, nil
+}
+
+func (lk *httpLookup) query(fields map[string]interface{}) (*query, error) {
+	q := &query{}
+	var err error
+	if q.url, err = sp.Render(lk.url, fields); err != nil {
+		return nil, err
+	}
+	if lk.body != nil {
+		if q.body, err = sp.Render(lk.body, fields); err != nil {
+			return nil, err
+		}
+	}
+	q.key = lk.method + " " + q.url + "\n" + q.body
+	return q, nil
+}
+
+// fetch requests q, 404 finds nothing; other client errors are permanent,
+// server errors and 429 are retried
+func (lk *httpLookup) fetch(ctx context.Context, q *query) ([]byte, error) {
+	req, err := http.NewRequest(lk.method, q.url, strings.NewReader(q.body))
+	if err != nil {
+		return nil, permanent{err}
+	}
+	req = req.WithContext(ctx)
+	for k, v := range lk.header {
+		req.Header[k] = v
+	}
+
+	resp, err := lk.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, lk.maxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%v %v: %v", lk.method, q.url, resp.Status)
+	case resp.StatusCode >= 300:
+		return nil, permanent{fmt.Errorf("%v %v: %v", lk.method, q.url, resp.Status)}
+	}
+	if !json.Valid(body) {
+		return nil, permanent{errors.New("response is not json: " + q.url)}
+	}
+	return body, nil
+}
+
+// sqlLookup runs a query whose placeholders, $1... for postgres and ? for
+// mysql, are bound to the json fields args of messages; the first row found
+// is the result, as an object of the columns
+type sqlLookup struct {
+	db   *sql.DB
+	stmt string
+	args []string
+}
+
+// newSQLLookup connects to the database, driver is postgres or mysql
+func newSQLLookup(driver, dsn, stmt string, args []string, maxConns int) (*sqlLookup, error) {
+	switch driver {
+	case "postgres", "mysql":
+	default:
+		return nil, fmt.Errorf("unsupported driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlLookup{db: db, stmt: stmt, args: args}, nil
+}
+
+func (lk *sqlLookup) query(fields map[string]interface{}) (*query, error) {
+	q := &query{args: make([]interface{}, len(lk.args))}
+	for i, path := range lk.args {
+		v := expr.Lookup(fields, path)
+		switch v.(type) {
+		case nil:
+			return nil, fmt.Errorf("missing query arg %v", path)
+		case map[string]interface{}, []interface{}:
+			bts, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			v = string(bts)
+		}
+		q.args[i] = v
+	}
+	bts, err := json.Marshal(q.args)
+	if err != nil {
+		return nil, err
+	}
+	q.key = string(bts)
+	return q, nil
+}
+
+func (lk *sqlLookup) fetch(ctx context.Context, q *query) ([]byte, error) {
+	rows, err := lk.db.QueryContext(ctx, lk.stmt, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		if bts, ok := values[i].([]byte); ok {
+			row[column] = string(bts)
+		} else {
+			row[column] = values[i]
+		}
+	}
+	return json.Marshal(row)
+}
+
+func (lk *sqlLookup) close() error { return lk.db.Close() }
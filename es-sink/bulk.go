@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// action is a document of a bulk request, deleted if doc is nil
+type action struct {
+	index string
+	id    string
+	doc   []byte
+}
+
+// line returns the lines of a in the bulk request body
+func (a *action) line() []byte {
+	meta := map[string]string{"_index": a.index}
+	if a.id != "" {
+		meta["_id"] = a.id
+	}
+	op := "index"
+	if a.doc == nil {
+		op = "delete"
+	}
+	bts, _ := json.Marshal(map[string]interface{}{op: meta})
+	bts = append(bts, '\n')
+	if a.doc != nil {
+		bts = append(append(bts, bytes.TrimSpace(a.doc)...), '\n')
+	}
+	return bts
+}
+
+// bulkResponse is the result of the actions of a bulk request, in order
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// rejected is an action failed permanently, e.g. on mapping errors
+type rejected struct {
+	action *action
+	reason string
+}
+
+// bulkClient sends actions to the _bulk endpoint of elasticsearch
+type bulkClient struct {
+	client   *http.Client
+	url      string
+	header   http.Header
+	user     string
+	password string
+	retries  int
+	backoff  time.Duration
+}
+
+// newBulkClient creates a client of the cluster at url, headers are like
+// "Name: value"
+func newBulkClient(url string, headers []string, user, password string, timeout time.Duration, retries int, backoff time.Duration) (*bulkClient, error) {
+	bc := &bulkClient{
+		client:   &http.Client{Timeout: timeout},
+		url:      strings.TrimRight(url, "/") + "/_bulk",
+		header:   make(http.Header),
+		user:     user,
+		password: password,
+		retries:  retries,
+		backoff:  backoff,
+	}
+	for _, h := range headers {
+		i := strings.IndexByte(h, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("header %q: expect name: value", h)
+		}
+		bc.header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return bc, nil
+}
+
+// send indexes actions, retrying the requests failing with 429 or 5xx and
+// the actions rejected with 429 up to retries times with exponential
+// backoff; returns the actions failed permanently, error if the retries
+// are exhausted
+func (bc *bulkClient) send(actions []*action) ([]rejected, error) {
+	var failed []rejected
+	for attempt := 0; len(actions) > 0; attempt++ {
+		resp, wait, err := bc.request(actions)
+		if err == nil {
+			var retry []*action
+			for i, item := range resp.Items {
+				if i >= len(actions) {
+					break
+				}
+				for _, r := range item {
+					switch {
+					case r.Status < 300, r.Status == http.StatusNotFound && actions[i].doc == nil:
+					case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+						retry = append(retry, actions[i])
+					default:
+						failed = append(failed, rejected{actions[i], string(r.Error)})
+					}
+				}
+			}
+			if len(retry) == 0 {
+				return failed, nil
+			}
+			actions = retry
+			err = fmt.Errorf("%v actions rejected with 429 or 5xx", len(retry))
+		}
+		if _, ok := err.(permanent); ok || attempt >= bc.retries {
+			return failed, err
+		}
+		if wait == 0 {
+			wait = bc.backoff << uint(attempt)
+		}
+		time.Sleep(wait)
+	}
+	return failed, nil
+}
+
+// permanent marks errors not worth retrying
+type permanent struct {
+	err error
+}
+
+func (e permanent) Error() string { return e.err.Error() }
+
+// request sends one bulk request, returns the delay of Retry-After headers
+func (bc *bulkClient) request(actions []*action) (*bulkResponse, time.Duration, error) {
+	var body bytes.Buffer
+	for _, a := range actions {
+		body.Write(a.line())
+	}
+	req, err := http.NewRequest("POST", bc.url, &body)
+	if err != nil {
+		return nil, 0, permanent{err}
+	}
+	for k, v := range bc.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if bc.user != "" {
+		req.SetBasicAuth(bc.user, bc.password)
+	}
+
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var wait time.Duration
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(s) * time.Second
+		}
+		return nil, wait, fmt.Errorf("bulk: %v", resp.Status)
+	case resp.StatusCode >= 300:
+		return nil, 0, permanent{fmt.Errorf("bulk: %v: %s", resp.Status, bytes.TrimSpace(bts))}
+	}
+	r := &bulkResponse{}
+	if err := json.Unmarshal(bts, r); err != nil {
+		return nil, 0, permanent{fmt.Errorf("bulk: %v", err)}
+	}
+	return r, 0, nil
+}
+
+// newIndexTemplate parses the template of index names executed on the
+// fields of messages, e.g.: logs-{{.service}}-{{date "2006.01.02" .timestamp}}
+func newIndexTemplate(text string) (*template.Template, error) {
+	return template.New("index").Option("missingkey=error").Funcs(template.FuncMap{
+		"lower": strings.ToLower,
+		"now":   func(layout string) string { return time.Now().UTC().Format(layout) },
+		"date":  formatDate,
+	}).Parse(text)
+}
+
+// formatDate formats a field of time with layout, RFC 3339 strings or
+// epoch seconds or milliseconds
+func formatDate(layout string, v interface{}) (string, error) {
+	var t time.Time
+	switch v := v.(type) {
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return "", err
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return "", err
+		}
+		if f > 1e11 { // milliseconds
+			f /= 1000
+		}
+		t = time.Unix(0, int64(f*float64(time.Second)))
+	default:
+		return "", fmt.Errorf("date: unsupported time %v", v)
+	}
+	return t.UTC().Format(layout), nil
+}
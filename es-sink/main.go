@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+	"github.com/xtaci/sp/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "es-sink"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Index the messages of a stream into elasticsearch with bulk requests",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to index",
+			},
+			&cli.StringFlag{
+				Name:  "url",
+				Value: "http://localhost:9200",
+				Usage: "elasticsearch url",
+			},
+			&cli.StringFlag{
+				Name:  "index",
+				Value: "",
+				Usage: "template of the index of messages over their json fields, e.g.: logs-{{.service}}-{{date \"2006.01.02\" .timestamp}}, with functions date, now and lower, default: stream-topic",
+			},
+			&cli.StringFlag{
+				Name:  "id-field",
+				Value: "",
+				Usage: "json field of the document ids, ids are generated by elasticsearch if not set, format: a.b.0.c",
+			},
+			&cli.BoolFlag{
+				Name:  "key-id",
+				Usage: "use the keys of messages as document ids, messages with a key and no value delete the document",
+			},
+			&cli.StringFlag{
+				Name:  "user",
+				Value: "",
+				Usage: "user of basic authentication",
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				EnvVars: []string{"ES_PASSWORD"},
+				Usage:   "password of basic authentication",
+			},
+			&cli.StringSliceFlag{
+				Name:  "header",
+				Usage: "header of bulk requests, e.g.: \"Authorization: ApiKey ...\"",
+			},
+			&cli.IntFlag{
+				Name:  "bulk-size",
+				Value: 1000,
+				Usage: "max documents per bulk request",
+			},
+			&cli.IntFlag{
+				Name:  "bulk-bytes",
+				Value: 5 << 20,
+				Usage: "max bytes of documents per bulk request",
+			},
+			&cli.DurationFlag{
+				Name:  "flush-interval",
+				Value: time.Second,
+				Usage: "max time documents wait for a bulk request",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: 30 * time.Second,
+				Usage: "timeout of each bulk request",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Value: 8,
+				Usage: "retries of bulk requests failing with timeouts, 429 or 5xx, and of documents rejected with 429, the sink exits once exhausted",
+			},
+			&cli.DurationFlag{
+				Name:  "retry-backoff",
+				Value: 500 * time.Millisecond,
+				Usage: "delay before the first retry, doubled on each retry, unless set by Retry-After",
+			},
+			&cli.StringFlag{
+				Name:  "on-failure",
+				Value: "drop",
+				Usage: "documents rejected permanently, e.g. by mappings, are, drop: logged and dropped, fatal: the sink exits",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(append(state.Flags, logging.Flags...), tracing.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	url := c.String("url")
+	index_template := c.String("index")
+	if index_template == "" {
+		index_template = stream_topic
+	}
+	id_field := c.String("id-field")
+	key_id := c.Bool("key-id")
+	user := c.String("user")
+	password := c.String("password")
+	headers := c.StringSlice("header")
+	bulk_size := c.Int("bulk-size")
+	bulk_bytes := c.Int("bulk-bytes")
+	flush_interval := c.Duration("flush-interval")
+	timeout := c.Duration("timeout")
+	retries := c.Int("retries")
+	retry_backoff := c.Duration("retry-backoff")
+	on_failure := c.String("on-failure")
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("url:", url)
+	log.Println("index:", index_template)
+	log.Println("id-field:", id_field)
+	log.Println("key-id:", key_id)
+	log.Println("user:", user)
+	log.Println("header:", len(headers))
+	log.Println("bulk-size:", bulk_size)
+	log.Println("bulk-bytes:", bulk_bytes)
+	log.Println("flush-interval:", flush_interval)
+	log.Println("timeout:", timeout)
+	log.Println("retries:", retries)
+	log.Println("retry-backoff:", retry_backoff)
+	log.Println("on-failure:", on_failure)
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".es-sink-%v-%v.cache", stream_topic, index_template)
+	log.Println("cache file:", cachefile)
+
+	if bulk_size <= 0 || bulk_bytes <= 0 {
+		log.Fatalln("bulk-size and bulk-bytes must be positive")
+	}
+	if id_field != "" && key_id {
+		log.Fatalln("id-field and key-id are exclusive")
+	}
+	switch on_failure {
+	case "drop", "fatal":
+	default:
+		log.Fatalln("unsupported on-failure:", on_failure)
+	}
+	index, err := newIndexTemplate(index_template)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	client, err := newBulkClient(url, headers, user, password, timeout, retries, retry_backoff)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	flushTicker := time.NewTicker(flush_interval)
+	numIndexed, numDeleted, numRejected, numInvalid := 0, 0, 0, 0
+
+	// documents of the next bulk request
+	var batch []*action
+	batchBytes := 0
+	var traces []context.Context // of the messages of the batch
+	tracer, err := tracing.Setup(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer tracing.Shutdown()
+
+	// flush sends the batch, the sink exits once the retries of a bulk
+	// request are exhausted, the stream is then reindexed from the last
+	// checkpoint
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		_, span := tracer.Batch(traces, "bulk")
+		traces = nil
+		defer span.End()
+		failed, err := client.send(batch)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, r := range failed {
+			log.Println("rejected:", r.action.index, r.action.id, r.reason)
+			tracing.Fail(span, fmt.Errorf("rejected: %v %v %v", r.action.index, r.action.id, r.reason))
+			if on_failure == "fatal" {
+				log.Fatalln("document rejected")
+			}
+		}
+		for _, a := range batch {
+			if a.doc == nil {
+				numDeleted++
+			} else {
+				numIndexed++
+			}
+		}
+		numIndexed -= len(failed)
+		numRejected += len(failed)
+		batch, batchBytes = nil, 0
+	}
+
+	add := func(msg *sarama.ConsumerMessage) {
+		trace, span := tracer.Start(msg, processorName)
+		defer span.End()
+		a := &action{}
+		if key_id {
+			a.id = string(msg.Key)
+		}
+		var fields map[string]interface{}
+		if msg.Value == nil {
+			if a.id == "" {
+				numInvalid++
+				return
+			}
+		} else {
+			value, err := decoder.Decode(msg.Value)
+			if err != nil {
+				numInvalid++
+				return
+			}
+			dec := json.NewDecoder(bytes.NewReader(value))
+			dec.UseNumber()
+			if err := dec.Decode(&fields); err != nil || fields == nil {
+				numInvalid++
+				return
+			}
+			if id_field != "" {
+				if v := expr.Lookup(fields, id_field); v != nil {
+					a.id = fmt.Sprint(v)
+				}
+			}
+			a.doc = value
+		}
+		if a.index, err = sp.Render(index, fields); err != nil {
+			log.WithFields(logging.Message(msg)).Println(err)
+			numInvalid++
+			return
+		}
+
+		batch = append(batch, a)
+		batchBytes += len(a.doc)
+		traces = append(traces, trace)
+		if len(batch) >= bulk_size || batchBytes >= bulk_bytes {
+			flush()
+		}
+	}
+
+	checkpoint := func() {
+		flush()
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("indexed:", numIndexed, "deleted:", numDeleted, "rejected:", numRejected, "invalid:", numInvalid, "stream offsets:", streamOffsets)
+		numIndexed, numDeleted, numRejected, numInvalid = 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case <-flushTicker.C:
+			flush()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			add(msg)
+		}
+	}
+}
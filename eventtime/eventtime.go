@@ -0,0 +1,110 @@
+// Package eventtime extracts the event time of stream messages, the time
+// the events happened rather than the time they are processed.
+//
+// The event time is read from a json field in one of the formats:
+//
+//	rfc3339   strings such as 2016-12-23T10:23:59.947Z
+//	unix      seconds since the epoch
+//	unix_ms   milliseconds since the epoch
+//	unix_us   microseconds since the epoch
+//	unix_ns   nanoseconds since the epoch
+//
+// or in a layout of package time such as "2006-01-02 15:04:05"; the
+// timestamps of kafka messages are used if no field is set.
+package eventtime
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+)
+
+// Extractor reads the event time of messages
+type Extractor struct {
+	path   string
+	format string
+	unit   time.Duration // unix formats
+}
+
+// NewExtractor creates an extractor of the field of a dotted path in a
+// format, the timestamps of kafka messages are used if path is empty
+func NewExtractor(path, format string) (*Extractor, error) {
+	e := &Extractor{path: path, format: format}
+	switch format {
+	case "", "rfc3339":
+		e.format = time.RFC3339Nano
+	case "unix":
+		e.unit = time.Second
+	case "unix_ms":
+		e.unit = time.Millisecond
+	case "unix_us":
+		e.unit = time.Microsecond
+	case "unix_ns":
+		e.unit = time.Nanosecond
+	default:
+		// a layout must at least contain the reference year
+		if !strings.Contains(format, "06") {
+			return nil, fmt.Errorf("eventtime: unsupported format %q", format)
+		}
+	}
+	return e, nil
+}
+
+// Path returns the path of the field, empty if the timestamps of kafka
+// messages are used
+func (e *Extractor) Path() string { return e.path }
+
+// Time returns the event time of a message, doc is its json document; the
+// messages without timestamp are of processing time if no field is set
+func (e *Extractor) Time(msg *sarama.ConsumerMessage, doc *gabs.Container) (time.Time, error) {
+	if e.path == "" {
+		if msg.Timestamp.IsZero() {
+			return time.Now(), nil
+		}
+		return msg.Timestamp, nil
+	}
+	v := doc.Path(e.path).Data()
+	if v == nil {
+		return time.Time{}, fmt.Errorf("eventtime: field %v not found", e.path)
+	}
+	return e.Parse(v)
+}
+
+// Parse converts a json value to time
+func (e *Extractor) Parse(v interface{}) (time.Time, error) {
+	if e.unit != 0 {
+		var n float64
+		switch v := v.(type) {
+		case float64:
+			n = v
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("eventtime: %q is not a number", v)
+			}
+			n = f
+		default:
+			return time.Time{}, fmt.Errorf("eventtime: %v is not a number", v)
+		}
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return time.Time{}, errors.New("eventtime: not a finite number")
+		}
+		whole, frac := math.Modf(n)
+		return time.Unix(0, int64(whole)*int64(e.unit)+int64(frac*float64(e.unit))), nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("eventtime: %v is not a string", v)
+	}
+	ts, err := time.Parse(e.format, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("eventtime: %v", err)
+	}
+	return ts, nil
+}
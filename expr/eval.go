@@ -0,0 +1,295 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type node interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(env map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+// ident resolves a dotted path, the first segment is looked up in env
+type ident struct {
+	path string
+}
+
+func (n *ident) eval(env map[string]interface{}) (interface{}, error) {
+	name, rest := n.path, ""
+	if i := strings.IndexByte(n.path, '.'); i >= 0 {
+		name, rest = n.path[:i], n.path[i+1:]
+	}
+	v, ok := env[name]
+	if !ok {
+		return nil, nil
+	}
+	return Lookup(v, rest), nil
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (n *unary) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !Truth(v), nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expr: cannot negate %T", v)
+	}
+	return -f, nil
+}
+
+type logical struct {
+	or          bool
+	left, right node
+}
+
+func (n *logical) eval(env map[string]interface{}) (interface{}, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if Truth(l) == n.or {
+		return n.or, nil
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return Truth(r), nil
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (n *binary) eval(env map[string]interface{}) (interface{}, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return Equal(l, r), nil
+	case "!=":
+		return !Equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, err := Compare(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "+":
+		if ls, ok := l.(string); ok {
+			return ls + toString(r), nil
+		}
+		if rs, ok := r.(string); ok {
+			return toString(l) + rs, nil
+		}
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("expr: invalid operands %T %v %T", l, n.op, r)
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		return lf / rf, nil
+	default:
+		return math.Mod(lf, rf), nil
+	}
+}
+
+// Equal compares two decoded json values, values of different types are
+// never equal
+func Equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		bf, ok := b.(float64)
+		return ok && a == bf
+	case string:
+		bs, ok := b.(string)
+		return ok && a == bs
+	case bool:
+		bb, ok := b.(bool)
+		return ok && a == bb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare orders two numbers or two strings
+func Compare(a, b interface{}) (int, error) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("expr: cannot compare %T with %T", a, b)
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+type call struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []node
+}
+
+func (n *call) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("expr: %v: %v", n.name, err)
+	}
+	return v, nil
+}
+
+// regexps caches the compiled patterns of matches()
+var regexps sync.Map
+
+func arity(n int, fn func(args []interface{}) (interface{}, error)) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != n {
+			return nil, fmt.Errorf("expects %v arguments, got %v", n, len(args))
+		}
+		return fn(args)
+	}
+}
+
+func stringFunc(fn func(s string) interface{}) func(args []interface{}) (interface{}, error) {
+	return arity(1, func(args []interface{}) (interface{}, error) {
+		return fn(toString(args[0])), nil
+	})
+}
+
+func stringsFunc(fn func(a, b string) bool) func(args []interface{}) (interface{}, error) {
+	return arity(2, func(args []interface{}) (interface{}, error) {
+		return fn(toString(args[0]), toString(args[1])), nil
+	})
+}
+
+var builtins = map[string]func(args []interface{}) (interface{}, error){
+	"lower":      stringFunc(func(s string) interface{} { return strings.ToLower(s) }),
+	"upper":      stringFunc(func(s string) interface{} { return strings.ToUpper(s) }),
+	"trim":       stringFunc(func(s string) interface{} { return strings.TrimSpace(s) }),
+	"string":     stringFunc(func(s string) interface{} { return s }),
+	"contains":   stringsFunc(strings.Contains),
+	"startsWith": stringsFunc(strings.HasPrefix),
+	"endsWith":   stringsFunc(strings.HasSuffix),
+	"exists": arity(1, func(args []interface{}) (interface{}, error) {
+		return args[0] != nil, nil
+	}),
+	"len": arity(1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return 0.0, nil
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("invalid argument %T", args[0])
+	}),
+	"number": arity(1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case float64:
+			return v, nil
+		case bool:
+			if v {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(toString(args[0])), 64)
+		if err != nil {
+			return nil, nil
+		}
+		return f, nil
+	}),
+	"matches": arity(2, func(args []interface{}) (interface{}, error) {
+		pattern := toString(args[1])
+		re, ok := regexps.Load(pattern)
+		if !ok {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			re, _ = regexps.LoadOrStore(pattern, compiled)
+		}
+		return re.(*regexp.Regexp).MatchString(toString(args[0])), nil
+	}),
+}
@@ -0,0 +1,125 @@
+package expr
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	var env map[string]interface{}
+	doc := `{
+		"stream": {"amount": 120, "fk": "a1", "tags": ["x", "y"], "name": " Bob "},
+		"table": {"min_amount": 100, "pk": "a1"},
+		"type": "purchase",
+		"country": "US"
+	}`
+	if err := json.Unmarshal([]byte(doc), &env); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{`stream.amount > table.min_amount && stream.fk == table.pk`, true},
+		{`type == "purchase" && lower(country) != "us"`, false},
+		{`1 + 2 * 3`, 7.0},
+		{`(1 + 2) * 3`, 9.0},
+		{`10 - 4 - 3`, 3.0}, // left associative
+		{`7 % 4`, 3.0},
+		{`-stream.amount / 2`, -60.0},
+		{`1.5e2`, 150.0},
+		{`!true || false`, false},
+		{`"a" + 1`, "a1"},
+		{`'it\'s' + "\t"`, "it's\t"},
+		{`stream.missing == null`, true},
+		{`stream.tags.1`, "y"},
+		{`stream.tags.5`, nil},
+		{`unknown.path`, nil},
+		{`1 == "1"`, false}, // no coercion
+		{`"b" > "a"`, true},
+		{`len(stream.tags) + len("abc")`, 5.0},
+		{`trim(stream.name)`, "Bob"},
+		{`upper(type)`, "PURCHASE"},
+		{`contains(type, "chas") && startsWith(type, "pur") && endsWith(type, "se")`, true},
+		{`exists(stream.fk) && !exists(stream.nope)`, true},
+		{`number(" 42 ") + number(true)`, 43.0},
+		{`number("x")`, nil},
+		{`string(1.25)`, "1.25"},
+		{`matches(stream.fk, "^[a-z][0-9]$")`, true},
+		{`false && 1 / "x"`, false}, // short circuit
+	}
+	for _, tt := range tests {
+		e, err := Compile(tt.src)
+		if err != nil {
+			t.Fatalf("compile %q: %v", tt.src, err)
+		}
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Fatalf("eval %q: %v", tt.src, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("eval %q: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`1 +`,
+		`(1 + 2`,
+		`"unterminated`,
+		`a # b`,
+		`1.2.3`,
+		`nope(1)`,
+		`lower(a b)`,
+		`a == b == c`,
+		`)`,
+	}
+	for _, src := range tests {
+		if _, err := Compile(src); err == nil {
+			t.Fatalf("compile %q: expected an error", src)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := map[string]interface{}{"s": "x", "n": 1.0}
+	tests := []string{
+		`-s`,
+		`n - s`,
+		`n < s`,
+		`lower(s, s)`,
+		`len(n)`,
+		`matches(s, "(")`,
+	}
+	for _, src := range tests {
+		if _, err := MustCompile(src).Eval(env); err == nil {
+			t.Fatalf("eval %q: expected an error", src)
+		}
+	}
+}
+
+func TestTruth(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want bool
+	}{
+		{nil, false},
+		{false, false},
+		{true, true},
+		{0.0, false},
+		{-1.0, true},
+		{"", false},
+		{"0", true},
+		{[]interface{}{}, true},
+		{map[string]interface{}{}, true},
+	}
+	for _, tt := range tests {
+		if got := Truth(tt.v); got != tt.want {
+			t.Fatalf("truth of %#v: got %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
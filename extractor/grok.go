@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// builtinPatterns are the grok patterns most logs are parsed with, after
+// the logstash ones, rewritten for the RE2 syntax of golang regexps
+var builtinPatterns = map[string]string{
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"INT":          `(?:[+-]?(?:[0-9]+))`,
+	"BASE10NUM":    `(?:[+-]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+))`,
+	"NUMBER":       `(?:%{BASE10NUM})`,
+	"BASE16NUM":    `(?:0[xX])?[0-9A-Fa-f]+`,
+	"POSINT":       `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":    `\b(?:[0-9]+)\b`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`,
+	"QS":           `%{QUOTEDSTRING}`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":          `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}`,
+
+	"IPV4":     `(?:(?:25[0-5]|2[0-4][0-9]|1?[0-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1?[0-9]?[0-9])`,
+	"IPV6":     `(?:(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:){1,6}:%{IPV4}|(?:[0-9A-Fa-f]{1,4}:){0,7}:(?:[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,6})?)`,
+	"IP":       `(?:%{IPV4}|%{IPV6})`,
+	"HOSTNAME": `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"IPORHOST": `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"UNIXPATH":     `(?:/[^/\s?#]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":         `(?:%{UNIXPATH}|%{WINPATH})`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{IPORHOST}(?::%{POSINT})?)?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|June?|July?|Aug(?:ust)?|Sep(?:tember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12][0-9]|3[01]|[1-9])`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+
+	"LOGLEVEL":   `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?)`,
+	"PROG":       `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG": `%{PROG:program}(?:\[%{POSINT:pid:int}\])?`,
+	"SYSLOGBASE": `%{SYSLOGTIMESTAMP:timestamp} %{IPORHOST:logsource} %{SYSLOGPROG}:`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{USER:ident} %{USER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{INT:response:int} (?:%{INT:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+}
+
+// grokRef is a reference to a pattern: %{NAME}, %{NAME:field} or
+// %{NAME:field:type}
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(\w+))?\}`)
+
+// capture is a named group of an expression, set to field converted to typ
+type capture struct {
+	field []string
+	typ   string // string, int or float
+}
+
+// extractor matches lines with a regexp expanded from a grok pattern
+type extractor struct {
+	re       *regexp.Regexp
+	captures []*capture // by group index, nil for unnamed groups
+}
+
+// grok expands and compiles grok patterns, plain regexps with named groups
+// like (?P<field>...) are grok patterns without references
+type grok struct {
+	patterns map[string]string
+}
+
+func newGrok() *grok {
+	g := &grok{patterns: make(map[string]string, len(builtinPatterns))}
+	for name, pattern := range builtinPatterns {
+		g.patterns[name] = pattern
+	}
+	return g
+}
+
+// addFile adds the patterns of a file of "NAME pattern" lines, like the
+// pattern files of logstash; lines starting with # are comments
+func (g *grok) addFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i <= 0 {
+			return fmt.Errorf("%v:%v: expect NAME pattern", path, n)
+		}
+		g.patterns[line[:i]] = strings.TrimSpace(line[i:])
+	}
+	return scanner.Err()
+}
+
+// compile expands the references of a pattern, references with a field
+// become capture groups
+func (g *grok) compile(pattern string) (*extractor, error) {
+	ex := &extractor{}
+	var captures []*capture
+	expanded, err := g.expand(pattern, &captures, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ex.re, err = regexp.Compile(expanded); err != nil {
+		return nil, err
+	}
+
+	names := ex.re.SubexpNames()
+	ex.captures = make([]*capture, len(names))
+	for i, name := range names {
+		switch {
+		case name == "":
+		case strings.HasPrefix(name, "grok"):
+			if n, err := strconv.Atoi(name[len("grok"):]); err == nil && n < len(captures) {
+				ex.captures[i] = captures[n]
+				continue
+			}
+			fallthrough
+		default: // named group of a plain regexp
+			ex.captures[i] = &capture{field: strings.Split(name, "."), typ: "string"}
+		}
+	}
+	return ex, nil
+}
+
+// expand replaces the references of pattern by their patterns, stack holds
+// the patterns being expanded to detect cycles
+func (g *grok) expand(pattern string, captures *[]*capture, stack []string) (string, error) {
+	var err error
+	expanded := grokRef.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := grokRef.FindStringSubmatch(ref)
+		name, field, typ := m[1], m[2], m[3]
+		sub, ok := g.patterns[name]
+		if !ok {
+			err = fmt.Errorf("unknown grok pattern %v", name)
+			return ""
+		}
+		for _, s := range stack {
+			if s == name {
+				err = fmt.Errorf("grok pattern %v references itself", name)
+				return ""
+			}
+		}
+		switch typ {
+		case "":
+			typ = "string"
+		case "string", "int", "float":
+		default:
+			err = fmt.Errorf("%v: unsupported type %v, expect int or float", ref, typ)
+			return ""
+		}
+		if sub, err = g.expand(sub, captures, append(stack, name)); err != nil {
+			return ""
+		}
+		if field == "" {
+			return "(?:" + sub + ")"
+		}
+		*captures = append(*captures, &capture{field: strings.Split(field, "."), typ: typ})
+		return fmt.Sprintf("(?P<grok%v>%v)", len(*captures)-1, sub)
+	})
+	return expanded, err
+}
+
+// extract returns the fields captured from line, false if not matched;
+// groups not participating in the match are omitted
+func (ex *extractor) extract(line string) (map[string]interface{}, bool) {
+	m := ex.re.FindStringSubmatchIndex(line)
+	if m == nil {
+		return nil, false
+	}
+	fields := make(map[string]interface{})
+	for i, c := range ex.captures {
+		if c == nil || m[2*i] < 0 {
+			continue
+		}
+		s := line[m[2*i]:m[2*i+1]]
+		var v interface{} = s
+		switch c.typ {
+		case "int":
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				v = n
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				v = f
+			}
+		}
+		setPath(fields, c.field, v)
+	}
+	return fields, true
+}
+
+// setPath sets v in nested objects along path
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[seg] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		pattern string
+		line    string
+		want    map[string]interface{} // nil if not matched
+	}{
+		{
+			`%{IP:client} %{WORD:method} %{URIPATHPARAM:path} %{NUMBER:bytes:int}`,
+			"55.3.244.1 GET /index.html?q=1 15824",
+			map[string]interface{}{"client": "55.3.244.1", "method": "GET", "path": "/index.html?q=1", "bytes": int64(15824)},
+		},
+		{
+			`(?P<level>\w+): (?P<msg>.*)`,
+			"ERROR: disk full",
+			map[string]interface{}{"level": "ERROR", "msg": "disk full"},
+		},
+		{
+			`%{NUMBER:http.duration:float}s %{WORD:http.status}`,
+			"0.25s ok",
+			map[string]interface{}{"http": map[string]interface{}{"duration": 0.25, "status": "ok"}},
+		},
+		{ // groups not participating are omitted
+			`^%{WORD:a}(?: %{INT:b:int})?$`,
+			"x",
+			map[string]interface{}{"a": "x"},
+		},
+		{ // values not converted are kept as strings
+			`%{NOTSPACE:n:int}`,
+			"abc",
+			map[string]interface{}{"n": "abc"},
+		},
+		{
+			`%{COMMONAPACHELOG}`,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			map[string]interface{}{"clientip": "127.0.0.1", "ident": "-", "auth": "frank", "timestamp": "10/Oct/2000:13:55:36 -0700",
+				"verb": "GET", "request": "/apache_pb.gif", "httpversion": "1.0", "response": int64(200), "bytes": int64(2326)},
+		},
+		{
+			`%{SYSLOGBASE} %{GREEDYDATA:message}`,
+			"Feb  5 17:32:18 host sshd[123]: Accepted publickey",
+			map[string]interface{}{"timestamp": "Feb  5 17:32:18", "logsource": "host", "program": "sshd", "pid": int64(123), "message": "Accepted publickey"},
+		},
+		{
+			`%{TIMESTAMP_ISO8601:ts} %{LOGLEVEL:level} %{UUID:id}`,
+			"2024-01-02T03:04:05.678Z WARN 123e4567-e89b-12d3-a456-426614174000",
+			map[string]interface{}{"ts": "2024-01-02T03:04:05.678Z", "level": "WARN", "id": "123e4567-e89b-12d3-a456-426614174000"},
+		},
+		{
+			`^%{INT:n}$`,
+			"abc",
+			nil,
+		},
+	}
+	g := newGrok()
+	for _, tt := range tests {
+		ex, err := g.compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("compile %q: %v", tt.pattern, err)
+		}
+		got, ok := ex.extract(tt.line)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("extract %q with %q: got %v %v, want %v", tt.line, tt.pattern, got, ok, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "patterns")
+	patterns := "# custom patterns\n\nAPPID app-[0-9]+\nLOOP a%{LOOP}\nPING %{PONG}\nPONG %{PING}\n"
+	if err := ioutil.WriteFile(path, []byte(patterns), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g := newGrok()
+	if err := g.addFile(path); err != nil {
+		t.Fatal(err)
+	}
+	ex, err := g.compile(`%{APPID:app}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ex.extract("from app-42"); !reflect.DeepEqual(got, map[string]interface{}{"app": "app-42"}) {
+		t.Fatalf("custom pattern: %v", got)
+	}
+
+	tests := []string{
+		`%{NOPE:x}`,
+		`%{INT:x:bool}`,
+		`(?P<a>`,
+		`%{LOOP}`,
+		`%{PING:x}`,
+	}
+	for _, pattern := range tests {
+		if _, err := g.compile(pattern); err == nil {
+			t.Fatalf("compile %q: expected an error", pattern)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(bad, []byte("NOPATTERN\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.addFile(bad); err == nil {
+		t.Fatal("addFile of a line without pattern: expected an error")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "extractor",
+		Usage: "Parse the plain text log lines of a stream into json messages with grok patterns or regexps",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "pattern",
+				Usage: "grok pattern or regexp with named groups parsing lines, tried in order until one matches, e.g.: '%{IP:client} %{WORD:method} %{URIPATHPARAM:path} %{NUMBER:bytes:int}' or '(?P<level>\\w+): (?P<msg>.*)'",
+			},
+			&cli.StringSliceFlag{
+				Name:  "patterns-file",
+				Usage: "file of custom grok patterns, a NAME pattern per line",
+			},
+			&cli.StringFlag{
+				Name:  "message-field",
+				Value: "",
+				Usage: "json field to keep the whole line in, not kept if not set",
+			},
+			&cli.StringFlag{
+				Name:  "unmatched-topic",
+				Value: "",
+				Usage: "topic to forward the lines matching no pattern as is, dropped if not set",
+			},
+		},
+		Processor: &extraction{},
+	})
+}
+
+// extraction produces the fields of the first pattern matching the lines
+// to the output topic, and the lines matching none to the unmatched topic
+// if set
+type extraction struct {
+	extractors     []*extractor
+	matched        []string // counters of the extractors
+	messagePath    []string
+	unmatchedTopic string
+}
+
+func (p *extraction) Setup(ctx *sp.Context) error {
+	patterns := ctx.StringSlice("pattern")
+	patternsFiles := ctx.StringSlice("patterns-file")
+	messageField := ctx.String("message-field")
+	p.unmatchedTopic = ctx.String("unmatched-topic")
+
+	log.Println("pattern:", patterns)
+	log.Println("patterns-file:", patternsFiles)
+	log.Println("message-field:", messageField)
+	log.Println("unmatched-topic:", p.unmatchedTopic)
+
+	if len(patterns) == 0 {
+		return errors.New("pattern must be set")
+	}
+	g := newGrok()
+	for _, path := range patternsFiles {
+		if err := g.addFile(path); err != nil {
+			return err
+		}
+	}
+	for i, pattern := range patterns {
+		ex, err := g.compile(pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %v", pattern, err)
+		}
+		p.extractors = append(p.extractors, ex)
+		p.matched = append(p.matched, fmt.Sprintf("matched[%v]", i))
+		ctx.Count(p.matched[i], 0)
+	}
+	if messageField != "" {
+		p.messagePath = strings.Split(messageField, ".")
+	}
+	ctx.Count("unmatched", 0)
+	ctx.Count("invalid", 0)
+	return nil
+}
+
+// Process emits the fields of the first pattern matching a line
+func (p *extraction) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	line := strings.TrimRight(string(msg.Value), "\r\n")
+	for i, ex := range p.extractors {
+		fields, ok := ex.extract(line)
+		if !ok {
+			continue
+		}
+		if p.messagePath != nil {
+			setPath(fields, p.messagePath, line)
+		}
+		bts, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		ctx.SendFrom(msg, ctx.OutputTopic, msg.Key, bts)
+		ctx.Count(p.matched[i], 1)
+		return nil
+	}
+
+	if p.unmatchedTopic != "" {
+		ctx.Forward(msg, p.unmatchedTopic)
+	}
+	ctx.Count("unmatched", 1)
+	return nil
+}
+
+func (p *extraction) Checkpoint(ctx *sp.Context) error { return nil }
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// inode is not available on windows, files are identified by path only
+func inode(fi os.FileInfo) uint64 { return 0 }
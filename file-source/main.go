@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	filesBucket   = "__files__"
+	processorName = "file-source"
+)
+
+// line is the message of a line of the json format
+type line struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Host   string `json:"host"`
+	Line   string `json:"line"`
+}
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Tail files and publish their lines to a kafka topic, following rotations, with the offsets of the files checkpointed",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringSliceFlag{
+				Name:  "path",
+				Usage: "glob pattern of the files to tail, e.g. /var/log/app/*.log, repeatable; patterns should not match the rotated files, read again otherwise",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "lines",
+				Usage: "topic to publish the lines to, keyed by file",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "raw",
+				Usage: "format of the messages, raw for the lines, or json for objects of file, offset, host and line",
+			},
+			&cli.StringFlag{
+				Name:  "start-position",
+				Value: "beginning",
+				Usage: "position of the files without a checkpoint at startup, beginning or end; files created later are read from the beginning",
+			},
+			&cli.IntFlag{
+				Name:  "max-line",
+				Value: 1 << 20,
+				Usage: "max bytes of lines, longer lines are split",
+			},
+			&cli.DurationFlag{
+				Name:  "poll-interval",
+				Value: 250 * time.Millisecond,
+				Usage: "interval of the reads of the files",
+			},
+			&cli.DurationFlag{
+				Name:  "scan-interval",
+				Value: 10 * time.Second,
+				Usage: "interval of the matches of the patterns for new files",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of the offsets of the files, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 10 * time.Second,
+				Usage: "interval of the checkpoints of the offsets",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	paths := c.StringSlice("path")
+	output_topic := c.String("output-topic")
+	format := c.String("format")
+	start_position := c.String("start-position")
+	max_line := c.Int("max-line")
+	poll_interval := c.Duration("poll-interval")
+	scan_interval := c.Duration("scan-interval")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("path:", paths)
+	log.Println("output-topic:", output_topic)
+	log.Println("format:", format)
+	log.Println("start-position:", start_position)
+	log.Println("max-line:", max_line)
+	log.Println("poll-interval:", poll_interval)
+	log.Println("scan-interval:", scan_interval)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	if len(paths) == 0 {
+		log.Fatalln("no path")
+	}
+	for _, p := range paths {
+		if _, err := filepath.Match(p, ""); err != nil {
+			log.Fatalln("path", p, err)
+		}
+	}
+	if format != "raw" && format != "json" {
+		log.Fatalln("unsupported format", format)
+	}
+	if start_position != "beginning" && start_position != "end" {
+		log.Fatalln("unsupported start-position", start_position)
+	}
+	if max_line <= 0 {
+		log.Fatalln("max-line must be positive")
+	}
+
+	// the state of a set of patterns is its own
+	cachefile := fmt.Sprintf(".file-source-%08x.cache", crc32.ChecksumIEEE([]byte(strings.Join(paths, "\x00"))))
+	log.Println("cache file:", cachefile)
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	kconfig := kafka.NewConfig()
+	kconfig.Producer.Return.Successes = true
+	kconfig.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, kconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// lines in flight, offsets are only checkpointed after all lines
+	// before them have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without checkpointing, the files are read again from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+	defer func() {
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	hostname, _ := os.Hostname()
+	tailers := make(map[string]*tailer)
+	removed := make(map[string]bool) // paths gone since the last checkpoint
+	numLines, numFiles, numRotated := 0, 0, 0
+
+	emitter := func(path string) func([]byte, int64) {
+		return func(text []byte, offset int64) {
+			value := append([]byte(nil), text...)
+			if format == "json" {
+				bts, err := json.Marshal(line{File: path, Offset: offset, Host: hostname, Line: string(text)})
+				if err != nil {
+					log.Fatalln(err)
+				}
+				value = bts
+			}
+			inflight.Add(1)
+			producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Key: sarama.StringEncoder(path), Value: sarama.ByteEncoder(value)}
+			numLines++
+		}
+	}
+
+	// scan opens the files matching the patterns not tailed yet, from
+	// their checkpoints if they are the same files
+	scan := func(startup bool) {
+		var matches []string
+		for _, p := range paths {
+			m, _ := filepath.Glob(p)
+			matches = append(matches, m...)
+		}
+		sort.Strings(matches)
+		for _, path := range matches {
+			if _, ok := tailers[path]; ok {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			offset := int64(0)
+			if startup && start_position == "end" {
+				offset = -1
+			}
+			if v, err := store.Get(filesBucket, []byte(path)); err != nil {
+				log.Fatalln(err)
+			} else if v != nil {
+				pos, err := unmarshalPosition(v)
+				if err != nil {
+					log.Fatalln(path, err)
+				}
+				if pos.Inode == inode(info) && pos.Offset <= info.Size() {
+					offset = pos.Offset
+				} else {
+					// rotated or truncated while stopped
+					offset = 0
+				}
+			}
+			t, err := openTailer(path, offset, max_line)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			log.Println("tailing:", path, "offset:", t.offset)
+			tailers[path] = t
+			delete(removed, path)
+			numFiles++
+		}
+	}
+
+	// poll reads the lines appended to the files
+	poll := func() {
+		for path, t := range tailers {
+			emit := emitter(path)
+			prev := t.info
+			exists, err := t.check(emit)
+			if err != nil {
+				log.Fatalln(path, err)
+			}
+			if !exists {
+				// deleted or renamed without a new file, read to the end
+				if err := t.read(emit); err != nil {
+					log.Fatalln(path, err)
+				}
+				t.flush(emit)
+				t.close()
+				delete(tailers, path)
+				removed[path] = true
+				log.Println("closed:", path)
+				continue
+			}
+			if !os.SameFile(prev, t.info) {
+				log.Println("rotated:", path)
+				numRotated++
+			}
+			if err := t.read(emit); err != nil {
+				log.Fatalln(path, err)
+			}
+		}
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		for path, t := range tailers {
+			if err := store.Put(filesBucket, []byte(path), t.position().marshal()); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		for path := range removed {
+			if err := store.Delete(filesBucket, []byte(path)); err != nil {
+				log.Fatalln(err)
+			}
+			delete(removed, path)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("lines:", numLines, "files opened:", numFiles, "rotated:", numRotated, "tailing:", len(tailers))
+		numLines, numFiles, numRotated = 0, 0, 0
+	}
+
+	scan(true)
+	log.Println("started")
+	pollTicker := time.NewTicker(poll_interval)
+	scanTicker := time.NewTicker(scan_interval)
+	commitTicker := time.NewTicker(write_interval)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-pollTicker.C:
+			poll()
+		case <-scanTicker.C:
+			scan(false)
+		case <-commitTicker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			for _, t := range tailers {
+				t.close()
+			}
+			return nil
+		}
+	}
+}
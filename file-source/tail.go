@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// position is the checkpoint of a file, the offset after the last line
+// shipped of the file of inode
+type position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func (p position) marshal() []byte {
+	bts, _ := json.Marshal(p)
+	return bts
+}
+
+func unmarshalPosition(bts []byte) (p position, err error) {
+	err = json.Unmarshal(bts, &p)
+	return
+}
+
+// tailer reads the lines appended to a file, following the path when the
+// file is rotated or truncated
+type tailer struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64  // offset after the last complete line
+	partial []byte // incomplete last line
+	maxLine int
+	buf     []byte
+}
+
+// openTailer opens path at offset, at the end of the file if offset is
+// negative
+func openTailer(path string, offset int64, maxLine int) (*tailer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset < 0 || offset > info.Size() {
+		offset = info.Size()
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tailer{path: path, file: f, info: info, offset: offset, maxLine: maxLine, buf: make([]byte, 64*1024)}, nil
+}
+
+func (t *tailer) position() position {
+	return position{Inode: inode(t.info), Offset: t.offset}
+}
+
+// read emits the complete lines appended since the last read with their
+// offsets, lines longer than maxLine are split
+func (t *tailer) read(emit func(line []byte, offset int64)) error {
+	for {
+		n, err := t.file.Read(t.buf)
+		if n > 0 {
+			t.partial = append(t.partial, t.buf[:n]...)
+			for {
+				i := bytes.IndexByte(t.partial, '\n')
+				if i >= 0 && i <= t.maxLine {
+					t.emit(emit, t.partial[:i], i+1)
+				} else if i >= 0 || len(t.partial) >= t.maxLine {
+					t.emit(emit, t.partial[:t.maxLine], t.maxLine)
+				} else {
+					break
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// emit emits line and consumes n bytes of the partial line
+func (t *tailer) emit(emit func(line []byte, offset int64), line []byte, n int) {
+	emit(bytes.TrimSuffix(line, []byte{'\r'}), t.offset)
+	t.offset += int64(n)
+	t.partial = t.partial[n:]
+}
+
+// flush emits the incomplete last line, of a file that won't be appended
+func (t *tailer) flush(emit func(line []byte, offset int64)) {
+	if len(t.partial) > 0 {
+		t.emit(emit, t.partial, len(t.partial))
+	}
+}
+
+// check detects the rotation or truncation of the file: a rotated file is
+// read to the end and the new file of the path opened from its start, a
+// truncated file is read again from its start; returns false if the path
+// no longer exists
+func (t *tailer) check(emit func(line []byte, offset int64)) (bool, error) {
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+	if !os.SameFile(t.info, info) {
+		if err := t.read(emit); err != nil {
+			return true, err
+		}
+		t.flush(emit)
+		t.file.Close()
+		f, err := os.Open(t.path)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return true, err
+		}
+		if info, err = f.Stat(); err != nil {
+			f.Close()
+			return true, err
+		}
+		t.file, t.info, t.offset, t.partial = f, info, 0, t.partial[:0]
+		return true, nil
+	}
+	if info.Size() < t.offset+int64(len(t.partial)) {
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return true, err
+		}
+		t.offset, t.partial = 0, t.partial[:0]
+	}
+	t.info = info
+	return true, nil
+}
+
+func (t *tailer) close() error {
+	return t.file.Close()
+}
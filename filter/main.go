@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/expr"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "filter",
+		Usage: "Forward the messages of a stream matching a predicate",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "where",
+				Value: "",
+				Usage: "predicate over the json fields of stream messages, e.g.: status == \"error\" && latency_ms > 500",
+			},
+			&cli.BoolFlag{
+				Name:  "invert",
+				Usage: "forward the messages not matching the predicate instead",
+			},
+			&cli.StringFlag{
+				Name:  "reject-topic",
+				Value: "",
+				Usage: "topic to forward the messages not forwarded to output-topic, dropped if not set",
+			},
+		},
+		Processor: &filter{},
+	})
+}
+
+// filter forwards the messages matching a predicate to the output topic,
+// and the others to the reject topic if set
+type filter struct {
+	predicate   *expr.Expr
+	invert      bool
+	rejectTopic string
+}
+
+func (f *filter) Setup(ctx *sp.Context) error {
+	where := ctx.String("where")
+	f.invert = ctx.Bool("invert")
+	f.rejectTopic = ctx.String("reject-topic")
+
+	log.Println("where:", where)
+	log.Println("invert:", f.invert)
+	log.Println("reject-topic:", f.rejectTopic)
+
+	if where == "" {
+		return errors.New("where must be set")
+	}
+	var err error
+	f.predicate, err = expr.Compile(where)
+	ctx.Count("forwarded", 0)
+	ctx.Count("rejected", 0)
+	ctx.Count("invalid", 0)
+	return err
+}
+
+func (f *filter) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	fields, err := ctx.Decode(msg)
+	if err != nil {
+		return err
+	}
+	ok, err := f.predicate.Bool(fields)
+	if err != nil {
+		return err
+	}
+
+	if ok != f.invert {
+		ctx.Forward(msg, ctx.OutputTopic)
+		ctx.Count("forwarded", 1)
+		return nil
+	}
+	if f.rejectTopic != "" {
+		ctx.Forward(msg, f.rejectTopic)
+	}
+	ctx.Count("rejected", 1)
+	return nil
+}
+
+func (f *filter) Checkpoint(ctx *sp.Context) error { return nil }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// flattener flattens nested objects into a single object of the leaf values
+// keyed by their joined paths, e.g. {"user":{"id":1}} into {"user.id":1}
+type flattener struct {
+	separator string
+	arrays    string // index: flattened by index, json: json strings, keep: as is
+}
+
+func (f *flattener) flatten(msg map[string]interface{}) (map[string]interface{}, error) {
+	flat := make(map[string]interface{})
+	if err := f.add(flat, "", msg); err != nil {
+		return nil, err
+	}
+	return flat, nil
+}
+
+// add adds v at key to flat, empty objects and arrays have no leaves
+func (f *flattener) add(flat map[string]interface{}, key string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if err := f.add(flat, f.join(key, k), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		switch f.arrays {
+		case "index":
+			for i, child := range v {
+				if err := f.add(flat, f.join(key, strconv.Itoa(i)), child); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "json":
+			bts, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			flat[key] = string(bts)
+			return nil
+		}
+	}
+	flat[key] = v
+	return nil
+}
+
+func (f *flattener) join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + f.separator + key
+}
+
+// explode returns a message per element of the array at each path, the
+// product of the elements for several paths; the array is replaced by the
+// element in each message; a message is kept without the field for empty
+// arrays, and as is if the field is missing or not an array
+func explode(msg map[string]interface{}, paths [][]string) []map[string]interface{} {
+	msgs := []map[string]interface{}{msg}
+	for _, path := range paths {
+		var exploded []map[string]interface{}
+		for _, m := range msgs {
+			arr, ok := lookupPath(m, path).([]interface{})
+			switch {
+			case !ok:
+				exploded = append(exploded, m)
+			case len(arr) == 0:
+				exploded = append(exploded, withPath(m, path, nil, true))
+			default:
+				for _, e := range arr {
+					exploded = append(exploded, withPath(m, path, e, false))
+				}
+			}
+		}
+		msgs = exploded
+	}
+	return msgs
+}
+
+func lookupPath(obj map[string]interface{}, path []string) interface{} {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		obj = child
+	}
+	return obj[path[len(path)-1]]
+}
+
+// withPath returns a copy of obj with v at path, or without path if del;
+// only the objects along path are copied, the other values are shared
+func withPath(obj map[string]interface{}, path []string, v interface{}, del bool) map[string]interface{} {
+	cp := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		cp[k] = v
+	}
+	if len(path) == 1 {
+		if del {
+			delete(cp, path[0])
+		} else {
+			cp[path[0]] = v
+		}
+		return cp
+	}
+	child, _ := cp[path[0]].(map[string]interface{})
+	cp[path[0]] = withPath(child, path[1:], v, del)
+	return cp
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "flattener",
+		Usage: "Flatten the nested json messages of a stream into records of dotted keys",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "separator",
+				Value: ".",
+				Usage: "separator of the keys of nested fields, e.g.: _ for user_id",
+			},
+			&cli.StringFlag{
+				Name:  "arrays",
+				Value: "index",
+				Usage: "arrays are, index: flattened by index like tags.0, json: kept as json strings, keep: kept as is",
+			},
+			&cli.StringSliceFlag{
+				Name:  "explode",
+				Usage: "json field of an array to explode into a message per element before flattening, repeated for the product of several arrays, e.g.: items",
+			},
+		},
+		Processor: &flattening{},
+	})
+}
+
+// flattening produces the flattened records of the messages to the output
+// topic
+type flattening struct {
+	flattener    *flattener
+	explodePaths [][]string
+}
+
+func (p *flattening) Setup(ctx *sp.Context) error {
+	separator := ctx.String("separator")
+	arrays := ctx.String("arrays")
+	explodeFields := ctx.StringSlice("explode")
+
+	log.Println("separator:", separator)
+	log.Println("arrays:", arrays)
+	log.Println("explode:", explodeFields)
+
+	if separator == "" {
+		return errors.New("separator must be set")
+	}
+	switch arrays {
+	case "index", "json", "keep":
+	default:
+		return fmt.Errorf("unsupported arrays: %v", arrays)
+	}
+	p.flattener = &flattener{separator: separator, arrays: arrays}
+	for _, field := range explodeFields {
+		p.explodePaths = append(p.explodePaths, strings.Split(field, "."))
+	}
+	ctx.Count("flattened", 0)
+	ctx.Count("emitted", 0)
+	ctx.Count("invalid", 0)
+	return nil
+}
+
+// Process emits the flattened records of a message, numbers are kept as is
+// so that large integers don't lose precision
+func (p *flattening) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	value, err := ctx.Decoder.Decode(msg.Value)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return errors.New("message is not a json object")
+	}
+
+	records := []map[string]interface{}{fields}
+	if p.explodePaths != nil {
+		records = explode(fields, p.explodePaths)
+	}
+	var outs [][]byte
+	for _, record := range records {
+		flat, err := p.flattener.flatten(record)
+		if err != nil {
+			return err
+		}
+		bts, err := json.Marshal(flat)
+		if err != nil {
+			return err
+		}
+		outs = append(outs, bts)
+	}
+
+	for _, bts := range outs {
+		ctx.SendFrom(msg, ctx.OutputTopic, msg.Key, bts)
+	}
+	ctx.Count("flattened", 1)
+	ctx.Count("emitted", len(outs))
+	return nil
+}
+
+func (p *flattening) Checkpoint(ctx *sp.Context) error { return nil }
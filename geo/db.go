@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// database is a maxmind database file, reopened when the file changes on
+// disk so that updates by geoipupdate are picked up without restart
+type database struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+func openDatabase(path string) (*database, error) {
+	db := &database{path: path}
+	if _, err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reload reopens the file if modified since last opened, the database in
+// use is kept if the new file fails to open, e.g. while being written
+func (db *database) reload() (bool, error) {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	if db.reader != nil && fi.ModTime().Equal(db.modTime) && fi.Size() == db.size {
+		return false, nil
+	}
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return false, err
+	}
+	if db.reader != nil {
+		db.reader.Close()
+	}
+	db.reader, db.modTime, db.size = reader, fi.ModTime(), fi.Size()
+	return true, nil
+}
+
+// lookup decodes the record of ip into v, returns false if not found
+func (db *database) lookup(ip net.IP, v interface{}) (bool, error) {
+	_, ok, err := db.reader.LookupNetwork(ip, v)
+	return ok, err
+}
+
+func (db *database) String() string {
+	m := db.reader.Metadata
+	return db.path + " (" + m.DatabaseType + ", built " + time.Unix(int64(m.BuildEpoch), 0).UTC().Format(time.RFC3339) + ")"
+}
+
+func (db *database) close() error { return db.reader.Close() }
+
+// cityRecord is the part of the records of GeoIP2/GeoLite2 City and Country
+// databases used, Country databases have no city nor location
+type cityRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+		TimeZone  string   `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+// asnRecord is the record of GeoLite2 ASN databases
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geo is the location of an ip set on messages, fields not found are omitted
+type geo struct {
+	ContinentCode string   `json:"continent_code,omitempty"`
+	CountryCode   string   `json:"country_code,omitempty"`
+	Country       string   `json:"country,omitempty"`
+	RegionCode    string   `json:"region_code,omitempty"`
+	Region        string   `json:"region,omitempty"`
+	City          string   `json:"city,omitempty"`
+	PostalCode    string   `json:"postal_code,omitempty"`
+	Latitude      *float64 `json:"latitude,omitempty"`
+	Longitude     *float64 `json:"longitude,omitempty"`
+	TimeZone      string   `json:"time_zone,omitempty"`
+	ASN           uint     `json:"asn,omitempty"`
+	ASOrg         string   `json:"as_org,omitempty"`
+}
+
+// setCity sets the fields of a city record, names in lang
+func (g *geo) setCity(r *cityRecord, lang string) {
+	g.ContinentCode = r.Continent.Code
+	g.CountryCode = r.Country.IsoCode
+	g.Country = r.Country.Names[lang]
+	if len(r.Subdivisions) > 0 {
+		g.RegionCode = r.Subdivisions[0].IsoCode
+		g.Region = r.Subdivisions[0].Names[lang]
+	}
+	g.City = r.City.Names[lang]
+	g.PostalCode = r.Postal.Code
+	g.Latitude, g.Longitude = r.Location.Latitude, r.Location.Longitude
+	g.TimeZone = r.Location.TimeZone
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/logging"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// reloadTimer is the timer of the checks of the database files for updates
+const reloadTimer = "reload"
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "geo",
+		Usage: "Enrich the messages of a stream with the location and network of an ip field from maxmind databases",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "ip-field",
+				Value: "",
+				Usage: "json field of the ip address to locate, e.g.: client.ip, a port is ignored",
+			},
+			&cli.StringFlag{
+				Name:  "city-db",
+				Value: "",
+				Usage: "maxmind city or country database file, e.g.: GeoLite2-City.mmdb",
+			},
+			&cli.StringFlag{
+				Name:  "asn-db",
+				Value: "",
+				Usage: "maxmind asn database file, e.g.: GeoLite2-ASN.mmdb",
+			},
+			&cli.StringFlag{
+				Name:  "target",
+				Value: "geo",
+				Usage: "json field to set to the location found",
+			},
+			&cli.StringFlag{
+				Name:  "lang",
+				Value: "en",
+				Usage: "language of the names of countries, regions and cities",
+			},
+			&cli.DurationFlag{
+				Name:  "reload-interval",
+				Value: time.Minute,
+				Usage: "interval to check the database files for updates, reloaded when modified",
+			},
+		},
+		Processor: &enrichment{},
+	})
+}
+
+// enrichment produces the messages with the location of their ip to the
+// output topic, messages without ip or with an ip not found as is; the
+// databases are reloaded by a timer, between the messages processed
+type enrichment struct {
+	ipField        string
+	path           []string
+	lang           string
+	reloadInterval time.Duration
+	cities, asns   *database
+}
+
+func (p *enrichment) Setup(ctx *sp.Context) error {
+	p.ipField = ctx.String("ip-field")
+	cityDB := ctx.String("city-db")
+	asnDB := ctx.String("asn-db")
+	target := ctx.String("target")
+	p.lang = ctx.String("lang")
+	p.reloadInterval = ctx.Duration("reload-interval")
+
+	log.Println("ip-field:", p.ipField)
+	log.Println("city-db:", cityDB)
+	log.Println("asn-db:", asnDB)
+	log.Println("target:", target)
+	log.Println("lang:", p.lang)
+	log.Println("reload-interval:", p.reloadInterval)
+
+	if p.ipField == "" {
+		return errors.New("ip-field must be set")
+	}
+	if target == "" {
+		return errors.New("target must be set")
+	}
+	if cityDB == "" && asnDB == "" {
+		return errors.New("city-db or asn-db must be set")
+	}
+	if p.reloadInterval <= 0 {
+		return errors.New("reload-interval must be positive")
+	}
+	p.path = strings.Split(target, ".")
+	for _, db := range []struct {
+		path string
+		db   **database
+	}{{cityDB, &p.cities}, {asnDB, &p.asns}} {
+		if db.path == "" {
+			continue
+		}
+		d, err := openDatabase(db.path)
+		if err != nil {
+			return err
+		}
+		log.Println("database:", d)
+		*db.db = d
+	}
+	ctx.SetTimer(reloadTimer, time.Now().Add(p.reloadInterval), nil)
+	ctx.Count("enriched", 0)
+	ctx.Count("unknown", 0)
+	ctx.Count("invalid", 0)
+	return nil
+}
+
+// locate looks up ip in the databases, nil if found in none
+func (p *enrichment) locate(ip net.IP) (*geo, error) {
+	g, found := &geo{}, false
+	if p.cities != nil {
+		var r cityRecord
+		ok, err := p.cities.lookup(ip, &r)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			g.setCity(&r, p.lang)
+			found = true
+		}
+	}
+	if p.asns != nil {
+		var r asnRecord
+		ok, err := p.asns.lookup(ip, &r)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			g.ASN, g.ASOrg = r.Number, r.Organization
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return g, nil
+}
+
+func (p *enrichment) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	fields, err := ctx.Decode(msg)
+	if err != nil {
+		return err
+	}
+	if fields == nil {
+		return errors.New("message is not a json object")
+	}
+
+	var g *geo
+	if ip := parseIP(expr.Lookup(fields, p.ipField)); ip != nil {
+		if g, err = p.locate(ip); err != nil {
+			log.WithFields(logging.Message(msg)).Println(err)
+		}
+	}
+	if g != nil {
+		setPath(fields, p.path, g)
+		ctx.Count("enriched", 1)
+	} else {
+		ctx.Count("unknown", 1)
+	}
+
+	bts, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	ctx.SendFrom(msg, ctx.OutputTopic, msg.Key, bts)
+	return nil
+}
+
+// OnTimer reloads the databases modified, never concurrently with the
+// lookups of Process
+func (p *enrichment) OnTimer(ctx *sp.Context, key string, data []byte) error {
+	ctx.SetTimer(reloadTimer, time.Now().Add(p.reloadInterval), nil)
+	for _, db := range []*database{p.cities, p.asns} {
+		if db == nil {
+			continue
+		}
+		if ok, err := db.reload(); err != nil {
+			log.Println("reload:", err)
+		} else if ok {
+			log.Println("reloaded database:", db)
+		}
+	}
+	return nil
+}
+
+func (p *enrichment) Checkpoint(ctx *sp.Context) error { return nil }
+
+// parseIP parses an ip address, with an optional port, nil if invalid
+func parseIP(v interface{}) net.IP {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// setPath sets v in nested objects along path
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[seg] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
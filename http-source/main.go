@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const processorName = "http-source"
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Accept json messages over http and produce them to a kafka topic, for clients that can't speak kafka",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "listen",
+				Value: ":8080",
+				Usage: "address of the http server",
+			},
+			&cli.StringFlag{
+				Name:  "path",
+				Value: "/ingest",
+				Usage: "path of the endpoint, POST a json message, or json lines with Content-Type: application/x-ndjson",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "http",
+				Usage: "topic to produce the messages to",
+			},
+			&cli.StringFlag{
+				Name:  "key-field",
+				Value: "",
+				Usage: "json field of the keys of messages, no keys if not set, format: a.b.0.c",
+			},
+			&cli.StringFlag{
+				Name:    "secret",
+				EnvVars: []string{"HTTP_SOURCE_SECRET"},
+				Usage:   "shared secret of clients, expected in the header: Authorization: Bearer {secret}, no auth if not set",
+			},
+			&cli.Float64Flag{
+				Name:  "client-rate",
+				Value: 0,
+				Usage: "messages per second per client, unlimited if 0",
+			},
+			&cli.IntFlag{
+				Name:  "client-burst",
+				Value: 1000,
+				Usage: "max burst of messages per client, batches larger are rejected",
+			},
+			&cli.StringFlag{
+				Name:  "client-header",
+				Value: "",
+				Usage: "header identifying clients for rate limiting, e.g. X-Client-Id, the remote ip if not set or absent",
+			},
+			&cli.IntFlag{
+				Name:  "max-body",
+				Value: 10 << 20,
+				Usage: "max bytes of request bodies",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval of the logs of counters",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	listen := c.String("listen")
+	path := c.String("path")
+	output_topic := c.String("output-topic")
+	key_field := c.String("key-field")
+	secret := c.String("secret")
+	client_rate := c.Float64("client-rate")
+	client_burst := c.Int("client-burst")
+	client_header := c.String("client-header")
+	max_body := c.Int("max-body")
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("listen:", listen)
+	log.Println("path:", path)
+	log.Println("output-topic:", output_topic)
+	log.Println("key-field:", key_field)
+	log.Println("secret:", secret != "")
+	log.Println("client-rate:", client_rate)
+	log.Println("client-burst:", client_burst)
+	log.Println("client-header:", client_header)
+	log.Println("max-body:", max_body)
+	log.Println("write-interval:", write_interval)
+
+	var limiter *clientLimiter
+	if client_rate > 0 {
+		if client_burst <= 0 {
+			log.Fatalln("client-burst must be positive")
+		}
+		limiter = newClientLimiter(client_rate, client_burst)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// counters are updated by the handlers
+	var numAccepted, numInvalid, numUnauthorized, numLimited, numFailed int64
+
+	reply := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(w http.ResponseWriter, status int, err error) {
+		reply(w, status, map[string]string{"error": err.Error()})
+	}
+
+	// ingest produces the messages of a request, the response is sent once
+	// all are acknowledged by kafka
+	ingest := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+			return
+		}
+		if secret != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+				atomic.AddInt64(&numUnauthorized, 1)
+				fail(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+				return
+			}
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(max_body)))
+		if err != nil {
+			atomic.AddInt64(&numInvalid, 1)
+			fail(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		messages, err := split(body, strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson"))
+		if err != nil {
+			atomic.AddInt64(&numInvalid, 1)
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if limiter != nil {
+			if len(messages) > client_burst {
+				atomic.AddInt64(&numLimited, 1)
+				fail(w, http.StatusRequestEntityTooLarge, fmt.Errorf("batch of %v messages larger than the burst of %v", len(messages), client_burst))
+				return
+			}
+			if ok, wait := limiter.allow(clientOf(r, client_header), len(messages), time.Now()); !ok {
+				atomic.AddInt64(&numLimited, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				fail(w, http.StatusTooManyRequests, fmt.Errorf("rate limited"))
+				return
+			}
+		}
+
+		out := make([]*sarama.ProducerMessage, len(messages))
+		for i, m := range messages {
+			out[i] = &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(m)}
+			if key_field != "" {
+				var doc interface{}
+				if err := json.Unmarshal(m, &doc); err == nil {
+					if v := expr.Lookup(doc, key_field); v != nil {
+						out[i].Key = sarama.StringEncoder(fmt.Sprint(v))
+					}
+				}
+			}
+		}
+		if err := producer.SendMessages(out); err != nil {
+			atomic.AddInt64(&numFailed, int64(len(out)))
+			fail(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		atomic.AddInt64(&numAccepted, int64(len(out)))
+		reply(w, http.StatusOK, map[string]int{"accepted": len(out)})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, ingest)
+	server := &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			evicted := 0
+			if limiter != nil {
+				evicted = limiter.evict(time.Now())
+			}
+			log.Println("accepted:", atomic.SwapInt64(&numAccepted, 0), "invalid:", atomic.SwapInt64(&numInvalid, 0),
+				"unauthorized:", atomic.SwapInt64(&numUnauthorized, 0), "limited:", atomic.SwapInt64(&numLimited, 0),
+				"failed:", atomic.SwapInt64(&numFailed, 0), "clients evicted:", evicted)
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			// requests in progress complete before the producer closes
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			server.Shutdown(ctx)
+			cancel()
+			log.Println("stopped")
+			return nil
+		}
+	}
+}
+
+// split returns the json messages of a body, one message, or one per line
+// of json lines skipping blank lines
+func split(body []byte, lines bool) ([][]byte, error) {
+	if !lines {
+		body = bytes.TrimSpace(body)
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("invalid json")
+		}
+		return [][]byte{body}, nil
+	}
+	var messages [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return nil, fmt.Errorf("invalid json at line %v", n)
+		}
+		messages = append(messages, append([]byte(nil), line...))
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("no message")
+	}
+	return messages, scanner.Err()
+}
+
+// clientOf identifies the client of a request by header, or by remote ip
+func clientOf(r *http.Request, header string) string {
+	if header != "" {
+		if id := r.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtaci/sp/expr"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// mapping is a tag or field of points set from a json path of messages
+type mapping struct {
+	key  string
+	path string
+}
+
+// parseMappings parses key=path, or path alone keyed by its last element
+func parseMappings(specs []string) ([]mapping, error) {
+	var ms []mapping
+	for _, spec := range specs {
+		m := mapping{path: spec, key: spec[strings.LastIndexByte(spec, '.')+1:]}
+		if i := strings.IndexByte(spec, '='); i >= 0 {
+			m.key, m.path = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		}
+		if m.key == "" || m.path == "" {
+			return nil, fmt.Errorf("%q: expect key=path", spec)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// converter converts json messages into points of line protocol
+type converter struct {
+	measurement      string
+	measurementField string
+	tags             []mapping
+	fields           []mapping // top-level numbers and booleans if empty
+	timeField        string
+}
+
+// line returns the point of a message in line protocol, with a timestamp
+// in nanoseconds, ts if the message has no time field
+func (cv *converter) line(doc map[string]interface{}, ts time.Time) ([]byte, error) {
+	measurement := cv.measurement
+	if cv.measurementField != "" {
+		v, ok := expr.Lookup(doc, cv.measurementField).(string)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("missing measurement %v", cv.measurementField)
+		}
+		measurement = v
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(measurementEscaper.Replace(measurement))
+	tags := make([]mapping, 0, len(cv.tags))
+	values := make(map[string]string, len(cv.tags))
+	isTag := make(map[string]bool, len(cv.tags))
+	for _, t := range cv.tags {
+		isTag[t.path] = true
+		v := expr.Lookup(doc, t.path)
+		if v == nil {
+			continue
+		}
+		s := fmt.Sprint(v)
+		if s == "" {
+			continue
+		}
+		tags = append(tags, t)
+		values[t.key] = s
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].key < tags[j].key })
+	for _, t := range tags {
+		fmt.Fprintf(&buf, ",%v=%v", keyEscaper.Replace(t.key), keyEscaper.Replace(values[t.key]))
+	}
+
+	fields := cv.fields
+	if len(fields) == 0 {
+		for k, v := range doc {
+			switch v.(type) {
+			case json.Number, bool:
+				if !isTag[k] && k != cv.timeField && k != cv.measurementField {
+					fields = append(fields, mapping{k, k})
+				}
+			}
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	}
+	n := 0
+	for _, f := range fields {
+		value, ok := fieldValue(expr.Lookup(doc, f.path))
+		if !ok {
+			continue
+		}
+		if n == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%v=%v", keyEscaper.Replace(f.key), value)
+		n++
+	}
+	if n == 0 {
+		return nil, errors.New("no field")
+	}
+
+	if cv.timeField != "" {
+		var err error
+		if ts, err = parseTime(expr.Lookup(doc, cv.timeField)); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Fprintf(&buf, " %v\n", ts.UnixNano())
+	return buf.Bytes(), nil
+}
+
+// fieldValue formats a json value as a field value, integers with the i
+// suffix; objects, arrays and nulls are not fields
+func fieldValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return strconv.FormatInt(i, 10) + "i", true
+		}
+		if f, err := v.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 64), true
+		}
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// parseTime parses a field of time, RFC 3339 strings or epoch seconds or
+// milliseconds
+func parseTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if f > 1e11 { // milliseconds
+			f /= 1000
+		}
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported time %v", v)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLine(t *testing.T) {
+	tests := []struct {
+		cv   converter
+		doc  string
+		want string // empty for an error
+	}{
+		{
+			converter{measurement: "cpu", tags: []mapping{{"region", "meta.region"}, {"host", "host"}}},
+			`{"host": "a b", "meta": {"region": "eu"}, "usage": 12.5, "count": 3, "ok": true, "name": "x"}`,
+			"cpu,host=a\\ b,region=eu count=3i,ok=true,usage=12.5 1000000005\n",
+		},
+		{
+			converter{measurement: "my m,x", fields: []mapping{{"msg", "msg"}, {"v", "val.n"}, {"k=1", "missing"}}},
+			`{"msg": "say \"hi\" \\", "val": {"n": 1e3}}`,
+			`my\ m\,x msg="say \"hi\" \\",v=1000 1000000005` + "\n",
+		},
+		{ // empty and missing tags are omitted
+			converter{measurement: "m", tags: []mapping{{"host", "host"}, {"dc", "dc"}}},
+			`{"host": "", "v": false}`,
+			"m v=false 1000000005\n",
+		},
+		{
+			converter{measurementField: "kind", timeField: "ts"},
+			`{"kind": "mem", "ts": "2024-01-02T03:04:05Z", "free": 1}`,
+			"mem free=1i 1704164645000000000\n",
+		},
+		{ // epoch seconds
+			converter{measurement: "m", timeField: "t"},
+			`{"t": 1700000000, "v": 1}`,
+			"m v=1i 1700000000000000000\n",
+		},
+		{ // epoch milliseconds
+			converter{measurement: "m", timeField: "t"},
+			`{"t": 1700000000500, "v": -2}`,
+			"m v=-2i 1700000000500000000\n",
+		},
+		{converter{measurement: "m"}, `{"s": "strings are not fields by default"}`, ""},
+		{converter{measurementField: "kind"}, `{"v": 1}`, ""},
+		{converter{measurement: "m", timeField: "t"}, `{"t": "yesterday", "v": 1}`, ""},
+		{converter{measurement: "m", timeField: "t"}, `{"t": true, "v": 1}`, ""},
+	}
+	ts := time.Unix(1, 5)
+	for _, tt := range tests {
+		var doc map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader([]byte(tt.doc)))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		got, err := tt.cv.line(doc, ts)
+		if tt.want == "" {
+			if err == nil {
+				t.Fatalf("line of %v: expected an error, got %q", tt.doc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("line of %v: %v", tt.doc, err)
+		}
+		if string(got) != tt.want {
+			t.Fatalf("line of %v:\ngot  %q\nwant %q", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestParseMappings(t *testing.T) {
+	tests := []struct {
+		specs []string
+		want  []mapping // nil for an error
+	}{
+		{[]string{"host", "meta.region", " r = meta.region "}, []mapping{{"host", "host"}, {"region", "meta.region"}, {"r", "meta.region"}}},
+		{[]string{"=x"}, nil},
+		{[]string{"x="}, nil},
+		{[]string{""}, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseMappings(tt.specs)
+		if (err != nil) != (tt.want == nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("parse %q: got %v %v, want %v", tt.specs, got, err, tt.want)
+		}
+	}
+}
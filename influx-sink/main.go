@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+	"github.com/xtaci/sp/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "influx-sink"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Write the messages of a stream into influxdb as points of line protocol",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to write",
+			},
+			&cli.StringFlag{
+				Name:  "url",
+				Value: "http://localhost:8086",
+				Usage: "influxdb url",
+			},
+			&cli.StringFlag{
+				Name:  "org",
+				Value: "",
+				Usage: "organization of the bucket, influxdb 2",
+			},
+			&cli.StringFlag{
+				Name:  "bucket",
+				Value: "",
+				Usage: "bucket to write to, influxdb 2",
+			},
+			&cli.StringFlag{
+				Name:  "database",
+				Value: "",
+				Usage: "database to write to, influxdb 1",
+			},
+			&cli.StringFlag{
+				Name:    "token",
+				EnvVars: []string{"INFLUX_TOKEN"},
+				Usage:   "api token, user:password with influxdb 1",
+			},
+			&cli.StringFlag{
+				Name:  "measurement",
+				Value: "",
+				Usage: "measurement of points, default: stream-topic",
+			},
+			&cli.StringFlag{
+				Name:  "measurement-field",
+				Value: "",
+				Usage: "json field of the measurement of points, instead of measurement",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "json field of a tag, repeated per tag, optionally named: host=meta.hostname, format: a.b.0.c",
+			},
+			&cli.StringSliceFlag{
+				Name:  "field",
+				Usage: "json field of a field, repeated per field, optionally named: cpu=stats.cpu, the top-level numbers and booleans if not set",
+			},
+			&cli.StringFlag{
+				Name:  "time-field",
+				Value: "",
+				Usage: "json field of the time of points, RFC 3339 or epoch seconds or milliseconds, the timestamps of kafka if not set",
+			},
+			&cli.IntFlag{
+				Name:  "batch-size",
+				Value: 5000,
+				Usage: "max points per write",
+			},
+			&cli.DurationFlag{
+				Name:  "flush-interval",
+				Value: time.Second,
+				Usage: "max time points wait for a write",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: 30 * time.Second,
+				Usage: "timeout of each write",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Value: 8,
+				Usage: "retries of writes failing with timeouts, 429 or 5xx, the sink exits once exhausted",
+			},
+			&cli.DurationFlag{
+				Name:  "retry-backoff",
+				Value: 500 * time.Millisecond,
+				Usage: "delay before the first retry, doubled on each retry, unless set by Retry-After",
+			},
+			&cli.StringFlag{
+				Name:  "on-failure",
+				Value: "drop",
+				Usage: "batches rejected by influxdb, e.g. on type conflicts, are, drop: logged and dropped, fatal: the sink exits",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(append(state.Flags, logging.Flags...), tracing.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	url := c.String("url")
+	org := c.String("org")
+	bucket := c.String("bucket")
+	database := c.String("database")
+	measurement := c.String("measurement")
+	if measurement == "" {
+		measurement = stream_topic
+	}
+	measurement_field := c.String("measurement-field")
+	tag_specs := c.StringSlice("tag")
+	field_specs := c.StringSlice("field")
+	time_field := c.String("time-field")
+	batch_size := c.Int("batch-size")
+	flush_interval := c.Duration("flush-interval")
+	timeout := c.Duration("timeout")
+	retries := c.Int("retries")
+	retry_backoff := c.Duration("retry-backoff")
+	on_failure := c.String("on-failure")
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("url:", url)
+	log.Println("org:", org)
+	log.Println("bucket:", bucket)
+	log.Println("database:", database)
+	log.Println("measurement:", measurement)
+	log.Println("measurement-field:", measurement_field)
+	log.Println("tag:", tag_specs)
+	log.Println("field:", field_specs)
+	log.Println("time-field:", time_field)
+	log.Println("batch-size:", batch_size)
+	log.Println("flush-interval:", flush_interval)
+	log.Println("timeout:", timeout)
+	log.Println("retries:", retries)
+	log.Println("retry-backoff:", retry_backoff)
+	log.Println("on-failure:", on_failure)
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".influx-sink-%v-%v%v.cache", stream_topic, bucket, database)
+	log.Println("cache file:", cachefile)
+
+	if batch_size <= 0 {
+		log.Fatalln("batch-size must be positive")
+	}
+	switch on_failure {
+	case "drop", "fatal":
+	default:
+		log.Fatalln("unsupported on-failure:", on_failure)
+	}
+	tags, err := parseMappings(tag_specs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fields, err := parseMappings(field_specs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	conv := &converter{
+		measurement:      measurement,
+		measurementField: measurement_field,
+		tags:             tags,
+		fields:           fields,
+		timeField:        time_field,
+	}
+	influx, err := newWriter(url, org, bucket, database, c.String("token"), timeout, retries, retry_backoff)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	flushTicker := time.NewTicker(flush_interval)
+	numWritten, numRejected, numInvalid := 0, 0, 0
+
+	// points of the next write
+	var lines bytes.Buffer
+	numLines := 0
+	var traces []context.Context // of the messages of the batch
+	tracer, err := tracing.Setup(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer tracing.Shutdown()
+
+	// flush writes the pending points, the sink exits once the retries are
+	// exhausted, the stream is then written again from the last checkpoint
+	flush := func() {
+		if numLines == 0 {
+			return
+		}
+		_, span := tracer.Batch(traces, "write")
+		traces = nil
+		defer span.End()
+		if err := influx.write(lines.Bytes()); err != nil {
+			tracing.Fail(span, err)
+			if _, ok := err.(permanent); !ok || on_failure == "fatal" {
+				log.Fatalln(err)
+			}
+			log.Println(err)
+			numRejected += numLines
+		} else {
+			numWritten += numLines
+		}
+		lines.Reset()
+		numLines = 0
+	}
+
+	add := func(msg *sarama.ConsumerMessage) {
+		trace, span := tracer.Start(msg, processorName)
+		defer span.End()
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		var doc map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil || doc == nil {
+			numInvalid++
+			return
+		}
+		line, err := conv.line(doc, msg.Timestamp)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		lines.Write(line)
+		numLines++
+		traces = append(traces, trace)
+		if numLines >= batch_size {
+			flush()
+		}
+	}
+
+	checkpoint := func() {
+		flush()
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("written:", numWritten, "rejected:", numRejected, "invalid:", numInvalid, "stream offsets:", streamOffsets)
+		numWritten, numRejected, numInvalid = 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case <-flushTicker.C:
+			flush()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			add(msg)
+		}
+	}
+}
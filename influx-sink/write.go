@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// permanent marks errors not worth retrying
+type permanent struct {
+	err error
+}
+
+func (e permanent) Error() string { return e.err.Error() }
+
+// writer writes batches of line protocol to the write api of influxdb, of
+// version 2 with a bucket, or of version 1 with a database
+type writer struct {
+	client  *http.Client
+	url     string
+	header  http.Header
+	retries int
+	backoff time.Duration
+}
+
+func newWriter(base, org, bucket, database, token string, timeout time.Duration, retries int, backoff time.Duration) (*writer, error) {
+	q := url.Values{"precision": {"ns"}}
+	endpoint := strings.TrimRight(base, "/")
+	switch {
+	case bucket != "":
+		endpoint += "/api/v2/write"
+		q.Set("org", org)
+		q.Set("bucket", bucket)
+	case database != "":
+		endpoint += "/write"
+		q.Set("db", database)
+	default:
+		return nil, fmt.Errorf("bucket or database must be set")
+	}
+	w := &writer{
+		client:  &http.Client{Timeout: timeout},
+		url:     endpoint + "?" + q.Encode(),
+		header:  make(http.Header),
+		retries: retries,
+		backoff: backoff,
+	}
+	w.header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		w.header.Set("Authorization", "Token "+token)
+	}
+	return w, nil
+}
+
+// write sends lines, retrying timeouts, 429 and 5xx up to retries times
+// with exponential backoff, unless delayed by Retry-After; other failures
+// are permanent
+func (w *writer) write(lines []byte) error {
+	for attempt := 0; ; attempt++ {
+		wait, err := w.request(lines)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(permanent); ok || attempt >= w.retries {
+			return err
+		}
+		if wait == 0 {
+			wait = w.backoff << uint(attempt)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (w *writer) request(lines []byte) (time.Duration, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(lines))
+	if err != nil {
+		return 0, permanent{err}
+	}
+	for k, v := range w.header {
+		req.Header[k] = v
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return 0, nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("write: %v: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		var wait time.Duration
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(s) * time.Second
+		}
+		return wait, err
+	}
+	return 0, permanent{err}
+}
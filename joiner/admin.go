@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// adminQuery is a read of the state by the admin api, run by the event
+// loop between two messages so that the tables are not read while updated
+type adminQuery struct {
+	fn   func()
+	done chan struct{}
+}
+
+func (q *adminQuery) run() {
+	q.fn()
+	close(q.done)
+}
+
+// admin serves the admin api of a running joiner:
+//
+//	GET /table/{key}         the rows of key in each table, or in ?table=
+//	GET /table?prefix=&limit= the rows of the keys with prefix, at most limit
+//	GET /offsets             the offsets of the stream and table topics
+//	GET /stats               the stats of the state store and parked messages
+type admin struct {
+	queries chan *adminQuery
+
+	tables  []*table
+	store   state.Store
+	normal  func(string) string
+	offsets func() (stream, table sp.Offsets)
+	parked  func() int
+}
+
+// adminTimeout bounds the wait of a query for the event loop
+const adminTimeout = 10 * time.Second
+
+// defaultAdminLimit is the number of rows of a scan without limit
+const defaultAdminLimit = 100
+
+// query runs fn in the event loop, false if it did not in time
+func (a *admin) query(fn func()) bool {
+	q := &adminQuery{fn: fn, done: make(chan struct{})}
+	timeout := time.After(adminTimeout)
+	select {
+	case a.queries <- q:
+	case <-timeout:
+		return false
+	}
+	select {
+	case <-q.done:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// selected returns the tables of the request, all tables by default
+func (a *admin) selected(r *http.Request) []*table {
+	name := r.URL.Query().Get("table")
+	if name == "" {
+		return a.tables
+	}
+	for _, t := range a.tables {
+		if t.name == name {
+			return []*table{t}
+		}
+	}
+	return nil
+}
+
+// rowValue is a row as json, or as a string if not json
+func rowValue(row []byte) interface{} {
+	if json.Valid(row) {
+		return json.RawMessage(append([]byte(nil), row...))
+	}
+	return string(row)
+}
+
+func (a *admin) handleTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tables := a.selected(r)
+	if tables == nil {
+		http.Error(w, "unknown table", http.StatusNotFound)
+		return
+	}
+
+	// GET /table/{key}
+	if key := strings.TrimPrefix(r.URL.Path, "/table/"); key != r.URL.Path && key != "" {
+		key = a.normal(key)
+		rows := make(map[string]interface{})
+		if !a.query(func() {
+			for _, t := range tables {
+				if row, ok := t.get(key); ok {
+					rows[t.name] = rowValue(row)
+				}
+			}
+		}) {
+			http.Error(w, "timeout", http.StatusServiceUnavailable)
+			return
+		}
+		if len(rows) == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		reply(w, map[string]interface{}{"key": key, "rows": rows})
+		return
+	}
+
+	// GET /table?prefix=&limit=
+	prefix := r.URL.Query().Get("prefix")
+	limit := defaultAdminLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	type entry struct {
+		Table string      `json:"table"`
+		Key   string      `json:"key"`
+		Row   interface{} `json:"row"`
+	}
+	entries := []entry{}
+	if !a.query(func() {
+		for _, t := range tables {
+			t.each(func(key string, row []byte) {
+				if len(entries) < limit && strings.HasPrefix(key, prefix) {
+					entries = append(entries, entry{t.name, key, rowValue(row)})
+				}
+			})
+		}
+	}) {
+		http.Error(w, "timeout", http.StatusServiceUnavailable)
+		return
+	}
+	reply(w, entries)
+}
+
+func (a *admin) handleOffsets(w http.ResponseWriter, r *http.Request) {
+	var stream, table sp.Offsets
+	if !a.query(func() {
+		s, t := a.offsets()
+		stream, table = copyOffsets(s), copyOffsets(t)
+	}) {
+		http.Error(w, "timeout", http.StatusServiceUnavailable)
+		return
+	}
+	reply(w, map[string]sp.Offsets{"stream": stream, "table": table})
+}
+
+func (a *admin) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]interface{})
+	if !a.query(func() {
+		if st, ok := state.StatsOf(a.store); ok {
+			stats["state"] = st
+		}
+		stats["parked"] = a.parked()
+		var names []string
+		for _, t := range a.tables {
+			names = append(names, t.name)
+		}
+		stats["tables"] = names
+	}) {
+		http.Error(w, "timeout", http.StatusServiceUnavailable)
+		return
+	}
+	reply(w, stats)
+}
+
+// serve starts the admin api on addr
+func (a *admin) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/table", a.handleTable)
+	mux.HandleFunc("/table/", a.handleTable)
+	mux.HandleFunc("/offsets", a.handleOffsets)
+	mux.HandleFunc("/stats", a.handleStats)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+}
+
+func copyOffsets(offs sp.Offsets) sp.Offsets {
+	c := make(sp.Offsets, len(offs))
+	for p, o := range offs {
+		c[p] = o
+	}
+	return c
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// lostState tells whether store holds no offset of topic, the table topic,
+// i.e. the state is new or was lost and is restored from the changelog
+func lostState(store state.Store, brokers []string, topic string) (bool, error) {
+	if v, err := store.Get(processorName, []byte(offsetWAL)); err != nil || v != nil {
+		return false, err // offsets of single partition versions
+	}
+	offs := make(sp.Offsets)
+	if err := offs.Load(store, offsetWAL); err != nil {
+		return false, err
+	}
+	if len(offs) > 0 {
+		return false, nil
+	}
+
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return false, err
+	}
+	loadPartitions(offs, store, partitions)
+	return len(offs) == 0, nil
+}
+
+// errFound stops an iteration at the first key
+var errFound = errors.New("found")
+
+// lostDedup tells whether the store of the dedup window holds no id, i.e.
+// is new or was lost and is restored from the changelog
+func lostDedup(store state.Store) bool {
+	err := store.Iterate(emittedStream, func(k, v []byte) error { return errFound })
+	if err != nil && err != errFound {
+		log.Fatalln(err)
+	}
+	return err == nil
+}
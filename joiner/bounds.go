@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/kafka"
+)
+
+// offsetsAt returns the offset of the first message of each partition of
+// topic with a timestamp at or after t, the high-watermark for partitions
+// without such a message
+func offsetsAt(brokers []string, topic string, t time.Time) (sp.Offsets, error) {
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	offs := make(sp.Offsets)
+	for _, partition := range partitions {
+		offset, err := client.GetOffset(topic, partition, t.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		if offset == -1 {
+			if offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+				return nil, err
+			}
+		}
+		offs[partition] = offset
+	}
+	return offs, nil
+}
+
+// stopOffsets returns the partitions of topic with messages to consume from
+// offs before the end of a bounded run, mapped to their end: stopOffset if
+// not negative, otherwise the offset of the first message at or after
+// stopTime; partitions without recorded offset are consumed from the newest
+// message
+func stopOffsets(brokers []string, topic string, offs sp.Offsets, stopOffset int64, stopTime time.Time) (sp.Offsets, error) {
+	ends := make(sp.Offsets)
+	if stopOffset < 0 {
+		var err error
+		if ends, err = offsetsAt(brokers, topic, stopTime); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(sp.Offsets)
+	for _, partition := range partitions {
+		end := stopOffset
+		if end < 0 {
+			end = ends[partition]
+		}
+		offset, ok := offs[partition]
+		if !ok {
+			if offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+				return nil, err
+			}
+		}
+		if offset < end {
+			pending[partition] = end
+		}
+	}
+	return pending, nil
+}
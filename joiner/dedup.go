@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// dedupWindow remembers the ids of the joined records acknowledged by kafka
+// within a rolling window, ids are checkpointed as soon as they are
+// acknowledged so records produced after the last checkpoint are not produced
+// again when the stream is replayed after a crash; the ids are kept in a
+// store of their own as they are checkpointed independently of the tables
+type dedupWindow struct {
+	store  state.Store
+	window time.Duration
+}
+
+func newDedupWindow(store state.Store, window time.Duration) *dedupWindow {
+	return &dedupWindow{store: store, window: window}
+}
+
+// seen reports whether the record of id was acknowledged already
+func (d *dedupWindow) seen(id string) bool {
+	v, err := d.store.Get(emittedStream, []byte(id))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return v != nil
+}
+
+// ack records the ids of the acknowledged messages, values are the
+// acknowledgement time; messages without id (e.g. dead letters) are ignored
+func (d *dedupWindow) ack(msgs []*sarama.ProducerMessage) {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(time.Now().UnixNano()))
+	for _, msg := range msgs {
+		if id, ok := msg.Metadata.(string); ok {
+			if err := d.store.Put(emittedStream, []byte(id), v); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	if err := d.store.Checkpoint(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// expire forgets the ids acknowledged before the window
+func (d *dedupWindow) expire(now time.Time) {
+	deadline := now.Add(-d.window).UnixNano()
+	if err := d.store.Iterate(emittedStream, func(k, v []byte) error {
+		if int64(binary.LittleEndian.Uint64(v)) < deadline {
+			return d.store.Delete(emittedStream, k)
+		}
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	if err := d.store.Checkpoint(); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+// types of the errors of dead letters, to triage and replay them
+// selectively
+const (
+	errorParse      = "parse"           // the message could not be decoded
+	errorMissingKey = "missing-key"     // the message lacks its join key
+	errorProduce    = "produce-failure" // the joined record could not be built
+)
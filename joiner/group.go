@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// groupHandler forwards messages of the claimed partitions into a single
+// channel, offsets are marked by the event loop after they have been
+// checkpointed
+type groupHandler struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+
+	// rebalances are handled by the event loop, between the messages of
+	// the claims revoked and the ones assigned
+	rebalances chan *rebalance
+	ctx        context.Context
+
+	mu      sync.Mutex
+	session sarama.ConsumerGroupSession
+}
+
+// rebalance is a change of the partitions claimed, done is closed once the
+// event loop has handled it
+type rebalance struct {
+	assigned   bool // claims assigned, revoked otherwise
+	generation int32
+	member     string
+	partitions []int32
+	done       chan struct{}
+}
+
+// assignment is the partitions of the stream claimed by a joiner of the
+// group, kept in its state file
+type assignment struct {
+	Group      string    `json:"group"`
+	Generation int32     `json:"generation"`
+	Member     string    `json:"member"`
+	Partitions []int32   `json:"partitions"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// store writes the assignment to the state file
+func (a *assignment) store(store state.Store) error {
+	bts, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return store.Put(groupBucket, []byte(assignmentKey), bts)
+}
+
+// loadAssignment reads the last assignment of the state file, nil if the
+// joiner never joined a group
+func loadAssignment(store state.Store) (*assignment, error) {
+	v, err := store.Get(groupBucket, []byte(assignmentKey))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	a := &assignment{}
+	if err := json.Unmarshal(v, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (h *groupHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	h.mu.Lock()
+	h.session = sess
+	h.mu.Unlock()
+	log.Println("group generation:", sess.GenerationID(), "member:", sess.MemberID(), "claims:", sess.Claims())
+	h.notify(true, sess)
+	return nil
+}
+
+// Cleanup checkpoints the state of the claims revoked while their offsets
+// can still be committed in the session ending
+func (h *groupHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	h.notify(false, sess)
+	h.mu.Lock()
+	h.session = nil
+	h.mu.Unlock()
+	return nil
+}
+
+// notify waits for the event loop to handle a rebalance, unless shut down
+func (h *groupHandler) notify(assigned bool, sess sarama.ConsumerGroupSession) {
+	r := &rebalance{
+		assigned:   assigned,
+		generation: sess.GenerationID(),
+		member:     sess.MemberID(),
+		partitions: sess.Claims()[h.topic],
+		done:       make(chan struct{}),
+	}
+	select {
+	case h.rebalances <- r:
+	case <-h.ctx.Done():
+		return
+	}
+	select {
+	case <-r.done:
+	case <-h.ctx.Done():
+	}
+}
+
+func (h *groupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		select {
+		case h.messages <- msg:
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// markOffsets records the next offsets to consume in the current group
+// session, partitions no longer claimed are ignored; the offsets of the
+// partitions with parked messages stop at the earliest of them, so that the
+// next owner of a partition joins them again
+func (h *groupHandler) markOffsets(offs, parked sp.Offsets) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.session != nil {
+		for partition, offset := range offs {
+			if p, ok := parked[partition]; ok && p < offset {
+				offset = p
+			}
+			h.session.MarkOffset(h.topic, partition, offset, "")
+		}
+	}
+}
+
+// consumeGroup joins the consumer group and consumes topic until ctx is done,
+// rejoining after every rebalance
+func consumeGroup(ctx context.Context, group sarama.ConsumerGroup, topic string) *groupHandler {
+	h := &groupHandler{
+		topic:      topic,
+		messages:   make(chan *sarama.ConsumerMessage),
+		rebalances: make(chan *rebalance),
+		ctx:        ctx,
+	}
+	go func() {
+		for ctx.Err() == nil {
+			if err := group.Consume(ctx, []string{topic}, h); err != nil {
+				log.Println(err)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return h
+}
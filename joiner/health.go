@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// health answers the probes of kubernetes: the joiner is live while its
+// event loop commits within the stall timeout, and ready once its tables
+// have caught up with the high-watermarks of the table topic at start
+type health struct {
+	stall      time.Duration
+	checkpoint int64 // unix nanoseconds of the last checkpoint
+	ready      int32
+}
+
+func newHealth(stall time.Duration) *health {
+	return &health{stall: stall, checkpoint: time.Now().UnixNano()}
+}
+
+// committed records a checkpoint of the event loop
+func (h *health) committed() {
+	atomic.StoreInt64(&h.checkpoint, time.Now().UnixNano())
+}
+
+// caughtUp marks the tables caught up with the table topic
+func (h *health) caughtUp() {
+	if atomic.CompareAndSwapInt32(&h.ready, 0, 1) {
+		log.Println("ready")
+	}
+}
+
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&h.checkpoint)))
+	if since > h.stall {
+		http.Error(w, fmt.Sprintf("no checkpoint for %v", since), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.ready) == 0 {
+		http.Error(w, "catching up with the table topic", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serve starts the endpoints /healthz and /readyz on addr
+func (h *health) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+}
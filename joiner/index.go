@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/Jeffail/gabs"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// secondaryIndex maps the values of a field of row data to the keys of the
+// rows, values are not unique
+type secondaryIndex struct {
+	field     string // json path in row data
+	normalize func(string) string
+	store     state.Store
+	bucket    string
+
+	keys   map[string]map[string]bool // value -> row keys
+	values map[string]string          // row key -> value
+}
+
+func newSecondaryIndex(store state.Store, table, field string, normalize func(string) string) *secondaryIndex {
+	return &secondaryIndex{
+		field:     field,
+		normalize: normalize,
+		store:     store,
+		bucket:    secondaryIndexes + "/" + table + "/" + field,
+		keys:      make(map[string]map[string]bool),
+		values:    make(map[string]string),
+	}
+}
+
+// put indexes the field of a row, rows without the field are not indexed
+func (idx *secondaryIndex) put(key string, row []byte) {
+	idx.remove(key)
+	data, err := gabs.Consume(rowData(row))
+	if err != nil {
+		return
+	}
+	v := data.Path(idx.field).Data()
+	if v == nil {
+		return
+	}
+	value := idx.normalize(fmt.Sprint(v))
+	idx.add(value, key)
+	if err := idx.store.Put(idx.bucket, indexEntry(value, key), []byte{}); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (idx *secondaryIndex) add(value, key string) {
+	if idx.keys[value] == nil {
+		idx.keys[value] = make(map[string]bool)
+	}
+	idx.keys[value][key] = true
+	idx.values[key] = value
+}
+
+// remove unindexes a row
+func (idx *secondaryIndex) remove(key string) {
+	value, ok := idx.values[key]
+	if !ok {
+		return
+	}
+	delete(idx.values, key)
+	delete(idx.keys[value], key)
+	if len(idx.keys[value]) == 0 {
+		delete(idx.keys, value)
+	}
+	if err := idx.store.Delete(idx.bucket, indexEntry(value, key)); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// lookup returns the sorted keys of the rows with value
+func (idx *secondaryIndex) lookup(value string) []string {
+	keys := make([]string, 0, len(idx.keys[value]))
+	for k := range idx.keys[value] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// load reads the index, entries are the length of the value, the value and
+// the row key; returns false if the index is empty
+func (idx *secondaryIndex) load() bool {
+	if err := idx.store.Iterate(idx.bucket, func(k, _ []byte) error {
+		if len(k) < 4 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint32(k))
+		if 4+n > len(k) {
+			return nil
+		}
+		idx.add(string(k[4:4+n]), string(k[4+n:]))
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	return len(idx.values) > 0
+}
+
+func indexEntry(value, key string) []byte {
+	n := make([]byte, 4)
+	binary.BigEndian.PutUint32(n, uint32(len(value)))
+	return append(append(n, value...), key...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/kafka"
+)
+
+// lagMonitor measures the lag of the consumption of topics, the messages
+// between the offsets consumed and the high-watermarks of the partitions,
+// published in the expvar lag as topic/partition
+type lagMonitor struct {
+	client sarama.Client
+	vars   *expvar.Map
+}
+
+func newLagMonitor(brokers []string) (*lagMonitor, error) {
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &lagMonitor{client: client, vars: expvar.NewMap("lag")}, nil
+}
+
+// measure returns the total lag of the partitions of topic consumed from
+// offs, partitions not consumed yet are skipped
+func (m *lagMonitor) measure(topic string, offs sp.Offsets) (int64, error) {
+	var total int64
+	for partition, offset := range offs {
+		hwm, err := m.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return 0, err
+		}
+		lag := hwm - offset
+		if lag < 0 {
+			lag = 0
+		}
+		lagVar := new(expvar.Int)
+		lagVar.Set(lag)
+		m.vars.Set(fmt.Sprintf("%v/%v", topic, partition), lagVar)
+		total += lag
+	}
+	return total, nil
+}
+
+func (m *lagMonitor) Close() error {
+	return m.client.Close()
+}
@@ -1,48 +1,65 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Jeffail/gabs"
 	"github.com/Shopify/sarama"
-	"github.com/boltdb/bolt"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+	"github.com/xtaci/sp/tracing"
 
 	log "github.com/Sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v2"
 )
 
 const (
-	offsetStream  = "__offset_stream__"
-	offsetWAL     = "__offset_wal__"
-	processorName = "joiner"
-	outputTable   = "joiner"
+	offsetStream     = "__offset_stream__"
+	offsetWAL        = "__offset_wal__"
+	updatedAt        = "__updated_at__"
+	parkedStream     = "__parked__"
+	emittedStream    = "__emitted__"
+	rangeIndexes     = "__ranges__"
+	secondaryIndexes = "__indexes__"
+	partitionsBucket = "__partitions__"
+	keyPartitions    = "__key_partitions__"
+	groupBucket      = "__group__"
+	assignmentKey    = "assignment"
+	processorName    = "joiner"
+	outputTable      = "joiner"
 )
 
-type WAL struct {
-	Type       string          `json:"type"`
-	InstanceId string          `json:"instanceId"`
-	Table      string          `json:"table"`
-	Host       string          `json:"host"`
-	Key        string          `json:"key"`
-	CreatedAt  time.Time       `json:"created_at"`
-	Data       json.RawMessage `json:"data"`
-}
-
 type STJoin struct {
 	Stream *json.RawMessage `json:"stream"`
 	Table  *json.RawMessage `json:"table"`
 }
 
+type STJoinMulti struct {
+	Stream *json.RawMessage            `json:"stream"`
+	Tables map[string]*json.RawMessage `json:"tables"`
+}
+
 func main() {
 	app := &cli.App{
 		Name:    processorName,
 		Usage:   "Stream-Table joining on stream-topic.stream-key = table-topic.key",
 		Version: "0.1",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringSliceFlag{
 				Name:  "brokers, b",
 				Value: cli.NewStringSlice("localhost:9092"),
@@ -53,92 +70,724 @@ func main() {
 				Value: "WAL",
 				Usage: "topic name that contains the table",
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:  "table",
-				Value: "user_updates",
-				Usage: "table name in WAL to JOIN",
+				Value: cli.NewStringSlice("user_updates"),
+				Usage: "table name in WAL to JOIN, repeat with stream-key to enrich the stream with multiple tables",
 			},
 			&cli.StringFlag{
 				Name:  "stream-topic",
 				Value: "events",
 				Usage: "the stream topic to do JOIN",
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:  "stream-key",
+				Usage: "extract the json field as foreign key in stream messages, one for each table, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "index",
+				Value: "",
+				Usage: "comma separated json fields of row data to maintain secondary indexes on, e.g.: email,phone",
+			},
+			&cli.StringSliceFlag{
+				Name:  "lookup-index",
+				Usage: "indexed field of table rows referenced by the stream-key instead of the row key, one for each table, empty for the row key",
+			},
+			&cli.StringFlag{
+				Name:  "multi-match",
+				Value: "first",
+				Usage: "when several rows match through a secondary index, fanout: emit a record for each row, array: emit the rows as an array under table, first: emit the first row",
+			},
+			&cli.StringFlag{
+				Name:  "range-key",
 				Value: "",
-				Usage: "extract the json field as foreign key in stream messages, format: https://github.com/Jeffail/gabs",
+				Usage: "match stream keys by containment in the [from, to] range of table rows instead of equality, comma separated json paths of the bounds in row data, e.g.: ip_from,ip_to",
+			},
+			&cli.StringFlag{
+				Name:  "key-normalize",
+				Value: "",
+				Usage: "comma separated normalizations of table and stream keys before matching: lowercase, trim, numeric (e.g. \"42.0\" and 42 match)",
+			},
+			&cli.StringFlag{
+				Name:  "key-source",
+				Value: "body",
+				Usage: "body: keys are read from the WAL key and stream-key, kafka-key: keys are the kafka message keys of both topics, table-kafka-key or stream-kafka-key: only for one topic",
 			},
 			&cli.StringFlag{
 				Name:  "output-topic",
 				Value: "",
 				Usage: "default output topic name: joiner-{table-topic}-{table}-{stream}",
 			},
+			&cli.StringFlag{
+				Name:  "filter",
+				Value: "",
+				Usage: "only join stream messages satisfying the expression over their fields, e.g.: type == \"purchase\"",
+			},
+			&cli.StringFlag{
+				Name:  "predicate",
+				Value: "",
+				Usage: "extra join condition over stream and table (the data of the WAL row, tables.{name} for multiple tables), e.g.: stream.amount > table.min_amount, without stream-key all rows satisfying the predicate are joined",
+			},
+			&cli.StringFlag{
+				Name:  "join-type",
+				Value: "inner",
+				Usage: "inner: drop stream messages without a matching table row, left: emit them with the missing placeholder as table",
+			},
+			&cli.DurationFlag{
+				Name:  "grace-period",
+				Value: 0,
+				Usage: "park stream messages without matching table row and retry them when the row arrives in WAL, until the grace period expires",
+			},
+			&cli.StringFlag{
+				Name:  "missing",
+				Value: "null",
+				Usage: "json placeholder emitted as table for unmatched stream messages in left join",
+			},
+			&cli.StringFlag{
+				Name:  "output-key",
+				Value: "",
+				Usage: "kafka message key of joined records, join-key: the extracted stream key, otherwise a json field of stream messages, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "output-template",
+				Value: "",
+				Usage: "shape of the joined data, empty: {\"stream\":...,\"table\":...}, merge: merge table row data into stream message, otherwise a golang text/template with .Stream, .Table and .Key",
+			},
+			&cli.StringFlag{
+				Name:  "select",
+				Value: "",
+				Usage: "comma separated fields to emit instead of the whole records, e.g.: stream.a,stream.b,table.name",
+			},
+			&cli.DurationFlag{
+				Name:  "table-ttl",
+				Value: 0,
+				Usage: "evict table rows not updated by the WAL within this duration, 0 to keep rows forever",
+			},
+			&cli.StringFlag{
+				Name:  "tombstone-field",
+				Value: "",
+				Usage: "json field of WAL messages marking the row as deleted, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "tombstone-value",
+				Value: "delete",
+				Usage: "value of tombstone-field which deletes the row",
+			},
+			&cli.BoolFlag{
+				Name:  "tombstone-on-null-value",
+				Value: true,
+				Usage: "delete the row of the kafka message key when the WAL message value is null",
+			},
+			&cli.StringFlag{
+				Name:  "format, input-format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "table-format",
+				Value: "",
+				Usage: "encoding of WAL messages, json, avro or msgpack, defaults to format unless protobuf",
+			},
+			&cli.StringFlag{
+				Name:  "wal-format",
+				Value: "wal",
+				Usage: "envelope of table topic messages, wal, debezium: change events of a debezium connector, maxwell: change events of maxwell's daemon",
+			},
+			&cli.StringFlag{
+				Name:  "database",
+				Value: "",
+				Usage: "only apply the change events of this database with debezium or maxwell wal-format",
+			},
+			&cli.StringFlag{
+				Name:  "output-format",
+				Value: "json",
+				Usage: "encoding of joined records, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Value: "",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "output-schema",
+				Value: "",
+				Usage: "avro schema file of joined records, registered under {output-topic}-value",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Value: "",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Value: "",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-proto-message",
+				Value: "",
+				Usage: "full name of the protobuf type of joined records",
+			},
+			&cli.StringFlag{
+				Name:  "dlq",
+				Value: "",
+				Usage: "dead letter topic for messages which are not valid json or lack the stream-key",
+			},
+			&cli.DurationFlag{
+				Name:  "dedup-window",
+				Value: 0,
+				Usage: "remember joined records acknowledged within this duration and skip them when the stream is replayed after a restart, 0 to disable",
+			},
+			&cli.StringFlag{
+				Name:  "group",
+				Value: "",
+				Usage: "consume the stream topic as a member of this consumer group, partitions are shared among joiners of the same group",
+			},
+			&cli.StringFlag{
+				Name:  "group-balance",
+				Value: "sticky",
+				Usage: "assignment of the stream partitions to the joiners of the group, range, roundrobin or sticky moving the fewest partitions when joiners come and go",
+			},
+			&cli.BoolFlag{
+				Name:  "standby",
+				Usage: "keep the tables warm from the table topic without consuming the stream until promoted by SIGUSR1, then join the group",
+			},
+			&cli.StringFlag{
+				Name:  "start-time",
+				Usage: "consume the stream and table topics from the first messages at or after this RFC3339 time instead of the offsets stored, e.g. 2024-01-01T00:00:00Z",
+			},
+			&cli.Int64Flag{
+				Name:  "stop-at-offset",
+				Usage: "exit with a final commit once each partition of the stream is consumed up to this offset, messages from this offset on are left for the next run",
+			},
+			&cli.StringFlag{
+				Name:  "stop-at-time",
+				Usage: "exit with a final commit once the stream is consumed up to the first messages at or after this RFC3339 time, resolved at start",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "consume and join without producing or committing: the joined records are printed to stdout and the dead letters logged, the state is left as it was",
+			},
+			&cli.BoolFlag{
+				Name:  "bootstrap",
+				Value: false,
+				Usage: "consume the table topic up to its current end before joining the stream",
+			},
+			&cli.BoolFlag{
+				Name:  "partition-buckets",
+				Usage: "store the rows and the offset of each partition of the table topic in their own bucket, to migrate, reset or repair partitions independently",
+			},
+			&cli.StringFlag{
+				Name:  "changelog-topic",
+				Usage: "compacted topic mirroring the state changes, the state is rebuilt from it when it holds no offset of the table topic; the ids of dedup-window are mirrored to the topic suffixed with -dedup",
+			},
+			&cli.StringFlag{
+				Name:    "state-encryption-key",
+				EnvVars: []string{"STATE_ENCRYPTION_KEY"},
+				Usage:   "hex encoded AES key (16, 24 or 32 bytes) encrypting the values of the state, the state must be created with it",
+			},
+			&cli.StringFlag{
+				Name:  "state-compression",
+				Usage: "compression of the values of the state, snappy, zstd or none, the state must be created with compression",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of tables and offsets, bolt: in memory, written to the cache file, rocksdb: on disk, for tables larger than memory (build with -tags rocksdb), badger: on disk, pure go, redis: shared by the replicas of the joiner",
+			},
 			&cli.DurationFlag{
 				Name:  "write-interval",
 				Value: 30 * time.Second,
 				Usage: "interval for cache writing",
 			},
-		},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+			&cli.Int64Flag{
+				Name:  "max-lag",
+				Value: 0,
+				Usage: "warn when the messages of the stream behind its high-watermarks exceed max-lag, 0 to disable; the lag of the topics is published in the expvar lag with debug-addr",
+			},
+			&cli.BoolFlag{
+				Name:  "exit-on-lag",
+				Usage: "exit with code 3 after a checkpoint instead of warning when the lag exceeds max-lag, for the joiner to be restarted",
+			},
+			&cli.StringFlag{
+				Name:  "admin-addr",
+				Value: "",
+				Usage: "serve the admin api, GET /table/{key}, /table?prefix=, /offsets and /stats, e.g.: localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "health-addr",
+				Value: "",
+				Usage: "serve /healthz, failing without checkpoint for 3 write intervals, and /readyz, failing until the table topic is consumed up to its end at start, e.g.: :8080",
+			},
+		}, append(append(append(state.Flags, logging.Flags...), tracing.Flags...), kafka.Flags...)...),
 		Action: processor,
 	}
 	app.Run(os.Args)
 }
 
 func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
 	brokers := c.StringSlice("brokers")
 	table_topic := c.String("table-topic")
-	table := c.String("table")
+	table_names := c.StringSlice("table")
 	stream_topic := c.String("stream-topic")
-	stream_key := c.String("stream-key")
+	stream_keys := c.StringSlice("stream-key")
+	key_source := c.String("key-source")
+	range_key := c.String("range-key")
+	index_fields := c.String("index")
+	lookup_indexes := c.StringSlice("lookup-index")
+	multi_match := c.String("multi-match")
+	key_normalize := c.String("key-normalize")
 	output_topic := c.String("output-topic")
 	if output_topic == "" {
-		output_topic = fmt.Sprintf("joiner-%v-%v-%v", table_topic, table, stream_topic)
+		output_topic = fmt.Sprintf("joiner-%v-%v-%v", table_topic, strings.Join(table_names, "+"), stream_topic)
 	}
 	write_interval := c.Duration("write-interval")
+	health_addr := c.String("health-addr")
+	admin_addr := c.String("admin-addr")
+	debug_addr := c.String("debug-addr")
+	max_lag := c.Int64("max-lag")
+	exit_on_lag := c.Bool("exit-on-lag")
+	bootstrap := c.Bool("bootstrap")
+	changelog_topic := c.String("changelog-topic")
+	partition_buckets := c.Bool("partition-buckets")
+	state_encryption_key := c.String("state-encryption-key")
+	state_compression := c.String("state-compression")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	state_options.RedisPrivate = privateBucket
+	group := c.String("group")
+	group_balance := c.String("group-balance")
+	standby := c.Bool("standby")
+	dry_run := c.Bool("dry-run")
+	start_time := c.String("start-time")
+	stop_at_offset := int64(-1)
+	if c.IsSet("stop-at-offset") {
+		stop_at_offset = c.Int64("stop-at-offset")
+	}
+	stop_at_time := c.String("stop-at-time")
+	dlq := c.String("dlq")
+	format_name := c.String("format")
+	table_format := c.String("table-format")
+	if table_format == "" && format_name != "protobuf" {
+		table_format = format_name
+	}
+	wal_format := c.String("wal-format")
+	database := c.String("database")
+	output_format := c.String("output-format")
+	schema_registry_url := c.String("schema-registry-url")
+	output_schema := c.String("output-schema")
+	proto_descriptor := c.String("proto-descriptor")
+	proto_message := c.String("proto-message")
+	output_proto_message := c.String("output-proto-message")
+	dedup_window := c.Duration("dedup-window")
+	join_type := c.String("join-type")
+	predicate_expr := c.String("predicate")
+	filter_expr := c.String("filter")
+	missing := []byte(c.String("missing"))
+	grace_period := c.Duration("grace-period")
+	table_ttl := c.Duration("table-ttl")
+	output_template := c.String("output-template")
+	output_key := c.String("output-key")
+	selects := c.String("select")
+	tombstone_field := c.String("tombstone-field")
+	tombstone_value := c.String("tombstone-value")
+	tombstone_on_null := c.Bool("tombstone-on-null-value")
 
 	log.Println("brokers:", brokers)
 	log.Println("table-topic:", table_topic)
-	log.Println("table:", table)
+	log.Println("table:", table_names)
 	log.Println("stream-topic:", stream_topic)
-	log.Println("stream-key:", stream_key)
+	log.Println("stream-key:", stream_keys)
+	log.Println("key-source:", key_source)
+	log.Println("range-key:", range_key)
+	log.Println("index:", index_fields)
+	log.Println("lookup-index:", lookup_indexes)
+	log.Println("multi-match:", multi_match)
+	log.Println("key-normalize:", key_normalize)
 	log.Println("output-topic:", output_topic)
 	log.Println("write-interval:", write_interval)
+	log.Println("health-addr:", health_addr)
+	log.Println("admin-addr:", admin_addr)
+	log.Println("debug-addr:", debug_addr)
+	log.Println("max-lag:", max_lag)
+	log.Println("exit-on-lag:", exit_on_lag)
+	debug.Serve(debug_addr)
+	log.Println("bootstrap:", bootstrap)
+	log.Println("changelog-topic:", changelog_topic)
+	log.Println("partition-buckets:", partition_buckets)
+	log.Println("state-encryption:", state_encryption_key != "")
+	log.Println("state-compression:", state_compression)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("group:", group)
+	log.Println("group-balance:", group_balance)
+	log.Println("standby:", standby)
+	log.Println("dry-run:", dry_run)
+	log.Println("start-time:", start_time)
+	log.Println("stop-at-offset:", stop_at_offset)
+	log.Println("stop-at-time:", stop_at_time)
+	log.Println("dlq:", dlq)
+	log.Println("format:", format_name)
+	log.Println("table-format:", table_format)
+	log.Println("wal-format:", wal_format)
+	log.Println("database:", database)
+	log.Println("output-format:", output_format)
+	log.Println("schema-registry-url:", schema_registry_url)
+	log.Println("output-schema:", output_schema)
+	log.Println("proto-descriptor:", proto_descriptor)
+	log.Println("proto-message:", proto_message)
+	log.Println("output-proto-message:", output_proto_message)
+	log.Println("dedup-window:", dedup_window)
+	log.Println("join-type:", join_type)
+	log.Println("predicate:", predicate_expr)
+	log.Println("filter:", filter_expr)
+	log.Println("missing:", string(missing))
+	log.Println("grace-period:", grace_period)
+	log.Println("table-ttl:", table_ttl)
+	log.Println("output-template:", output_template)
+	log.Println("output-key:", output_key)
+	log.Println("select:", selects)
+	log.Println("tombstone-field:", tombstone_field)
+	log.Println("tombstone-value:", tombstone_value)
+	log.Println("tombstone-on-null-value:", tombstone_on_null)
 
-	cachefile := fmt.Sprintf(".joiner-%v-%v-%v.cache", table_topic, table, stream_topic)
+	cachefile := fmt.Sprintf(".joiner-%v-%v-%v.cache", table_topic, strings.Join(table_names, "+"), stream_topic)
 	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
 	log.Println("cache file:", cachefile)
 	log.Println("instanceId:", instanceId)
 
-	if stream_key == "" {
+	var predicate *expr.Expr
+	if predicate_expr != "" {
+		e, err := expr.Compile(predicate_expr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		predicate = e
+	}
+
+	var filter *expr.Expr
+	if filter_expr != "" {
+		e, err := expr.Compile(filter_expr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		filter = e
+	}
+
+	var table_kafka_key, stream_kafka_key bool
+	switch key_source {
+	case "body":
+	case "kafka-key":
+		table_kafka_key, stream_kafka_key = true, true
+	case "table-kafka-key":
+		table_kafka_key = true
+	case "stream-kafka-key":
+		stream_kafka_key = true
+	default:
+		log.Fatalln("unsupported key-source:", key_source)
+	}
+
+	if stream_kafka_key && len(stream_keys) > 0 {
+		log.Fatalln("stream-key and key-source kafka-key are exclusive")
+	}
+
+	if len(stream_keys) == 0 && predicate == nil && !stream_kafka_key {
 		log.Fatalln("stream_key is not set")
 	}
 
-	db, err := bolt.Open(cachefile, 0666, nil)
+	if len(stream_keys) == 0 && len(table_names) > 1 && !stream_kafka_key {
+		log.Fatalln("stream-key must be set for each table when joining multiple tables")
+	}
+
+	if len(stream_keys) > 0 && len(stream_keys) != len(table_names) {
+		log.Fatalln("number of stream-key and table mismatch")
+	}
+
+	// a standby resumes the stream from the offsets committed by the
+	// active joiners in kafka
+	if standby && group == "" {
+		log.Fatalln("standby needs group")
+	}
+
+	// a dry run joining the group would take partitions from the joiners
+	// of the group
+	if dry_run && group != "" {
+		log.Fatalln("dry-run does not support group")
+	}
+
+	// the offsets of a group are reset in kafka
+	var startTime time.Time
+	if start_time != "" {
+		if group != "" {
+			log.Fatalln("start-time does not support group")
+		}
+		var err error
+		if startTime, err = time.Parse(time.RFC3339, start_time); err != nil {
+			log.Fatalln("invalid start-time:", err)
+		}
+	}
+
+	// a bounded run ends at offsets of the partitions it consumes
+	var stopTime time.Time
+	bounded := stop_at_offset >= 0 || stop_at_time != ""
+	if bounded && group != "" {
+		log.Fatalln("stop-at-offset and stop-at-time do not support group")
+	}
+	if c.IsSet("stop-at-offset") && stop_at_offset < 0 {
+		log.Fatalln("stop-at-offset must not be negative")
+	}
+	if stop_at_offset >= 0 && stop_at_time != "" {
+		log.Fatalln("stop-at-offset and stop-at-time are exclusive")
+	}
+	if stop_at_time != "" {
+		var err error
+		if stopTime, err = time.Parse(time.RFC3339, stop_at_time); err != nil {
+			log.Fatalln("invalid stop-at-time:", err)
+		}
+	}
+
+	var balance sarama.BalanceStrategy
+	switch group_balance {
+	case "range":
+		balance = sarama.BalanceStrategyRange
+	case "roundrobin":
+		balance = sarama.BalanceStrategyRoundRobin
+	case "sticky":
+		balance = sarama.BalanceStrategySticky
+	default:
+		log.Fatalln("unsupported group-balance:", group_balance)
+	}
+
+	if len(stream_keys) == 0 && grace_period > 0 && !stream_kafka_key {
+		log.Fatalln("grace-period requires stream-key")
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if changelog_topic != "" {
+		lost, err := lostState(store, brokers, table_topic)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		changelog, err := state.NewChangelog(store, brokers, changelog_topic)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if lost {
+			n, err := changelog.Restore()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Println("restored from changelog:", n)
+		}
+		store = changelog
+	}
+	if state_encryption_key != "" { // changelog messages are encrypted too
+		if store, err = state.NewEncrypted(store, state_encryption_key); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if state_compression != "" { // compressed before encryption
+		if store, err = state.NewCompressed(store, state_compression); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	defer store.Close()
+
+	tables := make([]*table, len(table_names))
+	tableByName := make(map[string]*table)
+	for i, name := range table_names {
+		stream_key := ""
+		if len(stream_keys) > 0 {
+			stream_key = stream_keys[i]
+		}
+		tables[i] = newTable(store, name, stream_key, table_ttl)
+		tableByName[name] = tables[i]
+	}
+
+	normalize, err := sp.NewKeyNormalizer(strings.Split(key_normalize, ","))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalln(err)
+	}
+
+	if index_fields != "" {
+		for _, t := range tables {
+			for _, field := range strings.Split(index_fields, ",") {
+				t.indexes[field] = newSecondaryIndex(store, t.name, field, normalize)
+			}
+		}
+	}
+
+	if len(lookup_indexes) > 0 {
+		if len(lookup_indexes) != len(tables) {
+			log.Fatalln("number of lookup-index and table mismatch")
+		}
+		for i, t := range tables {
+			if lookup_indexes[i] == "" {
+				continue
+			}
+			if t.indexes[lookup_indexes[i]] == nil {
+				log.Fatalln("lookup-index is not indexed:", lookup_indexes[i])
+			}
+			t.index = lookup_indexes[i]
+		}
+	}
+
+	if range_key != "" {
+		bounds := strings.Split(range_key, ",")
+		if len(bounds) != 2 {
+			log.Fatalln("range-key must be two comma separated json paths:", range_key)
+		}
+		if len(stream_keys) == 0 && !stream_kafka_key {
+			log.Fatalln("range-key requires stream-key")
+		}
+		for _, t := range tables {
+			t.ranges = newRangeIndex(store, t.name, bounds[0], bounds[1])
+		}
+	}
+
+	if multi_match != "first" && multi_match != "array" && multi_match != "fanout" {
+		log.Fatalln("unsupported multi-match:", multi_match)
 	}
-	defer db.Close()
 
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(processorName))
-		return err
-	}); err != nil {
+	if join_type != "inner" && join_type != "left" {
+		log.Fatalln("unsupported join-type:", join_type)
+	}
+
+	if !json.Valid(missing) {
+		log.Fatalln("missing placeholder is not valid json:", string(missing))
+	}
+
+	format, err := newFormatter(output_template)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if selects != "" {
+		if output_template != "" {
+			log.Fatalln("select and output-template are exclusive")
+		}
+		format = newProjection(strings.Split(selects, ","))
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: schema_registry_url,
+		ProtoDescriptor:   proto_descriptor,
+		ProtoMessage:      proto_message,
+	})
+	if err != nil {
 		log.Fatalln(err)
 	}
 
-	consumer, err := sarama.NewConsumer(brokers, nil)
+	tableDecoder, err := codec.NewDecoder(table_format, codec.Options{SchemaRegistryURL: schema_registry_url})
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	config := sarama.NewConfig()
-	config.Producer.Return.Successes = false
-	config.Producer.Return.Errors = false
+	parseWAL, err := sp.NewWALDecoder(wal_format, database)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	encoder, err := codec.NewEncoder(output_format, codec.Options{
+		SchemaRegistryURL: schema_registry_url,
+		SchemaFile:        output_schema,
+		Subject:           output_topic + "-value",
+		ProtoDescriptor:   proto_descriptor,
+		ProtoMessage:      output_proto_message,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
 	producer, err := sarama.NewAsyncProducer(brokers, config)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	var dedup *dedupWindow
+	if dedup_window > 0 && !dry_run { // the ids of a dry run are never produced
+		var dedupStore state.Store
+		dedupStore, err = state.Open(state_backend, strings.TrimSuffix(cachefile, ".cache")+"-dedup.cache", state_options)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if changelog_topic != "" { // the ids are mirrored to a topic of their own
+			changelog, err := state.NewChangelog(dedupStore, brokers, changelog_topic+"-dedup")
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if lostDedup(dedupStore) {
+				n, err := changelog.Restore()
+				if err != nil {
+					log.Fatalln(err)
+				}
+				log.Println("restored dedup from changelog:", n)
+			}
+			dedupStore = changelog
+		}
+		defer dedupStore.Close()
+		dedup = newDedupWindow(dedupStore, dedup_window)
+	}
+
+	// joined records in flight, offsets are only committed after all records
+	// produced before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for msg := range producer.Successes() {
+			if dedup == nil {
+				inflight.Done()
+				continue
+			}
+
+			// record the acknowledged ids in batches
+			acked := []*sarama.ProducerMessage{msg}
+		drain:
+			for {
+				select {
+				case msg, ok := <-producer.Successes():
+					if !ok {
+						break drain
+					}
+					acked = append(acked, msg)
+				default:
+					break drain
+				}
+			}
+			dedup.ack(acked)
+			for range acked {
+				inflight.Done()
+			}
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
 	defer func() {
 		if err := consumer.Close(); err != nil {
 			log.Fatalln(err)
@@ -148,120 +797,762 @@ func processor(c *cli.Context) error {
 		}
 	}()
 
-	// read database to memory
-	memTable := make(map[string][]byte)
-	streamOffset := sarama.OffsetNewest
-	tableOffset := sarama.OffsetOldest
+	// read state
+	streamOffsets := make(sp.Offsets)
+	tableOffsets := make(sp.Offsets)
+	retries := newRetryQueue(store, grace_period)
+	retries.load()
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	if err := tableOffsets.Load(store, offsetWAL); err != nil {
+		log.Fatalln(err)
+	}
+	if partition_buckets {
+		partitions, err := consumer.Partitions(table_topic)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, t := range tables {
+			t.partitioned = true
+			t.partitions = partitions
+		}
+		loadPartitions(tableOffsets, store, partitions)
+	}
 
-	db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket([]byte(processorName)); b != nil {
-			if v := b.Get([]byte(offsetStream)); v != nil {
-				streamOffset = int64(binary.LittleEndian.Uint64(v))
-			}
-			if v := b.Get([]byte(offsetWAL)); v != nil {
-				tableOffset = int64(binary.LittleEndian.Uint64(v))
-			}
+	// offsets of single partition versions were stored along with the table
+	if v, _ := store.Get(processorName, []byte(offsetStream)); v != nil {
+		if _, ok := streamOffsets[0]; !ok {
+			streamOffsets[0] = int64(binary.LittleEndian.Uint64(v)) + 1
+		}
+	}
+	if v, _ := store.Get(processorName, []byte(offsetWAL)); v != nil {
+		if _, ok := tableOffsets[0]; !ok {
+			tableOffsets[0] = int64(binary.LittleEndian.Uint64(v)) + 1
+		}
+	}
 
-			c := b.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				data := make([]byte, len(v))
-				copy(data, v)
-				memTable[string(k)] = data
-			}
+	if !startTime.IsZero() {
+		if streamOffsets, err = offsetsAt(brokers, stream_topic, startTime); err != nil {
+			log.Fatalln(err)
 		}
-		return nil
-	})
+		if tableOffsets, err = offsetsAt(brokers, table_topic, startTime); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("starting at:", startTime)
+	}
+
+	for _, t := range tables {
+		t.load(len(tables) == 1)
+	}
+
+	log.Printf("consuming from stream offsets:%v table offsets:%v", streamOffsets, tableOffsets)
+	if group != "" {
+		if a, err := loadAssignment(store); err != nil {
+			log.Fatalln(err)
+		} else if a != nil {
+			log.Printf("last assignment of group %v generation:%v member:%v partitions:%v at:%v", a.Group, a.Generation, a.Member, a.Partitions, a.AssignedAt)
+		}
+	}
 
-	log.Printf("consuming from stream offset:%v table offset:%v", streamOffset, tableOffset)
+	// cancelled on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	streamConsumer, err := consumer.ConsumePartition(stream_topic, 0, streamOffset)
+	var streamMessages <-chan *sarama.ConsumerMessage
+	var streamConsumers map[int32]sarama.PartitionConsumer
+	var streamGroup *groupHandler
+	tableMessages, tableConsumers, err := sp.ConsumeAll(consumer, table_topic, tableOffsets, sarama.OffsetOldest)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	tableConsumer, err := consumer.ConsumePartition(table_topic, 0, tableOffset)
+	defer func() {
+		for _, pcs := range []map[int32]sarama.PartitionConsumer{streamConsumers, tableConsumers} {
+			for _, pc := range pcs {
+				if err := pc.Close(); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(write_interval)
+	numJoined := 0
+	numUnmatched := 0
+	numFiltered := 0
+	numDead := 0
+	numDuplicated := 0
+
+	// parameters
+	host, _ := os.Hostname()
+
+	// trace of the stream message being joined, the parked messages joined
+	// later are not traced
+	tracer, err := tracing.Setup(c, processorName)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer tracing.Shutdown()
+	lookupTrace := context.Background()
 
-	defer func() {
-		if err := streamConsumer.Close(); err != nil {
+	// deadLetter forwards an unprocessable message to the dead letter topic
+	deadLetter := func(msg *sarama.ConsumerMessage, errorType string, reason error) {
+		if dry_run {
+			log.WithFields(logging.Message(msg)).WithError(reason).WithField("error_type", errorType).Println("dead letter")
+			numDead++
+			return
+		}
+		log.WithFields(logging.Message(msg)).WithError(reason).WithField("error_type", errorType).Debugln("dead letter")
+		if dlq == "" || standby { // dead letters of the table are sent by the active joiners
+			return
+		}
+		out, err := sp.NewDeadLetter(dlq, processorName, host, msg, errorType, reason)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- out
+		numDead++
+	}
+
+	// emit produces the joined record of a stream message and its table rows
+	emit := func(msg *sarama.ConsumerMessage, jsonParsed *gabs.Container, key, id string, matches []match) {
+		if dedup != nil && dedup.seen(id) {
+			numDuplicated++
+			return
+		}
+
+		data, err := format(msg.Value, matches, key)
+		if err != nil {
+			deadLetter(msg, errorProduce, err)
+			return
+		}
+
+		wal := &sp.WAL{}
+		wal.Type = "AUGMENT"
+		wal.InstanceId = instanceId
+		wal.Table = outputTable
+		wal.Host = host
+		wal.Data = data
+		wal.Key = id
+		wal.CreatedAt = time.Now()
+		bts, err := json.Marshal(wal)
+		if err != nil {
+			deadLetter(msg, errorProduce, err)
+			return
+		}
+		if dry_run {
+			fmt.Println(string(bts))
+			numJoined++
+			return
+		}
+		if bts, err = encoder.Encode(bts); err != nil {
+			deadLetter(msg, errorProduce, err)
+			return
+		}
+
+		out := &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(bts)}
+		switch output_key {
+		case "":
+		case "join-key":
+			out.Key = sarama.StringEncoder(key)
+		default:
+			out.Key = sarama.StringEncoder(fmt.Sprint(jsonParsed.Path(output_key).Data()))
+		}
+		if dedup != nil {
+			out.Metadata = id
+		}
+		produceTrace, produce := tracer.Stage(lookupTrace, "produce")
+		tracing.Inject(produceTrace, out)
+		inflight.Add(1)
+		producer.Input() <- out
+		produce.End()
+		numJoined++
+	}
+
+	// joinStream looks up the table rows of a stream message, the rows of
+	// the stream keys if set, otherwise all rows satisfying the predicate;
+	// with a grace period, messages missing a row are parked unless final
+	joinStream := func(msg *sarama.ConsumerMessage, since time.Time, final bool) {
+		jsonParsed, err := gabs.ParseJSON(msg.Value)
+		if err != nil {
+			deadLetter(msg, errorParse, err)
+			return
+		}
+
+		if filter != nil && since.IsZero() { // parked messages passed the filter already
+			fields, _ := jsonParsed.Data().(map[string]interface{})
+			if ok, err := filter.Bool(fields); err != nil || !ok {
+				numFiltered++
+				return
+			}
+		}
+		id := fmt.Sprintf("%v-%v", msg.Partition, msg.Offset) // partition & offset is unique as primary key
+
+		// accept evaluates the predicate on the candidate rows
+		accept := func(matches []match) bool {
+			if predicate == nil {
+				return true
+			}
+			rows := make(map[string]interface{})
+			for _, m := range matches {
+				rows[m.table] = rowData(m.row)
+			}
+			env := map[string]interface{}{"stream": jsonParsed.Data(), "table": rows[matches[0].table], "tables": rows}
+			ok, err := predicate.Bool(env)
+			return err == nil && ok
+		}
+
+		if tables[0].streamKey == "" && !stream_kafka_key { // nested loop join on predicate
+			t := tables[0]
+			matched := false
+			t.each(func(k string, row []byte) {
+				matches := []match{{t.name, row, k}}
+				if accept(matches) {
+					emit(msg, jsonParsed, k, id+"-"+k, matches)
+					matched = true
+				}
+			})
+			if !matched {
+				if join_type == "left" {
+					emit(msg, jsonParsed, "", id, []match{{t.name, missing, ""}})
+				} else {
+					numUnmatched++
+				}
+			}
+			return
+		}
+
+		var key string
+		candidates := make([][]match, 0, len(tables))
+		for i, t := range tables {
+			var v interface{}
+			if stream_kafka_key {
+				if msg.Key != nil {
+					v = string(msg.Key)
+				}
+			} else {
+				v = jsonParsed.Path(t.streamKey).Data()
+			}
+			if v == nil { // dead lettered if dlq is set, dropped otherwise
+				if stream_kafka_key {
+					deadLetter(msg, errorMissingKey, errors.New("missing kafka key"))
+				} else {
+					deadLetter(msg, errorMissingKey, fmt.Errorf("missing stream-key %v", t.streamKey))
+				}
+				return
+			}
+			k := normalize(fmt.Sprint(v))
+			if i == 0 {
+				key = k
+			}
+			if keys := t.lookup(k); len(keys) > 0 {
+				var ms []match
+				for _, rk := range keys {
+					row, _ := t.get(rk)
+					ms = append(ms, match{t.name, row, rk})
+				}
+				switch multi_match {
+				case "first":
+					ms = ms[:1]
+				case "array":
+					ms = []match{{t.name, rowArray(ms), k}}
+				}
+				candidates = append(candidates, ms)
+			} else if grace_period > 0 && !final {
+				retries.park(msg, since, t.name, k)
+				return
+			} else if join_type == "left" {
+				candidates = append(candidates, []match{{t.name, missing, ""}})
+			} else {
+				numUnmatched++
+				return
+			}
+		}
+
+		matched := false
+		for _, matches := range combinations(candidates) {
+			if accept(matches) {
+				matched = true
+				if multi_match == "fanout" {
+					emit(msg, jsonParsed, key, fanoutId(id, matches), matches)
+				} else {
+					emit(msg, jsonParsed, key, id, matches)
+				}
+			}
+		}
+
+		if !matched {
+			if join_type == "left" {
+				matches := make([]match, len(tables))
+				for i, t := range tables {
+					matches[i] = match{t.name, missing, ""}
+				}
+				emit(msg, jsonParsed, key, id, matches)
+			} else {
+				numUnmatched++
+			}
+		}
+	}
+
+	// partitions of the table topic behind their high-watermark at start,
+	// tracked with bootstrap or health
+	var catchUp *sp.CatchUp
+	var probes *health
+	if health_addr != "" {
+		probes = newHealth(3 * write_interval)
+		probes.serve(health_addr)
+	}
+
+	// reads of the admin api, run between messages
+	var adminQueries chan *adminQuery
+	if admin_addr != "" {
+		adminQueries = make(chan *adminQuery)
+		api := &admin{
+			queries: adminQueries,
+			tables:  tables,
+			store:   store,
+			normal:  normalize,
+			offsets: func() (sp.Offsets, sp.Offsets) { return streamOffsets, tableOffsets },
+			parked:  retries.len,
+		}
+		api.serve(admin_addr)
+	}
+
+	// checkpoint commits the state once all joined records are acknowledged
+	checkpoint := func() {
+		inflight.Wait()
+		updated, removed := 0, 0
+		for _, t := range tables {
+			updated += t.numUpdated
+			removed += t.numRemoved
+			t.numUpdated, t.numRemoved = 0, 0
+		}
+		if dedup != nil {
+			dedup.expire(time.Now())
+		}
+		before, _ := state.StatsOf(store)
+		switch {
+		case dry_run: // a dry run starts again from the same offsets
+		case streamGroup != nil:
+			commit(store, nil, tableOffsets, partition_buckets)
+			streamGroup.markOffsets(streamOffsets, retries.earliest())
+		default:
+			commit(store, streamOffsets, tableOffsets, partition_buckets)
+		}
+		if probes != nil {
+			probes.committed()
+		}
+		log.Println("updated:", updated, "removed:", removed, "parked:", retries.len(), "stream offsets:", streamOffsets, "table offsets:", tableOffsets, "joined:", numJoined, "unmatched:", numUnmatched, "filtered:", numFiltered, "dead:", numDead, "duplicated:", numDuplicated)
+		if stats, ok := state.StatsOf(store); ok {
+			stats.Dirty = before.Dirty // keys written by the checkpoint
+			log.Println("state:", stats)
+		}
+		numJoined = 0
+		numUnmatched = 0
+		numFiltered = 0
+		numDead = 0
+		numDuplicated = 0
+	}
+
+	// caughtUp reports the end of the catch up to the probes
+	caughtUp := func() {
+		if catchUp.Len() == 0 && probes != nil {
+			probes.caughtUp()
+		}
+	}
+
+	// settle ends the catch up once no message of the table topic arrived
+	// for sp.CatchUpIdle, the partitions left end with records never
+	// delivered
+	settle := func() {
+		if catchUp == nil {
+			return
+		}
+		settled := catchUp.Settle()
+		for partition, hwm := range settled {
+			log.Printf("partition %d of the table topic caught up at offset %d, idle before high-watermark %d", partition, tableOffsets[partition], hwm)
+		}
+		if len(settled) > 0 {
+			caughtUp()
+		}
+	}
+
+	// applyTable applies a message of the table topic to the tables
+	applyTable := func(msg *sarama.ConsumerMessage) {
+		tableOffsets[msg.Partition] = msg.Offset + 1
+		if catchUp != nil && catchUp.Consumed(msg) {
+			caughtUp()
+		}
+		if msg.Value == nil || string(msg.Value) == "null" {
+			if tombstone_on_null && msg.Key != nil {
+				for _, t := range tables {
+					t.remove(normalize(string(msg.Key)))
+				}
+			}
+			return
+		}
+
+		value, err := tableDecoder.Decode(msg.Value)
+		if err != nil {
+			deadLetter(msg, errorParse, err)
+			return
+		}
+
+		wal, row, remove, err := parseWAL(msg.Key, value)
+		if err != nil {
+			deadLetter(msg, errorParse, err)
+			return
+		}
+
+		if wal == nil { // skipped change events
+			return
+		}
+		t, ok := tableByName[wal.Table]
+		if !ok { // table filter
+			return
+		}
+
+		key := normalize(wal.Key)
+		if table_kafka_key {
+			if msg.Key == nil {
+				deadLetter(msg, errorMissingKey, errors.New("missing kafka key"))
+				return
+			}
+			key = normalize(string(msg.Key))
+		}
+		if remove {
+			t.remove(key)
+			return
+		}
+		if tombstone_field != "" {
+			if jsonParsed, err := gabs.ParseJSON(row); err == nil {
+				if v := jsonParsed.Path(tombstone_field).Data(); v != nil && fmt.Sprint(v) == tombstone_value {
+					t.remove(key)
+					return
+				}
+			}
+		}
+		t.put(msg.Partition, key, row)
+		if grace_period > 0 {
+			for _, p := range retries.take(t.name, key) {
+				joinStream(p.message(stream_topic), p.since, false)
+			}
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	if bootstrap || probes != nil {
+		pending, err := sp.PendingOffsets(brokers, table_topic, tableOffsets)
+		if err != nil {
 			log.Fatalln(err)
 		}
+		catchUp = sp.NewCatchUp(pending, tableConsumers)
+		caughtUp()
+	}
 
-		if err := tableConsumer.Close(); err != nil {
+	// build the whole table before joining the stream
+	if bootstrap {
+		start := time.Now()
+		log.Println("bootstrapping table up to offsets:", catchUp.Pending())
+		idle := time.NewTicker(time.Second)
+		for catchUp.Len() > 0 {
+			select {
+			case <-idle.C:
+				settle()
+			case <-ticker.C:
+				checkpoint()
+			case sig := <-signals:
+				log.Println("received signal:", sig)
+				checkpoint()
+				log.Println("stopped")
+				return nil
+			case q := <-adminQueries:
+				q.run()
+			case msg := <-tableMessages:
+				applyTable(msg)
+			}
+		}
+		idle.Stop()
+		checkpoint()
+		log.Println("bootstrapped table in", time.Since(start))
+	}
+
+	// a standby applies the table topic only, until promoted when the
+	// active joiner dies
+	if standby {
+		promote := make(chan os.Signal, 1)
+		signal.Notify(promote, syscall.SIGUSR1)
+		log.Println("standby, promote with SIGUSR1")
+	warm:
+		for {
+			select {
+			case <-ticker.C:
+				for _, t := range tables {
+					t.expire(time.Now())
+				}
+				settle()
+				checkpoint()
+			case sig := <-signals:
+				log.Println("received signal:", sig)
+				checkpoint()
+				log.Println("stopped")
+				return nil
+			case q := <-adminQueries:
+				q.run()
+			case msg := <-tableMessages:
+				applyTable(msg)
+			case <-promote:
+				signal.Stop(promote)
+				standby = false
+				log.Println("promoted")
+				break warm
+			}
+		}
+	}
+
+	// stream offsets are managed by kafka in group mode
+	if group != "" {
+		groupConfig := kafka.NewConfig()
+		groupConfig.Version = sarama.V0_10_2_0
+		groupConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+		groupConfig.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{balance}
+		consumerGroup, err := sarama.NewConsumerGroup(brokers, group, groupConfig)
+		if err != nil {
 			log.Fatalln(err)
 		}
-	}()
+		defer func() {
+			if err := consumerGroup.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}()
+		streamGroup = consumeGroup(ctx, consumerGroup, stream_topic)
+		streamMessages = streamGroup.messages
+	} else {
+		streamMessages, streamConsumers, err = sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// the partitions of a bounded run with messages left, mapped to their
+	// end
+	var stops sp.Offsets
+	if bounded {
+		if stops, err = stopOffsets(brokers, stream_topic, streamOffsets, stop_at_offset, stopTime); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("stopping at stream offsets:", stops)
+	}
+	// stop commits a bounded run once the stream is consumed up to its end,
+	// messages still parked are kept in the state
+	stop := func() {
+		cancel()
+		checkpoint()
+		log.Println("reached the end of the stream, parked:", retries.len())
+		log.Println("stopped")
+	}
+	if bounded && len(stops) == 0 {
+		stop()
+		return nil
+	}
+
+	// the lag is measured to check max-lag or to be published with the
+	// debug endpoints
+	var lags *lagMonitor
+	if max_lag > 0 || debug_addr != "" {
+		if lags, err = newLagMonitor(brokers); err != nil {
+			log.Fatalln(err)
+		}
+		defer lags.Close()
+	}
 
 	log.Println("started")
-	ticker := time.NewTicker(write_interval)
-	numJoined := 0
 
-	// parameters
-	host, _ := os.Hostname()
+	var rebalances <-chan *rebalance
+	if streamGroup != nil {
+		rebalances = streamGroup.rebalances
+	}
+
 	for {
 		select {
+		case r := <-rebalances:
+			if r.assigned {
+				// the claims resume from before their parked messages,
+				// joined again by their owners
+				log.Println("assigned partitions:", r.partitions, "dropped parked:", retries.clear())
+				a := &assignment{Group: group, Generation: r.generation, Member: r.member, Partitions: r.partitions, AssignedAt: time.Now()}
+				if err := a.store(store); err != nil {
+					log.Fatalln(err)
+				}
+			} else {
+				// commit the state and offsets of the claims revoked before
+				// the partitions move to other members
+				checkpoint()
+				streamOffsets = make(sp.Offsets)
+				log.Println("revoked partitions:", r.partitions)
+			}
+			close(r.done)
 		case <-ticker.C:
-			commit(db, memTable, streamOffset, tableOffset)
-			log.Println("committed:", len(memTable), "stream offset:", streamOffset, "table offset:", tableOffset, "joined:", numJoined)
-			numJoined = 0
-		case msg := <-tableConsumer.Messages():
-			tableOffset = msg.Offset
-			wal := &WAL{}
-			if err := json.Unmarshal(msg.Value, wal); err == nil {
-				if wal.Table == table { // table filter
-					memTable[wal.Key] = msg.Value
+			for _, t := range tables {
+				t.expire(time.Now())
+			}
+			settle()
+			if grace_period > 0 {
+				for _, p := range retries.expire(time.Now()) {
+					joinStream(p.message(stream_topic), p.since, true)
 				}
 			}
-		case msg := <-streamConsumer.Messages():
-			streamOffset = msg.Offset
-			if jsonParsed, err := gabs.ParseJSON(msg.Value); err == nil {
-				key := fmt.Sprint(jsonParsed.Path(stream_key).Data())
-				t := memTable[key]
-				wal := &WAL{}
-				wal.Type = "AUGMENT"
-				wal.InstanceId = instanceId
-				wal.Table = outputTable
-				wal.Host = host
-				data, _ := json.Marshal(STJoin{Stream: (*json.RawMessage)(&msg.Value), Table: (*json.RawMessage)(&t)})
-				wal.Data = data
-				wal.Key = fmt.Sprint(msg.Offset) // offset is unique as primary key
-				wal.CreatedAt = time.Now()
-				if bts, err := json.Marshal(wal); err == nil {
-					producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder([]byte(bts))}
-					numJoined++
-				} else {
-					log.Println(err)
+			checkpoint()
+			if lags == nil {
+				continue
+			}
+			streamLag, err := lags.measure(stream_topic, streamOffsets)
+			if err != nil {
+				log.Println("lag:", err)
+				continue
+			}
+			tableLag, err := lags.measure(table_topic, tableOffsets)
+			if err != nil {
+				log.Println("lag:", err)
+				continue
+			}
+			log.Println("stream lag:", streamLag, "table lag:", tableLag)
+			if max_lag > 0 && streamLag > max_lag {
+				if exit_on_lag {
+					cancel()
+					return cli.Exit(fmt.Sprintf("stream lag %v exceeds max-lag %v", streamLag, max_lag), 3)
+				}
+				log.Warnln("stream lag", streamLag, "exceeds max-lag", max_lag)
+			}
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			cancel()
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case q := <-adminQueries:
+			q.run()
+		case msg := <-tableMessages:
+			applyTable(msg)
+		case msg := <-streamMessages:
+			if bounded {
+				// messages after the end are left for the next run
+				if end, ok := stops[msg.Partition]; !ok || msg.Offset >= end {
+					continue
+				}
+			}
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			msgTrace, span := tracer.Start(msg, processorName)
+			_, parse := tracer.Stage(msgTrace, "parse")
+			value, err := decoder.Decode(msg.Value)
+			if err != nil {
+				tracing.Fail(parse, err)
+				parse.End()
+				span.End()
+				deadLetter(msg, errorParse, err)
+				continue
+			}
+			parse.End()
+			msg.Value = value // parked messages are kept decoded
+			lookupCtx, lookup := tracer.Stage(msgTrace, "lookup")
+			lookupTrace = lookupCtx
+			joinStream(msg, time.Time{}, false)
+			lookup.End()
+			span.End()
+			lookupTrace = context.Background()
+			if bounded && msg.Offset+1 >= stops[msg.Partition] {
+				delete(stops, msg.Partition)
+				if len(stops) == 0 {
+					stop()
+					return nil
 				}
 			}
 		}
 	}
 }
 
-func commit(db *bolt.DB, memtable map[string][]byte, streamOffset, tableOffset int64) {
-	if err := db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(processorName))
-		for k, v := range memtable {
-			if err := bucket.Put([]byte(k), v); err != nil {
-				return err
-			}
+// rowData decodes the data field of a table row, or the data fields of an
+// array of rows
+func rowData(row []byte) interface{} {
+	if len(row) > 0 && row[0] == '[' {
+		var wals []struct {
+			Data interface{} `json:"data"`
+		}
+		json.Unmarshal(row, &wals)
+		data := make([]interface{}, len(wals))
+		for i := range wals {
+			data[i] = wals[i].Data
 		}
+		return data
+	}
 
-		buf1 := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf1, uint64(tableOffset))
-		if err := bucket.Put([]byte(offsetWAL), buf1); err != nil {
-			return err
+	var wal struct {
+		Data interface{} `json:"data"`
+	}
+	json.Unmarshal(row, &wal)
+	return wal.Data
+}
+
+// loadPartitions reads the offsets stored in the buckets of partitions,
+// over the offsets stored before partition buckets
+func loadPartitions(offs sp.Offsets, store state.Store, partitions []int32) {
+	for _, p := range partitions {
+		v, err := store.Get(partitionBucket(p), []byte(offsetWAL))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if v != nil {
+			offs[p] = int64(binary.LittleEndian.Uint64(v))
 		}
+	}
+}
 
-		buf2 := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf2, uint64(streamOffset))
-		if err := bucket.Put([]byte(offsetStream), buf2); err != nil {
+// storePartitions writes the offset of each partition to its bucket, the
+// offsets stored before partition buckets are removed so that a partition
+// reset by removing its bucket is consumed from the oldest message
+func storePartitions(offs sp.Offsets, store state.Store) error {
+	for partition, offset := range offs {
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(offset))
+		if err := store.Put(partitionBucket(partition), []byte(offsetWAL), v); err != nil {
+			return err
+		}
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, uint32(partition))
+		if err := store.Delete(offsetWAL, k); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		return nil
-	}); err != nil {
+// commit checkpoints the state with the offsets, which must only be called
+// after the records produced for the consumed stream messages have been
+// acknowledged; on restart both topics are consumed from the checkpoint so
+// each stream message is joined at least once. streamOffsets is nil when they
+// are managed by a consumer group. Table offsets are stored in the bucket of
+// their partition if partitioned.
+func commit(store state.Store, streamOffsets, tableOffsets sp.Offsets, partitioned bool) {
+	var err error
+	if partitioned {
+		err = storePartitions(tableOffsets, store)
+	} else {
+		err = tableOffsets.Store(store, offsetWAL)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if streamOffsets != nil {
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := store.Checkpoint(); err != nil {
 		log.Fatalln(err)
 	}
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"text/template"
+
+	"github.com/xtaci/sp/expr"
+)
+
+// match is the row of a table joined with a stream message
+type match struct {
+	table string
+	row   []byte
+	key   string // row key, empty for the missing placeholder
+}
+
+// formatter builds the data field of a joined record from the stream message
+// and the matched table rows
+type formatter func(stream []byte, matches []match, key string) ([]byte, error)
+
+// newFormatter creates the formatter for the output-template flag, an empty
+// template keeps the {"stream":...,"table":...} shape (or "tables" keyed by
+// table name when joining multiple tables), "merge" merges the fields of the
+// table row data into the stream message (fields already present in the
+// stream message are kept), anything else is parsed as a text/template
+// executed with .Stream, .Table, .Tables and .Key which must produce a json
+// document
+func newFormatter(output_template string) (formatter, error) {
+	switch output_template {
+	case "":
+		return func(stream []byte, matches []match, key string) ([]byte, error) {
+			if len(matches) == 1 {
+				return json.Marshal(STJoin{Stream: (*json.RawMessage)(&stream), Table: (*json.RawMessage)(&matches[0].row)})
+			}
+			tables := make(map[string]*json.RawMessage)
+			for i := range matches {
+				tables[matches[i].table] = (*json.RawMessage)(&matches[i].row)
+			}
+			return json.Marshal(STJoinMulti{Stream: (*json.RawMessage)(&stream), Tables: tables})
+		}, nil
+	case "merge":
+		return mergeJoin, nil
+	}
+
+	tmpl, err := template.New("output").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			bts, err := json.Marshal(v)
+			return string(bts), err
+		},
+	}).Parse(output_template)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(stream []byte, matches []match, key string) ([]byte, error) {
+		var data struct {
+			Stream interface{}
+			Table  interface{}
+			Tables map[string]interface{}
+			Key    string
+		}
+		data.Key = key
+		data.Tables = make(map[string]interface{})
+		if err := json.Unmarshal(stream, &data.Stream); err != nil {
+			return nil, err
+		}
+		for i, m := range matches {
+			var row interface{}
+			if err := json.Unmarshal(m.row, &row); err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				data.Table = row
+			}
+			data.Tables[m.table] = row
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, errors.New("output template produced invalid json: " + buf.String())
+		}
+		return buf.Bytes(), nil
+	}, nil
+}
+
+// mergeJoin merges the data of the table rows into the stream message
+func mergeJoin(stream []byte, matches []match, key string) ([]byte, error) {
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal(stream, &s); err != nil {
+		return nil, err
+	}
+
+	for _, m := range matches {
+		var row struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(m.row, &row) // unmatched rows carry the missing placeholder
+		for k, v := range row.Data {
+			if _, ok := s[k]; !ok {
+				s[k] = v
+			}
+		}
+	}
+	return json.Marshal(s)
+}
+
+// newProjection creates a formatter emitting only the selected fields, paths
+// like stream.a or table.name are resolved as in predicates and the result is
+// nested the same way, e.g.: {"stream":{"a":1},"table":{"name":"x"}}
+func newProjection(fields []string) formatter {
+	return func(stream []byte, matches []match, key string) ([]byte, error) {
+		var s interface{}
+		if err := json.Unmarshal(stream, &s); err != nil {
+			return nil, err
+		}
+		rows := make(map[string]interface{})
+		for _, m := range matches {
+			rows[m.table] = rowData(m.row)
+		}
+		env := map[string]interface{}{"stream": s, "tables": rows}
+		if len(matches) > 0 {
+			env["table"] = rows[matches[0].table]
+		}
+
+		out := make(map[string]interface{})
+		for _, field := range fields {
+			setPath(out, strings.Split(field, "."), expr.Lookup(env, field))
+		}
+		return json.Marshal(out)
+	}
+}
+
+// setPath sets v in nested objects along path
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[seg] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
+
+// rowArray builds the json array of the matched rows
+func rowArray(matches []match) []byte {
+	rows := make([][]byte, len(matches))
+	for i := range matches {
+		rows[i] = matches[i].row
+	}
+	return append(append([]byte{'['}, bytes.Join(rows, []byte{','})...), ']')
+}
+
+// combinations returns the cartesian product of the candidate matches of
+// each table
+func combinations(candidates [][]match) [][]match {
+	combos := [][]match{{}}
+	for _, ms := range candidates {
+		next := make([][]match, 0, len(combos)*len(ms))
+		for _, combo := range combos {
+			for _, m := range ms {
+				next = append(next, append(combo[:len(combo):len(combo)], m))
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// fanoutId identifies the record of a combination of rows
+func fanoutId(id string, matches []match) string {
+	for _, m := range matches {
+		id += "-" + m.key
+	}
+	return id
+}
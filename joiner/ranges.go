@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// rangeEntry is the [lo, hi] range of the row of key
+type rangeEntry struct {
+	lo, hi []byte
+	key    string
+}
+
+// rangeIndex matches values by containment in the ranges of table rows,
+// e.g. ip ranges or price tiers; ranges are expected not to overlap, the
+// range with the greatest lower bound below the value is matched
+type rangeIndex struct {
+	from, to string // json paths of the bounds in row data
+	store    state.Store
+	bucket   string
+
+	entries []rangeEntry // sorted by lower bound, then row key
+	byKey   map[string]rangeEntry
+}
+
+func newRangeIndex(store state.Store, table, from, to string) *rangeIndex {
+	return &rangeIndex{
+		from:   from,
+		to:     to,
+		store:  store,
+		bucket: rangeIndexes + "/" + table,
+		byKey:  make(map[string]rangeEntry),
+	}
+}
+
+// put indexes the range of a row, rows without valid bounds are not indexed
+func (idx *rangeIndex) put(key string, row []byte) {
+	idx.remove(key)
+	data, err := gabs.Consume(rowData(row))
+	if err != nil {
+		return
+	}
+	lo, ok := rangeValue(data.Path(idx.from).Data())
+	if !ok {
+		return
+	}
+	hi, ok := rangeValue(data.Path(idx.to).Data())
+	if !ok || lo[0] != hi[0] {
+		return
+	}
+	e := rangeEntry{lo, hi, key}
+	idx.byKey[key] = e
+	i := idx.search(lo, key)
+	idx.entries = append(idx.entries, rangeEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = e
+
+	v := make([]byte, 2+len(hi))
+	binary.BigEndian.PutUint16(v, uint16(len(lo)))
+	copy(v[2:], hi)
+	if err := idx.store.Put(idx.bucket, e.storeKey(), v); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// storeKey is the lower bound followed by the row key
+func (e *rangeEntry) storeKey() []byte {
+	return append(append([]byte(nil), e.lo...), e.key...)
+}
+
+// less orders the entries by lower bound, then row key
+func (e *rangeEntry) less(lo []byte, key string) bool {
+	if c := bytes.Compare(e.lo, lo); c != 0 {
+		return c < 0
+	}
+	return e.key < key
+}
+
+// search returns the position of the entry of lo and key in the entries,
+// or where to insert it
+func (idx *rangeIndex) search(lo []byte, key string) int {
+	return sort.Search(len(idx.entries), func(i int) bool { return !idx.entries[i].less(lo, key) })
+}
+
+// remove unindexes the range of a row
+func (idx *rangeIndex) remove(key string) {
+	e, ok := idx.byKey[key]
+	if !ok {
+		return
+	}
+	delete(idx.byKey, key)
+	if i := idx.search(e.lo, key); i < len(idx.entries) && idx.entries[i].key == key {
+		idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+	}
+	if err := idx.store.Delete(idx.bucket, e.storeKey()); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// lookup returns the key of the row whose range contains v
+func (idx *rangeIndex) lookup(v interface{}) (string, bool) {
+	bts, ok := rangeValue(v)
+	if !ok {
+		return "", false
+	}
+	i := sort.Search(len(idx.entries), func(i int) bool { return bytes.Compare(idx.entries[i].lo, bts) > 0 })
+	if i == 0 {
+		return "", false
+	}
+	if e := idx.entries[i-1]; bytes.Compare(bts, e.hi) <= 0 {
+		return e.key, true
+	}
+	return "", false
+}
+
+// load reads the index, each range stored under its lower bound + the row
+// key, values are the length of the lower bound followed by the upper bound;
+// returns false if the index is empty
+func (idx *rangeIndex) load() bool {
+	if err := idx.store.Iterate(idx.bucket, func(k, v []byte) error {
+		if len(v) < 2 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(v))
+		if n > len(k) {
+			return nil
+		}
+		e := rangeEntry{
+			lo:  append([]byte(nil), k[:n]...),
+			hi:  append([]byte(nil), v[2:]...),
+			key: string(k[n:]),
+		}
+		idx.byKey[e.key] = e
+		idx.entries = append(idx.entries, e)
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	// stored in the order of the lower bound followed by the row key, which
+	// is not the order of the lower bounds when they differ in length
+	sort.Slice(idx.entries, func(i, j int) bool { return idx.entries[i].less(idx.entries[j].lo, idx.entries[j].key) })
+	return len(idx.entries) > 0
+}
+
+// rangeValue encodes a bound or a looked up value so that bytes order
+// follows the order of values, the first byte tells the kind of value:
+// ip addresses, times (RFC3339), numbers or strings
+func rangeValue(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case float64:
+		return orderedFloat('n', v), true
+	case string:
+		if ip := net.ParseIP(v); ip != nil {
+			return append([]byte{'i'}, ip.To16()...), true
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			bts := make([]byte, 9)
+			bts[0] = 't'
+			binary.BigEndian.PutUint64(bts[1:], uint64(t.UnixNano())^(1<<63))
+			return bts, true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return orderedFloat('n', f), true
+		}
+		return append([]byte{'s'}, v...), true
+	case nil:
+		return nil, false
+	}
+	return rangeValue(fmt.Sprint(v))
+}
+
+// orderedFloat encodes f so that bytes order follows numeric order
+func orderedFloat(kind byte, f float64) []byte {
+	u := math.Float64bits(f)
+	if f < 0 {
+		u = ^u
+	} else {
+		u |= 1 << 63
+	}
+	bts := make([]byte, 9)
+	bts[0] = kind
+	binary.BigEndian.PutUint64(bts[1:], u)
+	return bts
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/xtaci/sp/state"
+)
+
+func TestRangeValueOrder(t *testing.T) {
+	tests := []struct {
+		lower, greater interface{}
+	}{
+		{-1e9, -1.0},
+		{-1.0, -0.5},
+		{-0.5, 0.0},
+		{0.0, 1e-9},
+		{2.0, 10.0},
+		{"2", "10"}, // numeric strings are numbers
+		{"-3", 2.5},
+		{"10.0.0.2", "10.0.0.10"},
+		{"10.255.255.255", "11.0.0.0"},
+		{"::1", "fe80::1"},
+		{"1969-12-31T23:59:59Z", "1970-01-01T00:00:00Z"},
+		{"2024-01-01T00:00:00Z", "2024-01-01T00:00:00.5Z"},
+		{"2024-01-01T01:00:00+02:00", "2024-01-01T00:00:00Z"},
+		{"apple", "banana"},
+		{"a", "ab"},
+	}
+	for _, tt := range tests {
+		lo, ok := rangeValue(tt.lower)
+		if !ok {
+			t.Fatalf("encode %v", tt.lower)
+		}
+		hi, ok := rangeValue(tt.greater)
+		if !ok {
+			t.Fatalf("encode %v", tt.greater)
+		}
+		if bytes.Compare(lo, hi) >= 0 {
+			t.Fatalf("%v encoded as %x, not below %v encoded as %x", tt.lower, lo, tt.greater, hi)
+		}
+	}
+}
+
+func TestRangeValueKinds(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		kind byte
+		same interface{} // encoded the same if set
+	}{
+		{2.0, 'n', "2"},
+		{"1e3", 'n', 1000.0},
+		{"10.0.0.1", 'i', "::ffff:10.0.0.1"},
+		{"2024-01-01T01:00:00+01:00", 't', "2024-01-01T00:00:00Z"},
+		{"gold", 's', nil},
+		{true, 's', "true"},
+		{int64(7), 'n', 7.0},
+	}
+	for _, tt := range tests {
+		bts, ok := rangeValue(tt.v)
+		if !ok || bts[0] != tt.kind {
+			t.Fatalf("encode %#v: got %q %v, want kind %q", tt.v, bts, ok, tt.kind)
+		}
+		if tt.same != nil {
+			if same, _ := rangeValue(tt.same); !bytes.Equal(bts, same) {
+				t.Fatalf("encode %#v: got %x, want %x of %#v", tt.v, bts, same, tt.same)
+			}
+		}
+	}
+	if _, ok := rangeValue(nil); ok {
+		t.Fatal("encode nil: expected no value")
+	}
+}
+
+func TestRangeIndex(t *testing.T) {
+	store, err := state.OpenBolt(filepath.Join(t.TempDir(), "ranges.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	idx := newRangeIndex(store, "tiers", "from", "to")
+	rows := []struct{ key, row string }{
+		{"gold", `{"data": {"from": 1000, "to": 1e9}}`},
+		{"bronze", `{"data": {"from": 0, "to": 99.99}}`},
+		{"silver", `{"data": {"from": 100, "to": 999.99}}`},
+		{"office", `{"data": {"from": "10.0.0.0", "to": "10.0.0.255"}}`},
+		{"first", `{"data": {"from": "a", "to": "az"}}`},
+		{"second", `{"data": {"from": "b", "to": "bz"}}`},
+		{"unbounded", `{"data": {"from": 5}}`},
+		{"mixed", `{"data": {"from": 5, "to": "z"}}`},
+	}
+	for _, r := range rows {
+		idx.put(r.key, []byte(r.row))
+	}
+	idx.put("silver", []byte(`{"data": {"from": 100, "to": 499}}`)) // replaces the range
+	idx.remove("bronze")
+	idx.remove("unknown")
+
+	loaded := newRangeIndex(store, "tiers", "from", "to")
+	if !loaded.load() {
+		t.Fatal("loaded an empty index")
+	}
+
+	tests := []struct {
+		v   interface{}
+		key string // empty if not matched
+	}{
+		{50.0, ""}, // removed
+		{100.0, "silver"},
+		{"250", "silver"},
+		{700.0, ""}, // replaced
+		{1000.0, "gold"},
+		{1e10, ""},
+		{-1.0, ""},
+		{"10.0.0.42", "office"},
+		{"10.0.1.0", ""},
+		{"apple", "first"},
+		{"b", "second"},
+		{"c", ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		for name, idx := range map[string]*rangeIndex{"put": idx, "loaded": loaded} {
+			key, ok := idx.lookup(tt.v)
+			if key != tt.key || ok != (tt.key != "") {
+				t.Fatalf("lookup %v in the %v index: got %q %v, want %q", tt.v, name, key, ok, tt.key)
+			}
+		}
+	}
+}
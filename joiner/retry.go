@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// parked is a stream message waiting for the table row of its foreign key
+type parked struct {
+	partition int32
+	offset    int64
+	key       []byte
+	value     []byte
+	since     time.Time // when the message was parked first
+}
+
+func (p *parked) message(topic string) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{Topic: topic, Partition: p.partition, Offset: p.offset, Key: p.key, Value: p.value}
+}
+
+// retryQueue holds unmatched stream messages for a grace period, messages are
+// retried when the missing row arrives in the WAL, or joined according to the
+// join type when the grace period expires
+type retryQueue struct {
+	grace   time.Duration
+	store   state.Store
+	waiting map[string][]*parked // indexed by table + "\x00" + foreign key
+}
+
+func newRetryQueue(store state.Store, grace time.Duration) *retryQueue {
+	return &retryQueue{grace: grace, store: store, waiting: make(map[string][]*parked)}
+}
+
+// park puts msg aside until the row of key in table arrives
+func (q *retryQueue) park(msg *sarama.ConsumerMessage, since time.Time, table, key string) {
+	if since.IsZero() {
+		since = time.Now()
+	}
+	id := table + "\x00" + key
+	p := &parked{
+		partition: msg.Partition,
+		offset:    msg.Offset,
+		key:       msg.Key,
+		value:     msg.Value,
+		since:     since,
+	}
+	q.waiting[id] = append(q.waiting[id], p)
+
+	v := make([]byte, 12+len(p.key)+len(p.value))
+	binary.LittleEndian.PutUint64(v, uint64(p.since.UnixNano()))
+	binary.LittleEndian.PutUint32(v[8:], uint32(len(p.key)))
+	copy(v[12:], p.key)
+	copy(v[12+len(p.key):], p.value)
+	if err := q.store.Put(parkedStream, p.storeKey(id), v); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// storeKey is the waited id + "\x00" + partition + offset
+func (p *parked) storeKey(id string) []byte {
+	k := make([]byte, len(id)+13)
+	copy(k, id)
+	binary.BigEndian.PutUint32(k[len(id)+1:], uint32(p.partition))
+	binary.BigEndian.PutUint64(k[len(id)+5:], uint64(p.offset))
+	return k
+}
+
+// unpark deletes the stored messages
+func (q *retryQueue) unpark(id string, ps []*parked) {
+	for _, p := range ps {
+		if err := q.store.Delete(parkedStream, p.storeKey(id)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// take removes the messages waiting for the row of key in table
+func (q *retryQueue) take(table, key string) []*parked {
+	id := table + "\x00" + key
+	ps := q.waiting[id]
+	delete(q.waiting, id)
+	q.unpark(id, ps)
+	return ps
+}
+
+// expire removes the messages parked longer than the grace period
+func (q *retryQueue) expire(now time.Time) (expired []*parked) {
+	deadline := now.Add(-q.grace)
+	for id, ps := range q.waiting {
+		var alive, dead []*parked
+		for _, p := range ps {
+			if p.since.Before(deadline) {
+				dead = append(dead, p)
+			} else {
+				alive = append(alive, p)
+			}
+		}
+		q.unpark(id, dead)
+		expired = append(expired, dead...)
+		if len(alive) == 0 {
+			delete(q.waiting, id)
+		} else {
+			q.waiting[id] = alive
+		}
+	}
+	return
+}
+
+// earliest returns the offset of the earliest parked message of each
+// partition
+func (q *retryQueue) earliest() sp.Offsets {
+	offs := make(sp.Offsets)
+	for _, ps := range q.waiting {
+		for _, p := range ps {
+			if o, ok := offs[p.partition]; !ok || p.offset < o {
+				offs[p.partition] = p.offset
+			}
+		}
+	}
+	return offs
+}
+
+// clear removes all the parked messages, returns the number of messages
+// removed
+func (q *retryQueue) clear() (n int) {
+	for id, ps := range q.waiting {
+		q.unpark(id, ps)
+		n += len(ps)
+	}
+	q.waiting = make(map[string][]*parked)
+	return
+}
+
+// len returns the number of parked messages
+func (q *retryQueue) len() (n int) {
+	for _, ps := range q.waiting {
+		n += len(ps)
+	}
+	return
+}
+
+// load reads the parked messages, values are the parking time, the length of
+// the message key, the message key and the message value
+func (q *retryQueue) load() {
+	if err := q.store.Iterate(parkedStream, func(k, v []byte) error {
+		if len(k) < 13 || len(v) < 12 {
+			return nil
+		}
+		n := len(k) - 12
+		keyLen := int(binary.LittleEndian.Uint32(v[8:]))
+		if len(v) < 12+keyLen {
+			return nil
+		}
+		p := &parked{
+			partition: int32(binary.BigEndian.Uint32(k[n:])),
+			offset:    int64(binary.BigEndian.Uint64(k[n+4:])),
+			since:     time.Unix(0, int64(binary.LittleEndian.Uint64(v))),
+			value:     append([]byte(nil), v[12+keyLen:]...),
+		}
+		if keyLen > 0 {
+			p.key = append([]byte(nil), v[12:12+keyLen]...)
+		}
+		id := string(k[:n-1])
+		q.waiting[id] = append(q.waiting[id], p)
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// table is a table of the WAL kept in the state store, rows are stored in a
+// bucket named after the table inside the processor bucket, or inside the
+// bucket of the partition of the table topic they were consumed from when
+// partitioned
+type table struct {
+	name      string
+	streamKey string // json path of the foreign key in stream messages
+	ttl       time.Duration
+	store     state.Store
+
+	partitioned bool
+	partitions  []int32 // of the table topic, set if partitioned
+
+	ranges  *rangeIndex // stream keys are matched by range if set
+	indexes map[string]*secondaryIndex
+	index   string // field of rows referenced by stream keys instead of the row key
+
+	numUpdated int // rows put since last checkpoint
+	numRemoved int // rows removed since last checkpoint
+}
+
+func newTable(store state.Store, name, streamKey string, ttl time.Duration) *table {
+	return &table{
+		name:      name,
+		streamKey: streamKey,
+		ttl:       ttl,
+		store:     store,
+		indexes:   make(map[string]*secondaryIndex),
+	}
+}
+
+func (t *table) rowsBucket() string    { return processorName + "/" + t.name }
+func (t *table) updatedBucket() string { return updatedAt + "/" + t.name }
+
+// partitionBucket holds the rows and the table offset of a partition of
+// the table topic when partitioned
+func partitionBucket(partition int32) string {
+	return partitionsBucket + "/" + strconv.Itoa(int(partition))
+}
+
+// privateBucket reports the buckets kept per replica in a redis store
+// shared by the replicas of the joiner: the offsets, including the table
+// offsets of the partition buckets, the messages parked and the assignment
+// of the group; the tables and their indexes are shared
+func privateBucket(bucket string) bool {
+	switch bucket {
+	case offsetStream, offsetWAL, parkedStream, groupBucket:
+		return true
+	}
+	p := strings.TrimPrefix(bucket, partitionsBucket+"/")
+	return p != bucket && !strings.Contains(p, "/")
+}
+
+// slice is the buckets of the rows and of their updates of a partition
+type slice struct {
+	rows, updated string
+}
+
+// slice returns the buckets of partition, ignored unless partitioned
+func (t *table) slice(partition int32) slice {
+	if !t.partitioned {
+		return slice{t.rowsBucket(), t.updatedBucket()}
+	}
+	return slice{
+		partitionBucket(partition) + "/" + t.name,
+		partitionBucket(partition) + "/" + updatedAt + "/" + t.name,
+	}
+}
+
+// slices returns the buckets of all partitions, rows stored before the
+// table was partitioned are read until replaced
+func (t *table) slices() []slice {
+	slices := []slice{{t.rowsBucket(), t.updatedBucket()}}
+	if t.partitioned {
+		for _, p := range t.partitions {
+			slices = append(slices, t.slice(p))
+		}
+	}
+	return slices
+}
+
+// keysBucket maps the keys of the rows to their partition when partitioned
+func (t *table) keysBucket() string { return keyPartitions + "/" + t.name }
+
+// sliceOf returns the buckets holding the row of key if any: the slice of
+// its partition when partitioned, the buckets of the rows stored before the
+// table was partitioned for keys without partition
+func (t *table) sliceOf(key string) slice {
+	if t.partitioned {
+		v, err := t.store.Get(t.keysBucket(), []byte(key))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(v) == 4 {
+			return t.slice(int32(binary.BigEndian.Uint32(v)))
+		}
+	}
+	return slice{t.rowsBucket(), t.updatedBucket()}
+}
+
+// setPartition records the partition of the row of key
+func (t *table) setPartition(key string, partition int32) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(partition))
+	if err := t.store.Put(t.keysBucket(), []byte(key), v); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// get returns the row of key
+func (t *table) get(key string) ([]byte, bool) {
+	row, err := t.store.Get(t.sliceOf(key).rows, []byte(key))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return row, row != nil
+}
+
+// each calls fn for each row
+func (t *table) each(fn func(key string, row []byte)) {
+	for _, s := range t.slices() {
+		if err := t.store.Iterate(s.rows, func(k, v []byte) error {
+			fn(string(k), v)
+			return nil
+		}); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// put inserts or replaces a row consumed from partition, rows moving to
+// another partition are removed from their previous one
+func (t *table) put(partition int32, key string, row []byte) {
+	target := t.slice(partition)
+	if s := t.sliceOf(key); s != target {
+		t.delete(s, key)
+		if t.partitioned {
+			t.setPartition(key, partition)
+		}
+	}
+	if err := t.store.Put(target.rows, []byte(key), row); err != nil {
+		log.Fatalln(err)
+	}
+	if t.ranges != nil {
+		t.ranges.put(key, row)
+	}
+	for _, idx := range t.indexes {
+		idx.put(key, row)
+	}
+	if t.ttl > 0 {
+		t.touch(target, key, time.Now())
+	}
+	t.numUpdated++
+}
+
+// touch records the last WAL update of a row, tracked with ttl
+func (t *table) touch(s slice, key string, now time.Time) {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(now.UnixNano()))
+	if err := t.store.Put(s.updated, []byte(key), v); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// delete removes the row of key from the buckets of s if present
+func (t *table) delete(s slice, key string) {
+	if row, err := t.store.Get(s.rows, []byte(key)); err != nil {
+		log.Fatalln(err)
+	} else if row == nil {
+		return
+	}
+	if err := t.store.Delete(s.rows, []byte(key)); err != nil {
+		log.Fatalln(err)
+	}
+	if err := t.store.Delete(s.updated, []byte(key)); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// remove deletes a row
+func (t *table) remove(key string) {
+	t.delete(t.sliceOf(key), key)
+	if t.partitioned {
+		if err := t.store.Delete(t.keysBucket(), []byte(key)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if t.ranges != nil {
+		t.ranges.remove(key)
+	}
+	for _, idx := range t.indexes {
+		idx.remove(key)
+	}
+	t.numRemoved++
+}
+
+// lookup returns the keys of the rows matching the stream key v, rows
+// referenced by a secondary index may share the same value
+func (t *table) lookup(v interface{}) []string {
+	var keys []string
+	if t.ranges != nil {
+		if key, ok := t.ranges.lookup(v); ok {
+			keys = []string{key}
+		}
+	} else if t.index != "" {
+		keys = t.indexes[t.index].lookup(fmt.Sprint(v))
+	} else {
+		keys = []string{fmt.Sprint(v)}
+	}
+
+	found := keys[:0]
+	for _, k := range keys {
+		if _, ok := t.get(k); ok {
+			found = append(found, k)
+		}
+	}
+	return found
+}
+
+// expire removes the rows not updated within ttl
+func (t *table) expire(now time.Time) {
+	if t.ttl <= 0 {
+		return
+	}
+	deadline := now.Add(-t.ttl).UnixNano()
+	for _, s := range t.slices() {
+		if err := t.store.Iterate(s.updated, func(k, v []byte) error {
+			if int64(binary.LittleEndian.Uint64(v)) < deadline {
+				t.remove(string(k))
+			}
+			return nil
+		}); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// load prepares the rows of the table, single table versions stored rows
+// directly in the processor bucket which are moved with legacy set; indexes
+// created after the rows are built
+func (t *table) load(legacy bool) {
+	empty := true
+	t.each(func(string, []byte) { empty = false })
+	if empty && legacy {
+		t.migrate()
+	}
+	if t.partitioned && !empty {
+		t.indexPartitions()
+	}
+
+	if t.ttl > 0 { // rows loaded before ttl was set expire from now
+		now := time.Now()
+		for _, s := range t.slices() {
+			if err := t.store.Iterate(s.rows, func(k, _ []byte) error {
+				if v, err := t.store.Get(s.updated, k); err == nil && v == nil {
+					t.touch(s, string(k), now)
+				}
+				return nil
+			}); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	if t.ranges != nil && !t.ranges.load() {
+		t.each(t.ranges.put)
+	}
+	for _, idx := range t.indexes {
+		if !idx.load() {
+			t.each(idx.put)
+		}
+	}
+}
+
+// indexPartitions records the partition of the rows stored before the keys
+// were mapped to their partition
+func (t *table) indexPartitions() {
+	err := t.store.Iterate(t.keysBucket(), func(k, v []byte) error { return errFound })
+	if err == errFound {
+		return
+	} else if err != nil {
+		log.Fatalln(err)
+	}
+	for _, p := range t.partitions {
+		if err := t.store.Iterate(t.slice(p).rows, func(k, _ []byte) error {
+			t.setPartition(string(k), p)
+			return nil
+		}); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// migrate moves the rows stored in the processor bucket itself
+func (t *table) migrate() {
+	move := func(from, to string) {
+		if err := t.store.Iterate(from, func(k, v []byte) error {
+			if string(k) == offsetStream || string(k) == offsetWAL { // legacy offsets
+				return nil
+			}
+			if err := t.store.Put(to, k, v); err != nil {
+				return err
+			}
+			return t.store.Delete(from, k)
+		}); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	move(processorName, t.rowsBucket())
+	move(updatedAt, t.updatedBucket())
+}
@@ -0,0 +1,161 @@
+// Package kafka configures the connections of the processors to the
+// brokers, e.g. with TLS and SASL authentication; the flags are applied
+// once by Setup and every client, consumer and producer is created with a
+// config of NewConfig.
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Shopify/sarama"
+
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// Flags are the flags of the connections to the brokers
+var Flags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "tls",
+		Usage: "connect to the brokers with TLS",
+	},
+	&cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "PEM file of the certificate authorities verifying the brokers, the system pool if not set",
+	},
+	&cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "PEM file of the client certificate, for brokers authenticating clients by TLS",
+	},
+	&cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "PEM file of the key of the client certificate",
+	},
+	&cli.BoolFlag{
+		Name:  "tls-skip-verify",
+		Usage: "do not verify the certificates of the brokers, for tests only",
+	},
+	&cli.StringFlag{
+		Name:  "sasl-mechanism",
+		Usage: "authenticate to the brokers with SASL, PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, usually along with tls",
+	},
+	&cli.StringFlag{
+		Name:  "sasl-username",
+		Usage: "user name of SASL authentication",
+	},
+	&cli.StringFlag{
+		Name:    "sasl-password",
+		EnvVars: []string{"SASL_PASSWORD"},
+		Usage:   "password of SASL authentication",
+	},
+}
+
+// Options are the options of the connections to the brokers
+type Options struct {
+	TLS           bool
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+	TLSSkipVerify bool
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+var (
+	// tlsConfig of the connections, nil without TLS
+	tlsConfig *tls.Config
+	// sasl are the credentials of the connections, mechanism empty
+	// without SASL
+	sasl struct {
+		mechanism      sarama.SASLMechanism
+		user, password string
+	}
+)
+
+// Setup applies the flags of the connections
+func Setup(c *cli.Context) error {
+	return Configure(Options{
+		TLS:           c.Bool("tls"),
+		TLSCA:         c.String("tls-ca"),
+		TLSCert:       c.String("tls-cert"),
+		TLSKey:        c.String("tls-key"),
+		TLSSkipVerify: c.Bool("tls-skip-verify"),
+		SASLMechanism: c.String("sasl-mechanism"),
+		SASLUsername:  c.String("sasl-username"),
+		SASLPassword:  c.String("sasl-password"),
+	})
+}
+
+// Configure sets the options of the connections created by NewConfig
+func Configure(opts Options) error {
+	switch opts.SASLMechanism {
+	case "":
+		if opts.SASLUsername != "" || opts.SASLPassword != "" {
+			return errors.New("sasl-username and sasl-password require sasl-mechanism")
+		}
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if opts.SASLUsername == "" || opts.SASLPassword == "" {
+			return errors.New("sasl-mechanism requires sasl-username and sasl-password")
+		}
+	default:
+		return fmt.Errorf("unsupported sasl-mechanism: %v", opts.SASLMechanism)
+	}
+	sasl.mechanism = sarama.SASLMechanism(opts.SASLMechanism)
+	sasl.user, sasl.password = opts.SASLUsername, opts.SASLPassword
+
+	if !opts.TLS {
+		if opts.TLSCA != "" || opts.TLSCert != "" || opts.TLSKey != "" || opts.TLSSkipVerify {
+			return errors.New("tls-ca, tls-cert, tls-key and tls-skip-verify require tls")
+		}
+		tlsConfig = nil
+		return nil
+	}
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+
+	config := &tls.Config{InsecureSkipVerify: opts.TLSSkipVerify}
+	if opts.TLSCA != "" {
+		pem, err := ioutil.ReadFile(opts.TLSCA)
+		if err != nil {
+			return fmt.Errorf("tls-ca: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls-ca: no certificate in %v", opts.TLSCA)
+		}
+	}
+	if opts.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return fmt.Errorf("tls-cert: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	tlsConfig = config
+	return nil
+}
+
+// NewConfig returns a sarama config connecting with the options of the
+// flags
+func NewConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	if sasl.mechanism != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sasl.mechanism
+		config.Net.SASL.User = sasl.user
+		config.Net.SASL.Password = sasl.password
+		if sasl.mechanism != sarama.SASLTypePlaintext {
+			config.Net.SASL.SCRAMClientGeneratorFunc = scramGenerator(sasl.mechanism)
+		}
+	}
+	return config
+}
@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// scramClient is the client side of a SCRAM exchange for sarama, on a
+// conversation of xdg-go/scram which prepares the user name and the password
+// with SASLprep
+type scramClient struct {
+	*scram.ClientConversation
+	hash scram.HashGeneratorFcn
+}
+
+// scramGenerator returns the generator of the clients of mechanism
+func scramGenerator(mechanism sarama.SASLMechanism) func() sarama.SCRAMClient {
+	h := scram.SHA256
+	if mechanism == sarama.SASLTypeSCRAMSHA512 {
+		h = scram.SHA512
+	}
+	return func() sarama.SCRAMClient { return &scramClient{hash: h} }
+}
+
+// Begin implements sarama.SCRAMClient, Step and Done are those of the
+// conversation
+func (s *scramClient) Begin(user, pass, authzID string) error {
+	client, err := s.hash.NewClient(user, pass, authzID)
+	if err != nil {
+		return err
+	}
+	s.ClientConversation = client.NewConversation()
+	return nil
+}
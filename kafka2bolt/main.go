@@ -9,6 +9,10 @@ import (
 	"github.com/Shopify/sarama"
 	log "github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
 	cli "gopkg.in/urfave/cli.v2"
 )
 
@@ -17,22 +21,12 @@ const (
 	offsetKey  = "__offset__"
 )
 
-type WAL struct {
-	Type       string          `json:"type"`
-	InstanceId string          `json:"instanceId"`
-	Table      string          `json:"table"`
-	Host       string          `json:"host"`
-	Key        string          `json:"key"`
-	CreatedAt  time.Time       `json:"created_at"`
-	Data       json.RawMessage `json:"data"`
-}
-
 func main() {
 	app := &cli.App{
 		Name:    "kafka2bolt",
 		Usage:   `Store Kafka Topic To BoltDB file`,
 		Version: "0.1",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringSliceFlag{
 				Name:  "brokers, b",
 				Value: cli.NewStringSlice("localhost:9092"),
@@ -68,14 +62,26 @@ func main() {
 				Value: 30 * time.Second,
 				Usage: "longest commit interval to BoltDB",
 			},
-		},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
 		Action: processor,
 	}
 	app.Run(os.Args)
 }
 
 func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
 	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
 	table_topic := c.String("table-topic")
 	table := c.String("table")
 	base := c.String("base")
@@ -84,6 +90,8 @@ func processor(c *cli.Context) error {
 	commit_interval := c.Duration("commit-interval")
 
 	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
 	log.Println("table-topic:", table_topic)
 	log.Println("table:", table)
 	log.Println("base:", base)
@@ -97,7 +105,7 @@ func processor(c *cli.Context) error {
 	}
 	defer db.Close()
 
-	consumer, err := sarama.NewConsumer(brokers, nil)
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -140,14 +148,14 @@ func processor(c *cli.Context) error {
 	for {
 		select {
 		case msg := <-partitionConsumer.Messages():
-			wal := &WAL{}
+			wal := &sp.WAL{}
 			if err := json.Unmarshal(msg.Value, wal); err == nil {
 				if wal.Table == table { // table filter
 					pending[wal.Key] = msg.Value
 					offset = msg.Offset
 				}
 			} else {
-				log.Println(err)
+				log.WithFields(logging.Message(msg)).Println(err)
 			}
 		case <-commitTicker.C:
 			commit(db, pending, offset)
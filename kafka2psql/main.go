@@ -11,6 +11,10 @@ import (
 	postgres "github.com/lib/pq"
 
 	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
 
 	log "github.com/Sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v2"
@@ -18,22 +22,12 @@ import (
 
 var consumerTblName = postgres.QuoteIdentifier("kafka_consumer")
 
-type WAL struct {
-	Type       string          `json:"type"`
-	InstanceId string          `json:"instanceId"`
-	Table      string          `json:"table"`
-	Host       string          `json:"host"`
-	Key        string          `json:"key"`
-	CreatedAt  time.Time       `json:"created_at"`
-	Data       json.RawMessage `json:"data"`
-}
-
 func main() {
 	app := &cli.App{
 		Name:    "kafka2psql",
 		Usage:   `Store Kafka Topic To PostgreSQL Table`,
 		Version: "0.1",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringSliceFlag{
 				Name:  "brokers, b",
 				Value: cli.NewStringSlice("localhost:9092"),
@@ -64,14 +58,26 @@ func main() {
 				Value: time.Second,
 				Usage: "interval for committing pending data to psql",
 			},
-		},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
 		Action: processor,
 	}
 	app.Run(os.Args)
 }
 
 func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
 	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
 	table_topic := c.String("table-topic")
 	table := c.String("table")
 	pq := c.String("pq")
@@ -79,6 +85,8 @@ func processor(c *cli.Context) error {
 	commit_interval := c.Duration("commit-interval")
 
 	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
 	log.Println("table-topic:", table_topic)
 	log.Println("table:", table)
 	log.Println("pq:", pq)
@@ -96,7 +104,7 @@ func processor(c *cli.Context) error {
 	}
 	defer db.Close()
 
-	consumer, err := sarama.NewConsumer(brokers, nil)
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -138,7 +146,7 @@ func processor(c *cli.Context) error {
 	for {
 		select {
 		case msg := <-tableConsumer.Messages():
-			wal := &WAL{}
+			wal := &sp.WAL{}
 			if err := json.Unmarshal(msg.Value, wal); err == nil {
 				if wal.Table == table { // table filter
 					// create new table if necessary
@@ -157,7 +165,7 @@ func processor(c *cli.Context) error {
 					offset = msg.Offset
 				}
 			} else {
-				log.Println(err)
+				log.WithFields(logging.Message(msg)).Println(err)
 			}
 		case <-commitTicker.C:
 			commit(lastTblName, consumerId, db, pending, offset)
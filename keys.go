@@ -0,0 +1,46 @@
+package sp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NewKeyNormalizer creates the normalization applied to table keys and stream
+// keys before matching, options are applied in order:
+// lowercase, trim, numeric (canonical form of numbers, e.g.: "042.0" is "42")
+func NewKeyNormalizer(options []string) (func(string) string, error) {
+	var steps []func(string) string
+	for _, opt := range options {
+		switch strings.TrimSpace(opt) {
+		case "":
+		case "lowercase":
+			steps = append(steps, strings.ToLower)
+		case "trim":
+			steps = append(steps, strings.TrimSpace)
+		case "numeric":
+			steps = append(steps, canonicalNumber)
+		default:
+			return nil, fmt.Errorf("unsupported key-normalize option: %v", opt)
+		}
+	}
+
+	return func(key string) string {
+		for _, step := range steps {
+			key = step(key)
+		}
+		return key
+	}, nil
+}
+
+// canonicalNumber formats numbers without exponent, leading zeros or
+// trailing decimal zeros, other keys are kept as is
+func canonicalNumber(key string) string {
+	if i, err := strconv.ParseInt(key, 10, 64); err == nil {
+		return strconv.FormatInt(i, 10)
+	}
+	if f, err := strconv.ParseFloat(key, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return key
+}
@@ -0,0 +1,64 @@
+// Package logging configures the logs of the processors: the level of the
+// messages logged and their format, text for terminals or json lines for
+// log pipelines; the messages of the stream are located in the logs by the
+// fields topic, partition, offset and key.
+package logging
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// Flags are the flags of the logs
+var Flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "log-level",
+		Value: "info",
+		Usage: "level of the messages logged, debug, info, warn or error; messages of the stream failing are logged at debug",
+	},
+	&cli.StringFlag{
+		Name:  "log-format",
+		Value: "text",
+		Usage: "format of the logs, text or json",
+	},
+}
+
+// Setup applies the flags of the logs
+func Setup(c *cli.Context) error {
+	return Configure(c.String("log-level"), c.String("log-format"))
+}
+
+// Configure sets the level and the format of the logs
+func Configure(level, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log-format: %v", format)
+	}
+	log.SetLevel(lvl)
+	return nil
+}
+
+// Message returns the fields locating a message of a topic
+func Message(msg *sarama.ConsumerMessage) log.Fields {
+	fields := log.Fields{
+		"topic":     msg.Topic,
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+	}
+	if msg.Key != nil {
+		fields["key"] = string(msg.Key)
+	}
+	return fields
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "mapper",
+		Usage: "Transform the messages of a stream with field mappings or a script",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "map",
+				Usage: "set a field to an expression over the json fields of stream messages, e.g.: --map user.name=name --map 'total=price * quantity'",
+			},
+			&cli.StringFlag{
+				Name:  "drop",
+				Value: "",
+				Usage: "comma separated fields to remove after the maps, e.g. the source fields of renames",
+			},
+			&cli.BoolFlag{
+				Name:  "project",
+				Usage: "replace messages by the mapped fields instead of adding them",
+			},
+			&cli.StringFlag{
+				Name:  "script",
+				Value: "",
+				Usage: "javascript file defining function map(msg) returning the transformed message, or null to drop it, instead of map",
+			},
+		},
+		Processor: &mapper{},
+	})
+}
+
+// mapper produces the transformed messages to the output topic
+type mapper struct {
+	transform mapping
+}
+
+func (p *mapper) Setup(ctx *sp.Context) error {
+	maps := ctx.StringSlice("map")
+	var drop []string
+	if d := ctx.String("drop"); d != "" {
+		drop = strings.Split(d, ",")
+	}
+	project := ctx.Bool("project")
+	script := ctx.String("script")
+
+	log.Println("map:", maps)
+	log.Println("drop:", drop)
+	log.Println("project:", project)
+	log.Println("script:", script)
+
+	ctx.Count("mapped", 0)
+	ctx.Count("dropped", 0)
+	ctx.Count("invalid", 0)
+	if script != "" {
+		if len(maps) > 0 || len(drop) > 0 {
+			return errors.New("script can't be combined with map or drop")
+		}
+		src, err := ioutil.ReadFile(script)
+		if err != nil {
+			return err
+		}
+		p.transform, err = newScriptMapping(script, string(src))
+		return err
+	}
+	if len(maps) == 0 && len(drop) == 0 {
+		return errors.New("map, drop or script must be set")
+	}
+	var err error
+	p.transform, err = newFieldMapping(maps, drop, project)
+	return err
+}
+
+func (p *mapper) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	value, err := ctx.Decoder.Decode(msg.Value)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return err
+	}
+	mapped, err := p.transform(v)
+	if err != nil {
+		return err
+	}
+	if mapped == nil {
+		ctx.Count("dropped", 1)
+		return nil
+	}
+	bts, err := json.Marshal(mapped)
+	if err != nil {
+		return err
+	}
+	ctx.SendFrom(msg, ctx.OutputTopic, msg.Key, bts)
+	ctx.Count("mapped", 1)
+	return nil
+}
+
+func (p *mapper) Checkpoint(ctx *sp.Context) error { return nil }
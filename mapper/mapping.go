@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/xtaci/sp/expr"
+)
+
+// mapping transforms a decoded json message, nil drops the message
+type mapping func(msg interface{}) (interface{}, error)
+
+// field is a declarative mapping of a field to the value of an expression
+type field struct {
+	path []string
+	expr *expr.Expr
+}
+
+// newFieldMapping creates the mapping of the map and drop flags, maps are
+// like path=expression where expressions are evaluated on the incoming
+// message, so that maps don't see each other; fields of drop are removed
+// after the maps; with project the message is replaced by the mapped fields
+//
+//	--map user.name=name --drop name        renames name to user.name
+//	--map total='price * quantity'          adds a computed field
+func newFieldMapping(maps, drop []string, project bool) (mapping, error) {
+	var fields []field
+	for _, m := range maps {
+		i := strings.IndexByte(m, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("map %q: expect path=expression", m)
+		}
+		e, err := expr.Compile(m[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("map %q: %v", m, err)
+		}
+		fields = append(fields, field{strings.Split(strings.TrimSpace(m[:i]), "."), e})
+	}
+
+	return func(msg interface{}) (interface{}, error) {
+		env, ok := msg.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("message is not a json object")
+		}
+		values := make([]interface{}, len(fields))
+		for i, f := range fields {
+			v, err := f.expr.Eval(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+
+		out := env
+		if project {
+			out = make(map[string]interface{})
+		}
+		for i, f := range fields {
+			setPath(out, f.path, values[i])
+		}
+		for _, d := range drop {
+			deletePath(out, strings.Split(d, "."))
+		}
+		return out, nil
+	}, nil
+}
+
+// newScriptMapping creates the mapping of a javascript program defining a
+// function map(msg) which returns the transformed message, null or
+// undefined to drop it, e.g.:
+//
+//	function map(msg) {
+//	    if (msg.status == "debug") return null;
+//	    msg.latency_s = msg.latency_ms / 1000;
+//	    delete msg.latency_ms;
+//	    return msg;
+//	}
+//
+// the runtime isn't safe for concurrent use, calls of the mapping are
+// serialized
+func newScriptMapping(name, src string) (mapping, error) {
+	vm := goja.New()
+	if _, err := vm.RunScript(name, src); err != nil {
+		return nil, err
+	}
+	fn, ok := goja.AssertFunction(vm.Get("map"))
+	if !ok {
+		return nil, fmt.Errorf("%v: function map(msg) not defined", name)
+	}
+
+	var mu sync.Mutex
+	return func(msg interface{}) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		v, err := fn(goja.Undefined(), vm.ToValue(msg))
+		if err != nil {
+			return nil, err
+		}
+		if goja.IsUndefined(v) || goja.IsNull(v) {
+			return nil, nil
+		}
+		return v.Export(), nil
+	}, nil
+}
+
+// setPath sets v in nested objects along path
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[seg] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
+
+// deletePath removes the field at path from nested objects
+func deletePath(obj map[string]interface{}, path []string) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			return
+		}
+		obj = child
+	}
+	delete(obj, path[len(path)-1])
+}
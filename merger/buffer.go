@@ -0,0 +1,83 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// record is a message held for reordering
+type record struct {
+	msg       *sarama.ConsumerMessage
+	value     []byte // output value
+	eventTime time.Time
+	seq       uint64 // arrival order, breaks ties of event time
+}
+
+// partition identifies a partition of an input topic
+type partition struct {
+	topic     string
+	partition int32
+}
+
+// reorderBuffer holds messages up to delay after the greatest event time
+// seen and releases them in event time order, messages later than delay may
+// still be released out of order
+type reorderBuffer struct {
+	records   recordHeap
+	delay     time.Duration
+	watermark time.Time
+	seq       uint64
+}
+
+// push adds a record and returns the records released
+func (b *reorderBuffer) push(r *record) []*record {
+	if r.eventTime.After(b.watermark) {
+		b.watermark = r.eventTime
+	}
+	r.seq = b.seq
+	b.seq++
+	heap.Push(&b.records, r)
+
+	var released []*record
+	deadline := b.watermark.Add(-b.delay)
+	for len(b.records) > 0 && !b.records[0].eventTime.After(deadline) {
+		released = append(released, heap.Pop(&b.records).(*record))
+	}
+	return released
+}
+
+// pending returns the least offset held of each partition, offsets of
+// partitions with held messages must not be committed past them
+func (b *reorderBuffer) pending() map[partition]int64 {
+	least := make(map[partition]int64)
+	for _, r := range b.records {
+		p := partition{r.msg.Topic, r.msg.Partition}
+		if o, ok := least[p]; !ok || r.msg.Offset < o {
+			least[p] = r.msg.Offset
+		}
+	}
+	return least
+}
+
+func (b *reorderBuffer) len() int { return len(b.records) }
+
+// recordHeap is a min-heap of records by event time
+type recordHeap []*record
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if !h[i].eventTime.Equal(h[j].eventTime) {
+		return h[i].eventTime.Before(h[j].eventTime)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h recordHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(*record)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
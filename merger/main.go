@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	processorName = "merger"
+)
+
+// offsetBucket is the bucket of the offsets of an input topic
+func offsetBucket(topic string) string {
+	return fmt.Sprintf("__offset_%v__", topic)
+}
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Merge the messages of multiple topics into a single topic",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringSliceFlag{
+				Name:  "input-topic",
+				Usage: "topic names to merge, e.g.: --input-topic clicks --input-topic views",
+			},
+			&cli.StringFlag{
+				Name:  "tag-field",
+				Value: "",
+				Usage: "set the json field to the source topic of each message, messages are forwarded as is if not set",
+			},
+			&cli.DurationFlag{
+				Name:  "reorder",
+				Usage: "hold messages up to this delay after the greatest event time seen to emit them in event time order, 0 emits them as consumed",
+			},
+			&cli.StringFlag{
+				Name:  "time-field",
+				Value: "",
+				Usage: "json field of the event time to reorder by, RFC3339 or unix milliseconds, the kafka timestamp if not set",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: merger-{input-topics joined by -}",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	input_topics := c.StringSlice("input-topic")
+	tag_field := c.String("tag-field")
+	reorder := c.Duration("reorder")
+	time_field := c.String("time-field")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("merger-%v", strings.Join(input_topics, "-"))
+	}
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("input-topic:", input_topics)
+	log.Println("tag-field:", tag_field)
+	log.Println("reorder:", reorder)
+	log.Println("time-field:", time_field)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".merger-%v.cache", output_topic)
+	log.Println("cache file:", cachefile)
+
+	if len(input_topics) == 0 {
+		log.Fatalln("input-topic must be set")
+	}
+	if reorder < 0 {
+		log.Fatalln("reorder must not be negative")
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, offsets are only committed after all messages
+	// forwarded before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the inputs are reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state, and merge the messages of all input topics
+	inputOffsets := make(map[string]sp.Offsets)
+	inputMessages := make(chan *sarama.ConsumerMessage)
+	for _, topic := range input_topics {
+		offs := make(sp.Offsets)
+		if err := offs.Load(store, offsetBucket(topic)); err != nil {
+			log.Fatalln(err)
+		}
+		inputOffsets[topic] = offs
+		log.Printf("consuming from %v offsets:%v", topic, offs)
+
+		messages, consumers, err := sp.ConsumeAll(consumer, topic, offs, sarama.OffsetNewest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer func() {
+			for _, pc := range consumers {
+				if err := pc.Close(); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}()
+		go func() {
+			for msg := range messages {
+				inputMessages <- msg
+			}
+		}()
+	}
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numMerged, numInvalid := 0, 0
+	buffer := &reorderBuffer{delay: reorder}
+
+	forward := func(msg *sarama.ConsumerMessage, value []byte) {
+		out := &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(value)}
+		if msg.Key != nil {
+			out.Key = sarama.ByteEncoder(msg.Key)
+		}
+		inflight.Add(1)
+		producer.Input() <- out
+		numMerged++
+	}
+
+	merge := func(msg *sarama.ConsumerMessage) {
+		value := msg.Value
+		eventTime := msg.Timestamp
+		if tag_field != "" || (reorder > 0 && time_field != "") {
+			jsonParsed, err := gabs.ParseJSON(msg.Value)
+			if err != nil {
+				numInvalid++
+				return
+			}
+			if reorder > 0 && time_field != "" {
+				if ts, ok := parseTime(jsonParsed.Path(time_field).Data()); ok {
+					eventTime = ts
+				}
+			}
+			if tag_field != "" {
+				fields, ok := jsonParsed.Data().(map[string]interface{})
+				if !ok {
+					numInvalid++
+					return
+				}
+				setPath(fields, strings.Split(tag_field, "."), msg.Topic)
+				if value, err = json.Marshal(fields); err != nil {
+					numInvalid++
+					return
+				}
+			}
+		}
+
+		if reorder == 0 {
+			forward(msg, value)
+			return
+		}
+		for _, r := range buffer.push(&record{msg: msg, value: value, eventTime: eventTime}) {
+			forward(r.msg, r.value)
+		}
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		// messages held for reordering are consumed again after a restart
+		held := buffer.pending()
+		for topic, offs := range inputOffsets {
+			commit := make(sp.Offsets)
+			for p, offset := range offs {
+				if o, ok := held[partition{topic, p}]; ok {
+					offset = o
+				}
+				commit[p] = offset
+			}
+			if err := commit.Store(store, offsetBucket(topic)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("merged:", numMerged, "invalid:", numInvalid, "held:", buffer.len(), "offsets:", inputOffsets)
+		numMerged, numInvalid = 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-inputMessages:
+			inputOffsets[msg.Topic][msg.Partition] = msg.Offset + 1
+			merge(msg)
+		}
+	}
+}
+
+// parseTime converts RFC3339 strings and unix milliseconds
+func parseTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Millisecond))), true
+	case string:
+		ts, err := time.Parse(time.RFC3339Nano, v)
+		return ts, err == nil
+	}
+	return time.Time{}, false
+}
+
+// setPath sets v in nested objects along path
+func setPath(obj map[string]interface{}, path []string, v interface{}) {
+	for _, seg := range path[:len(path)-1] {
+		child, ok := obj[seg].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[seg] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "mqtt-sink"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Publish the messages of a stream to mqtt topics rendered from their fields, e.g. commands to devices",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "commands",
+				Usage: "topic name of the stream to publish",
+			},
+			&cli.StringFlag{
+				Name:  "mqtt",
+				Value: "tcp://localhost:1883",
+				Usage: "mqtt broker, tcp://, ssl:// or ws://",
+			},
+			&cli.StringFlag{
+				Name:  "client-id",
+				Value: processorName,
+				Usage: "mqtt client id",
+			},
+			&cli.StringFlag{
+				Name:  "username",
+				Usage: "mqtt username",
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				EnvVars: []string{"MQTT_PASSWORD"},
+				Usage:   "mqtt password",
+			},
+			&cli.StringFlag{
+				Name:  "topic",
+				Value: "",
+				Usage: "template of the mqtt topic of messages executed on their fields, e.g.: devices/{{.device}}/commands",
+			},
+			&cli.IntFlag{
+				Name:  "qos",
+				Value: 1,
+				Usage: "qos of publications, 0: at most once, 1: at least once, 2: exactly once from this sink; offsets are committed after the broker acknowledged the messages of qos 1 and 2",
+			},
+			&cli.BoolFlag{
+				Name:  "retained",
+				Usage: "publish retained messages, the last message of a topic is sent to new subscribers",
+			},
+			&cli.IntFlag{
+				Name:  "max-inflight",
+				Value: 1000,
+				Usage: "max publications waiting for acknowledgment",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: 30 * time.Second,
+				Usage: "timeout of acknowledgments",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	mqtt_broker := c.String("mqtt")
+	client_id := c.String("client-id")
+	username := c.String("username")
+	password := c.String("password")
+	topic := c.String("topic")
+	qos := c.Int("qos")
+	retained := c.Bool("retained")
+	max_inflight := c.Int("max-inflight")
+	timeout := c.Duration("timeout")
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("mqtt:", mqtt_broker)
+	log.Println("client-id:", client_id)
+	log.Println("username:", username)
+	log.Println("topic:", topic)
+	log.Println("qos:", qos)
+	log.Println("retained:", retained)
+	log.Println("max-inflight:", max_inflight)
+	log.Println("timeout:", timeout)
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".mqtt-sink-%v-%v.cache", stream_topic, client_id)
+	log.Println("cache file:", cachefile)
+
+	if topic == "" {
+		log.Fatalln("topic must be set")
+	}
+	if qos < 0 || qos > 2 {
+		log.Fatalln("qos must be 0, 1 or 2")
+	}
+	if max_inflight <= 0 {
+		log.Fatalln("max-inflight must be positive")
+	}
+	tmpl, err := sp.NewTemplate("topic", topic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqtt_broker).
+		SetClientID(client_id).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("connection lost:", err)
+		})
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalln(token.Error())
+	}
+	defer client.Disconnect(uint(time.Second / time.Millisecond))
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numPublished, numInvalid := 0, 0
+
+	// publications waiting for acknowledgment, offsets are only committed
+	// after all messages consumed before have been acknowledged
+	var pending []mqtt.Token
+	wait := func(tokens []mqtt.Token) {
+		for _, token := range tokens {
+			if !token.WaitTimeout(timeout) {
+				// exit without commit, the stream is published again from last checkpoint
+				log.Fatalln("publish: no acknowledgment in", timeout)
+			}
+			if err := token.Error(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	publish := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(value, &fields); err != nil {
+			numInvalid++
+			return
+		}
+		t, err := sp.Render(tmpl, fields)
+		if err != nil || t == "" {
+			numInvalid++
+			return
+		}
+		// wildcards are not allowed in the topics of publications
+		t = strings.NewReplacer("+", "_", "#", "_").Replace(t)
+		pending = append(pending, client.Publish(t, byte(qos), retained, value))
+		numPublished++
+		if len(pending) >= max_inflight {
+			wait(pending[:max_inflight/2])
+			pending = append(pending[:0], pending[max_inflight/2:]...)
+		}
+	}
+
+	checkpoint := func() {
+		wait(pending)
+		pending = pending[:0]
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("published:", numPublished, "invalid:", numInvalid, "stream offsets:", streamOffsets)
+		numPublished, numInvalid = 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			publish(msg)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const processorName = "mqtt-source"
+
+// envelope is the message of the json format
+type envelope struct {
+	Topic      string          `json:"topic"`
+	Payload    json.RawMessage `json:"payload"` // the payload as a json string if not json
+	QoS        byte            `json:"qos"`
+	Retained   bool            `json:"retained"`
+	ReceivedAt time.Time       `json:"received_at"`
+}
+
+// topicData is the data of the template of kafka topics, e.g. for the mqtt
+// topic sensors/kitchen/temperature: .Topic, .Levels 0 is sensors
+type topicData struct {
+	Topic  string
+	Levels []string
+}
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Subscribe to mqtt topics and publish the messages to kafka topics named after them, keyed by mqtt topic; messages of qos 1 and 2 are acknowledged to the mqtt broker once written to kafka",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "mqtt",
+				Value: "tcp://localhost:1883",
+				Usage: "mqtt broker, tcp://, ssl:// or ws://",
+			},
+			&cli.StringFlag{
+				Name:  "client-id",
+				Value: processorName,
+				Usage: "mqtt client id, the broker keeps the session of the client id between connections",
+			},
+			&cli.StringFlag{
+				Name:  "username",
+				Usage: "mqtt username",
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				EnvVars: []string{"MQTT_PASSWORD"},
+				Usage:   "mqtt password",
+			},
+			&cli.BoolFlag{
+				Name:  "clean-session",
+				Usage: "start a new session on connection, messages of qos 1 and 2 received while disconnected are lost",
+			},
+			&cli.StringSliceFlag{
+				Name:  "topic",
+				Usage: "mqtt topic filter to subscribe to, with wildcards + and #, e.g. sensors/+/temperature, repeatable",
+			},
+			&cli.IntFlag{
+				Name:  "qos",
+				Value: 1,
+				Usage: "qos of subscriptions, 0: at most once, 1: at least once, 2: exactly once to this source",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "mqtt",
+				Usage: "template of the kafka topic of messages on the mqtt topic .Topic and its .Levels, e.g.: iot.{{index .Levels 1}}; '/' become '.'",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "raw",
+				Usage: "format of messages, raw for the payloads, or json for objects of topic, payload, qos, retained and received_at",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval of the logs of counters",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	mqtt_broker := c.String("mqtt")
+	client_id := c.String("client-id")
+	username := c.String("username")
+	password := c.String("password")
+	clean_session := c.Bool("clean-session")
+	topics := c.StringSlice("topic")
+	qos := c.Int("qos")
+	output_topic := c.String("output-topic")
+	format := c.String("format")
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("mqtt:", mqtt_broker)
+	log.Println("client-id:", client_id)
+	log.Println("username:", username)
+	log.Println("clean-session:", clean_session)
+	log.Println("topic:", topics)
+	log.Println("qos:", qos)
+	log.Println("output-topic:", output_topic)
+	log.Println("format:", format)
+	log.Println("write-interval:", write_interval)
+
+	if len(topics) == 0 {
+		log.Fatalln("no topic")
+	}
+	if qos < 0 || qos > 2 {
+		log.Fatalln("qos must be 0, 1 or 2")
+	}
+	if format != "raw" && format != "json" {
+		log.Fatalln("unsupported format", format)
+	}
+	tmpl, err := sp.NewTemplate("topic", output_topic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	kconfig := kafka.NewConfig()
+	kconfig.Producer.RequiredAcks = sarama.WaitForAll
+	kconfig.Producer.Return.Successes = true
+	kconfig.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, kconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// counters are updated by the handler and the producer
+	var numReceived, numProduced, numInvalid int64
+
+	// messages are acknowledged to the mqtt broker once written, unacknowledged
+	// ones are delivered again by the broker in the session on reconnection
+	go func() {
+		for msg := range producer.Successes() {
+			msg.Metadata.(mqtt.Message).Ack()
+			atomic.AddInt64(&numProduced, 1)
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			log.Fatalln(err)
+		}
+	}()
+
+	// handle is called in the order of messages
+	handle := func(_ mqtt.Client, m mqtt.Message) {
+		atomic.AddInt64(&numReceived, 1)
+		// levels are separated by '.' in kafka topics
+		name, err := sp.Render(tmpl, topicData{Topic: m.Topic(), Levels: strings.Split(m.Topic(), "/")})
+		topic := sp.TopicName(strings.Replace(name, "/", ".", -1))
+		if err != nil || topic == "" {
+			log.Println(m.Topic(), err)
+			atomic.AddInt64(&numInvalid, 1)
+			m.Ack()
+			return
+		}
+		value := m.Payload()
+		if format == "json" {
+			payload := json.RawMessage(value)
+			if !json.Valid(value) {
+				payload, _ = json.Marshal(string(value))
+			}
+			if value, err = json.Marshal(envelope{Topic: m.Topic(), Payload: payload, QoS: m.Qos(), Retained: m.Retained(), ReceivedAt: time.Now()}); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		producer.Input() <- &sarama.ProducerMessage{Topic: topic, Key: sarama.StringEncoder(m.Topic()), Value: sarama.ByteEncoder(value), Metadata: m}
+	}
+
+	filters := make(map[string]byte)
+	for _, t := range topics {
+		filters[t] = byte(qos)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqtt_broker).
+		SetClientID(client_id).
+		SetUsername(username).
+		SetPassword(password).
+		SetCleanSession(clean_session).
+		SetOrderMatters(true).
+		SetAutoAckDisabled(true).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("connection lost:", err)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// subscribe on each connection, sessions may not have been kept
+			log.Println("connected:", mqtt_broker)
+			if token := client.SubscribeMultiple(filters, handle); token.Wait() && token.Error() != nil {
+				log.Fatalln(token.Error())
+			}
+		})
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalln(token.Error())
+	}
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Println("received:", atomic.SwapInt64(&numReceived, 0), "produced:", atomic.SwapInt64(&numProduced, 0), "invalid:", atomic.SwapInt64(&numInvalid, 0))
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			client.Disconnect(uint(time.Second / time.Millisecond))
+			if err := producer.Close(); err != nil {
+				log.Fatalln(err)
+			}
+			return nil
+		}
+	}
+}
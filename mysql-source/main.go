@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	driver "github.com/go-sql-driver/mysql"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	metaBucket    = "__meta__"
+	positionKey   = "position"
+	processorName = "mysql-source"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Tail the binlog of mysql and publish row changes in the WAL format of the joiner, deletes are WAL messages of type DELETE, applied by the joiner with: --tombstone-field type --tombstone-value DELETE",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "host",
+				Value: "127.0.0.1:3306",
+				Usage: "mysql server address",
+			},
+			&cli.StringFlag{
+				Name:  "user",
+				Value: "root",
+				Usage: "mysql user, with REPLICATION SLAVE, REPLICATION CLIENT and SELECT privileges",
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				EnvVars: []string{"MYSQL_PASSWORD"},
+				Usage:   "mysql password",
+			},
+			&cli.UintFlag{
+				Name:  "server-id",
+				Value: 1001,
+				Usage: "replica server id, unique among the replicas of the server",
+			},
+			&cli.StringFlag{
+				Name:  "flavor",
+				Value: "mysql",
+				Usage: "mysql or mariadb",
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "database.table of the tables to publish, with shell patterns, e.g.: shop.*, all tables if not set",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "database.table of tables not to publish, with shell patterns",
+			},
+			&cli.BoolFlag{
+				Name:  "qualified",
+				Usage: "name tables database.table in WAL messages instead of table",
+			},
+			&cli.StringFlag{
+				Name:  "binlog-file",
+				Value: "",
+				Usage: "binlog file to start from on first run, the current position of the server if not set",
+			},
+			&cli.UintFlag{
+				Name:  "binlog-pos",
+				Value: 4,
+				Usage: "position in binlog-file to start from",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "WAL",
+				Usage: "topic to publish the WAL messages of row changes to",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of the binlog position, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	host := c.String("host")
+	user := c.String("user")
+	password := c.String("password")
+	server_id := c.Uint("server-id")
+	flavor := c.String("flavor")
+	includes := c.StringSlice("include")
+	excludes := c.StringSlice("exclude")
+	qualified := c.Bool("qualified")
+	binlog_file := c.String("binlog-file")
+	binlog_pos := c.Uint("binlog-pos")
+	output_topic := c.String("output-topic")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("host:", host)
+	log.Println("user:", user)
+	log.Println("server-id:", server_id)
+	log.Println("flavor:", flavor)
+	log.Println("include:", includes)
+	log.Println("exclude:", excludes)
+	log.Println("qualified:", qualified)
+	log.Println("binlog-file:", binlog_file)
+	log.Println("binlog-pos:", binlog_pos)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".mysql-source-%v-%v.cache", host, server_id)
+	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	log.Println("cache file:", cachefile)
+	log.Println("instanceId:", instanceId)
+
+	for _, pattern := range append(includes, excludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("pattern %q: %v", pattern, err)
+		}
+	}
+	// match reports whether the changes of a table are published
+	match := func(name string) bool {
+		for _, pattern := range excludes {
+			if ok, _ := path.Match(pattern, name); ok {
+				return false
+			}
+		}
+		if len(includes) == 0 {
+			return true
+		}
+		for _, pattern := range includes {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	addr, port, err := net.SplitHostPort(host)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	port_number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		log.Fatalln("port:", err)
+	}
+
+	dsn := driver.NewConfig()
+	dsn.User, dsn.Passwd, dsn.Net, dsn.Addr = user, password, "tcp", host
+	db, err := sql.Open("mysql", dsn.FormatDSN())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.Fatalln(err)
+	}
+	tables := newSchemas(db)
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	// read state
+	var position mysql.Position
+	if v, err := store.Get(metaBucket, []byte(positionKey)); err != nil {
+		log.Fatalln(err)
+	} else if v != nil {
+		if err := json.Unmarshal(v, &position); err != nil {
+			log.Fatalln(err)
+		}
+	} else if binlog_file != "" {
+		position = mysql.Position{Name: binlog_file, Pos: uint32(binlog_pos)}
+	} else if position, err = masterPosition(db); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("starting from binlog position:", position)
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, the binlog position is only committed after all
+	// changes before it have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the binlog is replayed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+	defer func() {
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID: uint32(server_id),
+		Flavor:   flavor,
+		Host:     addr,
+		Port:     uint16(port_number),
+		User:     user,
+		Password: password,
+	})
+	defer syncer.Close()
+	streamer, err := syncer.StartSync(position)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *replication.BinlogEvent)
+	go func() {
+		for {
+			ev, err := streamer.GetEvent(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Fatalln(err)
+			}
+			events <- ev
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	hostname, _ := os.Hostname()
+	// committed is the position after the last complete transaction
+	committed := position
+	numInserted, numUpdated, numDeleted, numSkipped := 0, 0, 0, 0
+
+	emit := func(typ, table, key string, data map[string]interface{}, ts time.Time) {
+		bts, err := json.Marshal(data)
+		if err != nil {
+			log.Println(err)
+			numSkipped++
+			return
+		}
+		wal := &sp.WAL{
+			Type:       typ,
+			InstanceId: instanceId,
+			Table:      table,
+			Host:       hostname,
+			Key:        key,
+			CreatedAt:  ts,
+			Data:       bts,
+		}
+		if bts, err = json.Marshal(wal); err != nil {
+			log.Println(err)
+			numSkipped++
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Key: sarama.StringEncoder(key), Value: sarama.ByteEncoder(bts)}
+	}
+
+	// publish emits the rows of a rows event, the after image of updates;
+	// updates changing the primary key delete the row of the old key
+	publish := func(ev *replication.BinlogEvent, e *replication.RowsEvent) {
+		name := string(e.Table.Schema) + "." + string(e.Table.Table)
+		if !match(name) {
+			return
+		}
+		table := string(e.Table.Table)
+		if qualified {
+			table = name
+		}
+		schema, err := tables.get(e.Table)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ts := time.Unix(int64(ev.Header.Timestamp), 0)
+
+		switch e.Type() {
+		case replication.EnumRowsEventTypeInsert:
+			for _, values := range e.Rows {
+				data, key, err := schema.row(e.Table, values)
+				if err != nil {
+					log.Println(err)
+					numSkipped++
+					continue
+				}
+				emit("INSERT", table, key, data, ts)
+				numInserted++
+			}
+		case replication.EnumRowsEventTypeUpdate:
+			for i := 0; i+1 < len(e.Rows); i += 2 { // before and after images
+				_, before, err := schema.row(e.Table, e.Rows[i])
+				if err != nil {
+					log.Println(err)
+					numSkipped++
+					continue
+				}
+				data, key, err := schema.row(e.Table, e.Rows[i+1])
+				if err != nil {
+					log.Println(err)
+					numSkipped++
+					continue
+				}
+				if before != key {
+					old, _, _ := schema.row(e.Table, e.Rows[i])
+					emit("DELETE", table, before, old, ts)
+					numDeleted++
+				}
+				emit("UPDATE", table, key, data, ts)
+				numUpdated++
+			}
+		case replication.EnumRowsEventTypeDelete:
+			for _, values := range e.Rows {
+				data, key, err := schema.row(e.Table, values)
+				if err != nil {
+					log.Println(err)
+					numSkipped++
+					continue
+				}
+				emit("DELETE", table, key, data, ts)
+				numDeleted++
+			}
+		}
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		bts, err := json.Marshal(committed)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Put(metaBucket, []byte(positionKey), bts); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("inserted:", numInserted, "updated:", numUpdated, "deleted:", numDeleted, "skipped:", numSkipped, "binlog position:", committed)
+		numInserted, numUpdated, numDeleted, numSkipped = 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			cancel()
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case ev := <-events:
+			switch e := ev.Event.(type) {
+			case *replication.RotateEvent:
+				position = mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)}
+				committed = position
+			case *replication.RowsEvent:
+				publish(ev, e)
+			case *replication.XIDEvent:
+				committed = mysql.Position{Name: position.Name, Pos: ev.Header.LogPos}
+			case *replication.QueryEvent:
+				// statements but BEGIN end a transaction, ddl changes schemas
+				switch strings.ToUpper(strings.TrimSpace(string(e.Query))) {
+				case "BEGIN":
+				case "COMMIT":
+					committed = mysql.Position{Name: position.Name, Pos: ev.Header.LogPos}
+				default:
+					tables.invalidate()
+					committed = mysql.Position{Name: position.Name, Pos: ev.Header.LogPos}
+				}
+			}
+		}
+	}
+}
+
+// masterPosition returns the current binlog position of the server
+func masterPosition(db *sql.DB) (mysql.Position, error) {
+	rows, err := db.Query("SHOW BINARY LOG STATUS")
+	if err != nil { // before mysql 8.4 and mariadb
+		if rows, err = db.Query("SHOW MASTER STATUS"); err != nil {
+			return mysql.Position{}, err
+		}
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return mysql.Position{}, err
+	}
+	if !rows.Next() {
+		return mysql.Position{}, fmt.Errorf("binary log is disabled")
+	}
+	var pos mysql.Position
+	values := make([]interface{}, len(columns))
+	values[0], values[1] = &pos.Name, &pos.Pos
+	for i := 2; i < len(values); i++ {
+		values[i] = new(sql.RawBytes)
+	}
+	if err := rows.Scan(values...); err != nil {
+		return mysql.Position{}, err
+	}
+	return pos, nil
+}
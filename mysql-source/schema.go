@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// column of a table, unsigned integers are decoded as signed by the binlog
+type column struct {
+	name     string
+	unsigned bool
+}
+
+// tableSchema is the columns of a table in the order of the binlog rows
+// and the indexes of the columns of its primary key
+type tableSchema struct {
+	columns []column
+	pk      []int
+}
+
+// schemas resolves the columns of the tables of row events, from the
+// metadata of the events with binlog_row_metadata=FULL, otherwise from the
+// information schema, cached until the next DDL statement
+type schemas struct {
+	db     *sql.DB
+	tables map[string]*tableSchema
+}
+
+func newSchemas(db *sql.DB) *schemas {
+	return &schemas{db: db, tables: make(map[string]*tableSchema)}
+}
+
+// get returns the schema of the table of e
+func (s *schemas) get(e *replication.TableMapEvent) (*tableSchema, error) {
+	if len(e.ColumnName) > 0 && len(e.PrimaryKey) > 0 {
+		return eventSchema(e), nil
+	}
+	name := string(e.Schema) + "." + string(e.Table)
+	if t, ok := s.tables[name]; ok {
+		return t, nil
+	}
+	t, err := s.query(string(e.Schema), string(e.Table))
+	if err != nil {
+		return nil, fmt.Errorf("schema of %v: %v", name, err)
+	}
+	s.tables[name] = t
+	return t, nil
+}
+
+// invalidate forgets the schemas queried, on DDL statements
+func (s *schemas) invalidate() {
+	s.tables = make(map[string]*tableSchema)
+}
+
+func eventSchema(e *replication.TableMapEvent) *tableSchema {
+	unsigned := e.UnsignedMap()
+	t := &tableSchema{}
+	for i, name := range e.ColumnNameString() {
+		t.columns = append(t.columns, column{name, unsigned[i]})
+	}
+	for _, i := range e.PrimaryKey {
+		t.pk = append(t.pk, int(i))
+	}
+	return t
+}
+
+func (s *schemas) query(schema, table string) (*tableSchema, error) {
+	rows, err := s.db.Query(`SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	t := &tableSchema{}
+	index := make(map[string]int)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		index[name] = len(t.columns)
+		t.columns = append(t.columns, column{name, strings.Contains(typ, "unsigned")})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.columns) == 0 {
+		return nil, fmt.Errorf("table not found")
+	}
+
+	pk, err := s.db.Query(`SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' ORDER BY ORDINAL_POSITION`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer pk.Close()
+	for pk.Next() {
+		var name string
+		if err := pk.Scan(&name); err != nil {
+			return nil, err
+		}
+		t.pk = append(t.pk, index[name])
+	}
+	return t, pk.Err()
+}
+
+// row converts the values of a binlog row to the json object of the row
+// data, and its key: the values of the primary key joined with ","
+func (t *tableSchema) row(e *replication.TableMapEvent, values []interface{}) (map[string]interface{}, string, error) {
+	if len(values) > len(t.columns) {
+		return nil, "", fmt.Errorf("%s.%s: %v values for %v columns, schema changed", e.Schema, e.Table, len(values), len(t.columns))
+	}
+	data := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		c := t.columns[i]
+		switch x := v.(type) {
+		case []byte:
+			if e.ColumnType[i] == mysql.MYSQL_TYPE_JSON && json.Valid(x) {
+				v = json.RawMessage(x)
+			} else {
+				v = string(x)
+			}
+		case *replication.JsonDiff:
+			v = x.String()
+		case int8:
+			if c.unsigned {
+				v = uint8(x)
+			}
+		case int16:
+			if c.unsigned {
+				v = uint16(x)
+			}
+		case int32:
+			if c.unsigned {
+				if e.ColumnType[i] == mysql.MYSQL_TYPE_INT24 {
+					v = uint32(x) & 0xffffff
+				} else {
+					v = uint32(x)
+				}
+			}
+		case int64:
+			if c.unsigned {
+				v = uint64(x)
+			}
+		}
+		data[c.name] = v
+	}
+
+	if len(t.pk) == 0 {
+		return nil, "", fmt.Errorf("%s.%s: no primary key", e.Schema, e.Table)
+	}
+	keys := make([]string, len(t.pk))
+	for i, idx := range t.pk {
+		if idx >= len(values) {
+			return nil, "", fmt.Errorf("%s.%s: primary key not in binlog row, set binlog_row_image=FULL", e.Schema, e.Table)
+		}
+		keys[i] = fmt.Sprint(data[t.columns[idx].name])
+	}
+	return data, strings.Join(keys, ","), nil
+}
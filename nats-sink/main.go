@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nats-io/nats.go"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/natsconn"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "nats-sink"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Publish the messages of a stream to jetstream subjects rendered from their fields, with the message ids of their offsets deduplicated by jetstream",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to publish",
+			},
+			&cli.StringFlag{
+				Name:  "subject",
+				Value: "",
+				Usage: "template of the subject of messages executed on their fields, e.g.: orders.{{.region}}.created; the subjects must belong to a stream",
+			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Value: true,
+				Usage: "set the message ids to topic-partition-offset, jetstream drops the messages published again after a restart within the duplicate window of the stream",
+			},
+			&cli.IntFlag{
+				Name:  "max-inflight",
+				Value: 1000,
+				Usage: "max publications waiting for acknowledgment",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: 30 * time.Second,
+				Usage: "timeout of acknowledgments",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(append(natsconn.Flags, state.Flags...), logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	nats_url := c.String("nats")
+	subject := c.String("subject")
+	dedup := c.Bool("dedup")
+	max_inflight := c.Int("max-inflight")
+	timeout := c.Duration("timeout")
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("nats:", nats_url)
+	log.Println("subject:", subject)
+	log.Println("dedup:", dedup)
+	log.Println("max-inflight:", max_inflight)
+	log.Println("timeout:", timeout)
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".nats-sink-%v-%x.cache", stream_topic, subject)
+	log.Println("cache file:", cachefile)
+
+	if subject == "" {
+		log.Fatalln("subject must be set")
+	}
+	if max_inflight <= 0 {
+		log.Fatalln("max-inflight must be positive")
+	}
+	tmpl, err := sp.NewTemplate("subject", subject)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	nc, err := natsconn.Connect(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream(nats.PublishAsyncMaxPending(max_inflight))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numPublished, numInvalid := 0, 0
+
+	// publications waiting for acknowledgment, offsets are only committed
+	// after all messages consumed before have been acknowledged
+	var pending []nats.PubAckFuture
+	wait := func(futures []nats.PubAckFuture) {
+		deadline := time.After(timeout)
+		for _, f := range futures {
+			select {
+			case <-f.Ok():
+			case err := <-f.Err():
+				// exit without commit, the stream is published again from last checkpoint
+				log.Fatalln(err)
+			case <-deadline:
+				log.Fatalln("publish: no acknowledgment in", timeout)
+			}
+		}
+	}
+
+	publish := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(value, &fields); err != nil {
+			numInvalid++
+			return
+		}
+		s, err := sp.Render(tmpl, fields)
+		if err != nil || s == "" {
+			numInvalid++
+			return
+		}
+		// wildcards and whitespaces are not allowed in the subjects of
+		// publications
+		s = strings.NewReplacer("*", "_", ">", "_", " ", "_", "\t", "_").Replace(s)
+		var opts []nats.PubOpt
+		if dedup {
+			opts = append(opts, nats.MsgId(fmt.Sprintf("%v-%v-%v", msg.Topic, msg.Partition, msg.Offset)))
+		}
+		f, err := js.PublishMsgAsync(&nats.Msg{Subject: s, Data: value}, opts...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pending = append(pending, f)
+		numPublished++
+		if len(pending) >= max_inflight {
+			wait(pending[:max_inflight/2])
+			pending = append(pending[:0], pending[max_inflight/2:]...)
+		}
+	}
+
+	checkpoint := func() {
+		wait(pending)
+		pending = pending[:0]
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("published:", numPublished, "invalid:", numInvalid, "stream offsets:", streamOffsets)
+		numPublished, numInvalid = 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			publish(msg)
+		}
+	}
+}
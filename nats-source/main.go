@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nats-io/nats.go"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/natsconn"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const processorName = "nats-source"
+
+// envelope is the message of the json format
+type envelope struct {
+	Subject   string              `json:"subject"`
+	Header    map[string][]string `json:"header,omitempty"`
+	Payload   json.RawMessage     `json:"payload"` // the payload as a json string if not json
+	Sequence  uint64              `json:"sequence"`
+	Timestamp time.Time           `json:"timestamp"`
+}
+
+// topicData is the data of the template of kafka topics, e.g. for the
+// subject orders.eu.created: .Subject, .Tokens 1 is eu
+type topicData struct {
+	Subject string
+	Tokens  []string
+}
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Consume the messages of a jetstream stream with a durable consumer and publish them to kafka topics named after their subjects, keyed by subject; messages are acknowledged to jetstream once written to kafka",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream",
+				Value: "",
+				Usage: "jetstream stream to consume",
+			},
+			&cli.StringFlag{
+				Name:  "subject",
+				Value: "",
+				Usage: "subject filter of the consumer, with wildcards * and >, all subjects of the stream if not set",
+			},
+			&cli.StringFlag{
+				Name:  "durable",
+				Value: processorName,
+				Usage: "name of the durable consumer, jetstream keeps its position between runs",
+			},
+			&cli.StringFlag{
+				Name:  "deliver",
+				Value: "all",
+				Usage: "start of a new durable consumer, all, new or last",
+			},
+			&cli.IntFlag{
+				Name:  "batch-size",
+				Value: 100,
+				Usage: "messages per fetch",
+			},
+			&cli.DurationFlag{
+				Name:  "ack-wait",
+				Value: 30 * time.Second,
+				Usage: "delay before jetstream delivers again messages not acknowledged",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "nats",
+				Usage: "template of the kafka topic of messages on the .Subject and its .Tokens, e.g.: {{.Subject}}",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "raw",
+				Usage: "format of messages, raw for the payloads, or json for objects of subject, header, payload, sequence and timestamp",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval of the logs of counters",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(natsconn.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	nats_url := c.String("nats")
+	stream := c.String("stream")
+	subject := c.String("subject")
+	durable := c.String("durable")
+	deliver := c.String("deliver")
+	batch_size := c.Int("batch-size")
+	ack_wait := c.Duration("ack-wait")
+	output_topic := c.String("output-topic")
+	format := c.String("format")
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("nats:", nats_url)
+	log.Println("stream:", stream)
+	log.Println("subject:", subject)
+	log.Println("durable:", durable)
+	log.Println("deliver:", deliver)
+	log.Println("batch-size:", batch_size)
+	log.Println("ack-wait:", ack_wait)
+	log.Println("output-topic:", output_topic)
+	log.Println("format:", format)
+	log.Println("write-interval:", write_interval)
+
+	if stream == "" || durable == "" {
+		log.Fatalln("stream and durable must be set")
+	}
+	if batch_size <= 0 {
+		log.Fatalln("batch-size must be positive")
+	}
+	subOpts := []nats.SubOpt{nats.BindStream(stream), nats.AckExplicit(), nats.AckWait(ack_wait)}
+	switch deliver {
+	case "all":
+		subOpts = append(subOpts, nats.DeliverAll())
+	case "new":
+		subOpts = append(subOpts, nats.DeliverNew())
+	case "last":
+		subOpts = append(subOpts, nats.DeliverLast())
+	default:
+		log.Fatalln("unsupported deliver", deliver)
+	}
+	if format != "raw" && format != "json" {
+		log.Fatalln("unsupported format", format)
+	}
+	tmpl, err := sp.NewTemplate("topic", output_topic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	nc, err := natsconn.Connect(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sub, err := js.PullSubscribe(subject, durable, subOpts...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	kconfig := kafka.NewConfig()
+	kconfig.Producer.RequiredAcks = sarama.WaitForAll
+	kconfig.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, kconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	numProduced, numInvalid := 0, 0
+
+	convert := func(m *nats.Msg) (*sarama.ProducerMessage, error) {
+		name, err := sp.Render(tmpl, topicData{Subject: m.Subject, Tokens: strings.Split(m.Subject, ".")})
+		if err != nil {
+			return nil, err
+		}
+		topic := sp.TopicName(name)
+		value := m.Data
+		if format == "json" {
+			meta, err := m.Metadata()
+			if err != nil {
+				return nil, err
+			}
+			payload := json.RawMessage(value)
+			if !json.Valid(value) {
+				payload, _ = json.Marshal(string(value))
+			}
+			if value, err = json.Marshal(envelope{Subject: m.Subject, Header: m.Header, Payload: payload, Sequence: meta.Sequence.Stream, Timestamp: meta.Timestamp}); err != nil {
+				return nil, err
+			}
+		}
+		return &sarama.ProducerMessage{Topic: topic, Key: sarama.StringEncoder(m.Subject), Value: sarama.ByteEncoder(value)}, nil
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Println("produced:", numProduced, "invalid:", numInvalid)
+			numProduced, numInvalid = 0, 0
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			return nil
+		default:
+		}
+
+		msgs, err := sub.Fetch(batch_size, nats.MaxWait(time.Second))
+		if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+			continue
+		} else if err != nil {
+			log.Fatalln(err)
+		}
+
+		var out []*sarama.ProducerMessage
+		var acked []*nats.Msg
+		for _, m := range msgs {
+			pm, err := convert(m)
+			if err != nil {
+				// never delivered again
+				log.Println(m.Subject, err)
+				m.Term()
+				numInvalid++
+				continue
+			}
+			out = append(out, pm)
+			acked = append(acked, m)
+		}
+		if len(out) > 0 {
+			if err := producer.SendMessages(out); err != nil {
+				// exit without acknowledgment, jetstream delivers the messages again
+				log.Fatalln(err)
+			}
+		}
+		for _, m := range acked {
+			if err := m.Ack(); err != nil {
+				log.Println(err)
+			}
+		}
+		numProduced += len(out)
+	}
+}
@@ -0,0 +1,62 @@
+// Package natsconn connects the nats-sink and the nats-source to the nats
+// servers, authenticated with a credentials file, a user and password, or a
+// token.
+package natsconn
+
+import (
+	"github.com/nats-io/nats.go"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// Flags are the flags of the connections to the nats servers
+var Flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "nats",
+		Value: "nats://localhost:4222",
+		Usage: "nats servers, comma separated",
+	},
+	&cli.StringFlag{
+		Name:  "creds",
+		Usage: "nats credentials file",
+	},
+	&cli.StringFlag{
+		Name:  "user",
+		Usage: "nats user",
+	},
+	&cli.StringFlag{
+		Name:    "password",
+		EnvVars: []string{"NATS_PASSWORD"},
+		Usage:   "nats password",
+	},
+	&cli.StringFlag{
+		Name:    "token",
+		EnvVars: []string{"NATS_TOKEN"},
+		Usage:   "nats token",
+	},
+}
+
+// Connect connects to the nats servers of the flags with the connection
+// name of a processor, reconnecting forever
+func Connect(c *cli.Context, name string) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Println("disconnected:", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Println("reconnected:", nc.ConnectedUrl())
+		}),
+	}
+	switch {
+	case c.String("creds") != "":
+		opts = append(opts, nats.UserCredentials(c.String("creds")))
+	case c.String("user") != "":
+		opts = append(opts, nats.UserInfo(c.String("user"), c.String("password")))
+	case c.String("token") != "":
+		opts = append(opts, nats.Token(c.String("token")))
+	}
+	return nats.Connect(c.String("nats"), opts...)
+}
@@ -0,0 +1,513 @@
+package sp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtaci/sp/expr"
+)
+
+// Record is a message flowing through a topology, the decoded json fields
+// of a message of a source and its key
+type Record struct {
+	Key    []byte
+	Fields map[string]interface{}
+
+	// tick markers drive the timers of the operators
+	tick bool
+	now  time.Time
+}
+
+// clone copies a record for a second downstream, operators may modify the
+// fields of their records
+func (r *Record) clone() *Record {
+	c := *r
+	if r.Fields != nil {
+		c.Fields = deepCopy(r.Fields).(map[string]interface{})
+	}
+	return &c
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = deepCopy(e)
+		}
+		return s
+	}
+	return v
+}
+
+// Operator is a stage of a topology, its methods are called from the
+// goroutine of the stage, and from the checkpoints while the topology is
+// drained
+type Operator interface {
+	// Process handles a record, emitting its results; records failing
+	// are counted as invalid
+	Process(r *Record, emit func(*Record)) error
+	// Tick emits the results due at now, e.g. of closed windows
+	Tick(now time.Time, emit func(*Record))
+	// Save returns the state of the operator, nil if stateless
+	Save() ([]byte, error)
+	// Load restores the state saved
+	Load(state []byte) error
+}
+
+// Stateless can be embedded by the operators without state or timers
+type Stateless struct{}
+
+func (Stateless) Tick(time.Time, func(*Record)) {}
+func (Stateless) Save() ([]byte, error)         { return nil, nil }
+func (Stateless) Load([]byte) error             { return nil }
+
+// Value computes a value of a record, e.g. a key
+type Value func(r *Record) (interface{}, error)
+
+// Expr returns the value of an expression of package expr over the fields
+// of records, e.g. Expr("price * quantity")
+func Expr(src string) (Value, error) {
+	e, err := expr.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return func(r *Record) (interface{}, error) { return e.Eval(r.Fields) }, nil
+}
+
+// Field returns the value of the field of a dotted path
+func Field(path string) Value {
+	return func(r *Record) (interface{}, error) { return expr.Lookup(r.Fields, path), nil }
+}
+
+// filterOp forwards the records matching a predicate
+type filterOp struct {
+	Stateless
+	pred func(r *Record) (bool, error)
+}
+
+func (op *filterOp) Process(r *Record, emit func(*Record)) error {
+	ok, err := op.pred(r)
+	if err != nil {
+		return err
+	}
+	if ok {
+		emit(r)
+	}
+	return nil
+}
+
+// mapOp transforms records in place, nil fields drop them
+type mapOp struct {
+	Stateless
+	fn func(r *Record) error
+}
+
+func (op *mapOp) Process(r *Record, emit func(*Record)) error {
+	if err := op.fn(r); err != nil {
+		return err
+	}
+	if r.Fields != nil {
+		emit(r)
+	}
+	return nil
+}
+
+// Set returns a transformation setting fields of dotted paths to values
+// computed on the incoming record, so that values don't see each other
+func Set(values map[string]Value) func(r *Record) error {
+	return set(values, false)
+}
+
+// Project returns a transformation replacing the fields of records by the
+// fields of dotted paths set to values computed on them
+func Project(values map[string]Value) func(r *Record) error {
+	return set(values, true)
+}
+
+func set(values map[string]Value, project bool) func(r *Record) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return func(r *Record) error {
+		computed := make([]interface{}, len(names))
+		for i, name := range names {
+			v, err := values[name](r)
+			if err != nil {
+				return err
+			}
+			computed[i] = v
+		}
+		if project {
+			r.Fields = make(map[string]interface{})
+		}
+		for i, name := range names {
+			setPath(r.Fields, strings.Split(name, "."), computed[i])
+		}
+		return nil
+	}
+}
+
+// Drop returns a transformation removing the fields of dotted paths
+func Drop(paths ...string) func(r *Record) error {
+	return func(r *Record) error {
+		for _, p := range paths {
+			deletePath(r.Fields, strings.Split(p, "."))
+		}
+		return nil
+	}
+}
+
+// setPath sets the field of a dotted path, creating the objects missing
+func setPath(m map[string]interface{}, path []string, v interface{}) {
+	for _, p := range path[:len(path)-1] {
+		next, ok := m[p].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[p] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// deletePath removes the field of a dotted path
+func deletePath(m map[string]interface{}, path []string) {
+	for _, p := range path[:len(path)-1] {
+		next, ok := m[p].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+	delete(m, path[len(path)-1])
+}
+
+// KTable is the latest message of each key of a topic, keyed by a field of
+// the messages or by their keys, updated while the topology runs; messages
+// without values delete the rows of their keys
+type KTable struct {
+	topic string
+	key   string
+
+	mu   sync.RWMutex
+	rows map[string]map[string]interface{}
+}
+
+// Get returns the row of key
+func (t *KTable) Get(key string) (map[string]interface{}, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	row, ok := t.rows[key]
+	return row, ok
+}
+
+// put sets the row of key, nil deletes it
+func (t *KTable) put(key string, row map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if row == nil {
+		delete(t.rows, key)
+	} else {
+		t.rows[key] = row
+	}
+}
+
+// joinOp enriches records with the rows of a table of the same key
+type joinOp struct {
+	Stateless
+	table *KTable
+	on    Value
+	as    string // field of the row, merged into the record if empty
+	inner bool   // drop the records without a row
+}
+
+func (op *joinOp) Process(r *Record, emit func(*Record)) error {
+	k, err := op.on(r)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return errors.New("null join key")
+	}
+	row, ok := op.table.Get(fmt.Sprint(k))
+	if !ok {
+		if !op.inner {
+			emit(r)
+		}
+		return nil
+	}
+	row = deepCopy(row).(map[string]interface{})
+	if op.as != "" {
+		r.Fields[op.as] = row
+	} else {
+		for f, v := range row {
+			if _, ok := r.Fields[f]; !ok {
+				r.Fields[f] = v
+			}
+		}
+	}
+	emit(r)
+	return nil
+}
+
+// Window is the tumbling windows of an aggregation, the records of a
+// window are grouped by key and emitted once it closed: grace after its
+// end in processing time
+type Window struct {
+	Size       time.Duration
+	Grace      time.Duration
+	Key        Value                              // one group if nil
+	Time       func(r *Record) (time.Time, error) // processing time if nil
+	Aggregates []Aggregate
+}
+
+// Aggregate is an aggregate of the groups of a window: count, sum, avg, min
+// or max of a value
+type Aggregate struct {
+	Name  string
+	Func  string
+	Value Value // nil for count
+}
+
+var aggregateSpec = regexp.MustCompile(`^\s*(count|sum|avg|min|max)\s*\((.*)\)\s*$`)
+
+// ParseAggregate parses an aggregate like sum(price * quantity) or count()
+func ParseAggregate(name, spec string) (Aggregate, error) {
+	m := aggregateSpec.FindStringSubmatch(spec)
+	if m == nil {
+		return Aggregate{}, fmt.Errorf("aggregate %v: expect count(), sum, avg, min or max(expression)", name)
+	}
+	a := Aggregate{Name: name, Func: m[1]}
+	if strings.TrimSpace(m[2]) != "" {
+		v, err := Expr(m[2])
+		if err != nil {
+			return Aggregate{}, fmt.Errorf("aggregate %v: %v", name, err)
+		}
+		a.Value = v
+	}
+	return a, nil
+}
+
+// TimeField returns the time of a field, RFC 3339 strings or epoch seconds
+// or milliseconds
+func TimeField(path string) func(r *Record) (time.Time, error) {
+	return func(r *Record) (time.Time, error) {
+		switch v := expr.Lookup(r.Fields, path).(type) {
+		case string:
+			return time.Parse(time.RFC3339Nano, v)
+		case float64:
+			if v > 1e11 { // milliseconds
+				v /= 1000
+			}
+			return time.Unix(0, int64(v*float64(time.Second))), nil
+		}
+		return time.Time{}, fmt.Errorf("missing or unsupported time %v", path)
+	}
+}
+
+// accumulator is the state of an aggregate of a group
+type accumulator struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (a *accumulator) add(v float64) {
+	if a.Count == 0 || v < a.Min {
+		a.Min = v
+	}
+	if a.Count == 0 || v > a.Max {
+		a.Max = v
+	}
+	a.Count++
+	a.Sum += v
+}
+
+func (a *accumulator) result(fn string) interface{} {
+	switch fn {
+	case "count":
+		return a.Count
+	case "sum":
+		return a.Sum
+	}
+	if a.Count == 0 {
+		return nil
+	}
+	switch fn {
+	case "avg":
+		return a.Sum / float64(a.Count)
+	case "min":
+		return a.Min
+	}
+	return a.Max
+}
+
+// group is the aggregates of a key in a window
+type group struct {
+	Key  interface{}    `json:"key"`
+	Accs []*accumulator `json:"accs"`
+}
+
+// aggregateOp aggregates records in the windows of w
+type aggregateOp struct {
+	w Window
+
+	// groups of the open windows by start in unix nanoseconds
+	windows map[int64]map[string]*group
+}
+
+func newAggregateOp(w Window) (*aggregateOp, error) {
+	if w.Size <= 0 {
+		return nil, errors.New("window size must be positive")
+	}
+	if len(w.Aggregates) == 0 {
+		return nil, errors.New("no aggregates")
+	}
+	for _, a := range w.Aggregates {
+		switch a.Func {
+		case "count":
+		case "sum", "avg", "min", "max":
+			if a.Value == nil {
+				return nil, fmt.Errorf("aggregate %v: %v needs a value", a.Name, a.Func)
+			}
+		default:
+			return nil, fmt.Errorf("aggregate %v: unsupported %q", a.Name, a.Func)
+		}
+	}
+	return &aggregateOp{w: w, windows: make(map[int64]map[string]*group)}, nil
+}
+
+func (op *aggregateOp) Process(r *Record, emit func(*Record)) error {
+	ts := time.Now()
+	if op.w.Time != nil {
+		var err error
+		if ts, err = op.w.Time(r); err != nil {
+			return err
+		}
+	}
+	start := ts.Truncate(op.w.Size)
+	if !start.Add(op.w.Size + op.w.Grace).After(time.Now()) {
+		return errors.New("late record of a closed window")
+	}
+
+	var key interface{}
+	if op.w.Key != nil {
+		var err error
+		if key, err = op.w.Key(r); err != nil {
+			return err
+		}
+	}
+	groups, ok := op.windows[start.UnixNano()]
+	if !ok {
+		groups = make(map[string]*group)
+		op.windows[start.UnixNano()] = groups
+	}
+	k := fmt.Sprint(key)
+	g, ok := groups[k]
+	if !ok {
+		g = &group{Key: key, Accs: make([]*accumulator, len(op.w.Aggregates))}
+		for i := range g.Accs {
+			g.Accs[i] = &accumulator{}
+		}
+		groups[k] = g
+	}
+	for i, a := range op.w.Aggregates {
+		if a.Value == nil {
+			g.Accs[i].Count++
+			continue
+		}
+		v, err := a.Value(r)
+		if err != nil {
+			return err
+		}
+		if f, ok := toFloat(v); ok {
+			g.Accs[i].add(f)
+		}
+	}
+	return nil
+}
+
+// Tick emits the windows closed at now, in order of start
+func (op *aggregateOp) Tick(now time.Time, emit func(*Record)) {
+	var closed []int64
+	for start := range op.windows {
+		if !time.Unix(0, start).Add(op.w.Size + op.w.Grace).After(now) {
+			closed = append(closed, start)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i] < closed[j] })
+	for _, start := range closed {
+		groups := op.windows[start]
+		delete(op.windows, start)
+		keys := make([]string, 0, len(groups))
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			g := groups[k]
+			fields := map[string]interface{}{
+				"window_start": time.Unix(0, start).UTC().Format(time.RFC3339Nano),
+				"window_end":   time.Unix(0, start).Add(op.w.Size).UTC().Format(time.RFC3339Nano),
+			}
+			for i, a := range op.w.Aggregates {
+				fields[a.Name] = g.Accs[i].result(a.Func)
+			}
+			r := &Record{Fields: fields}
+			if op.w.Key != nil {
+				fields["key"] = g.Key
+				r.Key = []byte(k)
+			}
+			emit(r)
+		}
+	}
+}
+
+func (op *aggregateOp) Save() ([]byte, error) {
+	return json.Marshal(op.windows)
+}
+
+func (op *aggregateOp) Load(state []byte) error {
+	if err := json.Unmarshal(state, &op.windows); err != nil {
+		return err
+	}
+	for _, groups := range op.windows {
+		for _, g := range groups {
+			if len(g.Accs) != len(op.w.Aggregates) {
+				return errors.New("aggregates changed, state of open windows is incompatible")
+			}
+		}
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
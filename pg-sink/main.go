@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	_ "github.com/lib/pq"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const processorName = "pg-sink"
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Upsert the messages of a stream into a postgres table, the offsets are committed in the transactions of the rows",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to store",
+			},
+			&cli.StringFlag{
+				Name:  "pq",
+				Value: "postgres://127.0.0.1:5432/pipeline?sslmode=disable",
+				Usage: "psql url",
+			},
+			&cli.StringFlag{
+				Name:  "table",
+				Value: "",
+				Usage: "table to upsert into, optionally schema.table",
+			},
+			&cli.StringSliceFlag{
+				Name:  "column",
+				Usage: "column of the table and json path of its values in messages, repeated per column, e.g.: user_id=user.id, format: a.b.0.c, objects and arrays are stored as json",
+			},
+			&cli.StringSliceFlag{
+				Name:  "conflict",
+				Usage: "column of the unique constraint of ON CONFLICT, repeated per column, rows are inserted if not set",
+			},
+			&cli.StringFlag{
+				Name:  "on-conflict",
+				Value: "update",
+				Usage: "update: update the other columns of conflicting rows, nothing: keep them",
+			},
+			&cli.StringFlag{
+				Name:  "offsets-table",
+				Value: "kafka_consumer_offsets",
+				Usage: "table of the offsets of consumers, created if missing",
+			},
+			&cli.StringFlag{
+				Name:  "consumer-id",
+				Value: "",
+				Usage: "name of the offsets of the sink, default: {stream-topic}-{table}",
+			},
+			&cli.IntFlag{
+				Name:  "batch-size",
+				Value: 1000,
+				Usage: "max messages per transaction",
+			},
+			&cli.DurationFlag{
+				Name:  "commit-interval",
+				Value: time.Second,
+				Usage: "interval for committing pending data to psql",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(logging.Flags, tracing.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	pq := c.String("pq")
+	table := c.String("table")
+	columns := c.StringSlice("column")
+	conflict := c.StringSlice("conflict")
+	on_conflict := c.String("on-conflict")
+	offsets_table := c.String("offsets-table")
+	consumer_id := c.String("consumer-id")
+	if consumer_id == "" {
+		consumer_id = fmt.Sprintf("%v-%v", stream_topic, table)
+	}
+	batch_size := c.Int("batch-size")
+	commit_interval := c.Duration("commit-interval")
+	format_name := c.String("format")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("table:", table)
+	log.Println("column:", columns)
+	log.Println("conflict:", conflict)
+	log.Println("on-conflict:", on_conflict)
+	log.Println("offsets-table:", offsets_table)
+	log.Println("consumer-id:", consumer_id)
+	log.Println("batch-size:", batch_size)
+	log.Println("commit-interval:", commit_interval)
+	log.Println("format:", format_name)
+
+	if table == "" {
+		log.Fatalln("table must be set")
+	}
+	if batch_size <= 0 {
+		log.Fatalln("batch-size must be positive")
+	}
+	switch on_conflict {
+	case "update", "nothing":
+	default:
+		log.Fatalln("unsupported on-conflict:", on_conflict)
+	}
+	mappings, err := parseMappings(columns)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(mappings) == 0 {
+		log.Fatalln("column must be set")
+	}
+	upsert, err := newUpserter(table, mappings, conflict, on_conflict == "update")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// connect to postgres
+	db, err := sql.Open("postgres", pq)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+	offsetTable, err := newOffsetStore(db, offsets_table)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read offsets
+	streamOffsets, err := offsetTable.load(db, consumer_id, stream_topic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	commitTicker := time.NewTicker(commit_interval)
+	numWritten, numInvalid := 0, 0
+	// rows of the next transaction
+	var pending [][]interface{}
+	dirty := false
+	var traces []context.Context // of the messages of the batch
+	tracer, err := tracing.Setup(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer tracing.Shutdown()
+
+	// commit writes the pending rows and the offsets after them in one
+	// transaction, the sink exits on failures and resumes from the offsets
+	// of the last transaction
+	commit := func() {
+		if !dirty {
+			return
+		}
+		_, span := tracer.Batch(traces, "write")
+		traces = nil
+		defer span.End()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := upsert.exec(tx, pending); err != nil {
+			tx.Rollback()
+			log.Fatalln(err)
+		}
+		if err := offsetTable.store(tx, consumer_id, stream_topic, streamOffsets); err != nil {
+			tx.Rollback()
+			log.Fatalln(err)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("table:", table, "consumer id:", consumer_id, "written:", len(pending), "invalid:", numInvalid, "stream offsets:", streamOffsets)
+		numWritten += len(pending)
+		pending, dirty, numInvalid = nil, false, 0
+	}
+
+	add := func(msg *sarama.ConsumerMessage) {
+		trace, span := tracer.Start(msg, processorName)
+		defer span.End()
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		var fields map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil || fields == nil {
+			numInvalid++
+			return
+		}
+		row, err := upsert.row(fields)
+		if err != nil {
+			log.WithFields(logging.Message(msg)).Println(err)
+			numInvalid++
+			return
+		}
+		pending = append(pending, row)
+		traces = append(traces, trace)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-commitTicker.C:
+			commit()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			commit()
+			log.Println("stopped, written:", numWritten)
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			dirty = true
+			add(msg)
+			if len(pending) >= batch_size {
+				commit()
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/expr"
+
+	postgres "github.com/lib/pq"
+)
+
+// postgres binds at most 65535 parameters per statement
+const maxParams = 65535
+
+// mapping is a column of the table set from a json path of messages
+type mapping struct {
+	column string
+	path   string
+}
+
+// parseMappings parses column=path, or column alone for the field of the
+// same name
+func parseMappings(specs []string) ([]mapping, error) {
+	var ms []mapping
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		m := mapping{column: spec, path: spec}
+		if i := strings.IndexByte(spec, '='); i >= 0 {
+			m.column, m.path = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		}
+		if m.column == "" || m.path == "" {
+			return nil, fmt.Errorf("column %q: expect column=path", spec)
+		}
+		if seen[m.column] {
+			return nil, fmt.Errorf("column %q mapped twice", m.column)
+		}
+		seen[m.column] = true
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// quoteTable quotes a table name, optionally qualified by its schema
+func quoteTable(name string) string {
+	parts := strings.SplitN(name, ".", 2)
+	for i := range parts {
+		parts[i] = postgres.QuoteIdentifier(parts[i])
+	}
+	return strings.Join(parts, ".")
+}
+
+// upserter builds the statements upserting rows into a table
+type upserter struct {
+	table    string
+	mappings []mapping
+	conflict []int // indexes of the conflict columns in mappings
+	update   bool  // update rows on conflicts, keep them otherwise
+}
+
+func newUpserter(table string, mappings []mapping, conflict []string, update bool) (*upserter, error) {
+	u := &upserter{table: quoteTable(table), mappings: mappings, update: update}
+	for _, name := range conflict {
+		found := false
+		for i, m := range mappings {
+			if m.column == name {
+				u.conflict = append(u.conflict, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("conflict column %q is not mapped", name)
+		}
+	}
+	return u, nil
+}
+
+// row returns the values of the columns of a message, objects and arrays
+// as json text; missing fields are NULL
+func (u *upserter) row(fields map[string]interface{}) ([]interface{}, error) {
+	row := make([]interface{}, len(u.mappings))
+	for i, m := range u.mappings {
+		switch v := expr.Lookup(fields, m.path).(type) {
+		case map[string]interface{}, []interface{}:
+			bts, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = string(bts)
+		case json.Number:
+			row[i] = v.String()
+		default:
+			row[i] = v
+		}
+	}
+	for _, i := range u.conflict {
+		if row[i] == nil {
+			return nil, fmt.Errorf("conflict column %v is null", u.mappings[i].column)
+		}
+	}
+	return row, nil
+}
+
+// key returns the values of the conflict columns of a row, rows of the
+// same key are upserted once per statement
+func (u *upserter) key(row []interface{}) string {
+	if len(u.conflict) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	for _, i := range u.conflict {
+		fmt.Fprintf(&buf, "%v\x00", row[i])
+	}
+	return buf.String()
+}
+
+// exec upserts rows in statements of at most maxParams parameters; without
+// conflict columns rows are inserted
+func (u *upserter) exec(tx *sql.Tx, rows [][]interface{}) error {
+	// the last row of a key wins, a statement cannot update a row twice
+	if len(u.conflict) > 0 {
+		last := make(map[string]int, len(rows))
+		for i, row := range rows {
+			last[u.key(row)] = i
+		}
+		deduped := rows[:0:0]
+		for i, row := range rows {
+			if last[u.key(row)] == i {
+				deduped = append(deduped, row)
+			}
+		}
+		rows = deduped
+	}
+
+	chunk := maxParams / len(u.mappings)
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > chunk {
+			n = chunk
+		}
+		var args []interface{}
+		for _, row := range rows[:n] {
+			args = append(args, row...)
+		}
+		if _, err := tx.Exec(u.statement(n), args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// statement returns the upsert of n rows
+func (u *upserter) statement(n int) string {
+	columns := make([]string, len(u.mappings))
+	for i, m := range u.mappings {
+		columns[i] = postgres.QuoteIdentifier(m.column)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "INSERT INTO %v (%v) VALUES ", u.table, strings.Join(columns, ", "))
+	p := 1
+	for r := 0; r < n; r++ {
+		if r > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteByte('(')
+		for i := range columns {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "$%v", p)
+			p++
+		}
+		buf.WriteByte(')')
+	}
+	if len(u.conflict) == 0 {
+		return buf.String()
+	}
+
+	keys := make([]string, len(u.conflict))
+	isKey := make(map[int]bool)
+	for j, i := range u.conflict {
+		keys[j] = columns[i]
+		isKey[i] = true
+	}
+	fmt.Fprintf(&buf, " ON CONFLICT (%v) DO ", strings.Join(keys, ", "))
+	var sets []string
+	for i, c := range columns {
+		if !isKey[i] {
+			sets = append(sets, c+" = EXCLUDED."+c)
+		}
+	}
+	if !u.update || len(sets) == 0 {
+		buf.WriteString("NOTHING")
+	} else {
+		buf.WriteString("UPDATE SET " + strings.Join(sets, ", "))
+	}
+	return buf.String()
+}
+
+// offsetStore keeps the offsets of consumers in a table, written in the
+// transactions of the rows
+type offsetStore struct {
+	table string
+}
+
+func newOffsetStore(db *sql.DB, table string) (*offsetStore, error) {
+	s := &offsetStore{table: quoteTable(table)}
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v (
+		consumer TEXT NOT NULL, topic TEXT NOT NULL, partition INTEGER NOT NULL, next_offset BIGINT NOT NULL,
+		PRIMARY KEY (consumer, topic, partition))`, s.table))
+	return s, err
+}
+
+func (s *offsetStore) load(db *sql.DB, consumer, topic string) (sp.Offsets, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT partition, next_offset FROM %v WHERE consumer = $1 AND topic = $2", s.table), consumer, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	offs := make(sp.Offsets)
+	for rows.Next() {
+		var partition int32
+		var offset int64
+		if err := rows.Scan(&partition, &offset); err != nil {
+			return nil, err
+		}
+		offs[partition] = offset
+	}
+	return offs, rows.Err()
+}
+
+func (s *offsetStore) store(tx *sql.Tx, consumer, topic string, offs sp.Offsets) error {
+	for partition, offset := range offs {
+		if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO %v (consumer, topic, partition, next_offset) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (consumer, topic, partition) DO UPDATE SET next_offset = EXCLUDED.next_offset`, s.table),
+			consumer, topic, partition, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
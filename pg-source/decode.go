@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// change is a row change of a table
+type change struct {
+	typ    string // INSERT, UPDATE or DELETE
+	schema string
+	table  string
+	key    string // values of the replica identity joined with ","
+	data   map[string]interface{}
+	oldKey string // key before updates, empty if unknown
+	old    map[string]interface{}
+}
+
+// decoder decodes the messages of an output plugin
+type decoder interface {
+	// options of the plugin for START_REPLICATION
+	options() []string
+	// decode returns the changes of a message, and its position if it
+	// commits a transaction, 0 otherwise; the position of commits is the
+	// end of the transaction
+	decode(x *xlogData) ([]change, lsn, error)
+}
+
+// pgoutput decodes the binary protocol of the built-in pgoutput plugin,
+// version 1; relations are described before their first change
+type pgoutput struct {
+	publication string
+	relations   map[uint32]*relation
+}
+
+type relation struct {
+	schema, name string
+	columns      []relationColumn
+}
+
+type relationColumn struct {
+	name string
+	key  bool // part of the replica identity
+	oid  uint32
+}
+
+func newPgoutput(publication string) *pgoutput {
+	return &pgoutput{publication: publication, relations: make(map[uint32]*relation)}
+}
+
+func (d *pgoutput) options() []string {
+	return []string{"proto_version '1'", "publication_names " + quoteLiteral(d.publication)}
+}
+
+func (d *pgoutput) decode(x *xlogData) ([]change, lsn, error) {
+	r := &reader{data: x.data}
+	switch r.byte() {
+	case 'C':
+		return nil, x.walStart, nil
+	case 'R':
+		rel := &relation{}
+		id := r.uint32()
+		rel.schema, rel.name = r.string(), r.string()
+		r.byte() // replica identity setting
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			flags := r.byte()
+			name := r.string()
+			oid := r.uint32()
+			r.uint32() // type modifier
+			rel.columns = append(rel.columns, relationColumn{name, flags&1 != 0, oid})
+		}
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		d.relations[id] = rel
+		return nil, 0, nil
+	case 'I', 'U', 'D':
+	default: // begin, origin, type, truncate and messages
+		return nil, 0, nil
+	}
+
+	kind := x.data[0]
+	rel, ok := d.relations[r.uint32()]
+	if !ok {
+		return nil, 0, errors.New("pgoutput: change of an unknown relation")
+	}
+	c := change{schema: rel.schema, table: rel.name}
+	var err error
+	switch kind {
+	case 'I':
+		c.typ = "INSERT"
+		r.byte() // N
+		c.data, c.key, err = rel.tuple(r, false)
+	case 'U':
+		c.typ = "UPDATE"
+		if t := r.byte(); t == 'K' || t == 'O' { // old key or row
+			if c.old, c.oldKey, err = rel.tuple(r, t == 'K'); err != nil {
+				return nil, 0, err
+			}
+			r.byte() // N
+		}
+		c.data, c.key, err = rel.tuple(r, false)
+	case 'D':
+		c.typ = "DELETE"
+		t := r.byte()
+		c.data, c.key, err = rel.tuple(r, t == 'K')
+	}
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("pgoutput: %v.%v: %v", rel.schema, rel.name, err)
+	}
+	return []change{c}, 0, nil
+}
+
+// tuple reads the values of a row, columns unchanged since stored out of
+// line are absent from updates; only the key columns of key tuples are set
+func (rel *relation) tuple(r *reader, keyOnly bool) (map[string]interface{}, string, error) {
+	n := int(r.uint16())
+	if n > len(rel.columns) {
+		return nil, "", fmt.Errorf("%v values for %v columns", n, len(rel.columns))
+	}
+	data := make(map[string]interface{}, n)
+	var keys []string
+	for i := 0; i < n && r.err == nil; i++ {
+		col := rel.columns[i]
+		var v interface{}
+		switch r.byte() {
+		case 'n':
+		case 'u':
+			continue
+		case 't':
+			v = textValue(col.oid, string(r.bytes(int(r.uint32()))))
+		case 'b':
+			v = string(r.bytes(int(r.uint32())))
+		}
+		if col.key {
+			keys = append(keys, fmt.Sprint(v))
+		}
+		if !keyOnly || col.key {
+			data[col.name] = v
+		}
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("no replica identity, set a primary key or REPLICA IDENTITY")
+	}
+	return data, strings.Join(keys, ","), r.err
+}
+
+// textValue converts the text of a value of type oid, numbers, booleans and
+// json are kept as such, other types as text
+func textValue(oid uint32, text string) interface{} {
+	switch oid {
+	case 16: // bool
+		return text == "t"
+	case 20, 21, 23, 26: // int8, int2, int4, oid
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return i
+		}
+	case 700, 701: // float4, float8
+		if f, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f
+		}
+	case 114, 3802: // json, jsonb
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+	}
+	return text
+}
+
+// reader reads the fields of a pgoutput message, the first error is kept
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || len(r.data) < n {
+		if r.err == nil {
+			r.err = errors.New("truncated message")
+		}
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) string() string {
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.bytes(len(r.data) + 1)
+		return ""
+	}
+	s := string(r.data[:i])
+	r.bytes(i + 1)
+	return s
+}
+
+// wal2json decodes the json changes of the wal2json plugin, format 2
+type wal2json struct {
+	tables []string
+}
+
+func (d *wal2json) options() []string {
+	opts := []string{`"format-version" '2'`, `"include-pk" '1'`, `"include-transaction" '1'`}
+	if len(d.tables) > 0 {
+		opts = append(opts, `"add-tables" `+quoteLiteral(strings.Join(d.tables, ",")))
+	}
+	return opts
+}
+
+type wal2jsonColumn struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type wal2jsonChange struct {
+	Action   string           `json:"action"`
+	Schema   string           `json:"schema"`
+	Table    string           `json:"table"`
+	Columns  []wal2jsonColumn `json:"columns"`
+	Identity []wal2jsonColumn `json:"identity"`
+	PK       []wal2jsonColumn `json:"pk"`
+}
+
+func (d *wal2json) decode(x *xlogData) ([]change, lsn, error) {
+	var m wal2jsonChange
+	dec := json.NewDecoder(bytes.NewReader(x.data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, 0, fmt.Errorf("wal2json: %v", err)
+	}
+
+	c := change{schema: m.Schema, table: m.Table}
+	switch m.Action {
+	case "C":
+		return nil, x.walStart, nil
+	case "I":
+		c.typ = "INSERT"
+	case "U":
+		c.typ = "UPDATE"
+	case "D":
+		c.typ = "DELETE"
+	default: // begin, truncate and messages
+		return nil, 0, nil
+	}
+
+	var err error
+	if c.typ == "DELETE" {
+		c.data, c.key, err = m.row(m.Identity)
+	} else {
+		c.data, c.key, err = m.row(m.Columns)
+		if err == nil && len(m.Identity) > 0 {
+			c.old, c.oldKey, err = m.row(m.Identity)
+		}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("wal2json: %v.%v: %v", m.Schema, m.Table, err)
+	}
+	return []change{c}, 0, nil
+}
+
+// row returns the values of columns and the key of the primary key columns,
+// all columns are the key of tables without primary key
+func (m *wal2jsonChange) row(columns []wal2jsonColumn) (map[string]interface{}, string, error) {
+	data := make(map[string]interface{}, len(columns))
+	for _, c := range columns {
+		v := c.Value
+		if s, ok := v.(string); ok && (c.Type == "json" || c.Type == "jsonb") && json.Valid([]byte(s)) {
+			v = json.RawMessage(s)
+		}
+		data[c.Name] = v
+	}
+	pk := m.PK
+	if len(pk) == 0 {
+		pk = columns
+	}
+	var keys []string
+	for _, c := range pk {
+		keys = append(keys, fmt.Sprint(data[c.Name]))
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("no replica identity, set a primary key or REPLICA IDENTITY")
+	}
+	return data, strings.Join(keys, ","), nil
+}
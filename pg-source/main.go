@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	metaBucket    = "__meta__"
+	lsnKey        = "lsn"
+	processorName = "pg-source"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Stream the row changes of postgres from a logical replication slot and publish them in the WAL format of the joiner, deletes are WAL messages of type DELETE, applied by the joiner with: --tombstone-field type --tombstone-value DELETE",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "dsn",
+				Value: "postgres://postgres@127.0.0.1:5432/postgres",
+				Usage: "postgres connection string of the database, of a user with the REPLICATION attribute, the password from PGPASSWORD if not set",
+			},
+			&cli.StringFlag{
+				Name:  "slot",
+				Value: "sp",
+				Usage: "logical replication slot to stream from",
+			},
+			&cli.StringFlag{
+				Name:  "plugin",
+				Value: "pgoutput",
+				Usage: "output plugin of the slot, pgoutput or wal2json",
+			},
+			&cli.StringFlag{
+				Name:  "publication",
+				Value: "sp",
+				Usage: "publication of the tables streamed by pgoutput",
+			},
+			&cli.StringSliceFlag{
+				Name:  "table",
+				Usage: "schema.table of the tables to stream, of the publication created or of wal2json, all tables if not set",
+			},
+			&cli.BoolFlag{
+				Name:  "create",
+				Value: true,
+				Usage: "create the slot and the publication if missing",
+			},
+			&cli.BoolFlag{
+				Name:  "drop-slot",
+				Usage: "drop the slot and exit, the server retains the write-ahead log of the slot until dropped",
+			},
+			&cli.BoolFlag{
+				Name:  "qualified",
+				Usage: "name tables schema.table in WAL messages instead of table",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "WAL",
+				Usage: "topic to publish the WAL messages of row changes to",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of the restart lsn, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 10 * time.Second,
+				Usage: "interval of the checkpoints of the lsn, the status sent to the server",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	dsn := c.String("dsn")
+	slot := c.String("slot")
+	plugin := c.String("plugin")
+	publication := c.String("publication")
+	table_names := c.StringSlice("table")
+	create := c.Bool("create")
+	drop_slot := c.Bool("drop-slot")
+	qualified := c.Bool("qualified")
+	output_topic := c.String("output-topic")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("slot:", slot)
+	log.Println("plugin:", plugin)
+	log.Println("publication:", publication)
+	log.Println("table:", table_names)
+	log.Println("create:", create)
+	log.Println("drop-slot:", drop_slot)
+	log.Println("qualified:", qualified)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".pg-source-%v.cache", slot)
+	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	log.Println("cache file:", cachefile)
+	log.Println("instanceId:", instanceId)
+
+	var dec decoder
+	switch plugin {
+	case "pgoutput":
+		dec = newPgoutput(publication)
+	case "wal2json":
+		dec = &wal2json{tables: table_names}
+	default:
+		log.Fatalln("unsupported plugin:", plugin)
+	}
+
+	config, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config.RuntimeParams["replication"] = "database"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close(context.Background())
+
+	if drop_slot {
+		if err := dropSlot(ctx, conn, slot); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("dropped slot:", slot)
+		return nil
+	}
+	if create {
+		created, err := ensureSlot(ctx, conn, slot, plugin)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("slot created:", created)
+		if plugin == "pgoutput" {
+			if err := ensurePublication(ctx, conn, publication, table_names); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	// read state, the server streams from the confirmed position of the
+	// slot if the stored one is older or missing
+	var start lsn
+	if v, err := store.Get(metaBucket, []byte(lsnKey)); err != nil {
+		log.Fatalln(err)
+	} else if len(v) == 8 {
+		start = lsn(binary.BigEndian.Uint64(v))
+	}
+	log.Println("starting from lsn:", start)
+
+	kconfig := kafka.NewConfig()
+	kconfig.Producer.Return.Successes = true
+	kconfig.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, kconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, the lsn is only confirmed after all changes
+	// before it have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without confirming, the slot streams again from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+	defer func() {
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	if err := startReplication(ctx, conn, slot, start, dec.options()); err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Println("started")
+	hostname, _ := os.Hostname()
+	// committed is the end of the last complete transaction, pending is set
+	// from the begin of a transaction to its commit
+	committed := start
+	pending := false
+	numInserted, numUpdated, numDeleted, numSkipped := 0, 0, 0, 0
+
+	emit := func(typ string, ch *change, key string, data map[string]interface{}) {
+		table := ch.table
+		if qualified {
+			table = ch.schema + "." + ch.table
+		}
+		bts, err := json.Marshal(data)
+		if err != nil {
+			log.Println(err)
+			numSkipped++
+			return
+		}
+		wal := &sp.WAL{
+			Type:       typ,
+			InstanceId: instanceId,
+			Table:      table,
+			Host:       hostname,
+			Key:        key,
+			CreatedAt:  time.Now(),
+			Data:       bts,
+		}
+		if bts, err = json.Marshal(wal); err != nil {
+			log.Println(err)
+			numSkipped++
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Key: sarama.StringEncoder(key), Value: sarama.ByteEncoder(bts)}
+	}
+
+	// publish emits a change, updates changing the key delete the row of
+	// the old key
+	publish := func(ch *change) {
+		switch ch.typ {
+		case "INSERT":
+			numInserted++
+		case "UPDATE":
+			if ch.oldKey != "" && ch.oldKey != ch.key {
+				emit("DELETE", ch, ch.oldKey, ch.old)
+				numDeleted++
+			}
+			numUpdated++
+		case "DELETE":
+			numDeleted++
+		}
+		emit(ch.typ, ch, ch.key, ch.data)
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(committed))
+		if err := store.Put(metaBucket, []byte(lsnKey), v); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("inserted:", numInserted, "updated:", numUpdated, "deleted:", numDeleted, "skipped:", numSkipped, "lsn:", committed)
+		numInserted, numUpdated, numDeleted, numSkipped = 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Println("received signal:", sig)
+		cancel()
+	}()
+
+	// the connection is read and written from this loop only, reads time
+	// out at the next checkpoint
+	next := time.Now().Add(write_interval)
+	for {
+		if !time.Now().Before(next) {
+			checkpoint()
+			if err := sendStatus(conn, committed, committed); err != nil {
+				log.Fatalln(err)
+			}
+			next = time.Now().Add(write_interval)
+		}
+
+		rctx, rcancel := context.WithDeadline(ctx, next)
+		msg, err := receive(rctx, conn)
+		rcancel()
+		if ctx.Err() != nil {
+			// the connection is closed on cancel, the slot is confirmed up
+			// to the stored lsn on next start
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		}
+		if pgconn.Timeout(err) {
+			continue
+		} else if err != nil {
+			log.Fatalln(err)
+		}
+
+		switch msg := msg.(type) {
+		case *keepalive:
+			// the server has sent all changes before walEnd
+			if !pending && msg.walEnd > committed {
+				committed = msg.walEnd
+			}
+			if msg.reply {
+				next = time.Now()
+			}
+		case *xlogData:
+			changes, end, err := dec.decode(msg)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			for i := range changes {
+				publish(&changes[i])
+			}
+			if end > 0 {
+				committed = end
+			}
+			pending = end == 0
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// lsn is a position in the write-ahead log of postgres
+type lsn uint64
+
+func parseLSN(s string) (lsn, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("invalid lsn %q", s)
+	}
+	return lsn(uint64(hi)<<32 | uint64(lo)), nil
+}
+
+func (l lsn) String() string { return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l)) }
+
+// postgres timestamps are microseconds since 2000-01-01
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func pgTime(micros int64) time.Time { return pgEpoch.Add(time.Duration(micros) * time.Microsecond) }
+
+// quoteIdent quotes an identifier of a replication command
+func quoteIdent(s string) string { return `"` + strings.Replace(s, `"`, `""`, -1) + `"` }
+
+// quoteLiteral quotes a string literal of a replication command
+func quoteLiteral(s string) string { return `'` + strings.Replace(s, `'`, `''`, -1) + `'` }
+
+// query runs a sql statement on a replication connection and returns the
+// text values of its rows
+func query(ctx context.Context, conn *pgconn.PgConn, sql string) ([][]string, error) {
+	results, err := conn.Exec(ctx, sql).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, r := range results {
+		for _, row := range r.Rows {
+			values := make([]string, len(row))
+			for i, v := range row {
+				values[i] = string(v)
+			}
+			rows = append(rows, values)
+		}
+	}
+	return rows, nil
+}
+
+// ensureSlot creates the logical replication slot with plugin if missing,
+// returns whether it was created
+func ensureSlot(ctx context.Context, conn *pgconn.PgConn, slot, plugin string) (bool, error) {
+	rows, err := query(ctx, conn, "SELECT plugin FROM pg_replication_slots WHERE slot_name = "+quoteLiteral(slot))
+	if err != nil {
+		return false, err
+	}
+	if len(rows) > 0 {
+		if rows[0][0] != plugin {
+			return false, fmt.Errorf("slot %v uses plugin %v", slot, rows[0][0])
+		}
+		return false, nil
+	}
+	_, err = query(ctx, conn, fmt.Sprintf("CREATE_REPLICATION_SLOT %v LOGICAL %v NOEXPORT_SNAPSHOT", quoteIdent(slot), plugin))
+	return err == nil, err
+}
+
+// ensurePublication creates the publication of pgoutput if missing, for
+// tables or all tables
+func ensurePublication(ctx context.Context, conn *pgconn.PgConn, publication string, tables []string) error {
+	rows, err := query(ctx, conn, "SELECT 1 FROM pg_publication WHERE pubname = "+quoteLiteral(publication))
+	if err != nil || len(rows) > 0 {
+		return err
+	}
+	target := "ALL TABLES"
+	if len(tables) > 0 {
+		names := make([]string, len(tables))
+		for i, t := range tables {
+			parts := strings.SplitN(t, ".", 2)
+			for j := range parts {
+				parts[j] = quoteIdent(parts[j])
+			}
+			names[i] = strings.Join(parts, ".")
+		}
+		target = "TABLE " + strings.Join(names, ", ")
+	}
+	_, err = query(ctx, conn, fmt.Sprintf("CREATE PUBLICATION %v FOR %v", quoteIdent(publication), target))
+	return err
+}
+
+func dropSlot(ctx context.Context, conn *pgconn.PgConn, slot string) error {
+	_, err := query(ctx, conn, "DROP_REPLICATION_SLOT "+quoteIdent(slot))
+	return err
+}
+
+// startReplication streams the changes of slot from start, options are the
+// options of the output plugin
+func startReplication(ctx context.Context, conn *pgconn.PgConn, slot string, start lsn, options []string) error {
+	sql := fmt.Sprintf("START_REPLICATION SLOT %v LOGICAL %v", quoteIdent(slot), start)
+	if len(options) > 0 {
+		sql += " (" + strings.Join(options, ", ") + ")"
+	}
+	conn.Frontend().Send(&pgproto3.Query{String: sql})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.NoticeResponse:
+		default:
+			return fmt.Errorf("unexpected message %T starting replication", msg)
+		}
+	}
+}
+
+// xlogData is a message of the output plugin at walStart
+type xlogData struct {
+	walStart lsn
+	data     []byte
+}
+
+// keepalive is a heartbeat of the server, a status is expected if reply
+type keepalive struct {
+	walEnd lsn
+	reply  bool
+}
+
+// receive returns the next xlogData or keepalive of the replication stream
+func receive(ctx context.Context, conn *pgconn.PgConn) (interface{}, error) {
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data := msg.Data
+			switch {
+			case len(data) >= 25 && data[0] == 'w':
+				return &xlogData{lsn(binary.BigEndian.Uint64(data[1:])), append([]byte(nil), data[25:]...)}, nil
+			case len(data) >= 18 && data[0] == 'k':
+				return &keepalive{lsn(binary.BigEndian.Uint64(data[1:])), data[17] != 0}, nil
+			}
+		case *pgproto3.ErrorResponse:
+			return nil, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyDone:
+			return nil, errors.New("replication stream ended")
+		}
+	}
+}
+
+// sendStatus reports the position written and flushed by the client, the
+// server may recycle the write-ahead log before flushed
+func sendStatus(conn *pgconn.PgConn, written, flushed lsn) error {
+	data := make([]byte, 34)
+	data[0] = 'r'
+	binary.BigEndian.PutUint64(data[1:], uint64(written))
+	binary.BigEndian.PutUint64(data[9:], uint64(flushed))
+	binary.BigEndian.PutUint64(data[17:], uint64(flushed))
+	binary.BigEndian.PutUint64(data[25:], uint64(time.Since(pgEpoch)/time.Microsecond))
+	conn.Frontend().Send(&pgproto3.CopyData{Data: data})
+	return conn.Frontend().Flush()
+}
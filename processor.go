@@ -0,0 +1,558 @@
+// Package sp is the scaffolding of the stream processors: the common flags,
+// the consumption of the stream with its offsets checkpointed in a state
+// store, the producer of results, and the graceful shutdown; a processor
+// implements its business logic only.
+//
+// A processor forwarding the messages of a stream matching a field:
+//
+//	type match struct{ field, value string }
+//
+//	func (p *match) Setup(ctx *sp.Context) error {
+//		p.field, p.value = ctx.String("field"), ctx.String("value")
+//		return nil
+//	}
+//
+//	func (p *match) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+//		fields, err := ctx.Decode(msg)
+//		if err != nil {
+//			return err
+//		}
+//		if fmt.Sprint(fields[p.field]) == p.value {
+//			ctx.Forward(msg, ctx.OutputTopic)
+//			ctx.Count("matched", 1)
+//		}
+//		return nil
+//	}
+//
+//	func (p *match) Checkpoint(ctx *sp.Context) error { return nil }
+//
+//	func main() {
+//		sp.Run(&sp.App{
+//			Name:  "match",
+//			Usage: "Forward the messages of a stream whose field has a value",
+//			Flags: []cli.Flag{&cli.StringFlag{Name: "field"}, &cli.StringFlag{Name: "value"}},
+//			Processor: &match{},
+//		})
+//	}
+//
+// Processors implementing TimerProcessor schedule callbacks by key with
+// Context.SetTimer, pending timers are checkpointed along with the offsets.
+package sp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+	"github.com/xtaci/sp/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// OffsetBucket is the bucket of the offsets of the stream in the store,
+// shared with the processors written before the package
+const OffsetBucket = "__offset_stream__"
+
+// workerQueue is the number of messages queued to each worker with
+// parallelism
+const workerQueue = 64
+
+// Processor is the business logic of a stream processor, its methods are
+// called from a single goroutine but Process with --parallelism
+type Processor interface {
+	// Setup reads the flags of the processor and loads its state from
+	// ctx.Store, before the stream is consumed
+	Setup(ctx *Context) error
+	// Process handles a message of the stream; messages failing are
+	// counted as invalid and skipped. With --parallelism N it is called
+	// concurrently from N goroutines, the messages of a kafka key in order
+	// from the same one, and never concurrently with the other methods
+	Process(ctx *Context, msg *sarama.ConsumerMessage) error
+	// Checkpoint writes the state of the processor to ctx.Store, after
+	// the messages sent have been acknowledged and before the offsets are
+	// stored
+	Checkpoint(ctx *Context) error
+}
+
+// App describes a processor built on the scaffolding
+type App struct {
+	Name      string
+	Usage     string
+	Version   string
+	Flags     []cli.Flag // flags of the processor, besides the common ones
+	Processor Processor
+	// Oldest consumes the partitions without offsets from their oldest
+	// messages instead of their newest ones
+	Oldest bool
+	// NoOutput is set for processors producing to the topics of their own
+	// flags only, without the flag output-topic; the cache file is named
+	// after the stream topic
+	NoOutput bool
+}
+
+// Context is the environment of a processor: its flags, the store of its
+// state and the producer of its results
+type Context struct {
+	*cli.Context
+	Name        string
+	Brokers     []string
+	StreamTopic string
+	OutputTopic string // {name}-{stream-topic} if not set, empty with NoOutput
+	Store       state.Store
+	Decoder     codec.Decoder
+	Tracer      *tracing.Tracer
+
+	producer sarama.AsyncProducer
+	inflight sync.WaitGroup
+	mu       sync.Mutex // of timers and counters, with parallelism
+	timers   *timers
+	traces   sync.Map // trace contexts of the messages processed
+	counters map[string]int
+	names    []string // counters in order of first use
+}
+
+// Offsets tracks the next offset to consume of each partition of a topic
+type Offsets map[int32]int64
+
+// Run parses the command line and runs the processor of app until it
+// receives SIGINT or SIGTERM
+func Run(app *App) {
+	version := app.Version
+	if version == "" {
+		version = "0.1"
+	}
+	flags := []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "brokers, b",
+			Value: cli.NewStringSlice("localhost:9092"),
+			Usage: "kafka brokers address",
+		},
+		&cli.StringFlag{
+			Name:  "stream-topic",
+			Value: "events",
+			Usage: "topic name of the stream to process",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "json",
+			Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+		},
+		&cli.StringFlag{
+			Name:  "schema-registry-url",
+			Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+		},
+		&cli.StringFlag{
+			Name:  "proto-descriptor",
+			Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+		},
+		&cli.StringFlag{
+			Name:  "proto-message",
+			Usage: "full name of the protobuf type of stream messages",
+		},
+		&cli.StringFlag{
+			Name:  "state-backend",
+			Value: "bolt",
+			Usage: "store of state and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+		},
+		&cli.DurationFlag{
+			Name:  "write-interval",
+			Value: 30 * time.Second,
+			Usage: "interval for cache writing",
+		},
+		&cli.StringFlag{
+			Name:  "debug-addr",
+			Value: "",
+			Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+		},
+		&cli.IntFlag{
+			Name:  "parallelism",
+			Value: 1,
+			Usage: "number of goroutines processing the messages, the messages of a kafka key are processed in order by the same one",
+		},
+	}
+	if !app.NoOutput {
+		flags = append(flags, &cli.StringFlag{
+			Name:  "output-topic",
+			Value: "",
+			Usage: fmt.Sprintf("default output topic name: %v-{stream-topic}", app.Name),
+		})
+	}
+	cliApp := &cli.App{
+		Name:    app.Name,
+		Usage:   app.Usage,
+		Version: version,
+		Flags:   append(append(append(append(append(flags, state.Flags...), logging.Flags...), tracing.Flags...), kafka.Flags...), app.Flags...),
+		Action: func(c *cli.Context) error {
+			if err := logging.Setup(c); err != nil {
+				log.Fatalln(err)
+			}
+			if err := kafka.Setup(c); err != nil {
+				log.Fatalln(err)
+			}
+			run(app, c)
+			return nil
+		},
+	}
+	cliApp.Run(os.Args)
+}
+
+func run(app *App, c *cli.Context) {
+	ctx := &Context{
+		Context:     c,
+		Name:        app.Name,
+		Brokers:     c.StringSlice("brokers"),
+		StreamTopic: c.String("stream-topic"),
+		OutputTopic: c.String("output-topic"),
+		counters:    make(map[string]int),
+		timers:      newTimers(),
+	}
+	if ctx.OutputTopic == "" && !app.NoOutput {
+		ctx.OutputTopic = fmt.Sprintf("%v-%v", app.Name, ctx.StreamTopic)
+	}
+	tracer, err := tracing.Setup(c, app.Name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer tracing.Shutdown()
+	ctx.Tracer = tracer
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+	parallelism := c.Int("parallelism")
+
+	log.Println("brokers:", ctx.Brokers)
+	log.Println("stream-topic:", ctx.StreamTopic)
+	if !app.NoOutput {
+		log.Println("output-topic:", ctx.OutputTopic)
+	}
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+	log.Println("parallelism:", parallelism)
+	debug.Serve(c.String("debug-addr"))
+
+	if parallelism < 1 {
+		log.Fatalln("parallelism must be positive")
+	}
+
+	cachefile := fmt.Sprintf(".%v-%v-%v.cache", app.Name, ctx.StreamTopic, ctx.OutputTopic)
+	if app.NoOutput {
+		cachefile = fmt.Sprintf(".%v-%v.cache", app.Name, ctx.StreamTopic)
+	}
+	log.Println("cache file:", cachefile)
+
+	ctx.Decoder, err = codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx.Store, err = state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer ctx.Store.Close()
+
+	if err := ctx.timers.load(ctx.Store); err != nil {
+		log.Fatalln(err)
+	}
+	if err := app.Processor.Setup(ctx); err != nil {
+		log.Fatalln(err)
+	}
+
+	consumer, err := sarama.NewConsumer(ctx.Brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	ctx.producer, err = sarama.NewAsyncProducer(ctx.Brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, offsets are only committed after all messages
+	// sent before have been acknowledged
+	go func() {
+		for range ctx.producer.Successes() {
+			ctx.inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range ctx.producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := ctx.producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(Offsets)
+	if err := streamOffsets.Load(ctx.Store, OffsetBucket); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v pending timers:%v", streamOffsets, len(ctx.timers.pending))
+
+	defaultOffset := sarama.OffsetNewest
+	if app.Oldest {
+		defaultOffset = sarama.OffsetOldest
+	}
+	streamMessages, streamConsumers, err := ConsumeAll(consumer, ctx.StreamTopic, streamOffsets, defaultOffset)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	tick := time.NewTicker(tickInterval)
+	timerProcessor, _ := app.Processor.(TimerProcessor)
+
+	// workers process the messages hashed by key with parallelism,
+	// checkpoints and timers wait for the messages dispatched
+	var pending sync.WaitGroup
+	process := func(msg *sarama.ConsumerMessage) {
+		trace, span := ctx.Tracer.Start(msg, app.Name)
+		ctx.traces.Store(msg, trace)
+		if err := app.Processor.Process(ctx, msg); err != nil {
+			ctx.Count("invalid", 1)
+			log.WithFields(logging.Message(msg)).WithError(err).Debugln("invalid message")
+			tracing.Fail(span, err)
+		}
+		ctx.traces.Delete(msg)
+		span.End()
+	}
+	var workers []chan *sarama.ConsumerMessage
+	if parallelism > 1 {
+		for i := 0; i < parallelism; i++ {
+			queue := make(chan *sarama.ConsumerMessage, workerQueue)
+			workers = append(workers, queue)
+			go func() {
+				for msg := range queue {
+					process(msg)
+					pending.Done()
+				}
+			}()
+		}
+	}
+
+	checkpoint := func() {
+		pending.Wait()
+		ctx.inflight.Wait()
+		if err := app.Processor.Checkpoint(ctx); err != nil {
+			log.Fatalln(err)
+		}
+		if err := ctx.timers.flush(ctx.Store); err != nil {
+			log.Fatalln(err)
+		}
+		if err := streamOffsets.Store(ctx.Store, OffsetBucket); err != nil {
+			log.Fatalln(err)
+		}
+		if err := ctx.Store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		var counters []interface{}
+		for _, name := range ctx.names {
+			counters = append(counters, name+":", ctx.counters[name])
+			ctx.counters[name] = 0
+		}
+		log.Println(append(counters, "pending timers:", len(ctx.timers.pending), "stream offsets:", streamOffsets)...)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case now := <-tick.C:
+			if timerProcessor == nil {
+				continue
+			}
+			pending.Wait()
+			for _, t := range ctx.timers.due(now) {
+				if err := timerProcessor.OnTimer(ctx, t.key, t.data); err != nil {
+					ctx.Count("invalid", 1)
+					log.WithField("timer", t.key).WithError(err).Debugln("invalid timer")
+				}
+			}
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			if workers == nil {
+				process(msg)
+				continue
+			}
+			pending.Add(1)
+			workers[worker(msg, len(workers))] <- msg
+		}
+	}
+}
+
+// Decode decodes the value of a stream message into its json fields
+func (ctx *Context) Decode(msg *sarama.ConsumerMessage) (map[string]interface{}, error) {
+	value, err := ctx.Decoder.Decode(msg.Value)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Send produces a message to topic, acknowledged before the next checkpoint
+func (ctx *Context) Send(topic string, key, value []byte) {
+	ctx.SendFrom(nil, topic, key, value)
+}
+
+// SendFrom produces a message to topic resulting from a stream message,
+// carrying on the trace of the stream message in its headers
+func (ctx *Context) SendFrom(msg *sarama.ConsumerMessage, topic string, key, value []byte) {
+	out := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)}
+	if key != nil {
+		out.Key = sarama.ByteEncoder(key)
+	}
+	if msg != nil {
+		tracing.Inject(ctx.Trace(msg), out)
+	}
+	ctx.inflight.Add(1)
+	ctx.producer.Input() <- out
+}
+
+// Forward produces a stream message as is to topic
+func (ctx *Context) Forward(msg *sarama.ConsumerMessage, topic string) {
+	ctx.SendFrom(msg, topic, msg.Key, msg.Value)
+}
+
+// Trace returns the context of the span of a stream message being
+// processed, for the spans of the stages of its processing with
+// ctx.Tracer.Stage
+func (ctx *Context) Trace(msg *sarama.ConsumerMessage) context.Context {
+	if trace, ok := ctx.traces.Load(msg); ok {
+		return trace.(context.Context)
+	}
+	return tracing.Extract(msg)
+}
+
+// Count adds n to the counter of name, the counters are logged and reset
+// on checkpoints
+func (ctx *Context) Count(name string, n int) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if _, ok := ctx.counters[name]; !ok {
+		ctx.names = append(ctx.names, name)
+	}
+	ctx.counters[name] += n
+}
+
+// worker returns the worker of a message of n, by the hash of its kafka key
+// or its partition for messages without key
+func worker(msg *sarama.ConsumerMessage, n int) int {
+	h := fnv.New32a()
+	if msg.Key != nil {
+		h.Write(msg.Key)
+	} else {
+		binary.Write(h, binary.BigEndian, msg.Partition)
+	}
+	return int(h.Sum32() % uint32(n))
+}
+
+// ConsumeAll starts consuming all partitions of a topic, resuming from the
+// recorded offsets or from defaultOffset for newly seen partitions; messages
+// from all partitions are merged into a single channel, the consumers are
+// returned by partition
+func ConsumeAll(consumer sarama.Consumer, topic string, offs Offsets, defaultOffset int64) (<-chan *sarama.ConsumerMessage, map[int32]sarama.PartitionConsumer, error) {
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages := make(chan *sarama.ConsumerMessage)
+	pcs := make(map[int32]sarama.PartitionConsumer)
+	for _, partition := range partitions {
+		offset, ok := offs[partition]
+		if !ok {
+			offset = defaultOffset
+		}
+
+		pc, err := consumer.ConsumePartition(topic, partition, offset)
+		if err != nil {
+			for _, pc := range pcs {
+				pc.Close()
+			}
+			return nil, nil, err
+		}
+		pcs[partition] = pc
+
+		go func(pc sarama.PartitionConsumer) {
+			for msg := range pc.Messages() {
+				messages <- msg
+			}
+		}(pc)
+	}
+	return messages, pcs, nil
+}
+
+// Load reads per-partition offsets from bucket
+func (offs Offsets) Load(store state.Store, bucket string) error {
+	return store.Iterate(bucket, func(k, v []byte) error {
+		offs[int32(binary.BigEndian.Uint32(k))] = int64(binary.LittleEndian.Uint64(v))
+		return nil
+	})
+}
+
+// Store writes per-partition offsets to bucket
+func (offs Offsets) Store(store state.Store, bucket string) error {
+	for partition, offset := range offs {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, uint32(partition))
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(offset))
+		if err := store.Put(bucket, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/redis/go-redis/v9"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+	"github.com/xtaci/sp/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "redis-sink"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Write the messages of a stream into redis as strings or hashes, to serve them to online applications",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to write",
+			},
+			&cli.IntFlag{
+				Name:  "redis-db",
+				Value: 0,
+				Usage: "database of a redis server",
+			},
+			&cli.StringFlag{
+				Name:  "key-field",
+				Value: "",
+				Usage: "json field of the redis keys of messages, the keys of messages if not set, format: a.b.0.c",
+			},
+			&cli.StringFlag{
+				Name:  "key-prefix",
+				Value: "",
+				Usage: "prefix of redis keys, e.g.: user:",
+			},
+			&cli.StringFlag{
+				Name:  "type",
+				Value: "string",
+				Usage: "string: messages are stored as json strings, hash: the top-level fields of messages are stored as fields of hashes, objects and arrays as json",
+			},
+			&cli.StringFlag{
+				Name:  "value-field",
+				Value: "",
+				Usage: "json field stored as the string instead of whole messages, with type string",
+			},
+			&cli.StringSliceFlag{
+				Name:  "field",
+				Usage: "field of the hashes, repeated per field, all top-level fields if not set, with type hash",
+			},
+			&cli.BoolFlag{
+				Name:  "replace",
+				Usage: "replace hashes instead of merging the fields of messages into them",
+			},
+			&cli.DurationFlag{
+				Name:  "ttl",
+				Value: 0,
+				Usage: "expiration of the keys written, none if 0",
+			},
+			&cli.IntFlag{
+				Name:  "batch-size",
+				Value: 1000,
+				Usage: "max messages per pipeline",
+			},
+			&cli.DurationFlag{
+				Name:  "flush-interval",
+				Value: 100 * time.Millisecond,
+				Usage: "max time messages wait for a pipeline",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(append(state.Flags, logging.Flags...), tracing.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	redis_db := c.Int("redis-db")
+	key_field := c.String("key-field")
+	key_prefix := c.String("key-prefix")
+	type_name := c.String("type")
+	value_field := c.String("value-field")
+	hash_fields := c.StringSlice("field")
+	replace := c.Bool("replace")
+	ttl := c.Duration("ttl")
+	batch_size := c.Int("batch-size")
+	flush_interval := c.Duration("flush-interval")
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("redis-db:", redis_db)
+	log.Println("key-field:", key_field)
+	log.Println("key-prefix:", key_prefix)
+	log.Println("type:", type_name)
+	log.Println("value-field:", value_field)
+	log.Println("field:", hash_fields)
+	log.Println("replace:", replace)
+	log.Println("ttl:", ttl)
+	log.Println("batch-size:", batch_size)
+	log.Println("flush-interval:", flush_interval)
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".redis-sink-%v-%v.cache", stream_topic, key_prefix)
+	log.Println("cache file:", cachefile)
+
+	switch type_name {
+	case "string":
+		if len(hash_fields) > 0 || replace {
+			log.Fatalln("field and replace require type hash")
+		}
+	case "hash":
+		if value_field != "" {
+			log.Fatalln("value-field requires type string")
+		}
+	default:
+		log.Fatalln("unsupported type:", type_name)
+	}
+	if batch_size <= 0 {
+		log.Fatalln("batch-size must be positive")
+	}
+
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    state_options.RedisAddrs,
+		Password: state_options.RedisPassword,
+		DB:       redis_db,
+	})
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	flushTicker := time.NewTicker(flush_interval)
+	numWritten, numDeleted, numInvalid := 0, 0, 0
+
+	// commands of the next pipeline, in the order of messages
+	pipe := client.Pipeline()
+	numQueued := 0
+	var traces []context.Context // of the messages of the batch
+	tracer, err := tracing.Setup(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer tracing.Shutdown()
+
+	// flush executes the pipeline, the sink exits on failures, the stream
+	// is then written again from the last checkpoint
+	flush := func() {
+		if numQueued == 0 {
+			return
+		}
+		_, span := tracer.Batch(traces, "exec")
+		traces = nil
+		defer span.End()
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Fatalln(err)
+		}
+		numQueued = 0
+	}
+
+	add := func(msg *sarama.ConsumerMessage) {
+		trace, span := tracer.Start(msg, processorName)
+		defer span.End()
+		var doc interface{}
+		if msg.Value != nil {
+			value, err := decoder.Decode(msg.Value)
+			if err != nil {
+				numInvalid++
+				return
+			}
+			dec := json.NewDecoder(bytes.NewReader(value))
+			dec.UseNumber()
+			if err := dec.Decode(&doc); err != nil {
+				numInvalid++
+				return
+			}
+		}
+
+		key := string(msg.Key)
+		if key_field != "" {
+			v := expr.Lookup(doc, key_field)
+			if v == nil {
+				numInvalid++
+				return
+			}
+			key = fmt.Sprint(v)
+		}
+		if key == "" {
+			numInvalid++
+			return
+		}
+		key = key_prefix + key
+
+		switch {
+		case doc == nil: // messages without value delete their key
+			pipe.Del(ctx, key)
+			numDeleted++
+		case type_name == "string":
+			v := doc
+			if value_field != "" {
+				if v = expr.Lookup(doc, value_field); v == nil {
+					numInvalid++
+					return
+				}
+			}
+			s, err := stringValue(v)
+			if err != nil {
+				numInvalid++
+				return
+			}
+			pipe.Set(ctx, key, s, ttl)
+			numWritten++
+		default:
+			values, err := hashValues(doc, hash_fields)
+			if err != nil || len(values) == 0 {
+				numInvalid++
+				return
+			}
+			if replace {
+				pipe.Del(ctx, key)
+			}
+			pipe.HSet(ctx, key, values)
+			if ttl > 0 {
+				pipe.Expire(ctx, key, ttl)
+			}
+			numWritten++
+		}
+		numQueued++
+		traces = append(traces, trace)
+		if numQueued >= batch_size {
+			flush()
+		}
+	}
+
+	checkpoint := func() {
+		flush()
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("written:", numWritten, "deleted:", numDeleted, "invalid:", numInvalid, "stream offsets:", streamOffsets)
+		numWritten, numDeleted, numInvalid = 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case <-flushTicker.C:
+			flush()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			add(msg)
+		}
+	}
+}
+
+// stringValue formats a json value as a redis string, strings and numbers
+// as is, other values as json
+func stringValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+	bts, err := json.Marshal(v)
+	return string(bts), err
+}
+
+// hashValues returns the fields of the hash of a message, the values of
+// names if set, otherwise of all its top-level fields
+func hashValues(doc interface{}, names []string) (map[string]interface{}, error) {
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("message is not an object")
+	}
+	selected := fields
+	if len(names) > 0 {
+		selected = make(map[string]interface{}, len(names))
+		for _, name := range names {
+			selected[name] = expr.Lookup(fields, name)
+		}
+	}
+	values := make(map[string]interface{}, len(selected))
+	for name, v := range selected {
+		if v == nil {
+			continue
+		}
+		s, err := stringValue(v)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = s
+	}
+	return values, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	partitionsBucket = "__partitions__"
+	joinerBucket     = "joiner"
+	processorName    = "replayer"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Emit the rows or the whole state of a joiner state file back into a kafka topic",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "file",
+				Value: "",
+				Usage: "state file of the joiner to replay",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "topic to emit to",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "wal",
+				Usage: "wal: the WAL rows of the tables keyed by row key, to consume as table-topic, changelog: every key/value of the state as a changelog, to restore with changelog-topic, created compacted if missing",
+			},
+			&cli.StringSliceFlag{
+				Name:  "table",
+				Usage: "table of the rows to replay with wal format, all tables if not set",
+			},
+			&cli.StringFlag{
+				Name:    "state-encryption-key",
+				EnvVars: []string{"STATE_ENCRYPTION_KEY"},
+				Usage:   "hex encoded AES key of the state file, rows are decrypted with wal format",
+			},
+			&cli.StringFlag{
+				Name:  "state-compression",
+				Usage: "compression of the state file, rows are decompressed with wal format",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	file := c.String("file")
+	output_topic := c.String("output-topic")
+	format_name := c.String("format")
+	table_names := c.StringSlice("table")
+	state_encryption_key := c.String("state-encryption-key")
+	state_compression := c.String("state-compression")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("file:", file)
+	log.Println("output-topic:", output_topic)
+	log.Println("format:", format_name)
+	log.Println("table:", table_names)
+	log.Println("state-encryption:", state_encryption_key != "")
+	log.Println("state-compression:", state_compression)
+
+	if file == "" {
+		log.Fatalln("file must be set")
+	}
+	if output_topic == "" {
+		log.Fatalln("output-topic must be set")
+	}
+	if _, err := os.Stat(file); err != nil {
+		log.Fatalln(err)
+	}
+	base, err := state.OpenBolt(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer base.Close()
+
+	// buckets to replay, values of the changelog are stored as is like the
+	// changelog of the joiner, beneath encryption and compression
+	var store state.Store = base
+	var buckets []string
+	switch format_name {
+	case "wal":
+		tables := make(map[string]bool)
+		for _, name := range table_names {
+			tables[name] = true
+		}
+		for _, name := range base.Buckets() {
+			if table := tableOf(name); table != "" && (len(tables) == 0 || tables[table]) {
+				buckets = append(buckets, name)
+			}
+		}
+		if state_encryption_key != "" {
+			if store, err = state.NewEncrypted(store, state_encryption_key); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if state_compression != "" {
+			if store, err = state.NewCompressed(store, state_compression); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	case "changelog":
+		if len(table_names) > 0 {
+			log.Fatalln("table requires wal format")
+		}
+		buckets = base.Buckets()
+	default:
+		log.Fatalln("unsupported format:", format_name)
+	}
+	log.Println("buckets:", buckets)
+
+	config := kafka.NewConfig()
+	config.Version = sarama.V0_10_2_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+	if format_name == "changelog" {
+		if err := createCompacted(client, output_topic); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	producer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, the replay completes once all are acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			log.Fatalln(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(10 * time.Second)
+	start := time.Now()
+	numReplayed := 0
+
+	for _, bucket := range buckets {
+		n := 0
+		if err := store.Iterate(bucket, func(k, v []byte) error {
+			select {
+			case sig := <-signals:
+				log.Fatalln("received signal:", sig, "replayed:", numReplayed)
+			case <-ticker.C:
+				log.Println("replayed:", numReplayed)
+			default:
+			}
+
+			key := k
+			if format_name == "changelog" {
+				key = append(append([]byte(bucket), 0), k...)
+			}
+			out := &sarama.ProducerMessage{
+				Topic: output_topic,
+				Key:   sarama.ByteEncoder(append([]byte(nil), key...)),
+				Value: sarama.ByteEncoder(append([]byte(nil), v...)),
+			}
+			inflight.Add(1)
+			producer.Input() <- out
+			n++
+			numReplayed++
+			return nil
+		}); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("bucket:", bucket, "replayed:", n)
+	}
+
+	inflight.Wait()
+	if err := producer.Close(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("replayed:", numReplayed, "in", time.Since(start))
+	return nil
+}
+
+// tableOf returns the table of the rows of a bucket of the joiner, rows are
+// in joiner/{table}, or __partitions__/{partition}/{table} with partition
+// buckets; empty for other buckets
+func tableOf(bucket string) string {
+	parts := strings.Split(bucket, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == joinerBucket:
+		return parts[1]
+	case len(parts) == 3 && parts[0] == partitionsBucket:
+		return parts[2]
+	}
+	return ""
+}
+
+// createCompacted creates topic with compaction if missing, like the
+// changelog topics of processors
+func createCompacted(client sarama.Client, topic string) error {
+	topics, err := client.Topics()
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		if t == topic {
+			return nil
+		}
+	}
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return err
+	}
+	replicas := int16(len(client.Brokers()))
+	if replicas > 3 {
+		replicas = 3
+	}
+	compact := "compact"
+	return admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     1,
+		ReplicationFactor: replicas,
+		ConfigEntries:     map[string]*string{"cleanup.policy": &compact},
+	}, false)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "router",
+		Usage: "Route the messages of a stream to topics by field value or predicates",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "field",
+				Value: "",
+				Usage: "route by the value of the json field, routes are value:topic, e.g.: --field type --route click:clicks",
+			},
+			&cli.StringSliceFlag{
+				Name:  "route",
+				Usage: "predicate:topic rules over the json fields of stream messages tried in order, e.g.: --route 'type == \"click\":clicks', or value:topic with field",
+			},
+			&cli.StringFlag{
+				Name:  "default",
+				Value: "",
+				Usage: "topic of the messages matching no route, dropped if not set",
+			},
+		},
+		Processor: &routing{},
+		NoOutput:  true,
+	})
+}
+
+// routing forwards the messages to the topic of their route, or to the
+// default topic if set
+type routing struct {
+	router       *router
+	defaultTopic string
+}
+
+func (p *routing) Setup(ctx *sp.Context) error {
+	field := ctx.String("field")
+	routes := ctx.StringSlice("route")
+	p.defaultTopic = ctx.String("default")
+
+	log.Println("field:", field)
+	log.Println("route:", routes)
+	log.Println("default:", p.defaultTopic)
+
+	if len(routes) == 0 && p.defaultTopic == "" {
+		return errors.New("route or default must be set")
+	}
+	var err error
+	p.router, err = newRouter(field, routes)
+	ctx.Count("routed", 0)
+	ctx.Count("default", 0)
+	ctx.Count("dropped", 0)
+	ctx.Count("invalid", 0)
+	return err
+}
+
+func (p *routing) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	fields, err := ctx.Decode(msg)
+	if err != nil {
+		return err
+	}
+	switch topic := p.router.route(fields); {
+	case topic != "":
+		ctx.Forward(msg, topic)
+		ctx.Count("routed", 1)
+	case p.defaultTopic != "":
+		ctx.Forward(msg, p.defaultTopic)
+		ctx.Count("default", 1)
+	default:
+		ctx.Count("dropped", 1)
+	}
+	return nil
+}
+
+func (p *routing) Checkpoint(ctx *sp.Context) error { return nil }
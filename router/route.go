@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xtaci/sp/expr"
+)
+
+// rule routes the messages satisfying a predicate to a topic
+type rule struct {
+	predicate *expr.Expr
+	topic     string
+}
+
+// router picks the topic of a message, by the value of a field if set,
+// otherwise by the first rule the message satisfies
+type router struct {
+	field  string
+	values map[string]string // field value to topic
+	rules  []rule
+}
+
+// newRouter parses routes, value:topic with field and predicate:topic
+// without; routes split at the last colon as topic names have none
+func newRouter(field string, routes []string) (*router, error) {
+	r := &router{field: field, values: make(map[string]string)}
+	for _, route := range routes {
+		i := strings.LastIndexByte(route, ':')
+		if i <= 0 || i == len(route)-1 {
+			return nil, fmt.Errorf("route %q: expect condition:topic", route)
+		}
+		cond, topic := strings.TrimSpace(route[:i]), strings.TrimSpace(route[i+1:])
+		if field != "" {
+			r.values[cond] = topic
+			continue
+		}
+		e, err := expr.Compile(cond)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %v", route, err)
+		}
+		r.rules = append(r.rules, rule{e, topic})
+	}
+	return r, nil
+}
+
+// route returns the topic of a message, empty if no route matches; rules
+// failing to evaluate, e.g. comparing a missing field, don't match
+func (r *router) route(fields map[string]interface{}) string {
+	if r.field != "" {
+		v := expr.Lookup(fields, r.field)
+		if v == nil {
+			return ""
+		}
+		return r.values[fmt.Sprint(v)]
+	}
+	for _, rule := range r.rules {
+		if ok, err := rule.predicate.Bool(fields); err == nil && ok {
+			return rule.topic
+		}
+	}
+	return ""
+}
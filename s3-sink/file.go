@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// batch is the messages of a partition of the stream in a partition of
+// the bucket, uploaded as one file
+type batch struct {
+	dir       string // partition path, e.g. dt=2024-01-02/hour=13
+	partition int32
+	first     int64 // offset of the first message
+	records   [][]byte
+	bytes     int
+	opened    time.Time
+	traces    []context.Context // of the messages of the batch
+}
+
+// encoder encodes the json records of a batch into a file
+type encoder interface {
+	extension() string
+	contentType() string
+	encode(records [][]byte) ([]byte, error)
+}
+
+func newEncoder(format, parquetCompression string) (encoder, error) {
+	switch format {
+	case "jsonl":
+		return jsonlEncoder{}, nil
+	case "gzip":
+		return gzipEncoder{}, nil
+	case "parquet":
+		codecs := map[string]parquet.WriterOption{
+			"none":   parquet.Compression(&parquet.Uncompressed),
+			"snappy": parquet.Compression(&parquet.Snappy),
+			"gzip":   parquet.Compression(&parquet.Gzip),
+			"zstd":   parquet.Compression(&parquet.Zstd),
+		}
+		codec, ok := codecs[parquetCompression]
+		if !ok {
+			return nil, fmt.Errorf("unsupported parquet compression %q", parquetCompression)
+		}
+		return parquetEncoder{codec}, nil
+	}
+	return nil, fmt.Errorf("unsupported file format %q", format)
+}
+
+// jsonlEncoder writes a record per line
+type jsonlEncoder struct{}
+
+func (jsonlEncoder) extension() string   { return ".jsonl" }
+func (jsonlEncoder) contentType() string { return "application/x-ndjson" }
+
+func (jsonlEncoder) encode(records [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipEncoder writes gzip compressed json lines
+type gzipEncoder struct{}
+
+func (gzipEncoder) extension() string   { return ".jsonl.gz" }
+func (gzipEncoder) contentType() string { return "application/gzip" }
+
+func (gzipEncoder) encode(records [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	for _, r := range records {
+		w.Write(r)
+		w.Write([]byte{'\n'})
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parquetEncoder writes a column per top-level field of the records of a
+// file: integers are int64, other numbers double, booleans boolean,
+// strings string, objects and arrays json; fields of mixed types are json
+type parquetEncoder struct {
+	compression parquet.WriterOption
+}
+
+func (parquetEncoder) extension() string   { return ".parquet" }
+func (parquetEncoder) contentType() string { return "application/vnd.apache.parquet" }
+
+// column kinds, ordered by generality
+const (
+	kindInt = iota
+	kindFloat
+	kindBool
+	kindString
+	kindJSON
+)
+
+func (e parquetEncoder) encode(records [][]byte) ([]byte, error) {
+	rows := make([]map[string]interface{}, 0, len(records))
+	kinds := make(map[string]int)
+	for _, r := range records {
+		var fields map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(r))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil {
+			return nil, err
+		}
+		for name, v := range fields {
+			if v == nil {
+				if _, ok := kinds[name]; !ok {
+					kinds[name] = -1 // unknown until a value is seen
+				}
+				continue
+			}
+			k := kindOf(v)
+			if prev, ok := kinds[name]; ok && prev >= 0 && prev != k {
+				if prev <= kindFloat && k <= kindFloat {
+					k = kindFloat
+				} else {
+					k = kindJSON
+				}
+			}
+			kinds[name] = k
+		}
+		rows = append(rows, fields)
+	}
+
+	group := make(parquet.Group)
+	for name, k := range kinds {
+		switch k {
+		case kindInt:
+			group[name] = parquet.Optional(parquet.Int(64))
+		case kindFloat:
+			group[name] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		case kindBool:
+			group[name] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		case kindString, -1:
+			group[name] = parquet.Optional(parquet.String())
+		default:
+			group[name] = parquet.Optional(parquet.JSON())
+		}
+	}
+	schema := parquet.NewSchema("record", group)
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := make([]int, len(names))
+	for i, name := range names {
+		leaf, _ := schema.Lookup(name)
+		columns[i] = leaf.ColumnIndex
+	}
+
+	var buf bytes.Buffer
+	w := parquet.NewWriter(&buf, schema, e.compression)
+	row := make(parquet.Row, len(names))
+	for _, fields := range rows {
+		for i, name := range names {
+			if fields[name] == nil {
+				row[columns[i]] = parquet.Value{}.Level(0, 0, columns[i])
+				continue
+			}
+			v, err := parquetValue(kinds[name], fields[name])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", name, err)
+			}
+			row[columns[i]] = v.Level(0, 1, columns[i])
+		}
+		if _, err := w.WriteRows([]parquet.Row{row}); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func kindOf(v interface{}) int {
+	switch v := v.(type) {
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return kindInt
+		}
+		return kindFloat
+	case bool:
+		return kindBool
+	case string:
+		return kindString
+	}
+	return kindJSON
+}
+
+// parquetValue converts a json value to the value of a column of kind
+func parquetValue(kind int, v interface{}) (parquet.Value, error) {
+	switch kind {
+	case kindInt:
+		i, err := v.(json.Number).Int64()
+		return parquet.ValueOf(i), err
+	case kindFloat:
+		f, err := v.(json.Number).Float64()
+		return parquet.ValueOf(f), err
+	case kindBool:
+		return parquet.ValueOf(v.(bool)), nil
+	case kindString, -1:
+		return parquet.ValueOf(v.(string)), nil
+	}
+	bts, err := json.Marshal(v)
+	return parquet.ValueOf(bts), err
+}
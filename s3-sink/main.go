@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+	"github.com/xtaci/sp/tracing"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "s3-sink"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Archive the messages of a stream into files of s3 or gcs, partitioned by time",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to archive",
+			},
+			&cli.StringFlag{
+				Name:  "bucket",
+				Value: "",
+				Usage: "bucket of the files",
+			},
+			&cli.StringFlag{
+				Name:  "prefix",
+				Value: "",
+				Usage: "prefix of the keys of the files, default: stream-topic",
+			},
+			&cli.StringFlag{
+				Name:  "partition-layout",
+				Value: "dt=2006-01-02/hour=15",
+				Usage: "go time layout of the partition paths, in UTC",
+			},
+			&cli.StringFlag{
+				Name:  "time-field",
+				Value: "",
+				Usage: "json field of the time of messages partitioning the files, RFC 3339 or epoch seconds or milliseconds, the timestamps of kafka if not set, format: a.b.0.c",
+			},
+			&cli.StringFlag{
+				Name:  "file-format",
+				Value: "gzip",
+				Usage: "jsonl, gzip: gzipped jsonl, or parquet: a column per top-level field",
+			},
+			&cli.StringFlag{
+				Name:  "parquet-compression",
+				Value: "snappy",
+				Usage: "compression of parquet files, none, snappy, gzip or zstd",
+			},
+			&cli.IntFlag{
+				Name:  "max-bytes",
+				Value: 64 << 20,
+				Usage: "max bytes of messages per file",
+			},
+			&cli.IntFlag{
+				Name:  "max-records",
+				Value: 1000000,
+				Usage: "max messages per file",
+			},
+			&cli.DurationFlag{
+				Name:  "max-age",
+				Value: 5 * time.Minute,
+				Usage: "max time a file is open before upload",
+			},
+			&cli.StringFlag{
+				Name:  "endpoint",
+				Value: "",
+				Usage: "url of an s3 compatible store, e.g.: https://storage.googleapis.com, aws s3 in region if not set",
+			},
+			&cli.StringFlag{
+				Name:  "region",
+				Value: "us-east-1",
+				Usage: "region of the bucket, auto for gcs",
+			},
+			&cli.BoolFlag{
+				Name:  "path-style",
+				Usage: "address the bucket in the path instead of the host, e.g. for minio",
+			},
+			&cli.StringFlag{
+				Name:    "access-key",
+				EnvVars: []string{"AWS_ACCESS_KEY_ID"},
+				Usage:   "access key id, or hmac key of gcs",
+			},
+			&cli.StringFlag{
+				Name:    "secret-key",
+				EnvVars: []string{"AWS_SECRET_ACCESS_KEY"},
+				Usage:   "secret access key, or hmac secret of gcs",
+			},
+			&cli.StringFlag{
+				Name:    "session-token",
+				EnvVars: []string{"AWS_SESSION_TOKEN"},
+				Usage:   "session token of temporary credentials",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Value: 8,
+				Usage: "retries of uploads failing with timeouts, 429 or 5xx, the sink exits once exhausted",
+			},
+			&cli.DurationFlag{
+				Name:  "retry-backoff",
+				Value: 500 * time.Millisecond,
+				Usage: "delay before the first retry, doubled on each retry",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(append(state.Flags, logging.Flags...), tracing.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	bucket := c.String("bucket")
+	prefix := c.String("prefix")
+	if prefix == "" {
+		prefix = stream_topic
+	}
+	partition_layout := c.String("partition-layout")
+	time_field := c.String("time-field")
+	file_format := c.String("file-format")
+	parquet_compression := c.String("parquet-compression")
+	max_bytes := c.Int("max-bytes")
+	max_records := c.Int("max-records")
+	max_age := c.Duration("max-age")
+	endpoint := c.String("endpoint")
+	region := c.String("region")
+	path_style := c.Bool("path-style")
+	retries := c.Int("retries")
+	retry_backoff := c.Duration("retry-backoff")
+	format_name := c.String("format")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("bucket:", bucket)
+	log.Println("prefix:", prefix)
+	log.Println("partition-layout:", partition_layout)
+	log.Println("time-field:", time_field)
+	log.Println("file-format:", file_format)
+	log.Println("parquet-compression:", parquet_compression)
+	log.Println("max-bytes:", max_bytes)
+	log.Println("max-records:", max_records)
+	log.Println("max-age:", max_age)
+	log.Println("endpoint:", endpoint)
+	log.Println("region:", region)
+	log.Println("path-style:", path_style)
+	log.Println("retries:", retries)
+	log.Println("retry-backoff:", retry_backoff)
+	log.Println("format:", format_name)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".s3-sink-%v-%v.cache", stream_topic, bucket)
+	log.Println("cache file:", cachefile)
+
+	if bucket == "" {
+		log.Fatalln("bucket must be set")
+	}
+	if max_bytes <= 0 || max_records <= 0 || max_age <= 0 {
+		log.Fatalln("max-bytes, max-records and max-age must be positive")
+	}
+	enc, err := newEncoder(file_format, parquet_compression)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	objects, err := newObjectStore(endpoint, bucket, region, c.String("access-key"), c.String("secret-key"), c.String("session-token"), path_style, retries, retry_backoff)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	rotateTicker := time.NewTicker(time.Second)
+	numUploaded, numFiles, numInvalid := 0, 0, 0
+
+	// open files by partition path and partition of the stream, named after
+	// the offset of their first message, files are rewritten as is when the
+	// stream is replayed from a checkpoint
+	batches := make(map[string]*batch)
+	tracer, err := tracing.Setup(c, processorName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer tracing.Shutdown()
+
+	upload := func(id string, b *batch) {
+		_, span := tracer.Batch(b.traces, "upload")
+		defer span.End()
+		body, err := enc.encode(b.records)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		key := path.Join(prefix, b.dir, fmt.Sprintf("%v-%v-%020d%v", stream_topic, b.partition, b.first, enc.extension()))
+		if err := objects.put(key, body, enc.contentType()); err != nil {
+			// exit without commit, the stream is archived again from last checkpoint
+			log.Fatalln(err)
+		}
+		delete(batches, id)
+		numUploaded += len(b.records)
+		numFiles++
+	}
+
+	add := func(msg *sarama.ConsumerMessage) {
+		trace, span := tracer.Start(msg, processorName)
+		defer span.End()
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			numInvalid++
+			return
+		}
+		if _, ok := doc.(map[string]interface{}); !ok && file_format == "parquet" {
+			numInvalid++
+			return
+		}
+		ts := msg.Timestamp
+		if time_field != "" {
+			if ts, err = parseTime(expr.Lookup(doc, time_field)); err != nil {
+				numInvalid++
+				return
+			}
+		}
+		var record bytes.Buffer
+		if err := json.Compact(&record, value); err != nil {
+			numInvalid++
+			return
+		}
+
+		dir := ts.UTC().Format(partition_layout)
+		id := fmt.Sprintf("%v/%v", dir, msg.Partition)
+		b, ok := batches[id]
+		if !ok {
+			b = &batch{dir: dir, partition: msg.Partition, first: msg.Offset, opened: time.Now()}
+			batches[id] = b
+		}
+		b.records = append(b.records, record.Bytes())
+		b.bytes += record.Len()
+		b.traces = append(b.traces, trace)
+		if b.bytes >= max_bytes || len(b.records) >= max_records {
+			upload(id, b)
+		}
+	}
+
+	// committed returns the offsets of the stream below which all messages
+	// are uploaded: the first offsets of open files, or the next offsets
+	committed := func() sp.Offsets {
+		offs := make(sp.Offsets)
+		for p, o := range streamOffsets {
+			offs[p] = o
+		}
+		for _, b := range batches {
+			if o, ok := offs[b.partition]; !ok || b.first < o {
+				offs[b.partition] = b.first
+			}
+		}
+		return offs
+	}
+
+	checkpoint := func() {
+		offs := committed()
+		if err := offs.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("uploaded:", numUploaded, "files:", numFiles, "open files:", len(batches), "invalid:", numInvalid, "stream offsets:", offs)
+		numUploaded, numFiles, numInvalid = 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case <-rotateTicker.C:
+			for id, b := range batches {
+				if time.Since(b.opened) >= max_age {
+					upload(id, b)
+				}
+			}
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			for id, b := range batches {
+				upload(id, b)
+			}
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			add(msg)
+		}
+	}
+}
+
+// parseTime parses a field of time, RFC 3339 strings or epoch seconds or
+// milliseconds
+func parseTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if f > 1e11 { // milliseconds
+			f /= 1000
+		}
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported time %v", v)
+}
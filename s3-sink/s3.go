@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectStore uploads objects to a bucket of s3 or of a store with an s3
+// compatible api, e.g. minio or gcs with hmac keys, signed with aws
+// signature version 4
+type objectStore struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool // bucket in the path instead of the host
+	retries      int
+	backoff      time.Duration
+}
+
+// newObjectStore creates the store of bucket, the endpoint of aws s3 in
+// region if endpoint is not set
+func newObjectStore(endpoint, bucket, region, accessKey, secretKey, sessionToken string, pathStyle bool, retries int, backoff time.Duration) (*objectStore, error) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q: expect scheme://host", endpoint)
+	}
+	return &objectStore{
+		client:       &http.Client{Timeout: 5 * time.Minute},
+		endpoint:     u,
+		bucket:       bucket,
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		pathStyle:    pathStyle,
+		retries:      retries,
+		backoff:      backoff,
+	}, nil
+}
+
+// put uploads body to key, retrying failures but client errors up to
+// retries times with exponential backoff
+func (s *objectStore) put(key string, body []byte, contentType string) error {
+	for attempt := 0; ; attempt++ {
+		status, err := s.request(key, body, contentType)
+		if err == nil {
+			return nil
+		}
+		retry := status == 0 || status == http.StatusTooManyRequests || status >= 500
+		if !retry || attempt >= s.retries {
+			return err
+		}
+		time.Sleep(s.backoff << uint(attempt))
+	}
+}
+
+// request sends a signed PUT of key, returns the status of the response
+func (s *objectStore) request(key string, body []byte, contentType string) (int, error) {
+	host := s.endpoint.Host
+	path := "/" + uriEncode(key)
+	if s.pathStyle {
+		path = "/" + uriEncode(s.bucket) + path
+	} else {
+		host = s.bucket + "." + host
+	}
+	req, err := http.NewRequest("PUT", s.endpoint.Scheme+"://"+host+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, host, path, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("put %v: %v: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.StatusCode, nil
+}
+
+// sign sets the authorization of req with signature version 4
+func (s *objectStore) sign(req *http.Request, host, path string, body []byte, now time.Time) {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical bytes.Buffer
+	fmt.Fprintf(&canonical, "%v\n%v\n\n", req.Method, path)
+	for _, k := range names {
+		fmt.Fprintf(&canonical, "%v:%v\n", k, headers[k])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%v\n%x", signed, payload)
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, s.region)
+	hash := sha256.Sum256(canonical.Bytes())
+	toSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%v\n%v\n%x", amzDate, scope, hash)
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%x",
+		s.accessKey, scope, signed, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes the bytes of a path but unreserved ones and '/'
+func uriEncode(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
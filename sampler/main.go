@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  "sampler",
+		Usage: "Downsample the messages of a stream",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "mode",
+				Value: "random",
+				Usage: "random: keep messages with probability rate, key: keep the messages of a rate of the keys, head: keep the first limit messages of each key in each window",
+			},
+			&cli.Float64Flag{
+				Name:  "rate",
+				Value: 0.01,
+				Usage: "fraction of the messages or keys to keep",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "extract the json field as sampling key in stream messages, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Value: time.Minute,
+				Usage: "windows of head sampling, aligned by the timestamps of messages, messages of past windows are dropped",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Value: 100,
+				Usage: "messages kept of each key in each window by head sampling",
+			},
+		},
+		Processor: &sampling{},
+	})
+}
+
+// sampling forwards the messages kept by the sampler to the output topic
+type sampling struct {
+	sampler sampler
+	keyPath string
+	mu      sync.Mutex // of the sampler, with parallelism
+}
+
+func (p *sampling) Setup(ctx *sp.Context) error {
+	mode := ctx.String("mode")
+	rate := ctx.Float64("rate")
+	p.keyPath = ctx.String("key")
+	window := ctx.Duration("window")
+	limit := ctx.Int("limit")
+
+	log.Println("mode:", mode)
+	log.Println("rate:", rate)
+	log.Println("key:", p.keyPath)
+	log.Println("window:", window)
+	log.Println("limit:", limit)
+
+	switch mode {
+	case "random":
+		p.sampler = &randomSampler{rate: rate, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	case "key":
+		if p.keyPath == "" {
+			return errors.New("key must be set to sample by key")
+		}
+		p.sampler = newKeySampler(rate)
+	case "head":
+		if window <= 0 || limit <= 0 {
+			return errors.New("window and limit must be positive")
+		}
+		p.sampler = &headSampler{window: window, limit: limit}
+	default:
+		return fmt.Errorf("unsupported mode: %v", mode)
+	}
+	if mode != "head" && (rate < 0 || rate > 1) {
+		return errors.New("rate must be within [0, 1]")
+	}
+	ctx.Count("sampled", 0)
+	ctx.Count("skipped", 0)
+	ctx.Count("invalid", 0)
+	return nil
+}
+
+func (p *sampling) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	key := ""
+	if p.keyPath != "" {
+		value, err := ctx.Decoder.Decode(msg.Value)
+		if err != nil {
+			return err
+		}
+		jsonParsed, err := gabs.ParseJSON(value)
+		if err != nil {
+			return err
+		}
+		v := jsonParsed.Path(p.keyPath).Data()
+		if v == nil {
+			return fmt.Errorf("missing key %v", p.keyPath)
+		}
+		key = fmt.Sprint(v)
+	}
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	p.mu.Lock()
+	keep := p.sampler.keep(key, ts)
+	p.mu.Unlock()
+	if !keep {
+		ctx.Count("skipped", 1)
+		return nil
+	}
+	ctx.Forward(msg, ctx.OutputTopic)
+	ctx.Count("sampled", 1)
+	return nil
+}
+
+func (p *sampling) Checkpoint(ctx *sp.Context) error { return nil }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// sampler decides whether to keep a message of key at ts
+type sampler interface {
+	keep(key string, ts time.Time) bool
+}
+
+// randomSampler keeps each message with probability rate
+type randomSampler struct {
+	rate float64
+	rnd  *rand.Rand
+}
+
+func (s *randomSampler) keep(key string, ts time.Time) bool {
+	return s.rnd.Float64() < s.rate
+}
+
+// keySampler keeps all or none of the messages of a key, a rate of the
+// keys chosen by their hash, so that samples are consistent across runs and
+// processors sampling with the same rate
+type keySampler struct {
+	threshold uint64
+}
+
+func newKeySampler(rate float64) *keySampler {
+	if rate >= 1 {
+		return &keySampler{math.MaxUint64}
+	}
+	return &keySampler{uint64(rate * math.MaxUint64)}
+}
+
+func (s *keySampler) keep(key string, ts time.Time) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64() < s.threshold || s.threshold == math.MaxUint64
+}
+
+// headSampler keeps the first limit messages of each key in each window,
+// windows are aligned to the epoch by the timestamps of the messages
+type headSampler struct {
+	window time.Duration
+	limit  int
+	start  time.Time      // start of the current window
+	counts map[string]int // messages of the keys in the current window
+}
+
+func (s *headSampler) keep(key string, ts time.Time) bool {
+	start := ts.Truncate(s.window)
+	if start.After(s.start) {
+		s.start = start
+		s.counts = make(map[string]int)
+	} else if start.Before(s.start) { // the window is over
+		return false
+	}
+	if s.counts[key] >= s.limit {
+		return false
+	}
+	s.counts[key]++
+	return true
+}
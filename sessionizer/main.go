@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/eventtime"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	metaBucket    = "__meta__"
+	watermarkKey  = "watermark"
+	processorName = "sessionizer"
+	outputTable   = "sessionizer"
+)
+
+func main() {
+	sp.Run(&sp.App{
+		Name:  processorName,
+		Usage: "Group stream messages by key into sessions separated by inactivity gaps",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "extract the json field as session key in stream messages, e.g. the user id, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "fields",
+				Value: "",
+				Usage: "comma separated json fields to compute sum/min/max/avg of, messages are counted per session anyway",
+			},
+			&cli.DurationFlag{
+				Name:  "gap",
+				Value: 30 * time.Minute,
+				Usage: "inactivity closing a session, sessions are emitted when the timestamps of the messages pass their last message by the gap, or once no message of their key came for the gap and max-out-of-orderness",
+			},
+			&cli.StringFlag{
+				Name:  "event-time-path",
+				Value: "",
+				Usage: "extract the json field as event time of stream messages, the timestamps of kafka messages if not set",
+			},
+			&cli.StringFlag{
+				Name:  "event-time-format",
+				Value: "rfc3339",
+				Usage: "format of event times, rfc3339, unix, unix_ms, unix_us, unix_ns or a layout such as \"2006-01-02 15:04:05\"",
+			},
+			&cli.DurationFlag{
+				Name:  "max-out-of-orderness",
+				Value: 0,
+				Usage: "delay of the watermark behind the greatest event time seen, messages out of order within it join their sessions",
+			},
+		},
+		Processor: &sessionizer{},
+	})
+}
+
+// sessionizer emits the summaries of the sessions of the keys closed by the
+// watermark, or by the timer of their key once no message of the key came
+// for the gap and the out-of-orderness, e.g. on a stream gone idle
+type sessionizer struct {
+	keyPath    string
+	fields     []string
+	idle       time.Duration // of a key before its timer closes its sessions
+	eventTime  *eventtime.Extractor
+	instanceId string
+	host       string
+
+	mu sync.Mutex // of ss, with parallelism
+	ss *sessions
+}
+
+func (p *sessionizer) Setup(ctx *sp.Context) error {
+	p.keyPath = ctx.String("key")
+	if f := ctx.String("fields"); f != "" {
+		p.fields = strings.Split(f, ",")
+	}
+	gap := ctx.Duration("gap")
+	eventTimePath := ctx.String("event-time-path")
+	eventTimeFormat := ctx.String("event-time-format")
+	maxOutOfOrderness := ctx.Duration("max-out-of-orderness")
+	p.instanceId = fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	p.host, _ = os.Hostname()
+
+	log.Println("key:", p.keyPath)
+	log.Println("fields:", p.fields)
+	log.Println("gap:", gap)
+	log.Println("event-time-path:", eventTimePath)
+	log.Println("event-time-format:", eventTimeFormat)
+	log.Println("max-out-of-orderness:", maxOutOfOrderness)
+	log.Println("instanceId:", p.instanceId)
+
+	if gap <= 0 {
+		return errors.New("gap must be positive")
+	}
+	if p.keyPath == "" {
+		return errors.New("key is not set")
+	}
+	if maxOutOfOrderness < 0 {
+		return errors.New("max-out-of-orderness must not be negative")
+	}
+	var err error
+	if p.eventTime, err = eventtime.NewExtractor(eventTimePath, eventTimeFormat); err != nil {
+		return err
+	}
+	p.idle = gap + maxOutOfOrderness
+
+	p.ss = newSessions(ctx.Store, processorName, gap, maxOutOfOrderness)
+	p.ss.load()
+	log.Printf("open sessions:%v watermark:%v", p.ss.len(), p.ss.watermark)
+	ctx.Count("sessionized", 0)
+	ctx.Count("late", 0)
+	ctx.Count("invalid", 0)
+	ctx.Count("emitted", 0)
+	return nil
+}
+
+// emit produces the summary of a closed session
+func (p *sessionizer) emit(ctx *sp.Context, s *session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	wal := &sp.WAL{}
+	wal.Type = "SESSION"
+	wal.InstanceId = p.instanceId
+	wal.Table = outputTable
+	wal.Host = p.host
+	wal.Data = data
+	wal.Key = fmt.Sprintf("%v-%v", s.Key, s.Start.UnixNano()) // one summary per session
+	wal.CreatedAt = time.Now()
+	bts, err := json.Marshal(wal)
+	if err != nil {
+		return err
+	}
+	ctx.Send(ctx.OutputTopic, []byte(s.Key), bts)
+	ctx.Count("emitted", 1)
+	return nil
+}
+
+func (p *sessionizer) Process(ctx *sp.Context, msg *sarama.ConsumerMessage) error {
+	value, err := ctx.Decoder.Decode(msg.Value)
+	if err != nil {
+		return err
+	}
+	jsonParsed, err := gabs.ParseJSON(value)
+	if err != nil {
+		return err
+	}
+	v := jsonParsed.Path(p.keyPath).Data()
+	if v == nil {
+		return fmt.Errorf("missing key %v", p.keyPath)
+	}
+	key := fmt.Sprint(v)
+	ts, err := p.eventTime.Time(msg, jsonParsed)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	added := p.ss.add(key, ts, fieldValues(jsonParsed, p.fields))
+	closed := p.ss.close()
+	p.mu.Unlock()
+	if added {
+		ctx.SetTimer(key, time.Now().Add(p.idle), nil)
+		ctx.Count("sessionized", 1)
+	} else {
+		ctx.Count("late", 1)
+	}
+	for _, s := range closed {
+		if err := p.emit(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnTimer closes the sessions of a key without message for the gap
+func (p *sessionizer) OnTimer(ctx *sp.Context, key string, data []byte) error {
+	p.mu.Lock()
+	closed := p.ss.closeKey(key)
+	p.mu.Unlock()
+	for _, s := range closed {
+		if err := p.emit(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *sessionizer) Checkpoint(ctx *sp.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.ss.flush(); err != nil {
+		return err
+	}
+	log.Println("open sessions:", p.ss.len(), "watermark:", p.ss.watermark)
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fieldStats aggregates the numeric values of a field within a session
+type fieldStats struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+func (s *fieldStats) add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+	s.Avg = s.Sum / float64(s.Count)
+}
+
+// merge aggregates the values aggregated by o
+func (s *fieldStats) merge(o *fieldStats) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Count == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+	s.Avg = s.Sum / float64(s.Count)
+}
+
+// session aggregates the messages of a key separated by less than the gap,
+// from the first message at Start to the last at End
+type session struct {
+	Key      string                 `json:"key"`
+	Start    time.Time              `json:"session_start"`
+	End      time.Time              `json:"session_end"`
+	Duration float64                `json:"duration_seconds"`
+	Count    int64                  `json:"count"`
+	Fields   map[string]*fieldStats `json:"fields,omitempty"`
+}
+
+// add aggregates the field values of a message at ts
+func (s *session) add(ts time.Time, values map[string]float64) {
+	if s.Count == 0 || ts.Before(s.Start) {
+		s.Start = ts
+	}
+	if s.Count == 0 || ts.After(s.End) {
+		s.End = ts
+	}
+	s.Count++
+	for field, v := range values {
+		s.stats(field).add(v)
+	}
+	s.Duration = s.End.Sub(s.Start).Seconds()
+}
+
+// merge aggregates the messages of o, a session of the same key
+func (s *session) merge(o *session) {
+	if s.Count == 0 || o.Start.Before(s.Start) {
+		s.Start = o.Start
+	}
+	if s.Count == 0 || o.End.After(s.End) {
+		s.End = o.End
+	}
+	s.Count += o.Count
+	for field, fs := range o.Fields {
+		s.stats(field).merge(fs)
+	}
+	s.Duration = s.End.Sub(s.Start).Seconds()
+}
+
+func (s *session) stats(field string) *fieldStats {
+	if s.Fields == nil {
+		s.Fields = make(map[string]*fieldStats)
+	}
+	fs, ok := s.Fields[field]
+	if !ok {
+		fs = &fieldStats{}
+		s.Fields[field] = fs
+	}
+	return fs
+}
+
+// fieldValues extracts the fields of a message, fields missing or not
+// numeric are not aggregated
+func fieldValues(data *gabs.Container, fields []string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, field := range fields {
+		if v, ok := number(data.Path(field).Data()); ok {
+			values[field] = v
+		}
+	}
+	return values
+}
+
+// number converts json numbers and numeric strings
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, !math.IsNaN(v)
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+// sessions are the open sessions of each key, stored in a bucket of the
+// state store on checkpoint; sessions close when the watermark, the
+// greatest timestamp of the messages minus the out-of-orderness lag, passes
+// their end by the gap
+type sessions struct {
+	store  state.Store
+	bucket string
+	gap    time.Duration
+	lag    time.Duration // of the watermark behind the greatest timestamp
+
+	open      map[string][]*session // by key, sorted by start
+	dirty     map[string]bool       // keys changed since last checkpoint
+	nextClose time.Time             // earliest close of the open sessions
+	watermark time.Time
+}
+
+func newSessions(store state.Store, bucket string, gap, lag time.Duration) *sessions {
+	return &sessions{
+		store:  store,
+		bucket: bucket,
+		gap:    gap,
+		lag:    lag,
+		open:   make(map[string][]*session),
+		dirty:  make(map[string]bool),
+	}
+}
+
+// add aggregates a message of key at ts into its session, sessions joined
+// by the message are merged; returns false if the message is late, its
+// session being already closed
+func (ss *sessions) add(key string, ts time.Time, values map[string]float64) bool {
+	if wm := ts.Add(-ss.lag); wm.After(ss.watermark) {
+		ss.watermark = wm
+	}
+
+	s := &session{Key: key}
+	var rest []*session
+	for _, o := range ss.open[key] {
+		if ts.Before(o.Start.Add(-ss.gap)) || ts.After(o.End.Add(ss.gap)) {
+			rest = append(rest, o)
+		} else {
+			s.merge(o)
+		}
+	}
+	if s.Count == 0 && !ss.watermark.Before(ts.Add(ss.gap)) {
+		return false
+	}
+	s.add(ts, values)
+
+	rest = append(rest, s)
+	sort.Slice(rest, func(i, j int) bool { return rest[i].Start.Before(rest[j].Start) })
+	ss.open[key] = rest
+	ss.dirty[key] = true
+	if closeAt := s.End.Add(ss.gap); ss.nextClose.IsZero() || closeAt.Before(ss.nextClose) {
+		ss.nextClose = closeAt
+	}
+	return true
+}
+
+// close removes the sessions inactive for the gap at the watermark,
+// returned in the order of their end
+func (ss *sessions) close() []*session {
+	if ss.nextClose.IsZero() || ss.watermark.Before(ss.nextClose) {
+		return nil
+	}
+
+	var closed []*session
+	ss.nextClose = time.Time{}
+	for key, open := range ss.open {
+		var rest []*session
+		for _, s := range open {
+			closeAt := s.End.Add(ss.gap)
+			if !ss.watermark.Before(closeAt) {
+				closed = append(closed, s)
+				continue
+			}
+			rest = append(rest, s)
+			if ss.nextClose.IsZero() || closeAt.Before(ss.nextClose) {
+				ss.nextClose = closeAt
+			}
+		}
+		if len(rest) == len(open) {
+			continue
+		}
+		if len(rest) == 0 {
+			delete(ss.open, key)
+		} else {
+			ss.open[key] = rest
+		}
+		ss.dirty[key] = true
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		if !closed[i].End.Equal(closed[j].End) {
+			return closed[i].End.Before(closed[j].End)
+		}
+		return closed[i].Key < closed[j].Key
+	})
+	return closed
+}
+
+// closeKey removes the open sessions of key, returned in the order of
+// their end
+func (ss *sessions) closeKey(key string) []*session {
+	closed, ok := ss.open[key]
+	if !ok {
+		return nil
+	}
+	delete(ss.open, key)
+	ss.dirty[key] = true
+	sort.Slice(closed, func(i, j int) bool { return closed[i].End.Before(closed[j].End) })
+	return closed
+}
+
+// len returns the number of open sessions
+func (ss *sessions) len() (n int) {
+	for _, open := range ss.open {
+		n += len(open)
+	}
+	return
+}
+
+// flush puts the sessions of the keys changed since the last checkpoint
+// and the watermark to the store
+func (ss *sessions) flush() error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(ss.watermark.UnixNano()))
+	if err := ss.store.Put(metaBucket, []byte(watermarkKey), v); err != nil {
+		return err
+	}
+	for key := range ss.dirty {
+		open, ok := ss.open[key]
+		if !ok {
+			if err := ss.store.Delete(ss.bucket, []byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		bts, err := json.Marshal(open)
+		if err != nil {
+			return err
+		}
+		if err := ss.store.Put(ss.bucket, []byte(key), bts); err != nil {
+			return err
+		}
+	}
+	ss.dirty = make(map[string]bool)
+	return nil
+}
+
+// load reads the open sessions and the watermark
+func (ss *sessions) load() {
+	if v, err := ss.store.Get(metaBucket, []byte(watermarkKey)); err != nil {
+		log.Fatalln(err)
+	} else if len(v) == 8 {
+		ss.watermark = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	if err := ss.store.Iterate(ss.bucket, func(k, v []byte) error {
+		var open []*session
+		if err := json.Unmarshal(v, &open); err != nil {
+			return fmt.Errorf("sessions %q: %v", k, err)
+		}
+		ss.open[string(k)] = open
+		for _, s := range open {
+			if closeAt := s.End.Add(ss.gap); ss.nextClose.IsZero() || closeAt.Before(ss.nextClose) {
+				ss.nextClose = closeAt
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xtaci/sp/state"
+)
+
+func TestSessionsCloseKey(t *testing.T) {
+	store, err := state.OpenBolt(filepath.Join(t.TempDir(), "sessions.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Unix(1000, 0)
+	ss := newSessions(store, processorName, time.Minute, 0)
+	ss.add("a", start, map[string]float64{"amount": 1})
+	ss.add("a", start.Add(10*time.Second), map[string]float64{"amount": 3})
+	ss.add("a", start.Add(5*time.Minute), nil) // a second session of a
+	ss.add("b", start.Add(5*time.Minute), nil)
+	if err := ss.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := ss.closeKey("a")
+	if len(closed) != 2 {
+		t.Fatalf("closed sessions of a: %v, want 2", len(closed))
+	}
+	if s := closed[0]; s.Count != 2 || s.Fields["amount"].Sum != 4 || s.Duration != 10 {
+		t.Fatalf("first session of a: %+v", s)
+	}
+	if closed[1].Start != start.Add(5*time.Minute) {
+		t.Fatalf("second session of a starts at %v", closed[1].Start)
+	}
+	if closed := ss.closeKey("a"); closed != nil {
+		t.Fatalf("closed twice: %v", closed)
+	}
+	if err := ss.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newSessions(store, processorName, time.Minute, 0)
+	restarted.load()
+	if _, ok := restarted.open["a"]; ok || restarted.len() != 1 {
+		t.Fatalf("open sessions after restart: %v, want b only", restarted.open)
+	}
+}
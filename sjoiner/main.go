@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/eventtime"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetLeft    = "__offset_left__"
+	offsetRight   = "__offset_right__"
+	bufferLeft    = "left"
+	bufferRight   = "right"
+	processorName = "sjoiner"
+	outputTable   = "sjoiner"
+)
+
+type SSJoin struct {
+	Left  *json.RawMessage `json:"left"`
+	Right *json.RawMessage `json:"right"`
+}
+
+// record is a buffered stream message waiting for its counterpart
+type record struct {
+	partition int32
+	offset    int64
+	timestamp time.Time
+	value     []byte
+	stored    bool // in the store since the last checkpoint
+}
+
+// id identifies the record in the buffer
+func (r *record) id() string {
+	return fmt.Sprintf("%v-%v", r.partition, r.offset)
+}
+
+// buffer holds the records of one side of the join, grouped by join key
+type buffer map[string][]*record
+
+// expire removes all records older than deadline, returns the store keys
+// of the records removed
+func (b buffer) expire(deadline time.Time) (expired [][]byte) {
+	for key, records := range b {
+		alive := records[:0]
+		for _, r := range records {
+			if r.timestamp.After(deadline) {
+				alive = append(alive, r)
+			} else {
+				expired = append(expired, r.storeKey(key))
+			}
+		}
+		if len(alive) == 0 {
+			delete(b, key)
+		} else {
+			b[key] = alive
+		}
+	}
+	return
+}
+
+// latest returns the greatest timestamp of the records
+func (b buffer) latest() (ts time.Time) {
+	for _, records := range b {
+		for _, r := range records {
+			if r.timestamp.After(ts) {
+				ts = r.timestamp
+			}
+		}
+	}
+	return
+}
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Stream-Stream joining on left-topic.left-key = right-topic.right-key within a time window",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "left-topic",
+				Value: "events",
+				Usage: "the left stream topic to do JOIN",
+			},
+			&cli.StringFlag{
+				Name:  "left-key",
+				Value: "",
+				Usage: "extract the json field as join key in left stream messages, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "right-topic",
+				Value: "",
+				Usage: "the right stream topic to do JOIN",
+			},
+			&cli.StringFlag{
+				Name:  "right-key",
+				Value: "",
+				Usage: "extract the json field as join key in right stream messages, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Value: 5 * time.Minute,
+				Usage: "messages of both streams are joined if their timestamps are within the window",
+			},
+			&cli.StringFlag{
+				Name:  "event-time-path",
+				Value: "",
+				Usage: "extract the json field as event time of the messages of both streams, buffers expire by the watermarks of the streams instead of processing time if set",
+			},
+			&cli.StringFlag{
+				Name:  "event-time-format",
+				Value: "rfc3339",
+				Usage: "format of event times, rfc3339, unix, unix_ms, unix_us, unix_ns or a layout such as \"2006-01-02 15:04:05\"",
+			},
+			&cli.DurationFlag{
+				Name:  "max-out-of-orderness",
+				Value: 0,
+				Usage: "delay of the watermark of a stream behind the greatest event time seen",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: sjoiner-{left-topic}-{right-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of buffers and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for buffer writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	left_topic := c.String("left-topic")
+	left_key := c.String("left-key")
+	right_topic := c.String("right-topic")
+	right_key := c.String("right-key")
+	window := c.Duration("window")
+	event_time_path := c.String("event-time-path")
+	event_time_format := c.String("event-time-format")
+	max_out_of_orderness := c.Duration("max-out-of-orderness")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("sjoiner-%v-%v", left_topic, right_topic)
+	}
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("left-topic:", left_topic)
+	log.Println("left-key:", left_key)
+	log.Println("right-topic:", right_topic)
+	log.Println("right-key:", right_key)
+	log.Println("window:", window)
+	log.Println("event-time-path:", event_time_path)
+	log.Println("event-time-format:", event_time_format)
+	log.Println("max-out-of-orderness:", max_out_of_orderness)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".sjoiner-%v-%v.cache", left_topic, right_topic)
+	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	log.Println("cache file:", cachefile)
+	log.Println("instanceId:", instanceId)
+
+	if left_key == "" || right_key == "" {
+		log.Fatalln("left-key and right-key must be set")
+	}
+
+	if right_topic == "" || right_topic == left_topic {
+		log.Fatalln("right-topic must be set and differ from left-topic")
+	}
+
+	if max_out_of_orderness < 0 {
+		log.Fatalln("max-out-of-orderness must not be negative")
+	}
+	eventTime, err := eventtime.NewExtractor(event_time_path, event_time_format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// joined messages in flight, offsets are only committed after all
+	// messages produced before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the streams are reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read buffers to memory
+	lefts := make(buffer)
+	rights := make(buffer)
+	leftOffsets := make(sp.Offsets)
+	rightOffsets := make(sp.Offsets)
+
+	if err := leftOffsets.Load(store, offsetLeft); err != nil {
+		log.Fatalln(err)
+	}
+	if err := rightOffsets.Load(store, offsetRight); err != nil {
+		log.Fatalln(err)
+	}
+	if err := lefts.load(store, bufferLeft); err != nil {
+		log.Fatalln(err)
+	}
+	if err := rights.load(store, bufferRight); err != nil {
+		log.Fatalln(err)
+	}
+
+	// watermarks of the streams, the greatest event times seen minus the
+	// out-of-orderness, resumed from the buffered records
+	leftWatermark := lefts.latest().Add(-max_out_of_orderness)
+	rightWatermark := rights.latest().Add(-max_out_of_orderness)
+
+	log.Printf("consuming from left offsets:%v right offsets:%v", leftOffsets, rightOffsets)
+
+	leftMessages, leftConsumers, err := sp.ConsumeAll(consumer, left_topic, leftOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	rightMessages, rightConsumers, err := sp.ConsumeAll(consumer, right_topic, rightOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	defer func() {
+		for _, pcs := range []map[int32]sarama.PartitionConsumer{leftConsumers, rightConsumers} {
+			for _, pc := range pcs {
+				if err := pc.Close(); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numJoined := 0
+
+	// parameters
+	host, _ := os.Hostname()
+
+	// join matches msg against the buffered records of the other stream and
+	// buffers msg for later arrivals of the other stream
+	join := func(msg *sarama.ConsumerMessage, path string, mine, others buffer, isLeft bool) {
+		jsonParsed, err := gabs.ParseJSON(msg.Value)
+		if err != nil {
+			return
+		}
+		key := fmt.Sprint(jsonParsed.Path(path).Data())
+
+		ts, err := eventTime.Time(msg, jsonParsed)
+		if err != nil {
+			return
+		}
+		watermark := &leftWatermark
+		if !isLeft {
+			watermark = &rightWatermark
+		}
+		if wm := ts.Add(-max_out_of_orderness); wm.After(*watermark) {
+			*watermark = wm
+		}
+
+		r := &record{partition: msg.Partition, offset: msg.Offset, timestamp: ts, value: msg.Value}
+
+		for _, other := range others[key] {
+			if d := r.timestamp.Sub(other.timestamp); d > window || d < -window {
+				continue
+			}
+
+			left, right := r, other
+			if !isLeft {
+				left, right = other, r
+			}
+
+			wal := &sp.WAL{}
+			wal.Type = "AUGMENT"
+			wal.InstanceId = instanceId
+			wal.Table = outputTable
+			wal.Host = host
+			data, _ := json.Marshal(SSJoin{Left: (*json.RawMessage)(&left.value), Right: (*json.RawMessage)(&right.value)})
+			wal.Data = data
+			wal.Key = left.id() + "-" + right.id() // both coordinates are unique as primary key
+			wal.CreatedAt = time.Now()
+			if bts, err := json.Marshal(wal); err == nil {
+				inflight.Add(1)
+				producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(bts)}
+				numJoined++
+			} else {
+				log.Println(err)
+			}
+		}
+		mine[key] = append(mine[key], r)
+	}
+
+	// checkpoint expires the records and commits the buffers with the
+	// offsets once the joined messages produced have been acknowledged, so
+	// that each pair is joined at least once
+	checkpoint := func() {
+		inflight.Wait()
+		// records expire once the records of the other stream within the
+		// window can't arrive anymore
+		leftDeadline, rightDeadline := time.Now().Add(-window), time.Now().Add(-window)
+		if eventTime.Path() != "" {
+			leftDeadline, rightDeadline = rightWatermark.Add(-window), leftWatermark.Add(-window)
+		}
+		expiredLefts, expiredRights := lefts.expire(leftDeadline), rights.expire(rightDeadline)
+		commit(store, lefts, rights, expiredLefts, expiredRights, leftOffsets, rightOffsets)
+		log.Println("committed:", len(lefts), len(rights), "left offsets:", leftOffsets, "right offsets:", rightOffsets, "joined:", numJoined, "expired:", len(expiredLefts)+len(expiredRights), "watermarks:", leftWatermark, rightWatermark)
+		numJoined = 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-leftMessages:
+			leftOffsets[msg.Partition] = msg.Offset + 1
+			join(msg, left_key, lefts, rights, true)
+		case msg := <-rightMessages:
+			rightOffsets[msg.Partition] = msg.Offset + 1
+			join(msg, right_key, rights, lefts, false)
+		}
+	}
+}
+
+// storeKey is the key of the record of a join key in the buffers of the
+// store, key + "\x00" + partition + offset; the value is prefixed by the
+// timestamp
+func (r *record) storeKey(key string) []byte {
+	k := make([]byte, len(key)+13)
+	copy(k, key)
+	binary.BigEndian.PutUint32(k[len(key)+1:], uint32(r.partition))
+	binary.BigEndian.PutUint64(k[len(key)+5:], uint64(r.offset))
+	return k
+}
+
+// load reads the buffered records of bucket
+func (b buffer) load(store state.Store, bucket string) error {
+	return store.Iterate(bucket, func(k, v []byte) error {
+		if len(k) < 13 || len(v) < 8 {
+			return nil
+		}
+		n := len(k) - 12
+		r := &record{
+			partition: int32(binary.BigEndian.Uint32(k[n:])),
+			offset:    int64(binary.BigEndian.Uint64(k[n+4:])),
+			timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(v))),
+			value:     append([]byte(nil), v[8:]...),
+			stored:    true,
+		}
+		key := string(k[:n-1])
+		b[key] = append(b[key], r)
+		return nil
+	})
+}
+
+// store puts the records buffered since the last checkpoint to bucket and
+// removes the records expired
+func (b buffer) store(store state.Store, bucket string, expired [][]byte) error {
+	for _, k := range expired {
+		if err := store.Delete(bucket, k); err != nil {
+			return err
+		}
+	}
+	for key, records := range b {
+		for _, r := range records {
+			if r.stored {
+				continue
+			}
+			v := make([]byte, 8+len(r.value))
+			binary.LittleEndian.PutUint64(v, uint64(r.timestamp.UnixNano()))
+			copy(v[8:], r.value)
+			if err := store.Put(bucket, r.storeKey(key), v); err != nil {
+				return err
+			}
+			r.stored = true
+		}
+	}
+	return nil
+}
+
+// commit checkpoints the buffers with the offsets consumed
+func commit(store state.Store, lefts, rights buffer, expiredLefts, expiredRights [][]byte, leftOffsets, rightOffsets sp.Offsets) {
+	if err := lefts.store(store, bufferLeft, expiredLefts); err != nil {
+		log.Fatalln(err)
+	}
+	if err := rights.store(store, bufferRight, expiredRights); err != nil {
+		log.Fatalln(err)
+	}
+	if err := leftOffsets.Store(store, offsetLeft); err != nil {
+		log.Fatalln(err)
+	}
+	if err := rightOffsets.Store(store, offsetRight); err != nil {
+		log.Fatalln(err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		log.Fatalln(err)
+	}
+}
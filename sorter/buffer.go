@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// record is a message held for sorting
+type record struct {
+	msg       *sarama.ConsumerMessage
+	key       []byte // output key, the message key if nil
+	eventTime time.Time
+	seq       uint64 // arrival order, breaks ties of event time
+}
+
+// sortBuffer holds messages up to maxLateness after the greatest event time
+// seen and releases them in event time order; messages older than the last
+// released are late, as releasing them would break the order
+type sortBuffer struct {
+	records     recordHeap
+	maxLateness time.Duration
+	watermark   time.Time // greatest event time seen
+	released    time.Time // event time of the last released message
+	seq         uint64
+}
+
+// push adds a record and returns the records released, false if the record
+// is late and not added
+func (b *sortBuffer) push(r *record) ([]*record, bool) {
+	if r.eventTime.Before(b.released) {
+		return nil, false
+	}
+	if r.eventTime.After(b.watermark) {
+		b.watermark = r.eventTime
+	}
+	r.seq = b.seq
+	b.seq++
+	heap.Push(&b.records, r)
+	return b.release(b.watermark.Add(-b.maxLateness)), true
+}
+
+// release pops the records up to deadline in event time order
+func (b *sortBuffer) release(deadline time.Time) []*record {
+	var released []*record
+	for len(b.records) > 0 && !b.records[0].eventTime.After(deadline) {
+		r := heap.Pop(&b.records).(*record)
+		b.released = r.eventTime
+		released = append(released, r)
+	}
+	return released
+}
+
+// flush releases all records, e.g. when the stream is idle
+func (b *sortBuffer) flush() []*record {
+	return b.release(b.watermark)
+}
+
+// pending returns the least offset held of each partition, offsets of
+// partitions with held messages must not be committed past them
+func (b *sortBuffer) pending() map[int32]int64 {
+	least := make(map[int32]int64)
+	for _, r := range b.records {
+		if o, ok := least[r.msg.Partition]; !ok || r.msg.Offset < o {
+			least[r.msg.Partition] = r.msg.Offset
+		}
+	}
+	return least
+}
+
+func (b *sortBuffer) len() int { return len(b.records) }
+
+// recordHeap is a min-heap of records by event time
+type recordHeap []*record
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if !h[i].eventTime.Equal(h[j].eventTime) {
+		return h[i].eventTime.Before(h[j].eventTime)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h recordHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(*record)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
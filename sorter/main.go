@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "sorter"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Reorder the messages of a stream by event time within a bounded lateness",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to sort",
+			},
+			&cli.StringFlag{
+				Name:  "time-field",
+				Value: "",
+				Usage: "json field of the event time to sort by, RFC3339 or unix milliseconds, the kafka timestamp if not set",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "extract the json field as the kafka key of sorted messages, so that each key keeps its order in one partition, the message key if not set",
+			},
+			&cli.DurationFlag{
+				Name:  "max-lateness",
+				Value: 2 * time.Minute,
+				Usage: "hold messages up to this delay after the greatest event time seen, or for this long while the stream is idle",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: sorter-{stream-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "late-topic",
+				Value: "",
+				Usage: "topic to forward the messages older than those already emitted, dropped if not set",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	time_field := c.String("time-field")
+	key_path := c.String("key")
+	max_lateness := c.Duration("max-lateness")
+	format_name := c.String("format")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("sorter-%v", stream_topic)
+	}
+	late_topic := c.String("late-topic")
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("time-field:", time_field)
+	log.Println("key:", key_path)
+	log.Println("max-lateness:", max_lateness)
+	log.Println("format:", format_name)
+	log.Println("output-topic:", output_topic)
+	log.Println("late-topic:", late_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".sorter-%v-%v.cache", stream_topic, output_topic)
+	log.Println("cache file:", cachefile)
+
+	if max_lateness <= 0 {
+		log.Fatalln("max-lateness must be positive")
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, offsets are only committed after all messages
+	// forwarded before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	idle := time.NewTicker(time.Second)
+	numSorted, numLate, numInvalid := 0, 0, 0
+	buffer := &sortBuffer{maxLateness: max_lateness}
+	lastArrival := time.Now()
+
+	// forward produces a stream message as is to topic, keyed by key if set
+	forward := func(msg *sarama.ConsumerMessage, key []byte, topic string) {
+		out := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(msg.Value)}
+		if key == nil {
+			key = msg.Key
+		}
+		if key != nil {
+			out.Key = sarama.ByteEncoder(key)
+		}
+		inflight.Add(1)
+		producer.Input() <- out
+	}
+
+	emit := func(records []*record) {
+		for _, r := range records {
+			forward(r.msg, r.key, output_topic)
+			numSorted++
+		}
+	}
+
+	order := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		jsonParsed, err := gabs.ParseJSON(value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		r := &record{msg: msg, eventTime: msg.Timestamp}
+		if r.eventTime.IsZero() {
+			r.eventTime = time.Now()
+		}
+		if time_field != "" {
+			ts, ok := parseTime(jsonParsed.Path(time_field).Data())
+			if !ok {
+				numInvalid++
+				return
+			}
+			r.eventTime = ts
+		}
+		if key_path != "" {
+			if v := jsonParsed.Path(key_path).Data(); v != nil {
+				r.key = []byte(fmt.Sprint(v))
+			}
+		}
+
+		released, ok := buffer.push(r)
+		if !ok {
+			if late_topic != "" {
+				forward(msg, r.key, late_topic)
+			}
+			numLate++
+			return
+		}
+		emit(released)
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		// messages held are consumed again after a restart
+		commit := make(sp.Offsets)
+		held := buffer.pending()
+		for p, offset := range streamOffsets {
+			if o, ok := held[p]; ok {
+				offset = o
+			}
+			commit[p] = offset
+		}
+		if err := commit.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("sorted:", numSorted, "late:", numLate, "invalid:", numInvalid, "held:", buffer.len(), "watermark:", buffer.watermark, "stream offsets:", commit)
+		numSorted, numLate, numInvalid = 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case <-idle.C:
+			if buffer.len() > 0 && time.Since(lastArrival) >= max_lateness {
+				emit(buffer.flush())
+			}
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			lastArrival = time.Now()
+			order(msg)
+		}
+	}
+}
+
+// parseTime converts RFC3339 strings and unix milliseconds
+func parseTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Millisecond))), true
+	case string:
+		ts, err := time.Parse(time.RFC3339Nano, v)
+		return ts, err == nil
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/kafka"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var replayDLQCommand = &cli.Command{
+	Name:  "replay-dlq",
+	Usage: "send the messages of a dead letter topic, up to its end at start, back to the topics they were consumed from",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "brokers",
+			Aliases: []string{"b"},
+			Value:   cli.NewStringSlice("localhost:9092"),
+			Usage:   "kafka brokers address",
+		},
+		&cli.StringFlag{
+			Name:  "dlq",
+			Usage: "dead letter topic to replay",
+		},
+		&cli.StringFlag{
+			Name:  "topic",
+			Usage: "topic to send the messages to instead of their source topic, e.g. the stream topic of a processor",
+		},
+		&cli.StringSliceFlag{
+			Name:  "error-type",
+			Usage: "error type of the dead letters to replay, e.g. missing-key, all types if not set",
+		},
+		&cli.StringFlag{
+			Name:  "processor",
+			Usage: "processor of the dead letters to replay, all processors if not set",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "replay the dead letters created at or after this RFC3339 time",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "replay the dead letters created before this RFC3339 time",
+		},
+	},
+	Action: replayDLQ,
+}
+
+func replayDLQ(c *cli.Context) error {
+	brokers := c.StringSlice("brokers")
+	dlq := c.String("dlq")
+	topic := c.String("topic")
+	error_types := c.StringSlice("error-type")
+	processor := c.String("processor")
+	since := c.String("since")
+	until := c.String("until")
+
+	log.Println("brokers:", brokers)
+	log.Println("dlq:", dlq)
+	log.Println("topic:", topic)
+	log.Println("error-type:", error_types)
+	log.Println("processor:", processor)
+	log.Println("since:", since)
+	log.Println("until:", until)
+
+	if dlq == "" {
+		log.Fatalln("dlq is not set")
+	}
+	var from, to time.Time
+	var err error
+	if since != "" {
+		if from, err = time.Parse(time.RFC3339, since); err != nil {
+			log.Fatalln("invalid since:", err)
+		}
+	}
+	if until != "" {
+		if to, err = time.Parse(time.RFC3339, until); err != nil {
+			log.Fatalln("invalid until:", err)
+		}
+	}
+	types := make(map[string]bool)
+	for _, t := range error_types {
+		types[t] = true
+	}
+
+	// selected tells whether the dead letter is replayed
+	selected := func(dl *sp.DeadLetter) bool {
+		switch {
+		case len(types) > 0 && !types[dl.ErrorType]:
+		case processor != "" && dl.Processor != processor:
+		case !from.IsZero() && dl.CreatedAt.Before(from):
+		case !to.IsZero() && !dl.CreatedAt.Before(to):
+		default:
+			return true
+		}
+		return false
+	}
+
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer consumer.Close()
+
+	config := kafka.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer producer.Close()
+
+	partitions, err := client.Partitions(dlq)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	numReplayed, numSkipped, numInvalid := 0, 0, 0
+	for _, partition := range partitions {
+		hwm, err := client.GetOffset(dlq, partition, sarama.OffsetNewest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		oldest, err := client.GetOffset(dlq, partition, sarama.OffsetOldest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if oldest >= hwm {
+			continue
+		}
+
+		pc, err := consumer.ConsumePartition(dlq, partition, oldest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for msg := range pc.Messages() {
+			dl := &sp.DeadLetter{}
+			if err := json.Unmarshal(msg.Value, dl); err != nil || dl.Topic == "" {
+				numInvalid++
+			} else if !selected(dl) {
+				numSkipped++
+			} else {
+				out := &sarama.ProducerMessage{Topic: dl.Topic, Value: sarama.ByteEncoder(dl.Value)}
+				if topic != "" {
+					out.Topic = topic
+				}
+				if dl.Key != nil {
+					out.Key = sarama.ByteEncoder(dl.Key)
+				}
+				for _, h := range msg.Headers {
+					out.Headers = append(out.Headers, *h)
+				}
+				if _, _, err := producer.SendMessage(out); err != nil {
+					log.Fatalln(err)
+				}
+				numReplayed++
+			}
+			if msg.Offset+1 >= hwm {
+				break
+			}
+		}
+		if err := pc.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	log.Println("replayed:", numReplayed, "skipped:", numSkipped, "invalid:", numInvalid)
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// buckets of the state file of a joiner
+const (
+	joinerBucket     = "joiner"
+	partitionsBucket = "__partitions__"
+	offsetStream     = "__offset_stream__"
+	offsetWAL        = "__offset_wal__"
+)
+
+// stateFlags decode the values of a state file created with encryption or
+// compression
+var stateFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "state-encryption-key",
+		EnvVars: []string{"STATE_ENCRYPTION_KEY"},
+		Usage:   "hex encoded AES key of the state file",
+	},
+	&cli.StringFlag{
+		Name:  "state-compression",
+		Usage: "compression of the state file",
+	},
+}
+
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "print the offsets and key counts of a joiner state file, or get and scan its rows, offline",
+	ArgsUsage: "FILE",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "get",
+			Usage: "print the rows of key",
+		},
+		&cli.StringFlag{
+			Name:  "scan",
+			Usage: "print the rows of the keys with prefix, empty for all keys",
+		},
+		&cli.StringSliceFlag{
+			Name:  "table",
+			Usage: "table of the rows to get or scan, all tables if not set",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Value: 100,
+			Usage: "maximum number of rows scanned, 0 for no limit",
+		},
+	}, stateFlags...),
+	Action: inspectState,
+}
+
+func inspectState(c *cli.Context) error {
+	file := c.Args().First()
+	if file == "" {
+		log.Fatalln("file is not set")
+	}
+	base, store, err := openState(c, file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer base.Close()
+
+	selected := make(map[string]bool)
+	for _, name := range c.StringSlice("table") {
+		selected[name] = true
+	}
+	var rows []string // buckets of the rows of the selected tables
+	for _, name := range base.Buckets() {
+		if table := tableOf(name); table != "" && (len(selected) == 0 || selected[table]) {
+			rows = append(rows, name)
+		}
+	}
+
+	switch {
+	case c.IsSet("get"):
+		err = getRows(store, rows, c.String("get"))
+	case c.IsSet("scan"):
+		err = scanRows(store, rows, c.String("scan"), c.Int("limit"))
+	default:
+		err = summary(store, base.Buckets())
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return nil
+}
+
+// openState opens an existing state file, values are read and written
+// beneath decryption and decompression like the joiner
+func openState(c *cli.Context, file string) (*state.BoltStore, state.Store, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, nil, err
+	}
+	base, err := state.OpenBolt(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var store state.Store = base
+	if key := c.String("state-encryption-key"); key != "" {
+		if store, err = state.NewEncrypted(store, key); err != nil {
+			base.Close()
+			return nil, nil, err
+		}
+	}
+	if compression := c.String("state-compression"); compression != "" {
+		if store, err = state.NewCompressed(store, compression); err != nil {
+			base.Close()
+			return nil, nil, err
+		}
+	}
+	return base, store, nil
+}
+
+// tableOf returns the table of the rows of a bucket, empty if the bucket
+// does not hold rows
+func tableOf(bucket string) string {
+	parts := strings.Split(bucket, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == joinerBucket:
+		return parts[1]
+	case len(parts) == 3 && parts[0] == partitionsBucket:
+		return parts[2]
+	}
+	return ""
+}
+
+// summary prints the offsets of the stream and table topics and the number
+// of keys of each bucket
+func summary(store state.Store, buckets []string) error {
+	stream, table, err := joinerOffsets(store, buckets)
+	if err != nil {
+		return err
+	}
+	printOffsets("stream offsets", stream)
+	printOffsets("table offsets", table)
+	fmt.Println("buckets:")
+	for _, name := range buckets {
+		n := 0
+		if err := store.Iterate(name, func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			return err
+		}
+		fmt.Printf("  %s: %d\n", name, n)
+	}
+	return nil
+}
+
+// getRows prints the rows of key in the buckets
+func getRows(store state.Store, buckets []string, key string) error {
+	found := false
+	for _, bucket := range buckets {
+		v, err := store.Get(bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			printRow(bucket, key, v)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%v: not found", key)
+	}
+	return nil
+}
+
+// scanRows prints the rows of the keys with prefix in the buckets, at most
+// limit rows if limit > 0
+func scanRows(store state.Store, buckets []string, prefix string, limit int) error {
+	n := 0
+	done := fmt.Errorf("limit")
+	for _, bucket := range buckets {
+		err := store.Iterate(bucket, func(k, v []byte) error {
+			if !bytes.HasPrefix(k, []byte(prefix)) {
+				return nil
+			}
+			if limit > 0 && n >= limit {
+				return done
+			}
+			printRow(bucket, string(k), v)
+			n++
+			return nil
+		})
+		if err == done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printRow prints the row of key, indented if json
+func printRow(bucket, key string, row []byte) {
+	fmt.Printf("%s %s\n", tableOf(bucket), key)
+	var out bytes.Buffer
+	if json.Indent(&out, row, "", "  ") == nil {
+		fmt.Println(out.String())
+		return
+	}
+	fmt.Printf("%q\n", row)
+}
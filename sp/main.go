@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    "sp",
+		Usage:   `Run pipelines and manage the state of stream processors`,
+		Version: "0.1",
+		Flags:   append(logging.Flags, kafka.Flags...),
+		Before: func(c *cli.Context) error {
+			if err := logging.Setup(c); err != nil {
+				return err
+			}
+			return kafka.Setup(c)
+		},
+		Commands: []*cli.Command{
+			runCommand,
+			stateCommand,
+			inspectCommand,
+			offsetsCommand,
+			replayDLQCommand,
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var offsetsCommand = &cli.Command{
+	Name:  "offsets",
+	Usage: "view or reset the offsets of the stream and table topics stored in a joiner state file",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "view",
+			Usage:     "print the offsets of the stream and table topics",
+			ArgsUsage: "FILE",
+			Flags:     stateFlags,
+			Action:    viewOffsets,
+		},
+		{
+			Name:      "reset",
+			Usage:     "set the offsets of the stream topic, or of the table topic with --wal, for the next start of the joiner, which must be stopped; the offsets of the stream topic are not used with --group",
+			ArgsUsage: "FILE",
+			Flags: append([]cli.Flag{
+				&cli.StringSliceFlag{
+					Name:    "brokers",
+					Aliases: []string{"b"},
+					Value:   cli.NewStringSlice("localhost:9092"),
+					Usage:   "kafka brokers address",
+				},
+				&cli.StringFlag{
+					Name:  "topic",
+					Usage: "stream topic, or table topic with --wal",
+				},
+				&cli.BoolFlag{
+					Name:  "wal",
+					Usage: "reset the offsets of the table topic instead of the stream topic",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "earliest, latest, an offset or a RFC3339 timestamp, resolved to the first message at or after it",
+				},
+				&cli.IntSliceFlag{
+					Name:  "partition",
+					Usage: "partition to reset, all partitions if not set",
+				},
+			}, stateFlags...),
+			Action: resetOffsets,
+		},
+	},
+}
+
+func viewOffsets(c *cli.Context) error {
+	file := c.Args().First()
+	if file == "" {
+		log.Fatalln("file is not set")
+	}
+	base, store, err := openState(c, file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer base.Close()
+
+	stream, table, err := joinerOffsets(store, base.Buckets())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printOffsets("stream offsets", stream)
+	printOffsets("table offsets", table)
+	return nil
+}
+
+func resetOffsets(c *cli.Context) error {
+	file := c.Args().First()
+	brokers := c.StringSlice("brokers")
+	topic := c.String("topic")
+	wal := c.Bool("wal")
+	to := c.String("to")
+	partitions := c.IntSlice("partition")
+
+	log.Println("file:", file)
+	log.Println("brokers:", brokers)
+	log.Println("topic:", topic)
+	log.Println("wal:", wal)
+	log.Println("to:", to)
+	log.Println("partition:", partitions)
+
+	if file == "" {
+		log.Fatalln("file is not set")
+	}
+	if topic == "" {
+		log.Fatalln("topic is not set")
+	}
+	if to == "" {
+		log.Fatalln("to is not set")
+	}
+
+	// the offset of each partition, or the time to resolve it with
+	var offset, timestamp int64
+	switch to {
+	case "earliest":
+		offset = sarama.OffsetOldest
+	case "latest":
+		offset = sarama.OffsetNewest
+	default:
+		if n, err := strconv.ParseInt(to, 10, 64); err == nil && n >= 0 {
+			offset = n
+		} else if t, err := time.Parse(time.RFC3339, to); err == nil {
+			timestamp = t.UnixNano() / int64(time.Millisecond)
+		} else {
+			log.Fatalln("invalid to:", to)
+		}
+	}
+
+	base, store, err := openState(c, file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer base.Close()
+
+	client, err := sarama.NewClient(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
+
+	all, err := client.Partitions(topic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	selected := make(map[int32]bool)
+	for _, p := range partitions {
+		selected[int32(p)] = true
+	}
+
+	buckets := make(map[string]bool)
+	for _, name := range base.Buckets() {
+		buckets[name] = true
+	}
+	for _, partition := range all {
+		if len(selected) > 0 && !selected[partition] {
+			continue
+		}
+		next := offset
+		if timestamp > 0 {
+			if next, err = client.GetOffset(topic, partition, timestamp); err != nil {
+				log.Fatalln(err)
+			}
+			if next == -1 { // no message at or after the time
+				next = sarama.OffsetNewest
+			}
+		}
+		if next < 0 {
+			if next, err = client.GetOffset(topic, partition, next); err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(next))
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, uint32(partition))
+		// the offsets of the table topic are kept in the bucket of their
+		// partition when the joiner stores partitions apart
+		if bucket := partitionBucket(partition); wal && buckets[bucket] {
+			err = store.Put(bucket, []byte(offsetWAL), v)
+		} else if wal {
+			err = store.Put(offsetWAL, k, v)
+		} else {
+			err = store.Put(offsetStream, k, v)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("partition %d: %d", partition, next)
+	}
+	if err := store.Checkpoint(); err != nil {
+		log.Fatalln(err)
+	}
+	return nil
+}
+
+// partitionBucket is the bucket of a partition of the table topic
+func partitionBucket(partition int32) string {
+	return partitionsBucket + "/" + strconv.Itoa(int(partition))
+}
+
+// joinerOffsets reads the offsets of the stream and table topics, the
+// offsets kept in the buckets of the partitions of the table topic take
+// precedence
+func joinerOffsets(store state.Store, buckets []string) (stream, table map[int32]int64, err error) {
+	if stream, err = loadOffsets(store, offsetStream); err != nil {
+		return nil, nil, err
+	}
+	if table, err = loadOffsets(store, offsetWAL); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range buckets {
+		parts := strings.Split(name, "/")
+		if len(parts) != 2 || parts[0] != partitionsBucket {
+			continue
+		}
+		p, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		v, err := store.Get(name, []byte(offsetWAL))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(v) == 8 {
+			table[int32(p)] = int64(binary.LittleEndian.Uint64(v))
+		}
+	}
+	return stream, table, nil
+}
+
+// loadOffsets reads the per-partition offsets of bucket
+func loadOffsets(store state.Store, bucket string) (map[int32]int64, error) {
+	offs := make(map[int32]int64)
+	err := store.Iterate(bucket, func(k, v []byte) error {
+		if len(k) != 4 || len(v) != 8 {
+			return fmt.Errorf("%v: invalid offset %q", bucket, k)
+		}
+		offs[int32(binary.BigEndian.Uint32(k))] = int64(binary.LittleEndian.Uint64(v))
+		return nil
+	})
+	return offs, err
+}
+
+func printOffsets(title string, offs map[int32]int64) {
+	fmt.Println(title + ":")
+	partitions := make([]int, 0, len(offs))
+	for p := range offs {
+		partitions = append(partitions, int(p))
+	}
+	sort.Ints(partitions)
+	for _, p := range partitions {
+		fmt.Printf("  %d: %d\n", p, offs[int32(p)])
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/expr"
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineConfig is a pipeline of sources, processors and sinks declared in
+// yaml, e.g.:
+//
+//	name: orders
+//	sources:
+//	  - {name: orders, topic: orders}
+//	processors:
+//	  - {name: large, type: filter, input: orders, where: amount > 100}
+//	  - name: per-country
+//	    type: aggregate
+//	    input: large
+//	    key: country
+//	    window: 1m
+//	    aggregates: {orders: count(), revenue: sum(amount)}
+//	sinks:
+//	  - {name: out, input: per-country, topic: revenue-per-country}
+//
+// The processors and sinks read their input from a source or from another
+// processor declared before them, the records between processors flow
+// through channels instead of topics.
+type pipelineConfig struct {
+	Name          string            `yaml:"name"`
+	Brokers       []string          `yaml:"brokers"`
+	StateBackend  string            `yaml:"state-backend"`
+	WriteInterval time.Duration     `yaml:"write-interval"`
+	DebugAddr     string            `yaml:"debug-addr"`
+	Sources       []sourceConfig    `yaml:"sources"`
+	Processors    []processorConfig `yaml:"processors"`
+	Sinks         []sinkConfig      `yaml:"sinks"`
+}
+
+// sourceConfig is a topic consumed by a pipeline
+type sourceConfig struct {
+	Name   string `yaml:"name"`
+	Topic  string `yaml:"topic"`
+	Format string `yaml:"format"` // json if not set
+	// start of the partitions without offsets, newest or oldest
+	Start             string `yaml:"start"`
+	SchemaRegistryURL string `yaml:"schema-registry-url"`
+	ProtoDescriptor   string `yaml:"proto-descriptor"`
+	ProtoMessage      string `yaml:"proto-message"`
+}
+
+// processorConfig is an operator of a pipeline, the fields used depend on
+// its type
+type processorConfig struct {
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"` // filter, map, join or aggregate
+	Input string `yaml:"input"`
+
+	// filter: predicate of the records forwarded
+	Where string `yaml:"where"`
+
+	// map: fields set to expressions, fields removed, and whether the
+	// records are replaced by the fields set
+	Set     map[string]string `yaml:"set"`
+	Drop    []string          `yaml:"drop"`
+	Project bool              `yaml:"project"`
+
+	// join: the table of the latest message of each key of a topic, keyed
+	// by table-key or by the keys of its messages; records are joined on
+	// the value of the expression key, with the rows set to the field as
+	// or merged; with inner the records without rows are dropped
+	TableTopic string `yaml:"table-topic"`
+	TableKey   string `yaml:"table-key"`
+	As         string `yaml:"as"`
+	Inner      bool   `yaml:"inner"`
+
+	// aggregate: tumbling windows of records grouped by key, of event time
+	// if time-field is set, closed grace after their end
+	Key        string            `yaml:"key"`
+	Window     time.Duration     `yaml:"window"`
+	Grace      time.Duration     `yaml:"grace"`
+	TimeField  string            `yaml:"time-field"`
+	Aggregates map[string]string `yaml:"aggregates"`
+}
+
+// sinkConfig is the output of a pipeline, a topic or stdout
+type sinkConfig struct {
+	Name  string `yaml:"name"`
+	Input string `yaml:"input"`
+	Type  string `yaml:"type"` // kafka if not set, or stdout
+	Topic string `yaml:"topic"`
+	// expression of the keys of messages, the keys of records if not set
+	Key string `yaml:"key"`
+}
+
+// loadPipeline reads and validates a pipeline file
+func loadPipeline(path string) (*pipelineConfig, error) {
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &pipelineConfig{
+		Brokers:       []string{"localhost:9092"},
+		StateBackend:  "bolt",
+		WriteInterval: 30 * time.Second,
+	}
+	if err := yaml.Unmarshal(bts, cfg); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks the names and the wiring, inputs must be declared before
+// so that pipelines are acyclic
+func (cfg *pipelineConfig) validate() error {
+	if cfg.Name == "" {
+		return errors.New("pipeline: name must be set")
+	}
+	if len(cfg.Sources) == 0 || len(cfg.Sinks) == 0 {
+		return errors.New("pipeline: no source or no sink")
+	}
+	if cfg.WriteInterval <= 0 {
+		return errors.New("pipeline: write-interval must be positive")
+	}
+	declared := make(map[string]string) // kinds by name
+	declare := func(kind, name string) error {
+		if name == "" {
+			return fmt.Errorf("%v: name must be set", kind)
+		}
+		if declared[name] != "" {
+			return fmt.Errorf("%v %v: name declared twice", kind, name)
+		}
+		declared[name] = kind
+		return nil
+	}
+	input := func(kind, name, in string) error {
+		if k := declared[in]; k != "source" && k != "processor" {
+			return fmt.Errorf("%v %v: input %q is not a source or a processor declared before", kind, name, in)
+		}
+		return nil
+	}
+
+	for _, s := range cfg.Sources {
+		if err := declare("source", s.Name); err != nil {
+			return err
+		}
+		if s.Topic == "" {
+			return fmt.Errorf("source %v: topic must be set", s.Name)
+		}
+		if s.Start != "" && s.Start != "newest" && s.Start != "oldest" {
+			return fmt.Errorf("source %v: start must be newest or oldest", s.Name)
+		}
+	}
+	for _, p := range cfg.Processors {
+		if err := input("processor", p.Name, p.Input); err != nil {
+			return err
+		}
+		if err := declare("processor", p.Name); err != nil {
+			return err
+		}
+	}
+	for _, s := range cfg.Sinks {
+		if err := input("sink", s.Name, s.Input); err != nil {
+			return err
+		}
+		if err := declare("sink", s.Name); err != nil {
+			return err
+		}
+		switch s.Type {
+		case "", "kafka":
+			if s.Topic == "" {
+				return fmt.Errorf("sink %v: topic must be set", s.Name)
+			}
+		case "stdout":
+		default:
+			return fmt.Errorf("sink %v: unsupported type %q", s.Name, s.Type)
+		}
+		if s.Key != "" {
+			if _, err := expr.Compile(s.Key); err != nil {
+				return fmt.Errorf("sink %v: key: %v", s.Name, err)
+			}
+		}
+	}
+	// the expressions and the fields of the processors
+	_, err := cfg.topology()
+	return err
+}
+
+// topology builds the topology of a pipeline
+func (cfg *pipelineConfig) topology() (*sp.Topology, error) {
+	t := sp.NewTopology(cfg.Name)
+	streams := make(map[string]*sp.KStream)
+	for _, s := range cfg.Sources {
+		streams[s.Name] = t.Source(sp.Source{
+			Name:              s.Name,
+			Topic:             s.Topic,
+			Oldest:            s.Start == "oldest",
+			Format:            s.Format,
+			SchemaRegistryURL: s.SchemaRegistryURL,
+			ProtoDescriptor:   s.ProtoDescriptor,
+			ProtoMessage:      s.ProtoMessage,
+		})
+	}
+	tables := make(map[[2]string]*sp.KTable)
+	for i := range cfg.Processors {
+		p := &cfg.Processors[i]
+		s, err := p.stream(t, streams[p.Input], tables)
+		if err != nil {
+			return nil, fmt.Errorf("processor %v: %v", p.Name, err)
+		}
+		streams[p.Name] = s.Named(p.Name)
+	}
+	for _, sc := range cfg.Sinks {
+		s := streams[sc.Input]
+		if sc.Key != "" {
+			key, err := sp.Expr(sc.Key)
+			if err != nil {
+				return nil, fmt.Errorf("sink %v: key: %v", sc.Name, err)
+			}
+			s = s.KeyBy(key).Named(sc.Name)
+		}
+		if sc.Type == "stdout" {
+			s.Print()
+		} else {
+			s.To(sc.Topic)
+		}
+	}
+	return t, t.Err()
+}
+
+// stream adds the stage of a processor to its input
+func (p *processorConfig) stream(t *sp.Topology, in *sp.KStream, tables map[[2]string]*sp.KTable) (*sp.KStream, error) {
+	switch p.Type {
+	case "filter":
+		if p.Where == "" {
+			return nil, errors.New("where must be set")
+		}
+		if _, err := expr.Compile(p.Where); err != nil {
+			return nil, err
+		}
+		return in.Where(p.Where), nil
+	case "map":
+		if len(p.Set) == 0 && len(p.Drop) == 0 {
+			return nil, errors.New("set or drop must be set")
+		}
+		values := make(map[string]sp.Value)
+		for name, src := range p.Set {
+			v, err := sp.Expr(src)
+			if err != nil {
+				return nil, fmt.Errorf("set %v: %v", name, err)
+			}
+			values[name] = v
+		}
+		set := sp.Set(values)
+		if p.Project {
+			set = sp.Project(values)
+		}
+		drop := sp.Drop(p.Drop...)
+		return in.Map(func(r *sp.Record) error {
+			if err := set(r); err != nil {
+				return err
+			}
+			return drop(r)
+		}), nil
+	case "join":
+		if p.TableTopic == "" || p.Key == "" {
+			return nil, errors.New("table-topic and key must be set")
+		}
+		on, err := sp.Expr(p.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key: %v", err)
+		}
+		// joins of the same table share it
+		table, ok := tables[[2]string{p.TableTopic, p.TableKey}]
+		if !ok {
+			table = t.Table(p.TableTopic, p.TableKey)
+			tables[[2]string{p.TableTopic, p.TableKey}] = table
+		}
+		if p.Inner {
+			return in.InnerJoin(table, on, p.As), nil
+		}
+		return in.Join(table, on, p.As), nil
+	case "aggregate":
+		w := sp.Window{Size: p.Window, Grace: p.Grace}
+		if p.Key != "" {
+			key, err := sp.Expr(p.Key)
+			if err != nil {
+				return nil, fmt.Errorf("key: %v", err)
+			}
+			w.Key = key
+		}
+		if p.TimeField != "" {
+			w.Time = sp.TimeField(p.TimeField)
+		}
+		names := make([]string, 0, len(p.Aggregates))
+		for name := range p.Aggregates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			a, err := sp.ParseAggregate(name, p.Aggregates[name])
+			if err != nil {
+				return nil, err
+			}
+			w.Aggregates = append(w.Aggregates, a)
+		}
+		s := in.Aggregate(w)
+		return s, t.Err()
+	}
+	return nil, fmt.Errorf("unsupported type %q", p.Type)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const orders = `
+name: orders
+sources:
+  - {name: orders, topic: orders}
+processors:
+  - {name: large, type: filter, input: orders, where: amount > 100}
+  - name: per-country
+    type: aggregate
+    input: large
+    key: country
+    window: 1m
+    aggregates: {orders: count(), revenue: sum(amount)}
+sinks:
+  - {name: out, input: per-country, topic: revenue-per-country}
+`
+
+func TestLoadPipeline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline.yaml")
+	if err := ioutil.WriteFile(path, []byte(orders), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadPipeline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Brokers, []string{"localhost:9092"}) || cfg.StateBackend != "bolt" || cfg.WriteInterval != 30*time.Second {
+		t.Fatalf("defaults: %v %v %v", cfg.Brokers, cfg.StateBackend, cfg.WriteInterval)
+	}
+	agg := cfg.Processors[1]
+	if agg.Input != "large" || agg.Window != time.Minute || agg.Aggregates["revenue"] != "sum(amount)" {
+		t.Fatalf("aggregate: %+v", agg)
+	}
+
+	if _, err := loadPipeline(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("missing file: expected an error")
+	}
+	if err := ioutil.WriteFile(path, []byte("name: [orders"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPipeline(path); err == nil || !strings.HasPrefix(err.Error(), path) {
+		t.Fatalf("invalid yaml: %v", err)
+	}
+}
+
+func TestValidatePipeline(t *testing.T) {
+	tests := []struct {
+		yaml string
+		err  string // empty if valid
+	}{
+		{orders, ""},
+		{`
+name: enrich
+brokers: [kafka-1:9092, kafka-2:9092]
+write-interval: 5s
+sources:
+  - {name: clicks, topic: clicks, start: oldest}
+processors:
+  - {name: users, type: join, input: clicks, table-topic: users, table-key: id, key: user_id, as: user}
+  - {name: countries, type: join, input: users, table-topic: users, table-key: id, key: referrer_id, as: referrer, inner: true}
+  - name: slim
+    type: map
+    input: countries
+    set: {country: user.country, total: price * quantity}
+    drop: [user]
+sinks:
+  - {name: out, input: slim, topic: enriched, key: user_id}
+  - {name: print, input: clicks, type: stdout}
+`, ""},
+		{`
+sources: [{name: s, topic: t}]
+sinks: [{name: o, input: s, topic: u}]
+`, "name must be set"},
+		{`
+name: p
+sinks: [{name: o, input: s, topic: u}]
+`, "no source or no sink"},
+		{`
+name: p
+write-interval: 0s
+sources: [{name: s, topic: t}]
+sinks: [{name: o, input: s, topic: u}]
+`, "write-interval must be positive"},
+		{`
+name: p
+sources: [{name: s}]
+sinks: [{name: o, input: s, topic: u}]
+`, "source s: topic must be set"},
+		{`
+name: p
+sources: [{name: s, topic: t, start: earliest}]
+sinks: [{name: o, input: s, topic: u}]
+`, "start must be newest or oldest"},
+		{`
+name: p
+sources: [{name: s, topic: t}, {name: s, topic: u}]
+sinks: [{name: o, input: s, topic: u}]
+`, "source s: name declared twice"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors:
+  - {name: a, type: filter, input: b, where: x > 1}
+  - {name: b, type: filter, input: s, where: x > 1}
+sinks: [{name: o, input: a, topic: u}]
+`, `processor a: input "b" is not a source or a processor declared before`},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+sinks: [{name: o, input: s, topic: u}, {name: o2, input: o, topic: v}]
+`, `sink o2: input "o"`},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+sinks: [{name: o, input: s}]
+`, "sink o: topic must be set"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+sinks: [{name: o, input: s, type: file}]
+`, `sink o: unsupported type "file"`},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+sinks: [{name: o, input: s, topic: u, key: "a +"}]
+`, "sink o: key:"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: f, type: filter, input: s}]
+sinks: [{name: o, input: f, topic: u}]
+`, "processor f: where must be set"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: f, type: filter, input: s, where: "x >"}]
+sinks: [{name: o, input: f, topic: u}]
+`, "processor f: expr:"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: m, type: map, input: s}]
+sinks: [{name: o, input: m, topic: u}]
+`, "processor m: set or drop must be set"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: j, type: join, input: s, table-topic: users}]
+sinks: [{name: o, input: j, topic: u}]
+`, "processor j: table-topic and key must be set"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: a, type: aggregate, input: s, aggregates: {n: count()}}]
+sinks: [{name: o, input: a, topic: u}]
+`, "window size must be positive"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: a, type: aggregate, input: s, window: 1m, aggregates: {n: median(x)}}]
+sinks: [{name: o, input: a, topic: u}]
+`, "aggregate n:"},
+		{`
+name: p
+sources: [{name: s, topic: t}]
+processors: [{name: x, type: sort, input: s}]
+sinks: [{name: o, input: x, topic: u}]
+`, `processor x: unsupported type "sort"`},
+	}
+	for _, tt := range tests {
+		cfg := &pipelineConfig{WriteInterval: 30 * time.Second}
+		if err := yaml.Unmarshal([]byte(tt.yaml), cfg); err != nil {
+			t.Fatalf("%v: %v", tt.yaml, err)
+		}
+		err := cfg.validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Fatalf("%v: got error %v, want %q", tt.yaml, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var runCommand = &cli.Command{
+	Name:      "run",
+	Usage:     "run the sources, processors and sinks of a pipeline file in one process",
+	ArgsUsage: "pipeline.yaml",
+	Flags:     state.Flags,
+	Action:    runPipeline,
+}
+
+func runPipeline(c *cli.Context) error {
+	if c.NArg() != 1 {
+		log.Fatalln("usage: sp run pipeline.yaml")
+	}
+	cfg, err := loadPipeline(c.Args().First())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	t, err := cfg.topology()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := t.Run(sp.Config{
+		Brokers:       cfg.Brokers,
+		StateBackend:  cfg.StateBackend,
+		StateOptions:  state.OptionsOf(c),
+		WriteInterval: cfg.WriteInterval,
+		DebugAddr:     cfg.DebugAddr,
+	}); err != nil {
+		log.Fatalln(err)
+	}
+	return nil
+}
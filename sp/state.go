@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var stateCommand = &cli.Command{
+	Name:  "state",
+	Usage: "export or import the state of a processor",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "export",
+			Usage: "write the tables and offsets of a cache file to a portable json snapshot",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "file",
+					Aliases: []string{"f"},
+					Usage:   "cache file of the processor",
+				},
+				&cli.StringFlag{
+					Name:    "out",
+					Aliases: []string{"o"},
+					Usage:   "snapshot path, stdout if not set",
+				},
+			},
+			Action: exportState,
+		},
+		{
+			Name:  "import",
+			Usage: "read a json snapshot into a cache file, created if missing",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "file",
+					Aliases: []string{"f"},
+					Usage:   "cache file of the processor",
+				},
+				&cli.StringFlag{
+					Name:    "in",
+					Aliases: []string{"i"},
+					Usage:   "snapshot path, stdin if not set",
+				},
+			},
+			Action: importState,
+		},
+	},
+}
+
+func exportState(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		log.Fatalln("file is not set")
+	}
+	if _, err := os.Stat(file); err != nil {
+		log.Fatalln(err)
+	}
+	store, err := state.OpenBolt(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if out := c.String("out"); out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := state.Export(store, store.Buckets(), w); err != nil {
+		log.Fatalln(err)
+	}
+	return nil
+}
+
+func importState(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		log.Fatalln("file is not set")
+	}
+	var r io.Reader = os.Stdin
+	if in := c.String("in"); in != "" {
+		f, err := os.Open(in)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	store, err := state.OpenBolt(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+	n, err := state.Import(store, r)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("imported:", n)
+	return nil
+}
@@ -0,0 +1,148 @@
+package state
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// badgerDB is a flatDB on badger, a pure Go alternative to rocksdb for
+// tables that don't fit in memory
+type badgerDB struct {
+	db   *badger.DB
+	die  chan struct{}
+	done chan struct{}
+}
+
+// OpenBadger opens or creates the badger database directory at path, the
+// value log is garbage collected every opts.GCInterval
+func OpenBadger(path string, opts Options) (Store, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithSyncWrites(true).WithLogger(badgerLogger{}))
+	if err != nil {
+		return nil, err
+	}
+	b := &badgerDB{db: db, die: make(chan struct{}), done: make(chan struct{})}
+	go b.gc(opts.GCInterval, opts.GCDiscardRatio)
+	return newFlatStore(b, 0), nil
+}
+
+// gc rewrites the value log files with more than ratio of stale data
+func (b *badgerDB) gc(interval time.Duration, ratio float64) {
+	defer close(b.done)
+	if interval <= 0 {
+		return
+	}
+	if ratio <= 0 || ratio >= 1 {
+		ratio = 0.5
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for b.db.RunValueLogGC(ratio) == nil { // until nothing to rewrite
+			}
+		case <-b.die:
+			return
+		}
+	}
+}
+
+func (b *badgerDB) get(key []byte) (value []byte, err error) {
+	err = b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return
+}
+
+func (b *badgerDB) iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// write commits the changes in as many transactions as badger needs for
+// them, the changes of the buckets __*__, the offsets and timers, last: the
+// offsets are committed with or after the changes they cover, a crash
+// between the transactions reprocesses the messages from the offsets of
+// the previous checkpoint over the changes already committed
+func (b *badgerDB) write(changes map[string][]byte) error {
+	var keys, internal []string
+	for k := range changes {
+		if internalBucket(k[:strings.IndexByte(k, 0)]) {
+			internal = append(internal, k)
+		} else {
+			keys = append(keys, k)
+		}
+	}
+
+	txn := b.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	for _, k := range append(keys, internal...) {
+		err := setOrDelete(txn, k, changes[k])
+		if err == badger.ErrTxnTooBig {
+			if err := txn.Commit(); err != nil {
+				return err
+			}
+			txn = b.db.NewTransaction(true)
+			err = setOrDelete(txn, k, changes[k])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// setOrDelete sets k to v in txn, or deletes it if v is nil
+func setOrDelete(txn *badger.Txn, k string, v []byte) error {
+	if v == nil {
+		return txn.Delete([]byte(k))
+	}
+	return txn.Set([]byte(k), v)
+}
+
+func (b *badgerDB) size() int64 {
+	lsm, vlog := b.db.Size()
+	return lsm + vlog
+}
+
+func (b *badgerDB) entries() int64 { return -1 }
+
+// badgerLogger logs the errors and warnings of badger only
+type badgerLogger struct{}
+
+func (badgerLogger) Errorf(f string, v ...interface{})   { log.Errorf("badger: "+f, v...) }
+func (badgerLogger) Warningf(f string, v ...interface{}) { log.Warnf("badger: "+f, v...) }
+func (badgerLogger) Infof(string, ...interface{})        {}
+func (badgerLogger) Debugf(string, ...interface{})       {}
+
+func (b *badgerDB) close() error {
+	close(b.die)
+	<-b.done
+	return b.db.Close()
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+func TestBadgerCheckpointBeyondTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badger")
+	store, err := OpenBadger(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// about 32MB of rows, more than a badger transaction holds
+	const rows = 32 << 10
+	value := bytes.Repeat([]byte{'x'}, 1<<10)
+	for i := 0; i < rows; i++ {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		if err := store.Put("joiner/users", k, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put("__offset_wal__", []byte{0, 0, 0, 0}, []byte("offset")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBadger(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	n := 0
+	if err := store.Iterate("joiner/users", func(k, v []byte) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != rows {
+		t.Fatalf("rows after restart: %v, want %v", n, rows)
+	}
+	if v, err := store.Get("__offset_wal__", []byte{0, 0, 0, 0}); err != nil || string(v) != "offset" {
+		t.Fatalf("offset after restart: %q %v", v, err)
+	}
+}
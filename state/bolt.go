@@ -0,0 +1,330 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// memBucket holds the key/values of a bucket in memory
+type memBucket struct {
+	values map[string][]byte
+	dirty  map[string]bool // keys put or deleted since last checkpoint
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{values: make(map[string][]byte), dirty: make(map[string]bool)}
+}
+
+// BoltStore keeps the whole state in memory and writes the keys changed
+// since the last checkpoint to a BoltDB file on checkpoint
+type BoltStore struct {
+	db *bolt.DB
+
+	mu         sync.Mutex
+	buckets    map[string]*memBucket
+	checkpoint time.Duration // of the last checkpoint
+}
+
+// OpenBolt opens the BoltDB file at path, created if missing, and reads its
+// content to memory
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BoltStore{db: db, buckets: make(map[string]*memBucket)}
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			s.load(string(name), b)
+			return nil
+		})
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads bucket b and its nested buckets
+func (s *BoltStore) load(name string, b *bolt.Bucket) {
+	mb := newMemBucket()
+	s.buckets[name] = mb
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil {
+			if nested := b.Bucket(k); nested != nil {
+				s.load(name+"/"+string(k), nested)
+			}
+			continue
+		}
+		mb.values[string(k)] = append([]byte(nil), v...)
+	}
+}
+
+// Buckets returns the sorted names of the buckets
+func (s *BoltStore) Buckets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get implements Store
+func (s *BoltStore) Get(bucket string, key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mb, ok := s.buckets[bucket]; ok {
+		return mb.values[string(key)], nil
+	}
+	return nil, nil
+}
+
+// Put implements Store
+func (s *BoltStore) Put(bucket string, key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mb, ok := s.buckets[bucket]
+	if !ok {
+		mb = newMemBucket()
+		s.buckets[bucket] = mb
+	}
+	mb.values[string(key)] = append([]byte(nil), value...)
+	mb.dirty[string(key)] = true
+	return nil
+}
+
+// Delete implements Store
+func (s *BoltStore) Delete(bucket string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mb, ok := s.buckets[bucket]; ok {
+		delete(mb.values, string(key))
+		mb.dirty[string(key)] = true
+	}
+	return nil
+}
+
+// Iterate implements Store
+func (s *BoltStore) Iterate(bucket string, fn func(key, value []byte) error) error {
+	s.mu.Lock()
+	mb, ok := s.buckets[bucket]
+	var keys []string
+	if ok {
+		keys = make([]string, 0, len(mb.values))
+		for k := range mb.values {
+			keys = append(keys, k)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.mu.Lock()
+		v, ok := mb.values[k]
+		s.mu.Unlock()
+		if !ok { // deleted by fn
+			continue
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint writes the keys changed since the last checkpoint in a single
+// transaction, nothing is written if no key changed
+func (s *BoltStore) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+	dirty := false
+	for _, mb := range s.buckets {
+		if len(mb.dirty) > 0 {
+			dirty = true
+			break
+		}
+	}
+	if !dirty {
+		return nil
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		for name, mb := range s.buckets {
+			if len(mb.dirty) == 0 {
+				continue
+			}
+			b, err := createBucket(tx, name)
+			if err != nil {
+				return err
+			}
+			for k := range mb.dirty {
+				if v, ok := mb.values[k]; ok {
+					err = b.Put([]byte(k), v)
+				} else {
+					err = b.Delete([]byte(k))
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, mb := range s.buckets {
+		mb.dirty = make(map[string]bool)
+	}
+	s.checkpoint = time.Since(start)
+	return nil
+}
+
+// Stats returns the stats of the store, values are all in memory
+func (s *BoltStore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := Stats{DiskBytes: fileSize(s.db.Path()), Checkpoint: s.checkpoint}
+	for _, mb := range s.buckets {
+		stats.Entries += int64(len(mb.values))
+		stats.Dirty += len(mb.dirty)
+	}
+	return stats
+}
+
+// fileSize returns the size of a file, -1 on error
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// Close implements Store
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// createBucket creates the nested buckets of name if missing
+func createBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	path := strings.Split(name, "/")
+	b, err := tx.CreateBucketIfNotExists([]byte(path[0]))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range path[1:] {
+		if b, err = b.CreateBucketIfNotExists([]byte(p)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// boltDB is a flatDB on a BoltDB file, for stores bounded in memory
+type boltDB struct {
+	db *bolt.DB
+}
+
+// OpenBoltCached opens the BoltDB file at path like OpenBolt without reading
+// its content, values are read on demand and up to cacheSize bytes of them
+// are kept in memory
+func OpenBoltCached(path string, cacheSize int64) (Store, error) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newFlatStore(&boltDB{db}, cacheSize), nil
+}
+
+// bucket returns the nested bucket of name, nil if missing
+func (b *boltDB) bucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	path := strings.Split(name, "/")
+	bucket := tx.Bucket([]byte(path[0]))
+	for _, p := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(p))
+	}
+	return bucket
+}
+
+// split splits a flat key into its bucket name and its key in the bucket
+func (b *boltDB) split(key []byte) (string, []byte) {
+	i := bytes.IndexByte(key, 0)
+	return string(key[:i]), key[i+1:]
+}
+
+func (b *boltDB) get(key []byte) (value []byte, err error) {
+	name, k := b.split(key)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if bucket := b.bucket(tx, name); bucket != nil {
+			if v := bucket.Get(k); v != nil {
+				value = append([]byte(nil), v...)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (b *boltDB) iterate(prefix []byte, fn func(key, value []byte) error) error {
+	name, _ := b.split(prefix)
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := b.bucket(tx, name)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v == nil { // nested bucket
+				continue
+			}
+			if err := fn(append(append([]byte(nil), prefix...), k...), append([]byte(nil), v...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltDB) write(changes map[string][]byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for key, v := range changes {
+			name, k := b.split([]byte(key))
+			var err error
+			if v != nil {
+				var bucket *bolt.Bucket
+				if bucket, err = createBucket(tx, name); err == nil {
+					err = bucket.Put(k, v)
+				}
+			} else if bucket := b.bucket(tx, name); bucket != nil {
+				err = bucket.Delete(k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltDB) size() int64    { return fileSize(b.db.Path()) }
+func (b *boltDB) entries() int64 { return -1 }
+
+func (b *boltDB) close() error {
+	return b.db.Close()
+}
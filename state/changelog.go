@@ -0,0 +1,206 @@
+package state
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/kafka"
+)
+
+// ChangelogStore mirrors the changes of a store to a compacted kafka topic
+// on checkpoint, before the store checkpoints itself, so that the store can
+// be rebuilt from the topic if lost; messages are keyed by bucket, a zero
+// byte and key, deletes are tombstones
+type ChangelogStore struct {
+	Store
+	brokers  []string
+	topic    string
+	client   sarama.Client
+	producer sarama.SyncProducer
+
+	mu      sync.Mutex
+	changes map[string][]byte // nil for deleted keys
+}
+
+// NewChangelog mirrors the changes of store to topic, created compacted if
+// missing
+func NewChangelog(store Store, brokers []string, topic string) (*ChangelogStore, error) {
+	config := kafka.NewConfig()
+	config.Version = sarama.V0_10_2_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := createCompacted(client, topic); err != nil {
+		client.Close()
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &ChangelogStore{
+		Store:    store,
+		brokers:  brokers,
+		topic:    topic,
+		client:   client,
+		producer: producer,
+		changes:  make(map[string][]byte),
+	}, nil
+}
+
+// createCompacted creates topic with compaction if missing
+func createCompacted(client sarama.Client, topic string) error {
+	topics, err := client.Topics()
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		if t == topic {
+			return nil
+		}
+	}
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return err
+	}
+	replicas := int16(len(client.Brokers()))
+	if replicas > 3 {
+		replicas = 3
+	}
+	compact := "compact"
+	return admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     1,
+		ReplicationFactor: replicas,
+		ConfigEntries:     map[string]*string{"cleanup.policy": &compact},
+	}, false)
+}
+
+// Put implements Store
+func (s *ChangelogStore) Put(bucket string, key, value []byte) error {
+	if err := s.Store.Put(bucket, key, value); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.changes[string(flatKey(bucket, key))] = append([]byte{}, value...)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete implements Store
+func (s *ChangelogStore) Delete(bucket string, key []byte) error {
+	if err := s.Store.Delete(bucket, key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.changes[string(flatKey(bucket, key))] = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// Checkpoint sends the changes since the last checkpoint to the changelog
+// then checkpoints the store
+func (s *ChangelogStore) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.changes) > 0 {
+		msgs := make([]*sarama.ProducerMessage, 0, len(s.changes))
+		for k, v := range s.changes {
+			msg := &sarama.ProducerMessage{Topic: s.topic, Key: sarama.StringEncoder(k)}
+			if v != nil {
+				msg.Value = sarama.ByteEncoder(v)
+			}
+			msgs = append(msgs, msg)
+		}
+		if err := s.producer.SendMessages(msgs); err != nil {
+			return err
+		}
+		s.changes = make(map[string][]byte)
+	}
+	return s.Store.Checkpoint()
+}
+
+// Close implements Store
+func (s *ChangelogStore) Close() error {
+	s.producer.Close()
+	s.client.Close()
+	return s.Store.Close()
+}
+
+// Restore replays the changelog into the store up to its end at the time
+// of the call and checkpoints the store
+func (s *ChangelogStore) Restore() (restored int, err error) {
+	client, err := sarama.NewClient(s.brokers, kafka.NewConfig())
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return 0, err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(s.topic)
+	if err != nil {
+		return 0, err
+	}
+	for _, partition := range partitions {
+		hwm, err := client.GetOffset(s.topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return restored, err
+		}
+		oldest, err := client.GetOffset(s.topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return restored, err
+		}
+		if oldest >= hwm { // empty
+			continue
+		}
+		pc, err := consumer.ConsumePartition(s.topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return restored, err
+		}
+		if err := s.replay(pc, hwm, &restored); err != nil {
+			pc.Close()
+			return restored, err
+		}
+		pc.Close()
+	}
+	return restored, s.Store.Checkpoint()
+}
+
+// replay applies the messages of pc below hwm
+func (s *ChangelogStore) replay(pc sarama.PartitionConsumer, hwm int64, restored *int) error {
+	for {
+		select {
+		case msg := <-pc.Messages():
+			if i := bytes.IndexByte(msg.Key, 0); i >= 0 {
+				bucket, key := string(msg.Key[:i]), msg.Key[i+1:]
+				var err error
+				if msg.Value == nil {
+					err = s.Store.Delete(bucket, key)
+				} else {
+					err = s.Store.Put(bucket, key, msg.Value)
+				}
+				if err != nil {
+					return err
+				}
+				*restored++
+			}
+			if msg.Offset+1 >= hwm {
+				return nil
+			}
+		case err := <-pc.Errors():
+			return err
+		}
+	}
+}
+
+// Unwrap returns the wrapped store
+func (s *ChangelogStore) Unwrap() Store { return s.Store }
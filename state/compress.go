@@ -0,0 +1,114 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression of a value, stored as its first byte
+const (
+	compressNone   = 0
+	compressSnappy = 1
+	compressZstd   = 2
+)
+
+// CompressedStore compresses the values of a store, values which don't
+// shrink are stored as is; values of any compression can be read so that
+// the compression of a store can be changed
+type CompressedStore struct {
+	Store
+	kind    byte
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewCompressed compresses the values of store with snappy or zstd
+func NewCompressed(store Store, compression string) (*CompressedStore, error) {
+	s := &CompressedStore{Store: store}
+	switch compression {
+	case "snappy":
+		s.kind = compressSnappy
+	case "zstd":
+		s.kind = compressZstd
+	case "none":
+		s.kind = compressNone
+	default:
+		return nil, fmt.Errorf("state: unsupported compression %q", compression)
+	}
+
+	var err error
+	if s.encoder, err = zstd.NewWriter(nil); err != nil {
+		return nil, err
+	}
+	if s.decoder, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get implements Store
+func (s *CompressedStore) Get(bucket string, key []byte) ([]byte, error) {
+	v, err := s.Store.Get(bucket, key)
+	if err != nil || v == nil {
+		return v, err
+	}
+	return s.decompress(v)
+}
+
+// Put implements Store
+func (s *CompressedStore) Put(bucket string, key, value []byte) error {
+	return s.Store.Put(bucket, key, s.compress(value))
+}
+
+// Iterate implements Store
+func (s *CompressedStore) Iterate(bucket string, fn func(key, value []byte) error) error {
+	return s.Store.Iterate(bucket, func(k, v []byte) error {
+		value, err := s.decompress(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, value)
+	})
+}
+
+// Close implements Store
+func (s *CompressedStore) Close() error {
+	s.encoder.Close()
+	s.decoder.Close()
+	return s.Store.Close()
+}
+
+func (s *CompressedStore) compress(value []byte) []byte {
+	var bts []byte
+	switch s.kind {
+	case compressSnappy:
+		bts = append([]byte{compressSnappy}, snappy.Encode(nil, value)...)
+	case compressZstd:
+		bts = s.encoder.EncodeAll(value, []byte{compressZstd})
+	}
+	if bts == nil || len(bts) > len(value) {
+		return append([]byte{compressNone}, value...)
+	}
+	return bts
+}
+
+func (s *CompressedStore) decompress(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, errors.New("state: decompress: empty value")
+	}
+	switch v[0] {
+	case compressNone:
+		return v[1:], nil
+	case compressSnappy:
+		return snappy.Decode(nil, v[1:])
+	case compressZstd:
+		return s.decoder.DecodeAll(v[1:], []byte{})
+	}
+	return nil, fmt.Errorf("state: decompress: unknown compression %v", v[0])
+}
+
+// Unwrap returns the wrapped store
+func (s *CompressedStore) Unwrap() Store { return s.Store }
@@ -0,0 +1,86 @@
+package state
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// EncryptedStore encrypts the values of a store with AES-GCM, each value is
+// stored as a random nonce followed by the sealed value; keys are not
+// encrypted so that iteration keeps key order
+type EncryptedStore struct {
+	Store
+	aead cipher.AEAD
+}
+
+// NewEncrypted encrypts the values of store with key, a hex encoded AES
+// key of 16, 24 or 32 bytes
+func NewEncrypted(store Store, key string) (*EncryptedStore, error) {
+	bts, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("state: encryption key: %v", err)
+	}
+	block, err := aes.NewCipher(bts)
+	if err != nil {
+		return nil, fmt.Errorf("state: encryption key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{Store: store, aead: aead}, nil
+}
+
+// Get implements Store
+func (s *EncryptedStore) Get(bucket string, key []byte) ([]byte, error) {
+	v, err := s.Store.Get(bucket, key)
+	if err != nil || v == nil {
+		return v, err
+	}
+	return s.open(bucket, key, v)
+}
+
+// Put implements Store
+func (s *EncryptedStore) Put(bucket string, key, value []byte) error {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(value)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return s.Store.Put(bucket, key, s.aead.Seal(nonce, nonce, value, additionalData(bucket, key)))
+}
+
+// Iterate implements Store
+func (s *EncryptedStore) Iterate(bucket string, fn func(key, value []byte) error) error {
+	return s.Store.Iterate(bucket, func(k, v []byte) error {
+		value, err := s.open(bucket, k, v)
+		if err != nil {
+			return err
+		}
+		return fn(k, value)
+	})
+}
+
+// open decrypts the value of key, sealed values are bound to their bucket
+// and key so that they can't be swapped
+func (s *EncryptedStore) open(bucket string, key, v []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(v) < n {
+		return nil, errors.New("state: decrypt: value too short")
+	}
+	value, err := s.aead.Open(make([]byte, 0, len(v)), v[:n], v[n:], additionalData(bucket, key))
+	if err != nil {
+		return nil, fmt.Errorf("state: decrypt %v/%q: %v", bucket, key, err)
+	}
+	return value, nil
+}
+
+func additionalData(bucket string, key []byte) []byte {
+	return flatKey(bucket, key)
+}
+
+// Unwrap returns the wrapped store
+func (s *EncryptedStore) Unwrap() Store { return s.Store }
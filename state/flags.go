@@ -0,0 +1,59 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// Flags are the flags of the options of the backends, for the processors
+// taking a state-backend
+var Flags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "max-memory",
+		Usage: "megabytes of values kept in memory by the bolt backend, least recently used values are read back from the cache file, 0 for no limit",
+	},
+	&cli.DurationFlag{
+		Name:  "state-gc-interval",
+		Value: 10 * time.Minute,
+		Usage: "interval of value log garbage collection of the badger backend, 0 to disable",
+	},
+	&cli.Float64Flag{
+		Name:  "state-gc-ratio",
+		Value: 0.5,
+		Usage: "fraction of stale data for a badger value log file to be rewritten",
+	},
+	&cli.StringSliceFlag{
+		Name:  "redis",
+		Value: cli.NewStringSlice("localhost:6379"),
+		Usage: "addresses of the redis server or cluster of the redis backend, redis-sink writes to them too",
+	},
+	&cli.StringFlag{
+		Name:    "redis-password",
+		EnvVars: []string{"REDIS_PASSWORD"},
+		Usage:   "password of the redis backend",
+	},
+	&cli.StringFlag{
+		Name:  "redis-replica",
+		Usage: "name of the replica in a redis backend shared by several replicas, e.g. the hostname of a pod of a statefulset, its offsets are kept apart from the others",
+	},
+}
+
+// OptionsOf returns the options of the backends set by Flags
+func OptionsOf(c *cli.Context) Options {
+	return Options{
+		MaxMemory:      int64(c.Int("max-memory")) << 20,
+		GCInterval:     c.Duration("state-gc-interval"),
+		GCDiscardRatio: c.Float64("state-gc-ratio"),
+		RedisAddrs:     c.StringSlice("redis"),
+		RedisPassword:  c.String("redis-password"),
+		RedisReplica:   c.String("redis-replica"),
+	}
+}
+
+// String formats the options for the logs, without the redis password
+func (opts Options) String() string {
+	return fmt.Sprintf("max-memory: %vMB state-gc-interval: %v state-gc-ratio: %v redis: %v redis-replica: %v",
+		opts.MaxMemory>>20, opts.GCInterval, opts.GCDiscardRatio, opts.RedisAddrs, opts.RedisReplica)
+}
@@ -0,0 +1,201 @@
+package state
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flatDB is a database of sorted key/values without buckets, the key of a
+// value is its bucket name, a zero byte and its key in the bucket
+type flatDB interface {
+	get(key []byte) ([]byte, error)
+	// iterate calls fn for each key/value starting with prefix in key order
+	iterate(prefix []byte, fn func(key, value []byte) error) error
+	// write applies the changes atomically, nil values delete their key
+	write(changes map[string][]byte) error
+	// size returns the bytes on disk, entries the number of key/values, -1
+	// if unknown
+	size() int64
+	entries() int64
+	close() error
+}
+
+// flatStore keeps the changes since the last checkpoint in memory on top of
+// a flatDB, so that only the keys in use are held in memory; values read
+// are cached up to a size if set
+type flatStore struct {
+	db flatDB
+
+	mu         sync.Mutex
+	changes    map[string][]byte // nil for deleted keys
+	cache      *lru
+	generation int // checkpoints written, values read before are stale
+
+	checkpoint             time.Duration // of the last checkpoint
+	cacheHits, cacheMisses int64
+}
+
+// newFlatStore returns a store on db caching up to cacheSize bytes of
+// values read, 0 disables the cache
+func newFlatStore(db flatDB, cacheSize int64) *flatStore {
+	s := &flatStore{db: db, changes: make(map[string][]byte)}
+	if cacheSize > 0 {
+		s.cache = newLRU(cacheSize)
+	}
+	return s
+}
+
+// internalBucket reports the buckets named __*__, the offsets and timers of
+// the processors, and their nested buckets
+func internalBucket(bucket string) bool {
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		bucket = bucket[:i]
+	}
+	return len(bucket) > 4 && strings.HasPrefix(bucket, "__") && strings.HasSuffix(bucket, "__")
+}
+
+func flatKey(bucket string, key []byte) []byte {
+	k := make([]byte, 0, len(bucket)+1+len(key))
+	k = append(append([]byte(bucket), 0), key...)
+	return k
+}
+
+// Get implements Store
+func (s *flatStore) Get(bucket string, key []byte) ([]byte, error) {
+	k := flatKey(bucket, key)
+	s.mu.Lock()
+	v, ok := s.changes[string(k)]
+	if !ok && s.cache != nil {
+		if v, ok = s.cache.get(string(k)); ok {
+			s.cacheHits++
+		} else {
+			s.cacheMisses++
+		}
+	}
+	generation := s.generation
+	s.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	v, err := s.db.get(k)
+	if err != nil || s.cache == nil {
+		return v, err
+	}
+	s.mu.Lock()
+	if _, changed := s.changes[string(k)]; !changed && generation == s.generation {
+		s.cache.add(string(k), v)
+	}
+	s.mu.Unlock()
+	return v, nil
+}
+
+// Put implements Store
+func (s *flatStore) Put(bucket string, key, value []byte) error {
+	s.mu.Lock()
+	s.changes[string(flatKey(bucket, key))] = append([]byte{}, value...)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete implements Store
+func (s *flatStore) Delete(bucket string, key []byte) error {
+	s.mu.Lock()
+	s.changes[string(flatKey(bucket, key))] = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// Iterate implements Store, the keys of the database are merged with the
+// changes since the last checkpoint
+func (s *flatStore) Iterate(bucket string, fn func(key, value []byte) error) error {
+	prefix := flatKey(bucket, nil)
+
+	// changes of the bucket when the iteration starts
+	s.mu.Lock()
+	var keys []string
+	values := make(map[string][]byte)
+	for k, v := range s.changes {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+			values[k] = v
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+
+	yield := func(k string) error {
+		if v := values[k]; v != nil {
+			return fn([]byte(k[len(prefix):]), v)
+		}
+		return nil
+	}
+
+	if err := s.db.iterate(prefix, func(k, v []byte) error {
+		for len(keys) > 0 && keys[0] < string(k) {
+			if err := yield(keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		if len(keys) > 0 && keys[0] == string(k) { // changed since last checkpoint
+			keys = keys[1:]
+			return yield(string(k))
+		}
+		return fn(bytes.TrimPrefix(k, prefix), v)
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := yield(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint writes the changes since the last checkpoint
+func (s *flatStore) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.changes) == 0 {
+		return nil
+	}
+	start := time.Now()
+	if err := s.db.write(s.changes); err != nil {
+		return err
+	}
+	if s.cache != nil {
+		for k, v := range s.changes {
+			s.cache.add(k, v)
+		}
+	}
+	s.changes = make(map[string][]byte)
+	s.generation++
+	s.checkpoint = time.Since(start)
+	return nil
+}
+
+// Stats returns the stats of the store, cache counts are of the reads
+// not served by the changes since the last checkpoint
+func (s *flatStore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Entries:     s.db.entries(),
+		DiskBytes:   s.db.size(),
+		Dirty:       len(s.changes),
+		Checkpoint:  s.checkpoint,
+		CacheHits:   s.cacheHits,
+		CacheMisses: s.cacheMisses,
+	}
+}
+
+// Close implements Store
+func (s *flatStore) Close() error {
+	return s.db.close()
+}
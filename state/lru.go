@@ -0,0 +1,48 @@
+package state
+
+import (
+	"container/list"
+)
+
+// lru caches values up to a total size in bytes of keys and values, the
+// least recently used values are evicted first; nil values cache missing
+// keys
+type lru struct {
+	max, size int64
+	ll        *list.List // front is most recently used
+	items     map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	value []byte
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lru) get(key string) ([]byte, bool) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruItem).value, true
+	}
+	return nil, false
+}
+
+func (c *lru) add(key string, value []byte) {
+	c.remove(key)
+	c.items[key] = c.ll.PushFront(&lruItem{key, value})
+	c.size += int64(len(key) + len(value))
+	for c.size > c.max && c.ll.Len() > 0 {
+		c.remove(c.ll.Back().Value.(*lruItem).key)
+	}
+}
+
+func (c *lru) remove(key string) {
+	if e, ok := c.items[key]; ok {
+		item := c.ll.Remove(e).(*lruItem)
+		delete(c.items, key)
+		c.size -= int64(len(item.key) + len(item.value))
+	}
+}
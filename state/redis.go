@@ -0,0 +1,148 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisDB is a flatDB on a redis server or cluster, each bucket is a hash
+// named after the store path and the bucket, with a sorted set of its fields
+// to iterate them in order a page at a time; the store path is a hash tag so
+// that all the keys of a store live in the same cluster slot and checkpoints
+// run in one transaction.
+//
+// Several replicas share a store: the private buckets of a replica, e.g. its
+// offsets, are named after the replica too, and the other buckets, e.g. the
+// tables, are shared. A checkpoint writes the fields changed by the replica
+// only, in a transaction, so that checkpoints of replicas run concurrently
+// without overwriting the offsets of each other.
+type redisDB struct {
+	client  redis.UniversalClient
+	prefix  string
+	replica string // prefix of the private buckets, the shared prefix if no replica
+	private func(bucket string) bool
+}
+
+// iteratePage is the number of fields read at a time by iterate
+const iteratePage = 1000
+
+// OpenRedis connects to the redis servers of opts.RedisAddrs, path names
+// the store among the stores of the servers
+func OpenRedis(path string, opts Options) (Store, error) {
+	if len(opts.RedisAddrs) == 0 {
+		return nil, errors.New("state: redis backend requires redis addresses")
+	}
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    opts.RedisAddrs,
+		Password: opts.RedisPassword,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	r := &redisDB{
+		client:  client,
+		prefix:  "{" + path + "}",
+		private: opts.RedisPrivate,
+	}
+	r.replica = r.prefix
+	if opts.RedisReplica != "" {
+		r.replica = r.prefix + "@" + opts.RedisReplica
+	}
+	if r.private == nil {
+		r.private = internalBucket
+	}
+	return newFlatStore(r, 0), nil
+}
+
+// scope returns the prefix of the keys of the bucket of a flat key, and
+// the bucket
+func (r *redisDB) scope(key []byte) (string, string) {
+	bucket := string(key[:bytes.IndexByte(key, 0)])
+	if r.private(bucket) {
+		return r.replica, bucket
+	}
+	return r.prefix, bucket
+}
+
+// hash splits a flat key into the hash of its bucket and its field
+func (r *redisDB) hash(key []byte) (string, string) {
+	prefix, bucket := r.scope(key)
+	return prefix + ":" + bucket, string(key[bytes.IndexByte(key, 0)+1:])
+}
+
+// fields is the sorted set of the fields of the hash of a bucket
+func (r *redisDB) fields(key []byte) string {
+	prefix, bucket := r.scope(key)
+	return prefix + "#" + bucket
+}
+
+func (r *redisDB) get(key []byte) ([]byte, error) {
+	h, f := r.hash(key)
+	v, err := r.client.HGet(context.Background(), h, f).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return v, err
+}
+
+// iterate reads the fields of the bucket in order from its sorted set, and
+// their values from its hash, a page at a time
+func (r *redisDB) iterate(prefix []byte, fn func(key, value []byte) error) error {
+	ctx := context.Background()
+	h, _ := r.hash(prefix)
+	z := r.fields(prefix)
+	min := "-"
+	for {
+		fields, err := r.client.ZRangeByLex(ctx, z, &redis.ZRangeBy{Min: min, Max: "+", Count: iteratePage}).Result()
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		values, err := r.client.HMGet(ctx, h, fields...).Result()
+		if err != nil {
+			return err
+		}
+		for i, f := range fields {
+			v, ok := values[i].(string)
+			if !ok { // deleted since the page was read
+				continue
+			}
+			if err := fn(append(append([]byte(nil), prefix...), f...), []byte(v)); err != nil {
+				return err
+			}
+		}
+		min = "(" + fields[len(fields)-1]
+	}
+}
+
+func (r *redisDB) write(changes map[string][]byte) error {
+	ctx := context.Background()
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for k, v := range changes {
+			h, f := r.hash([]byte(k))
+			z := r.fields([]byte(k))
+			if v == nil {
+				p.HDel(ctx, h, f)
+				p.ZRem(ctx, z, f)
+			} else {
+				p.HSet(ctx, h, f, v)
+				p.ZAdd(ctx, z, redis.Z{Member: f})
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisDB) size() int64    { return -1 }
+func (r *redisDB) entries() int64 { return -1 }
+
+func (r *redisDB) close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,87 @@
+//go:build rocksdb
+// +build rocksdb
+
+package state
+
+import (
+	"github.com/linxGnu/grocksdb"
+)
+
+func init() {
+	backends["rocksdb"] = func(path string, _ Options) (Store, error) { return OpenRocksDB(path) }
+}
+
+// rocksDB is a flatDB on rocksdb, values live on disk and only the changes
+// since the last checkpoint are kept in memory, for tables that don't fit
+// in memory; requires cgo and librocksdb, built with the rocksdb tag
+type rocksDB struct {
+	db *grocksdb.DB
+	ro *grocksdb.ReadOptions
+	wo *grocksdb.WriteOptions
+}
+
+// OpenRocksDB opens or creates the rocksdb database directory at path
+func OpenRocksDB(path string) (Store, error) {
+	opts := grocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := grocksdb.OpenDb(opts, path)
+	opts.Destroy()
+	if err != nil {
+		return nil, err
+	}
+	wo := grocksdb.NewDefaultWriteOptions()
+	wo.SetSync(true) // checkpoints are durable
+	return newFlatStore(&rocksDB{db, grocksdb.NewDefaultReadOptions(), wo}, 0), nil
+}
+
+func (r *rocksDB) get(key []byte) ([]byte, error) {
+	return r.db.GetBytes(r.ro, key)
+}
+
+func (r *rocksDB) iterate(prefix []byte, fn func(key, value []byte) error) error {
+	it := r.db.NewIterator(r.ro)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		// slices of the iterator are only valid until Next
+		k := append([]byte(nil), it.Key().Data()...)
+		v := append([]byte{}, it.Value().Data()...)
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (r *rocksDB) write(changes map[string][]byte) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for k, v := range changes {
+		if v == nil {
+			wb.Delete([]byte(k))
+		} else {
+			wb.Put([]byte(k), v)
+		}
+	}
+	return r.db.Write(r.wo, wb)
+}
+
+func (r *rocksDB) size() int64 {
+	if n, ok := r.db.GetIntProperty("rocksdb.total-sst-files-size"); ok {
+		return int64(n)
+	}
+	return -1
+}
+
+func (r *rocksDB) entries() int64 {
+	if n, ok := r.db.GetIntProperty("rocksdb.estimate-num-keys"); ok {
+		return int64(n)
+	}
+	return -1
+}
+
+func (r *rocksDB) close() error {
+	r.db.Close()
+	r.ro.Destroy()
+	r.wo.Destroy()
+	return nil
+}
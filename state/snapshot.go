@@ -0,0 +1,100 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// Snapshot is the portable form of a store, keys and values are strings if
+// printable, base64 otherwise
+type Snapshot struct {
+	Buckets map[string][]Entry `json:"buckets"`
+}
+
+// Entry is a key/value of a snapshot
+type Entry struct {
+	Key         string `json:"key,omitempty"`
+	KeyBase64   []byte `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+}
+
+func newEntry(k, v []byte) Entry {
+	var e Entry
+	if printable(k) {
+		e.Key = string(k)
+	} else {
+		e.KeyBase64 = append([]byte(nil), k...)
+	}
+	if printable(v) {
+		e.Value = string(v)
+	} else {
+		e.ValueBase64 = append([]byte(nil), v...)
+	}
+	return e
+}
+
+func (e *Entry) key() []byte {
+	if e.KeyBase64 != nil {
+		return e.KeyBase64
+	}
+	return []byte(e.Key)
+}
+
+func (e *Entry) value() []byte {
+	if e.ValueBase64 != nil {
+		return e.ValueBase64
+	}
+	return []byte(e.Value)
+}
+
+// printable tells if bts is utf8 text without control characters but spaces
+func printable(bts []byte) bool {
+	if !utf8.Valid(bts) {
+		return false
+	}
+	for _, r := range string(bts) {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// Export writes a snapshot of the buckets of s to w
+func Export(s Store, buckets []string, w io.Writer) error {
+	snapshot := Snapshot{Buckets: make(map[string][]Entry)}
+	for _, name := range buckets {
+		entries := []Entry{}
+		if err := s.Iterate(name, func(k, v []byte) error {
+			entries = append(entries, newEntry(k, v))
+			return nil
+		}); err != nil {
+			return err
+		}
+		snapshot.Buckets[name] = entries
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snapshot)
+}
+
+// Import puts the key/values of the snapshot read from r to s and
+// checkpoints s, returns the number of key/values imported
+func Import(s Store, r io.Reader) (int, error) {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+	n := 0
+	for name, entries := range snapshot.Buckets {
+		for i := range entries {
+			if err := s.Put(name, entries[i].key(), entries[i].value()); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, s.Checkpoint()
+}
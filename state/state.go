@@ -0,0 +1,84 @@
+// Package state implements the stores of stream processor state, e.g. the
+// tables of a joiner and the offsets consumed.
+//
+// Stores hold key/values in named buckets, "/" separates the names of
+// nested buckets, e.g.: "joiner/user_updates". Changes become durable on
+// Checkpoint, which commits all changes since the previous checkpoint
+// atomically so that processor state and consumed offsets stay consistent.
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store is a key/value store of processor state, stores are safe for
+// concurrent use
+type Store interface {
+	// Get returns the value of key in bucket, nil if missing, the value
+	// must not be modified
+	Get(bucket string, key []byte) ([]byte, error)
+	// Put sets the value of key in bucket
+	Put(bucket string, key, value []byte) error
+	// Delete removes key from bucket
+	Delete(bucket string, key []byte) error
+	// Iterate calls fn for each key/value of bucket in key order, fn may
+	// modify the bucket, iteration stops on the first error of fn
+	Iterate(bucket string, fn func(key, value []byte) error) error
+	// Checkpoint makes the changes since the last checkpoint durable
+	Checkpoint() error
+	// Close releases the store without checkpoint
+	Close() error
+}
+
+// Options tunes the backends, zero values are the defaults of the backend
+type Options struct {
+	// GCInterval is the interval between value log garbage collections of
+	// badger, 0 disables them
+	GCInterval time.Duration
+	// GCDiscardRatio is the fraction of stale data of a value log file for
+	// badger to rewrite it
+	GCDiscardRatio float64
+
+	// MaxMemory caps the bytes of values of the bolt backend kept in memory,
+	// least recently used values are read back from the file on demand; 0
+	// keeps the whole state in memory
+	MaxMemory int64
+
+	// RedisAddrs are the addresses of the redis server, sentinels or
+	// cluster nodes of the redis backend
+	RedisAddrs    []string
+	RedisPassword string
+	// RedisReplica names the replica among the replicas of a processor
+	// sharing a redis store, e.g. the hostname of a pod of a statefulset;
+	// the buckets of RedisPrivate are kept per replica, the others are
+	// shared. A store without replica has a single writer
+	RedisReplica string
+	// RedisPrivate reports the buckets kept per replica, e.g. the offsets
+	// consumed; the buckets named __*__ and their nested buckets if nil
+	RedisPrivate func(bucket string) bool
+}
+
+// backends opens stores by backend name, backends with cgo or other heavy
+// dependencies register themselves when built with their build tag
+var backends = map[string]func(path string, opts Options) (Store, error){
+	"":       openBolt,
+	"bolt":   openBolt,
+	"badger": OpenBadger,
+	"redis":  OpenRedis,
+}
+
+func openBolt(path string, opts Options) (Store, error) {
+	if opts.MaxMemory > 0 {
+		return OpenBoltCached(path, opts.MaxMemory)
+	}
+	return OpenBolt(path)
+}
+
+// Open opens the store of backend at path
+func Open(backend, path string, opts Options) (Store, error) {
+	if open, ok := backends[backend]; ok {
+		return open(path, opts)
+	}
+	return nil, fmt.Errorf("state: unsupported backend %q", backend)
+}
@@ -0,0 +1,49 @@
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// Stats are metrics of a store, counts unknown to a backend are -1
+type Stats struct {
+	Entries     int64         // key/values stored
+	DiskBytes   int64         // size of the store on disk
+	Dirty       int           // keys changed since the last checkpoint
+	Checkpoint  time.Duration // duration of the last checkpoint
+	CacheHits   int64         // reads served from memory by read-through caches
+	CacheMisses int64
+}
+
+// String formats the stats for logs
+func (s Stats) String() string {
+	hitRate := "n/a"
+	if n := s.CacheHits + s.CacheMisses; n > 0 {
+		hitRate = fmt.Sprintf("%.1f%%", float64(s.CacheHits)*100/float64(n))
+	}
+	return fmt.Sprintf("entries:%v disk:%v dirty:%v checkpoint:%v cache-hit-rate:%v", s.Entries, s.DiskBytes, s.Dirty, s.Checkpoint, hitRate)
+}
+
+// statser is a store reporting stats
+type statser interface {
+	Stats() Stats
+}
+
+// wrapper is a store wrapping another store, e.g. to encrypt values
+type wrapper interface {
+	Unwrap() Store
+}
+
+// StatsOf returns the stats of the store wrapped by s
+func StatsOf(s Store) (Stats, bool) {
+	for {
+		if st, ok := s.(statser); ok {
+			return st.Stats(), true
+		}
+		w, ok := s.(wrapper)
+		if !ok {
+			return Stats{}, false
+		}
+		s = w.Unwrap()
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const processorName = "syslog-source"
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Receive syslog messages of rfc 3164 or rfc 5424 over udp and tcp, and publish them as json to a kafka topic keyed by hostname",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "udp",
+				Value: ":5514",
+				Usage: "udp address to listen on, disabled if empty",
+			},
+			&cli.StringFlag{
+				Name:  "tcp",
+				Value: ":5514",
+				Usage: "tcp address to listen on, messages framed by newlines or octet counting of rfc 6587, disabled if empty",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "syslog",
+				Usage: "topic to publish the messages to",
+			},
+			&cli.StringFlag{
+				Name:  "timezone",
+				Value: "Local",
+				Usage: "timezone of the timestamps of rfc 3164, which have none, e.g. UTC",
+			},
+			&cli.BoolFlag{
+				Name:  "keep-invalid",
+				Usage: "publish the messages failing to parse with the raw message, dropped if not set",
+			},
+			&cli.IntFlag{
+				Name:  "max-message",
+				Value: 64 * 1024,
+				Usage: "max bytes of messages over tcp",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval of the logs of counters",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(logging.Flags, kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	udp_addr := c.String("udp")
+	tcp_addr := c.String("tcp")
+	output_topic := c.String("output-topic")
+	timezone := c.String("timezone")
+	keep_invalid := c.Bool("keep-invalid")
+	max_message := c.Int("max-message")
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("udp:", udp_addr)
+	log.Println("tcp:", tcp_addr)
+	log.Println("output-topic:", output_topic)
+	log.Println("timezone:", timezone)
+	log.Println("keep-invalid:", keep_invalid)
+	log.Println("max-message:", max_message)
+	log.Println("write-interval:", write_interval)
+
+	if udp_addr == "" && tcp_addr == "" {
+		log.Fatalln("no udp or tcp address")
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	kconfig := kafka.NewConfig()
+	kconfig.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, kconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// counters are updated by the listeners
+	var numReceived, numInvalid, numFailed int64
+	go func() {
+		// syslog has no acknowledgment, messages failing are lost
+		for err := range producer.Errors() {
+			log.Println(err)
+			atomic.AddInt64(&numFailed, 1)
+		}
+	}()
+
+	handle := func(b []byte, source string) {
+		atomic.AddInt64(&numReceived, 1)
+		now := time.Now()
+		m, err := parse(b, now, loc)
+		if err != nil {
+			atomic.AddInt64(&numInvalid, 1)
+			if !keep_invalid {
+				return
+			}
+			m = &message{Facility: 1, Severity: 5, Message: string(b)} // user.notice, the default of rfc 3164
+		}
+		m.Source, m.ReceivedAt = source, now
+		bts, err := json.Marshal(m)
+		if err != nil {
+			atomic.AddInt64(&numInvalid, 1)
+			return
+		}
+		msg := &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(bts)}
+		if m.Hostname != "" {
+			msg.Key = sarama.StringEncoder(m.Hostname)
+		} else {
+			msg.Key = sarama.StringEncoder(source)
+		}
+		producer.Input() <- msg
+	}
+
+	var udpConn net.PacketConn
+	if udp_addr != "" {
+		if udpConn, err = net.ListenPacket("udp", udp_addr); err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, addr, err := udpConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				handle(buf[:n], hostOf(addr))
+			}
+		}()
+	}
+
+	var tcpListener net.Listener
+	if tcp_addr != "" {
+		if tcpListener, err = net.Listen("tcp", tcp_addr); err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			for {
+				conn, err := tcpListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					source := hostOf(conn.RemoteAddr())
+					if err := readFrames(bufio.NewReader(conn), max_message, func(b []byte) { handle(b, source) }); err != nil && err != io.EOF {
+						log.Println(source, err)
+					}
+				}()
+			}
+		}()
+	}
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Println("received:", atomic.SwapInt64(&numReceived, 0), "invalid:", atomic.SwapInt64(&numInvalid, 0), "failed:", atomic.SwapInt64(&numFailed, 0))
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			if udpConn != nil {
+				udpConn.Close()
+			}
+			if tcpListener != nil {
+				tcpListener.Close()
+			}
+			if err := producer.Close(); err != nil {
+				log.Println(err)
+			}
+			return nil
+		}
+	}
+}
+
+// readFrames reads the messages of a tcp stream, each framed by octet
+// counting, MSG-LEN SP MSG, if it starts with a digit, by a newline
+// otherwise
+func readFrames(r *bufio.Reader, max int, fn func([]byte)) error {
+	buf := make([]byte, max)
+	for {
+		c, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if c[0] >= '0' && c[0] <= '9' {
+			prefix, err := r.ReadString(' ')
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(prefix[:len(prefix)-1])
+			if err != nil || n > max {
+				return fmt.Errorf("invalid frame length %q", prefix)
+			}
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return err
+			}
+			fn(buf[:n])
+			continue
+		}
+
+		n := 0
+		for {
+			line, err := r.ReadSlice('\n')
+			if n+len(line) > max {
+				return fmt.Errorf("message longer than %v bytes", max)
+			}
+			n += copy(buf[n:], line)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && n == 0 {
+				return err
+			}
+			break
+		}
+		if n > 1 || buf[0] != '\n' {
+			fn(buf[:n])
+		}
+	}
+}
+
+// hostOf returns the ip of an address
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNoPriority = errors.New("missing priority")
+	errTruncated  = errors.New("truncated message")
+)
+
+// message is a syslog message, fields missing from the message are empty
+type message struct {
+	Facility       int                          `json:"facility"`
+	Severity       int                          `json:"severity"`
+	Version        int                          `json:"version,omitempty"`
+	Timestamp      *time.Time                   `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+	Source         string                       `json:"source"`
+	ReceivedAt     time.Time                    `json:"received_at"`
+}
+
+// parse parses a message of rfc 5424, or of rfc 3164 if it has no version;
+// the timestamps of rfc 3164 without a year are in the year of now in loc
+func parse(b []byte, now time.Time, loc *time.Location) (*message, error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+	if len(b) < 3 || b[0] != '<' {
+		return nil, errNoPriority
+	}
+	end := bytes.IndexByte(b[:min(len(b), 5)], '>')
+	if end < 2 {
+		return nil, errNoPriority
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri > 191 {
+		return nil, errNoPriority
+	}
+	m := &message{Facility: pri / 8, Severity: pri % 8}
+	b = b[end+1:]
+
+	if len(b) >= 2 && b[0] >= '1' && b[0] <= '9' && (b[1] == ' ' || len(b) > 2 && b[1] >= '0' && b[1] <= '9' && b[2] == ' ') {
+		return m, parse5424(m, b)
+	}
+	parse3164(m, b, now, loc)
+	return m, nil
+}
+
+// parse5424 parses VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID
+// SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parse5424(m *message, b []byte) error {
+	fields := make([]string, 6)
+	for i := range fields {
+		sp := bytes.IndexByte(b, ' ')
+		if sp < 0 {
+			return errTruncated
+		}
+		if f := string(b[:sp]); f != "-" {
+			fields[i] = f
+		}
+		b = b[sp+1:]
+	}
+	m.Version, _ = strconv.Atoi(fields[0])
+	if fields[1] != "" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			return err
+		}
+		m.Timestamp = &ts
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = fields[2], fields[3], fields[4], fields[5]
+
+	if len(b) > 0 && b[0] == '-' {
+		b = b[1:]
+	} else {
+		sd, rest, err := parseStructuredData(b)
+		if err != nil {
+			return err
+		}
+		m.StructuredData, b = sd, rest
+	}
+	b = bytes.TrimPrefix(b, []byte{' '})
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	m.Message = string(b)
+	return nil
+}
+
+// parseStructuredData parses elements of [SD-ID *(SP NAME="VALUE")], values
+// escape '"', '\' and ']' with '\'
+func parseStructuredData(b []byte) (map[string]map[string]string, []byte, error) {
+	sd := make(map[string]map[string]string)
+	for len(b) > 0 && b[0] == '[' {
+		b = b[1:]
+		end := bytes.IndexAny(b, " ]")
+		if end < 1 {
+			return nil, nil, errTruncated
+		}
+		params := make(map[string]string)
+		sd[string(b[:end])] = params
+		b = b[end:]
+		for {
+			if len(b) == 0 {
+				return nil, nil, errTruncated
+			}
+			if b[0] == ']' {
+				b = b[1:]
+				break
+			}
+			b = b[1:] // space
+			eq := bytes.IndexByte(b, '=')
+			if eq < 1 || len(b) < eq+2 || b[eq+1] != '"' {
+				return nil, nil, errTruncated
+			}
+			name := string(b[:eq])
+			b = b[eq+2:]
+			var value strings.Builder
+			i := 0
+			for ; i < len(b) && b[i] != '"'; i++ {
+				if b[i] == '\\' && i+1 < len(b) && strings.IndexByte(`"\]`, b[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(b[i])
+			}
+			if i == len(b) {
+				return nil, nil, errTruncated
+			}
+			params[name] = value.String()
+			b = b[i+1:]
+		}
+	}
+	return sd, b, nil
+}
+
+// parse3164 parses TIMESTAMP SP HOSTNAME SP TAG[PID]: MSG of rfc 3164, as
+// sent by most devices; what doesn't match is the message
+func parse3164(m *message, b []byte, now time.Time, loc *time.Location) {
+	// Mmm dd hh:mm:ss, days padded with a space
+	if len(b) >= 16 && b[15] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, string(b[:15]), loc); err == nil {
+			year := now.In(loc).Year()
+			ts = ts.AddDate(year, 0, 0)
+			// messages of december received in january
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = &ts
+			b = b[16:]
+
+			// hostname, unless the next word is the tag
+			if sp := bytes.IndexByte(b, ' '); sp > 0 && !bytes.ContainsAny(b[:sp], ":[") {
+				m.Hostname = string(b[:sp])
+				b = b[sp+1:]
+			}
+		}
+	}
+
+	// tag of alphanumerics, up to 32 characters, and an optional [pid]
+	tag := 0
+	for tag < len(b) && tag < 48 && b[tag] != ':' && b[tag] != '[' && b[tag] != ' ' {
+		tag++
+	}
+	if tag > 0 && tag < len(b) && (b[tag] == ':' || b[tag] == '[') {
+		m.AppName = string(b[:tag])
+		rest := b[tag:]
+		if rest[0] == '[' {
+			if end := bytes.IndexByte(rest, ']'); end > 0 {
+				m.ProcID = string(rest[1:end])
+				rest = rest[end+1:]
+			}
+		}
+		if len(rest) > 0 && rest[0] == ':' {
+			b = bytes.TrimPrefix(rest[1:], []byte{' '})
+		} else {
+			m.AppName, m.ProcID = "", ""
+		}
+	}
+	m.Message = string(b)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	ts := func(s string) *time.Time {
+		v, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &v
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	newYear := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+
+	tests := []struct {
+		in   string
+		now  time.Time
+		want message
+	}{
+		{ // rfc 5424
+			"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xef\xbb\xbf'su root' failed for lonvick on /dev/pts/8\n",
+			now,
+			message{Facility: 4, Severity: 2, Version: 1, Timestamp: ts("2003-10-11T22:14:15.003Z"), Hostname: "mymachine.example.com",
+				AppName: "su", MsgID: "ID47", Message: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{ // rfc 5424 with structured data
+			`<165>1 2003-10-11T22:14:15.003-07:00 host evntslog 42 ID47 [exampleSDID@32473 iut="3" eventSource="Application"][examplePriority@32473 class="high"] An application event`,
+			now,
+			message{Facility: 20, Severity: 5, Version: 1, Timestamp: ts("2003-10-11T22:14:15.003-07:00"), Hostname: "host",
+				AppName: "evntslog", ProcID: "42", MsgID: "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473":     {"iut": "3", "eventSource": "Application"},
+					"examplePriority@32473": {"class": "high"},
+				},
+				Message: "An application event"},
+		},
+		{ // escapes of structured data, nil values and no message
+			`<14>1 - - - - - [id a="x\"y\]z\\" b="\n"]`,
+			now,
+			message{Facility: 1, Severity: 6, Version: 1, StructuredData: map[string]map[string]string{"id": {"a": `x"y]z\`, "b": `\n`}}},
+		},
+		{ // rfc 3164
+			"<13>Feb  5 17:32:18 10.0.0.99 myapp[123]: Use the BFG!",
+			now,
+			message{Facility: 1, Severity: 5, Timestamp: ts("2024-02-05T17:32:18Z"), Hostname: "10.0.0.99", AppName: "myapp", ProcID: "123", Message: "Use the BFG!"},
+		},
+		{ // rfc 3164 of december received in january
+			"<13>Dec 31 23:59:59 host app: bye",
+			newYear,
+			message{Facility: 1, Severity: 5, Timestamp: ts("2023-12-31T23:59:59Z"), Hostname: "host", AppName: "app", Message: "bye"},
+		},
+		{ // rfc 3164 without hostname
+			"<13>Feb  5 17:32:18 app: hi",
+			now,
+			message{Facility: 1, Severity: 5, Timestamp: ts("2024-02-05T17:32:18Z"), AppName: "app", Message: "hi"},
+		},
+		{ // tag without timestamp
+			"<0>sshd: hello",
+			now,
+			message{AppName: "sshd", Message: "hello"},
+		},
+		{ // no tag
+			"<191>just a message",
+			now,
+			message{Facility: 23, Severity: 7, Message: "just a message"},
+		},
+		{ // tag not followed by a colon
+			"<13>app[12] text",
+			now,
+			message{Facility: 1, Severity: 5, Message: "app[12] text"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parse([]byte(tt.in), tt.now, time.UTC)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.in, err)
+		}
+		if (got.Timestamp == nil) != (tt.want.Timestamp == nil) ||
+			got.Timestamp != nil && !got.Timestamp.Equal(*tt.want.Timestamp) {
+			t.Fatalf("parse %q: timestamp %v, want %v", tt.in, got.Timestamp, tt.want.Timestamp)
+		}
+		got.Timestamp, tt.want.Timestamp = nil, nil
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Fatalf("parse %q:\ngot  %+v\nwant %+v", tt.in, *got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err error // any error if nil
+	}{
+		{"", errNoPriority},
+		{"no priority", errNoPriority},
+		{"<>x", errNoPriority},
+		{"<abc>x", errNoPriority},
+		{"<192>x", errNoPriority},
+		{"<123456>x", errNoPriority},
+		{"<13>1 2003-10-11T22:14:15Z host", errTruncated},
+		{`<13>1 - - - - - [id a="x`, errTruncated},
+		{`<13>1 - - - - - [id a=x]`, errTruncated},
+		{`<13>1 - - - - - [id`, errTruncated},
+		{"<13>1 yesterday host app - - - msg", nil}, // bad timestamp
+	}
+	for _, tt := range tests {
+		_, err := parse([]byte(tt.in), time.Now(), time.UTC)
+		if err == nil || tt.err != nil && err != tt.err {
+			t.Fatalf("parse %q: got error %v, want %v", tt.in, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package sp
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+// NewTemplate parses a template of names, e.g. the topics or the subjects
+// of messages, executed on their fields with the functions lower and
+// replace; fields missing fail the execution
+func NewTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"lower":   strings.ToLower,
+		"replace": strings.ReplaceAll,
+	}).Parse(text)
+}
+
+// Render executes t on data
+func Render(t *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// TopicName replaces the characters invalid in kafka topics of name by '_'
+func TopicName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+)
+
+// tokenBucket allows rate messages per second on average and bursts of up
+// to burst messages
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// refill adds the tokens accumulated since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// wait returns the delay until a token is available at now
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take consumes a token, wait must have returned 0
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// full reports whether the bucket refilled to burst, buckets full are
+// equivalent to new buckets
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// limiter combines a global bucket and per-key buckets, each nil if
+// unlimited
+type limiter struct {
+	global   *tokenBucket
+	keyRate  float64
+	keyBurst int
+	keys     map[string]*tokenBucket
+}
+
+// wait returns the delay until a message of key can be forwarded at now
+func (l *limiter) wait(key string, now time.Time) time.Duration {
+	var d time.Duration
+	if l.global != nil {
+		d = l.global.wait(now)
+	}
+	if l.keys != nil {
+		b, ok := l.keys[key]
+		if !ok {
+			b = newTokenBucket(l.keyRate, l.keyBurst, now)
+			l.keys[key] = b
+		}
+		if kd := b.wait(now); kd > d {
+			d = kd
+		}
+	}
+	return d
+}
+
+// take consumes the tokens of a message of key, wait must have returned 0
+func (l *limiter) take(key string) {
+	if l.global != nil {
+		l.global.take()
+	}
+	if l.keys != nil {
+		l.keys[key].take()
+	}
+}
+
+// evict removes the buckets of the keys idle long enough to be full
+func (l *limiter) evict(now time.Time) int {
+	n := 0
+	for key, b := range l.keys {
+		if b.full(now) {
+			delete(l.keys, key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,9 @@
+package main
+
+import "errors"
+
+// errorOverflow is the type of the error of the messages over the rates
+const errorOverflow = "overflow"
+
+// errOverflow is the reason of messages dropped over the rates
+var errOverflow = errors.New("throttled: over the rate")
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	processorName = "throttler"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Forward the messages of a stream at a bounded rate",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to throttle",
+			},
+			&cli.Float64Flag{
+				Name:  "rate",
+				Value: 0,
+				Usage: "messages forwarded per second, 0 for unlimited",
+			},
+			&cli.IntFlag{
+				Name:  "burst",
+				Value: 1,
+				Usage: "messages forwarded at once after idle periods",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "extract the json field as throttling key in stream messages, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.Float64Flag{
+				Name:  "key-rate",
+				Value: 0,
+				Usage: "messages of each key forwarded per second, 0 for unlimited",
+			},
+			&cli.IntFlag{
+				Name:  "key-burst",
+				Value: 1,
+				Usage: "messages of each key forwarded at once after idle periods",
+			},
+			&cli.StringFlag{
+				Name:  "on-overflow",
+				Value: "buffer",
+				Usage: "messages over the rates are, buffer: delayed, holding back the messages after them, drop: dropped, dlq: sent to the dead letter topic",
+			},
+			&cli.StringFlag{
+				Name:  "dlq",
+				Value: "",
+				Usage: "dead letter topic for messages over the rates with --on-overflow dlq",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: throttler-{stream-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	rate := c.Float64("rate")
+	burst := c.Int("burst")
+	key_path := c.String("key")
+	key_rate := c.Float64("key-rate")
+	key_burst := c.Int("key-burst")
+	on_overflow := c.String("on-overflow")
+	dlq := c.String("dlq")
+	format_name := c.String("format")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("throttler-%v", stream_topic)
+	}
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("rate:", rate)
+	log.Println("burst:", burst)
+	log.Println("key:", key_path)
+	log.Println("key-rate:", key_rate)
+	log.Println("key-burst:", key_burst)
+	log.Println("on-overflow:", on_overflow)
+	log.Println("dlq:", dlq)
+	log.Println("format:", format_name)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".throttler-%v-%v.cache", stream_topic, output_topic)
+	log.Println("cache file:", cachefile)
+
+	if rate < 0 || key_rate < 0 {
+		log.Fatalln("rates must not be negative")
+	}
+	if burst < 1 || key_burst < 1 {
+		log.Fatalln("bursts must be at least 1")
+	}
+	if key_rate > 0 && key_path == "" {
+		log.Fatalln("key must be set with key-rate")
+	}
+	switch on_overflow {
+	case "buffer", "drop":
+	case "dlq":
+		if dlq == "" {
+			log.Fatalln("dlq must be set with --on-overflow dlq")
+		}
+	default:
+		log.Fatalln("unsupported on-overflow:", on_overflow)
+	}
+
+	l := &limiter{}
+	if rate > 0 {
+		l.global = newTokenBucket(rate, burst, time.Now())
+	}
+	if key_rate > 0 {
+		l.keyRate, l.keyBurst = key_rate, key_burst
+		l.keys = make(map[string]*tokenBucket)
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// messages in flight, offsets are only committed after all messages
+	// forwarded before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("consuming from stream offsets:%v", streamOffsets)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numForwarded, numDelayed, numOverflow, numInvalid := 0, 0, 0, 0
+	host, _ := os.Hostname()
+
+	// a message buffered until the tokens to forward it are available
+	var pending *sarama.ConsumerMessage
+	var pendingKey string
+	retry := time.NewTimer(0)
+	<-retry.C
+
+	forward := func(msg *sarama.ConsumerMessage) {
+		out := &sarama.ProducerMessage{Topic: output_topic, Value: sarama.ByteEncoder(msg.Value)}
+		if msg.Key != nil {
+			out.Key = sarama.ByteEncoder(msg.Key)
+		}
+		inflight.Add(1)
+		producer.Input() <- out
+		numForwarded++
+	}
+
+	// throttle forwards a message of key if the rates allow, otherwise
+	// handles the overflow
+	throttle := func(msg *sarama.ConsumerMessage, key string) {
+		d := l.wait(key, time.Now())
+		if d == 0 {
+			l.take(key)
+			forward(msg)
+			return
+		}
+
+		switch on_overflow {
+		case "buffer":
+			if pending == nil {
+				numDelayed++
+			}
+			pending, pendingKey = msg, key
+			retry.Reset(d)
+		case "dlq":
+			out, err := sp.NewDeadLetter(dlq, processorName, host, msg, errorOverflow, errOverflow)
+			if err != nil {
+				log.WithFields(logging.Message(msg)).Println(err)
+				return
+			}
+			inflight.Add(1)
+			producer.Input() <- out
+			numOverflow++
+		default:
+			numOverflow++
+		}
+	}
+
+	receive := func(msg *sarama.ConsumerMessage) {
+		key := ""
+		if key_path != "" {
+			value, err := decoder.Decode(msg.Value)
+			if err != nil {
+				numInvalid++
+				return
+			}
+			jsonParsed, err := gabs.ParseJSON(value)
+			if err != nil {
+				numInvalid++
+				return
+			}
+			if v := jsonParsed.Path(key_path).Data(); v != nil {
+				key = fmt.Sprint(v)
+			}
+		}
+		throttle(msg, key)
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		// the message buffered is consumed again after a restart
+		commit := make(sp.Offsets)
+		for p, offset := range streamOffsets {
+			commit[p] = offset
+		}
+		if pending != nil {
+			commit[pending.Partition] = pending.Offset
+		}
+		if err := commit.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		evicted := l.evict(time.Now())
+		log.Println("forwarded:", numForwarded, "delayed:", numDelayed, "overflow:", numOverflow, "invalid:", numInvalid, "keys:", len(l.keys), "evicted:", evicted, "stream offsets:", commit)
+		numForwarded, numDelayed, numOverflow, numInvalid = 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		// no message is consumed while one is buffered
+		messages := streamMessages
+		if pending != nil {
+			messages = nil
+		}
+
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case <-retry.C:
+			msg := pending
+			pending = nil
+			throttle(msg, pendingKey)
+		case msg := <-messages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			receive(msg)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package sp
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/xtaci/sp/state"
+)
+
+// TimerBucket is the bucket of the pending timers of a processor in the
+// store
+const TimerBucket = "__timers__"
+
+// TimerProcessor is a processor scheduling callbacks by key with
+// Context.SetTimer, e.g. to close a session after inactivity, expire an
+// entry or delay an emission
+type TimerProcessor interface {
+	Processor
+	// OnTimer is called from the goroutine of Checkpoint when the timer
+	// of key fires with the data it was set with; timers failing are
+	// counted as invalid
+	OnTimer(ctx *Context, key string, data []byte) error
+}
+
+// timer is a callback of a key pending until at
+type timer struct {
+	key  string
+	at   time.Time
+	data []byte
+	seq  uint64 // of the last set of the key, older entries of the heap are stale
+}
+
+// timerHeap orders the timers by time
+type timerHeap []*timer
+
+func (h timerHeap) Len() int            { return len(h) }
+func (h timerHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h timerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(*timer)) }
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// timers are the pending timers of a processor, one per key, stored in
+// TimerBucket on checkpoint so that they survive restarts; timers fired
+// after the last checkpoint fire again on restart, like the messages
+// reprocessed from the offsets of the checkpoint
+type timers struct {
+	pending map[string]*timer
+	queue   timerHeap // may hold timers replaced or deleted since pushed
+	dirty   map[string]bool
+	seq     uint64
+}
+
+func newTimers() *timers {
+	return &timers{
+		pending: make(map[string]*timer),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// set schedules the timer of key at, replacing the one pending
+func (ts *timers) set(key string, at time.Time, data []byte) {
+	ts.seq++
+	t := &timer{key: key, at: at, data: data, seq: ts.seq}
+	ts.pending[key] = t
+	ts.dirty[key] = true
+	heap.Push(&ts.queue, t)
+}
+
+// delete cancels the timer of key
+func (ts *timers) delete(key string) {
+	if _, ok := ts.pending[key]; ok {
+		delete(ts.pending, key)
+		ts.dirty[key] = true
+	}
+}
+
+// due removes and returns the timers at or before now in the order of
+// their time
+func (ts *timers) due(now time.Time) []*timer {
+	var fired []*timer
+	for len(ts.queue) > 0 && !ts.queue[0].at.After(now) {
+		t := heap.Pop(&ts.queue).(*timer)
+		if p, ok := ts.pending[t.key]; !ok || p.seq != t.seq {
+			continue
+		}
+		delete(ts.pending, t.key)
+		ts.dirty[t.key] = true
+		fired = append(fired, t)
+	}
+	return fired
+}
+
+// flush puts the timers changed since the last checkpoint to the store,
+// the time in nanoseconds followed by the data
+func (ts *timers) flush(store state.Store) error {
+	for key := range ts.dirty {
+		t, ok := ts.pending[key]
+		if !ok {
+			if err := store.Delete(TimerBucket, []byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		v := make([]byte, 8, 8+len(t.data))
+		binary.BigEndian.PutUint64(v, uint64(t.at.UnixNano()))
+		if err := store.Put(TimerBucket, []byte(key), append(v, t.data...)); err != nil {
+			return err
+		}
+	}
+	ts.dirty = make(map[string]bool)
+	return nil
+}
+
+// load reads the pending timers
+func (ts *timers) load(store state.Store) error {
+	return store.Iterate(TimerBucket, func(k, v []byte) error {
+		if len(v) < 8 {
+			return fmt.Errorf("timer %q: invalid value", k)
+		}
+		at := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		ts.set(string(k), at, append([]byte(nil), v[8:]...))
+		delete(ts.dirty, string(k))
+		return nil
+	})
+}
+
+// SetTimer schedules a callback of the processor, a TimerProcessor, for key
+// at a processing time, replacing the timer of key pending; the timers
+// fire with a resolution of a second
+func (ctx *Context) SetTimer(key string, at time.Time, data []byte) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.timers.set(key, at, data)
+}
+
+// DeleteTimer cancels the timer of key pending
+func (ctx *Context) DeleteTimer(key string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.timers.delete(key)
+}
+
+// Timer returns the time and data of the timer of key pending
+func (ctx *Context) Timer(key string) (at time.Time, data []byte, ok bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	t, ok := ctx.timers.pending[key]
+	if !ok {
+		return time.Time{}, nil, false
+	}
+	return t.at, t.data, true
+}
@@ -0,0 +1,118 @@
+package sp
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xtaci/sp/state"
+)
+
+// fired returns the keys and data of the timers due at now
+func fired(ts *timers, now time.Time) (keys []string, data []string) {
+	for _, t := range ts.due(now) {
+		keys = append(keys, t.key)
+		data = append(data, string(t.data))
+	}
+	return
+}
+
+func TestTimersFire(t *testing.T) {
+	start := time.Unix(1000, 0)
+	ts := newTimers()
+	ts.set("a", start.Add(2*time.Second), []byte("a1"))
+	ts.set("b", start.Add(1*time.Second), []byte("b1"))
+	ts.set("c", start.Add(3*time.Second), []byte("c1"))
+	ts.set("b", start.Add(4*time.Second), []byte("b2")) // replaces b
+	ts.set("d", start.Add(1*time.Second), []byte("d1"))
+	ts.delete("d")
+
+	tests := []struct {
+		now  time.Duration
+		keys []string
+		data []string
+	}{
+		{0, nil, nil},
+		{time.Second, nil, nil}, // b replaced and d deleted
+		{3 * time.Second, []string{"a", "c"}, []string{"a1", "c1"}},
+		{3 * time.Second, nil, nil}, // fired once
+		{time.Minute, []string{"b"}, []string{"b2"}},
+	}
+	for _, tt := range tests {
+		keys, data := fired(ts, start.Add(tt.now))
+		if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(data, tt.data) {
+			t.Fatalf("due at +%v: got %v %v, want %v %v", tt.now, keys, data, tt.keys, tt.data)
+		}
+	}
+	if len(ts.pending) != 0 {
+		t.Fatalf("pending after all fired: %v", len(ts.pending))
+	}
+}
+
+func TestTimersRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timers.cache")
+	start := time.Unix(1000, 0)
+
+	store, err := state.OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTimers()
+	ts.set("fired", start.Add(time.Second), []byte("x"))
+	ts.set("deleted", start.Add(time.Second), []byte("x"))
+	ts.set("session", start.Add(2*time.Second), []byte("s1"))
+	ts.set("expiry", start.Add(time.Hour), nil)
+	ts.delete("deleted")
+	if err := ts.flush(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes of the timers after a checkpoint are stored by the next one
+	if keys, _ := fired(ts, start.Add(time.Second)); !reflect.DeepEqual(keys, []string{"fired"}) {
+		t.Fatalf("fired before restart: %v", keys)
+	}
+	ts.set("session", start.Add(3*time.Second), []byte("s2"))
+	if err := ts.flush(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	ts.set("lost", start.Add(time.Second), nil) // set after the last checkpoint
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = state.OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	restarted := newTimers()
+	if err := restarted.load(store); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.dirty) != 0 {
+		t.Fatalf("dirty after load: %v", restarted.dirty)
+	}
+
+	tests := []struct {
+		now  time.Duration
+		keys []string
+		data []string
+	}{
+		{2 * time.Second, nil, nil},
+		{3 * time.Second, []string{"session"}, []string{"s2"}},
+		{2 * time.Hour, []string{"expiry"}, []string{""}},
+	}
+	for _, tt := range tests {
+		keys, data := fired(restarted, start.Add(tt.now))
+		if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(data, tt.data) {
+			t.Fatalf("due at +%v after restart: got %v %v, want %v %v", tt.now, keys, data, tt.keys, tt.data)
+		}
+	}
+}
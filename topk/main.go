@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	offsetStream  = "__offset_stream__"
+	metaBucket    = "__meta__"
+	watermarkKey  = "watermark"
+	processorName = "topk"
+	outputTable   = "topk"
+)
+
+// TopK is the ranking of a window
+type TopK struct {
+	Start time.Time `json:"window_start"`
+	End   time.Time `json:"window_end"`
+	Total float64   `json:"total"` // weight of all keys
+	Top   []counter `json:"top"`
+}
+
+func main() {
+	app := &cli.App{
+		Name:    processorName,
+		Usage:   "Rank the heaviest keys of stream messages over time windows",
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "stream-topic",
+				Value: "events",
+				Usage: "topic name of the stream to rank",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "extract the json field as the key to rank in stream messages, e.g. the url, format: https://github.com/Jeffail/gabs",
+			},
+			&cli.StringFlag{
+				Name:  "weight",
+				Value: "",
+				Usage: "json field summed per key to rank by, keys are ranked by message count if not set",
+			},
+			&cli.IntFlag{
+				Name:  "k",
+				Value: 100,
+				Usage: "keys emitted per window",
+			},
+			&cli.IntFlag{
+				Name:  "capacity",
+				Value: 0,
+				Usage: "keys counted per window by the space-saving sketch, more is more accurate, default 10*k",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Value: time.Minute,
+				Usage: "size of the tumbling windows, windows are emitted when the timestamps of the messages pass their end",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "encoding of stream messages, json, avro, protobuf or msgpack",
+			},
+			&cli.StringFlag{
+				Name:  "schema-registry-url",
+				Usage: "confluent schema registry resolving the schemas of avro messages, e.g.: http://localhost:8081",
+			},
+			&cli.StringFlag{
+				Name:  "proto-descriptor",
+				Usage: "descriptor set of protobuf messages, generated with: protoc --include_imports --descriptor_set_out=FILE",
+			},
+			&cli.StringFlag{
+				Name:  "proto-message",
+				Usage: "full name of the protobuf type of stream messages",
+			},
+			&cli.StringFlag{
+				Name:  "output-topic",
+				Value: "",
+				Usage: "default output topic name: topk-{stream-topic}",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of window sketches and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: processor,
+	}
+	app.Run(os.Args)
+}
+
+func processor(c *cli.Context) error {
+	if err := logging.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	if err := kafka.Setup(c); err != nil {
+		log.Fatalln(err)
+	}
+	brokers := c.StringSlice("brokers")
+	debug_addr := c.String("debug-addr")
+	stream_topic := c.String("stream-topic")
+	key_path := c.String("key")
+	weight_path := c.String("weight")
+	k := c.Int("k")
+	capacity := c.Int("capacity")
+	if capacity == 0 {
+		capacity = 10 * k
+	}
+	window_size := c.Duration("window")
+	format_name := c.String("format")
+	output_topic := c.String("output-topic")
+	if output_topic == "" {
+		output_topic = fmt.Sprintf("topk-%v", stream_topic)
+	}
+	state_backend := c.String("state-backend")
+	state_options := state.OptionsOf(c)
+	write_interval := c.Duration("write-interval")
+
+	log.Println("brokers:", brokers)
+	log.Println("debug-addr:", debug_addr)
+	debug.Serve(debug_addr)
+	log.Println("stream-topic:", stream_topic)
+	log.Println("key:", key_path)
+	log.Println("weight:", weight_path)
+	log.Println("k:", k)
+	log.Println("capacity:", capacity)
+	log.Println("window:", window_size)
+	log.Println("format:", format_name)
+	log.Println("output-topic:", output_topic)
+	log.Println("state-backend:", state_backend)
+	log.Println("state-options:", state_options)
+	log.Println("write-interval:", write_interval)
+
+	cachefile := fmt.Sprintf(".topk-%v-%v.cache", stream_topic, output_topic)
+	instanceId := fmt.Sprintf("%v-%v", processorName, os.Getpid())
+	log.Println("cache file:", cachefile)
+	log.Println("instanceId:", instanceId)
+
+	if window_size <= 0 {
+		log.Fatalln("window must be positive")
+	}
+	if key_path == "" {
+		log.Fatalln("key must be set")
+	}
+	if k <= 0 || capacity < k {
+		log.Fatalln("k must be positive and capacity at least k")
+	}
+
+	decoder, err := codec.NewDecoder(format_name, codec.Options{
+		SchemaRegistryURL: c.String("schema-registry-url"),
+		ProtoDescriptor:   c.String("proto-descriptor"),
+		ProtoMessage:      c.String("proto-message"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := state.Open(state_backend, cachefile, state_options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, kafka.NewConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// window results in flight, offsets are only committed after all
+	// results produced before have been acknowledged
+	var inflight sync.WaitGroup
+	go func() {
+		for range producer.Successes() {
+			inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			// exit without commit, the stream is reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// read state
+	streamOffsets := make(sp.Offsets)
+	if err := streamOffsets.Load(store, offsetStream); err != nil {
+		log.Fatalln(err)
+	}
+	ws := newWindows(store, processorName, window_size, capacity)
+	ws.load()
+	log.Printf("consuming from stream offsets:%v open windows:%v watermark:%v", streamOffsets, len(ws.open), ws.watermark)
+
+	streamMessages, streamConsumers, err := sp.ConsumeAll(consumer, stream_topic, streamOffsets, sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		for _, pc := range streamConsumers {
+			if err := pc.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}()
+
+	log.Println("started")
+	ticker := time.NewTicker(write_interval)
+	numRanked, numLate, numInvalid, numEmitted := 0, 0, 0, 0
+
+	// parameters
+	host, _ := os.Hostname()
+
+	emit := func(w *window) {
+		data, err := json.Marshal(TopK{Start: w.Start, End: w.End, Total: w.Sketch.Total, Top: w.Sketch.top(k)})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		wal := &sp.WAL{}
+		wal.Type = "TOPK"
+		wal.InstanceId = instanceId
+		wal.Table = outputTable
+		wal.Host = host
+		wal.Data = data
+		wal.Key = fmt.Sprint(w.Start.UnixNano()) // one result per window
+		wal.CreatedAt = time.Now()
+		bts, err := json.Marshal(wal)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		inflight.Add(1)
+		producer.Input() <- &sarama.ProducerMessage{Topic: output_topic, Key: sarama.StringEncoder(wal.Key), Value: sarama.ByteEncoder(bts)}
+		numEmitted++
+	}
+
+	rank := func(msg *sarama.ConsumerMessage) {
+		value, err := decoder.Decode(msg.Value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		jsonParsed, err := gabs.ParseJSON(value)
+		if err != nil {
+			numInvalid++
+			return
+		}
+		v := jsonParsed.Path(key_path).Data()
+		if v == nil {
+			numInvalid++
+			return
+		}
+		weight := 1.0
+		if weight_path != "" {
+			var ok bool
+			if weight, ok = number(jsonParsed.Path(weight_path).Data()); !ok {
+				numInvalid++
+				return
+			}
+		}
+		ts := msg.Timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+
+		if ws.add(fmt.Sprint(v), ts, weight) {
+			numRanked++
+		} else {
+			numLate++
+		}
+		for _, w := range ws.close() {
+			emit(w)
+		}
+	}
+
+	checkpoint := func() {
+		inflight.Wait()
+		if err := ws.flush(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := streamOffsets.Store(store, offsetStream); err != nil {
+			log.Fatalln(err)
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("ranked:", numRanked, "late:", numLate, "invalid:", numInvalid, "emitted:", numEmitted, "open windows:", len(ws.open), "watermark:", ws.watermark, "stream offsets:", streamOffsets)
+		numRanked, numLate, numInvalid, numEmitted = 0, 0, 0, 0
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case msg := <-streamMessages:
+			streamOffsets[msg.Partition] = msg.Offset + 1
+			rank(msg)
+		}
+	}
+}
+
+// number converts json numbers and numeric strings
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, !math.IsNaN(v)
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sort"
+)
+
+// counter is the estimated weight of a key, overestimated by at most Error
+type counter struct {
+	Key    string  `json:"key"`
+	Weight float64 `json:"weight"`
+	Error  float64 `json:"error"`
+	index  int     // in the heap
+}
+
+// sketch estimates the heaviest keys of a stream with the space-saving
+// algorithm: it keeps capacity counters, a key without counter replaces the
+// lightest key and inherits its weight as error, so keys heavier than
+// total/capacity are always counted
+type sketch struct {
+	capacity int
+	Total    float64
+	counters counterHeap
+	keys     map[string]*counter
+}
+
+func newSketch(capacity int) *sketch {
+	return &sketch{capacity: capacity, keys: make(map[string]*counter)}
+}
+
+// add adds weight to key
+func (s *sketch) add(key string, weight float64) {
+	s.Total += weight
+	if c, ok := s.keys[key]; ok {
+		c.Weight += weight
+		heap.Fix(&s.counters, c.index)
+		return
+	}
+	if len(s.counters) < s.capacity {
+		c := &counter{Key: key, Weight: weight}
+		s.keys[key] = c
+		heap.Push(&s.counters, c)
+		return
+	}
+
+	// replace the lightest key
+	c := s.counters[0]
+	delete(s.keys, c.Key)
+	c.Key, c.Error = key, c.Weight
+	c.Weight += weight
+	s.keys[key] = c
+	heap.Fix(&s.counters, 0)
+}
+
+// top returns the k heaviest keys, heaviest first
+func (s *sketch) top(k int) []counter {
+	top := make([]counter, len(s.counters))
+	for i, c := range s.counters {
+		top[i] = *c
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Weight != top[j].Weight {
+			return top[i].Weight > top[j].Weight
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+type sketchJSON struct {
+	Total    float64   `json:"total"`
+	Counters []counter `json:"counters"`
+}
+
+func (s *sketch) MarshalJSON() ([]byte, error) {
+	v := sketchJSON{Total: s.Total, Counters: make([]counter, len(s.counters))}
+	for i, c := range s.counters {
+		v.Counters[i] = *c
+	}
+	return json.Marshal(v)
+}
+
+// unmarshal restores a sketch marshaled with the same capacity
+func (s *sketch) unmarshal(data []byte) error {
+	var v sketchJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	s.Total = v.Total
+	for i := range v.Counters {
+		c := v.Counters[i]
+		s.keys[c.Key] = &c
+		heap.Push(&s.counters, &c)
+	}
+	for len(s.counters) > s.capacity { // capacity lowered
+		c := heap.Pop(&s.counters).(*counter)
+		delete(s.keys, c.Key)
+	}
+	return nil
+}
+
+// counterHeap is a min-heap of counters by weight
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Weight < h[j].Weight }
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// window estimates the heaviest keys within [Start, End)
+type window struct {
+	Start  time.Time `json:"window_start"`
+	End    time.Time `json:"window_end"`
+	Sketch *sketch   `json:"sketch"`
+}
+
+// storeKey is the start of the window, so that windows are stored in the
+// order of their start
+func (w *window) storeKey() string {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(w.Start.UnixNano()))
+	return string(k)
+}
+
+// windows are the open tumbling windows, aligned to the epoch and stored in
+// a bucket of the state store on checkpoint; windows close when the
+// watermark, the greatest timestamp of the messages, passes their end
+type windows struct {
+	store     state.Store
+	bucket    string
+	size      time.Duration
+	capacity  int
+	open      map[string]*window
+	dirty     map[string]bool // windows changed since last checkpoint
+	watermark time.Time
+}
+
+func newWindows(store state.Store, bucket string, size time.Duration, capacity int) *windows {
+	return &windows{store: store, bucket: bucket, size: size, capacity: capacity, open: make(map[string]*window), dirty: make(map[string]bool)}
+}
+
+// add adds weight to key in the window of ts, returns false if the window
+// is already closed
+func (ws *windows) add(key string, ts time.Time, weight float64) bool {
+	if ts.After(ws.watermark) {
+		ws.watermark = ts
+	}
+	start := ts.Truncate(ws.size)
+	w := &window{Start: start, End: start.Add(ws.size)}
+	if !ws.watermark.Before(w.End) {
+		return false
+	}
+	id := w.storeKey()
+	if open, ok := ws.open[id]; ok {
+		w = open
+	} else {
+		w.Sketch = newSketch(ws.capacity)
+		ws.open[id] = w
+	}
+	w.Sketch.add(key, weight)
+	ws.dirty[id] = true
+	return true
+}
+
+// close removes the windows ended at the watermark, returned in the order
+// of their end
+func (ws *windows) close() []*window {
+	var closed []*window
+	for id, w := range ws.open {
+		if !ws.watermark.Before(w.End) {
+			closed = append(closed, w)
+			delete(ws.open, id)
+			delete(ws.dirty, id)
+			if err := ws.store.Delete(ws.bucket, []byte(id)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].End.Before(closed[j].End) })
+	return closed
+}
+
+// flush puts the windows changed since the last checkpoint and the
+// watermark to the store
+func (ws *windows) flush() error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(ws.watermark.UnixNano()))
+	if err := ws.store.Put(metaBucket, []byte(watermarkKey), v); err != nil {
+		return err
+	}
+	for id := range ws.dirty {
+		bts, err := json.Marshal(ws.open[id])
+		if err != nil {
+			return err
+		}
+		if err := ws.store.Put(ws.bucket, []byte(id), bts); err != nil {
+			return err
+		}
+	}
+	ws.dirty = make(map[string]bool)
+	return nil
+}
+
+// load reads the open windows and the watermark
+func (ws *windows) load() {
+	if v, err := ws.store.Get(metaBucket, []byte(watermarkKey)); err != nil {
+		log.Fatalln(err)
+	} else if len(v) == 8 {
+		ws.watermark = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	if err := ws.store.Iterate(ws.bucket, func(k, v []byte) error {
+		var stored struct {
+			Start  time.Time       `json:"window_start"`
+			End    time.Time       `json:"window_end"`
+			Sketch json.RawMessage `json:"sketch"`
+		}
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("window %q: %v", k, err)
+		}
+		w := &window{Start: stored.Start, End: stored.End, Sketch: newSketch(ws.capacity)}
+		if err := w.Sketch.unmarshal(stored.Sketch); err != nil {
+			return fmt.Errorf("window %q: %v", k, err)
+		}
+		ws.open[string(k)] = w
+		return nil
+	}); err != nil {
+		log.Fatalln(err)
+	}
+}
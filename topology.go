@@ -0,0 +1,632 @@
+package sp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xtaci/sp/codec"
+	"github.com/xtaci/sp/debug"
+	"github.com/xtaci/sp/expr"
+	"github.com/xtaci/sp/kafka"
+	"github.com/xtaci/sp/logging"
+	"github.com/xtaci/sp/state"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	// topologyBucket keeps the state of the operators by stage name
+	topologyBucket = "__pipeline__"
+	// tickInterval is the resolution of the timers of the operators
+	tickInterval = time.Second
+)
+
+// Topology is a graph of streams from sources to sinks run in one process,
+// records flow between the stages through channels instead of topics:
+//
+//	t := sp.NewTopology("orders")
+//	users := t.Table("users", "id")
+//	t.Stream("orders").
+//		Where("amount > 100").
+//		Join(users, sp.Field("user_id"), "user").
+//		To("large-orders")
+//	t.Main()
+//
+// The offsets of the sources and the state of the operators are
+// checkpointed in the state store once the records consumed before have
+// been written by the sinks.
+type Topology struct {
+	name    string
+	sources []*source
+	tables  []*KTable
+	stages  []*stage
+	err     error // first error of the builders, returned by Run
+
+	producer sarama.AsyncProducer
+	inflight sync.WaitGroup // records in the channels and in the producer
+}
+
+// Source is a topic consumed by a topology
+type Source struct {
+	Name   string // offsets are kept by name, the topic if not set
+	Topic  string
+	Oldest bool // consume the partitions without offsets from their oldest messages
+	// decoding of messages, json if not set
+	Format            string
+	SchemaRegistryURL string
+	ProtoDescriptor   string
+	ProtoMessage      string
+}
+
+type source struct {
+	Source
+	outs []*stage
+}
+
+// stage is an operator of a topology, fed by a channel and run by a
+// goroutine
+type stage struct {
+	name string
+	op   Operator
+	in   chan *Record
+	outs []*stage
+
+	numIn, numOut, numInvalid int64
+}
+
+// KStream is the output of a source or of a stage, the stages added to a
+// stream all receive its records
+type KStream struct {
+	t      *Topology
+	source *source // nil if the output of a stage
+	stage  *stage
+}
+
+// Config is the environment of a running topology
+type Config struct {
+	Brokers       []string
+	StateBackend  string
+	StateOptions  state.Options
+	WriteInterval time.Duration
+	DebugAddr     string // of pprof and expvar if set
+}
+
+// NewTopology creates an empty topology, its state is kept in the cache
+// file .sp-{name}.cache
+func NewTopology(name string) *Topology {
+	return &Topology{name: name}
+}
+
+// Default is the topology of the package-level builders
+var Default = NewTopology(filepath.Base(os.Args[0]))
+
+// Stream consumes a topic of the default topology
+func Stream(topic string) *KStream { return Default.Stream(topic) }
+
+// Table materializes a topic of the default topology
+func Table(topic, key string) *KTable { return Default.Table(topic, key) }
+
+// Main runs the default topology
+func Main() { Default.Main() }
+
+// Stream consumes a topic of json messages from the newest messages
+func (t *Topology) Stream(topic string) *KStream {
+	return t.Source(Source{Topic: topic})
+}
+
+// Source consumes a topic
+func (t *Topology) Source(s Source) *KStream {
+	if s.Name == "" {
+		s.Name = s.Topic
+	}
+	src := &source{Source: s}
+	t.sources = append(t.sources, src)
+	return &KStream{t: t, source: src}
+}
+
+// Table materializes the latest message of each key of a topic, keyed by
+// the field of a dotted path or by the keys of messages if key is empty;
+// the topic is read from its oldest messages before the sources are
+// consumed
+func (t *Topology) Table(topic, key string) *KTable {
+	table := &KTable{topic: topic, key: key, rows: make(map[string]map[string]interface{})}
+	t.tables = append(t.tables, table)
+	return table
+}
+
+// Err returns the first error of the builders, e.g. of expressions
+func (t *Topology) Err() error { return t.err }
+
+// fail records the first error of the builders
+func (t *Topology) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Through adds a stage of an operator to the stream
+func (s *KStream) Through(op Operator) *KStream {
+	st := &stage{name: fmt.Sprintf("stage-%v", len(s.t.stages)), op: op, in: make(chan *Record, 128)}
+	if s.source != nil {
+		s.source.outs = append(s.source.outs, st)
+	} else {
+		s.stage.outs = append(s.stage.outs, st)
+	}
+	s.t.stages = append(s.t.stages, st)
+	return &KStream{t: s.t, stage: st}
+}
+
+// Named names the stage of the stream, the state of the operator is kept
+// by name, e.g. the open windows of aggregations
+func (s *KStream) Named(name string) *KStream {
+	if s.stage == nil {
+		s.t.fail(errors.New("sources are named by Source"))
+		return s
+	}
+	for _, st := range s.t.stages {
+		if st.name == name && st != s.stage {
+			s.t.fail(fmt.Errorf("stage %v named twice", name))
+		}
+	}
+	s.stage.name = name
+	return s
+}
+
+// Filter forwards the records for which pred is true
+func (s *KStream) Filter(pred func(r *Record) bool) *KStream {
+	return s.Through(&filterOp{pred: func(r *Record) (bool, error) { return pred(r), nil }})
+}
+
+// Where forwards the records matching a predicate of package expr, e.g.:
+// status == "error" && latency_ms > 500
+func (s *KStream) Where(predicate string) *KStream {
+	e, err := expr.Compile(predicate)
+	if err != nil {
+		s.t.fail(fmt.Errorf("where %q: %v", predicate, err))
+		e = expr.MustCompile("false")
+	}
+	return s.Through(&filterOp{pred: func(r *Record) (bool, error) { return e.Bool(r.Fields) }})
+}
+
+// Map transforms records in place, records whose fields are set to nil are
+// dropped
+func (s *KStream) Map(fn func(r *Record) error) *KStream {
+	return s.Through(&mapOp{fn: fn})
+}
+
+// KeyBy sets the keys of records to a value, nil removes them
+func (s *KStream) KeyBy(key Value) *KStream {
+	return s.Map(func(r *Record) error {
+		v, err := key(r)
+		if err != nil {
+			return err
+		}
+		r.Key = nil
+		if v != nil {
+			r.Key = []byte(fmt.Sprint(v))
+		}
+		return nil
+	})
+}
+
+// Join sets the field as of records to the row of table of the key on, or
+// merges the fields of the row missing from records if as is empty;
+// records without a row are forwarded as is
+func (s *KStream) Join(table *KTable, on Value, as string) *KStream {
+	return s.Through(&joinOp{table: table, on: on, as: as})
+}
+
+// InnerJoin is like Join but drops the records without a row
+func (s *KStream) InnerJoin(table *KTable, on Value, as string) *KStream {
+	return s.Through(&joinOp{table: table, on: on, as: as, inner: true})
+}
+
+// Aggregate aggregates records in tumbling windows, emitting a record of
+// window_start, window_end, key and the aggregates per group of a window
+func (s *KStream) Aggregate(w Window) *KStream {
+	op, err := newAggregateOp(w)
+	if err != nil {
+		s.t.fail(err)
+		return s.Through(&filterOp{pred: func(*Record) (bool, error) { return false, nil }})
+	}
+	return s.Through(op)
+}
+
+// To produces records to a topic as json
+func (s *KStream) To(topic string) {
+	s.Through(&sinkOp{t: s.t, topic: topic}).stage.name = "to-" + topic
+}
+
+// Print writes records to stdout as json lines
+func (s *KStream) Print() {
+	s.Through(&sinkOp{t: s.t, stdout: true}).stage.name = "print"
+}
+
+// sinkOp produces records to a topic as json, or prints them
+type sinkOp struct {
+	Stateless
+	t      *Topology
+	topic  string
+	stdout bool
+}
+
+func (op *sinkOp) Process(r *Record, emit func(*Record)) error {
+	value, err := json.Marshal(r.Fields)
+	if err != nil {
+		return err
+	}
+	if op.stdout {
+		fmt.Println(string(value))
+		return nil
+	}
+	msg := &sarama.ProducerMessage{Topic: op.topic, Value: sarama.ByteEncoder(value)}
+	if r.Key != nil {
+		msg.Key = sarama.ByteEncoder(r.Key)
+	}
+	op.t.inflight.Add(1)
+	op.t.producer.Input() <- msg
+	return nil
+}
+
+// emit sends a record to stages, copied for all but the last
+func (t *Topology) emit(to []*stage, r *Record) {
+	for i, s := range to {
+		out := r
+		if i < len(to)-1 {
+			out = r.clone()
+		}
+		t.inflight.Add(1)
+		s.in <- out
+	}
+}
+
+// run processes the records of a stage, tick markers are forwarded to the
+// downstream stages after the timers of the stage
+func (t *Topology) run(s *stage) {
+	emit := func(r *Record) {
+		atomic.AddInt64(&s.numOut, 1)
+		t.emit(s.outs, r)
+	}
+	for r := range s.in {
+		if r.tick {
+			s.op.Tick(r.now, emit)
+			t.emit(s.outs, r)
+		} else {
+			atomic.AddInt64(&s.numIn, 1)
+			if err := s.op.Process(r, emit); err != nil {
+				atomic.AddInt64(&s.numInvalid, 1)
+			}
+		}
+		t.inflight.Done()
+	}
+}
+
+// Main runs the topology with the flags brokers, state-backend, the options
+// of the backends and write-interval until SIGINT or SIGTERM
+func (t *Topology) Main() {
+	app := &cli.App{
+		Name:    t.name,
+		Usage:   "Run the topology " + t.name,
+		Version: "0.1",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "brokers, b",
+				Value: cli.NewStringSlice("localhost:9092"),
+				Usage: "kafka brokers address",
+			},
+			&cli.StringFlag{
+				Name:  "state-backend",
+				Value: "bolt",
+				Usage: "store of state and offsets, bolt, badger, redis or rocksdb (build with -tags rocksdb)",
+			},
+			&cli.DurationFlag{
+				Name:  "write-interval",
+				Value: 30 * time.Second,
+				Usage: "interval for cache writing",
+			},
+			&cli.StringFlag{
+				Name:  "debug-addr",
+				Value: "",
+				Usage: "serve net/http/pprof and expvar under /debug/ on the address, e.g.: localhost:6060",
+			},
+		}, append(append(state.Flags, logging.Flags...), kafka.Flags...)...),
+		Action: func(c *cli.Context) error {
+			if err := logging.Setup(c); err != nil {
+				return err
+			}
+			if err := kafka.Setup(c); err != nil {
+				return err
+			}
+			return t.Run(Config{
+				Brokers:       c.StringSlice("brokers"),
+				StateBackend:  c.String("state-backend"),
+				StateOptions:  state.OptionsOf(c),
+				WriteInterval: c.Duration("write-interval"),
+				DebugAddr:     c.String("debug-addr"),
+			})
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Run runs the topology until SIGINT or SIGTERM, errors of the builders
+// and of the setup are returned, errors while running are fatal
+func (t *Topology) Run(cfg Config) error {
+	if t.err != nil {
+		return t.err
+	}
+	if len(t.sources) == 0 {
+		return errors.New("no source")
+	}
+	log.Println("topology:", t.name)
+	log.Println("brokers:", cfg.Brokers)
+	log.Println("state-backend:", cfg.StateBackend)
+	log.Println("state-options:", cfg.StateOptions)
+	log.Println("write-interval:", cfg.WriteInterval)
+	log.Println("debug-addr:", cfg.DebugAddr)
+	debug.Serve(cfg.DebugAddr)
+
+	cachefile := fmt.Sprintf(".sp-%v.cache", t.name)
+	log.Println("cache file:", cachefile)
+	store, err := state.Open(cfg.StateBackend, cachefile, cfg.StateOptions)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	decoders := make([]codec.Decoder, len(t.sources))
+	for i, s := range t.sources {
+		format := s.Format
+		if format == "" {
+			format = "json"
+		}
+		if decoders[i], err = codec.NewDecoder(format, codec.Options{
+			SchemaRegistryURL: s.SchemaRegistryURL,
+			ProtoDescriptor:   s.ProtoDescriptor,
+			ProtoMessage:      s.ProtoMessage,
+		}); err != nil {
+			return fmt.Errorf("source %v: %v", s.Name, err)
+		}
+	}
+	for _, s := range t.stages {
+		if v, err := store.Get(topologyBucket, []byte(s.name)); err != nil {
+			return err
+		} else if v != nil {
+			if err := s.op.Load(v); err != nil {
+				return fmt.Errorf("stage %v: %v", s.name, err)
+			}
+		}
+	}
+
+	client, err := sarama.NewClient(cfg.Brokers, kafka.NewConfig())
+	if err != nil {
+		return err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	t.producer, err = sarama.NewAsyncProducer(cfg.Brokers, config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := t.producer.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		client.Close()
+	}()
+
+	for _, table := range t.tables {
+		pcs, err := table.load(client, consumer)
+		if err != nil {
+			return fmt.Errorf("table %v: %v", table.topic, err)
+		}
+		defer func() {
+			for _, pc := range pcs {
+				pc.Close()
+			}
+		}()
+	}
+
+	// messages in flight, offsets are only committed after all messages
+	// produced before have been acknowledged
+	go func() {
+		for range t.producer.Successes() {
+			t.inflight.Done()
+		}
+	}()
+	go func() {
+		for err := range t.producer.Errors() {
+			// exit without commit, the sources are reprocessed from last checkpoint
+			log.Fatalln(err)
+		}
+	}()
+	for _, s := range t.stages {
+		go t.run(s)
+	}
+
+	// consume the sources into one channel
+	type sourceMessage struct {
+		source int
+		msg    *sarama.ConsumerMessage
+	}
+	messages := make(chan sourceMessage)
+	offsets := make([]Offsets, len(t.sources))
+	numConsumed := make([]int, len(t.sources))
+	numInvalid := make([]int, len(t.sources))
+	for i, s := range t.sources {
+		offsets[i] = make(Offsets)
+		if err := offsets[i].Load(store, offsetBucket(s.Name)); err != nil {
+			return err
+		}
+		log.Printf("source %v consuming from offsets:%v", s.Name, offsets[i])
+		defaultOffset := sarama.OffsetNewest
+		if s.Oldest {
+			defaultOffset = sarama.OffsetOldest
+		}
+		msgs, pcs, err := ConsumeAll(consumer, s.Topic, offsets[i], defaultOffset)
+		if err != nil {
+			return fmt.Errorf("source %v: %v", s.Name, err)
+		}
+		defer func() {
+			for _, pc := range pcs {
+				if err := pc.Close(); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}()
+		go func(i int) {
+			for msg := range msgs {
+				messages <- sourceMessage{i, msg}
+			}
+		}(i)
+	}
+
+	checkpoint := func() {
+		t.inflight.Wait()
+		for _, s := range t.stages {
+			v, err := s.op.Save()
+			if err != nil {
+				log.Fatalln(s.name, err)
+			}
+			if v != nil {
+				if err := store.Put(topologyBucket, []byte(s.name), v); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}
+		for i, s := range t.sources {
+			if err := offsets[i].Store(store, offsetBucket(s.Name)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if err := store.Checkpoint(); err != nil {
+			log.Fatalln(err)
+		}
+		for i, s := range t.sources {
+			log.Println("source:", s.Name, "consumed:", numConsumed[i], "invalid:", numInvalid[i], "offsets:", offsets[i])
+			numConsumed[i], numInvalid[i] = 0, 0
+		}
+		for _, s := range t.stages {
+			log.Println("stage:", s.name, "in:", atomic.SwapInt64(&s.numIn, 0), "out:", atomic.SwapInt64(&s.numOut, 0), "invalid:", atomic.SwapInt64(&s.numInvalid, 0))
+		}
+	}
+
+	log.Println("started")
+	ticker := time.NewTicker(cfg.WriteInterval)
+	timers := time.NewTicker(tickInterval)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case now := <-timers.C:
+			for _, s := range t.sources {
+				t.emit(s.outs, &Record{tick: true, now: now})
+			}
+		case <-ticker.C:
+			checkpoint()
+		case sig := <-signals:
+			log.Println("received signal:", sig)
+			checkpoint()
+			log.Println("stopped")
+			return nil
+		case m := <-messages:
+			offsets[m.source][m.msg.Partition] = m.msg.Offset + 1
+			numConsumed[m.source]++
+			value, err := decoders[m.source].Decode(m.msg.Value)
+			if err != nil {
+				numInvalid[m.source]++
+				log.WithFields(logging.Message(m.msg)).WithError(err).Debugln("invalid message")
+				continue
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(value, &fields); err != nil || fields == nil {
+				numInvalid[m.source]++
+				log.WithFields(logging.Message(m.msg)).Debugln("invalid message: not a json object")
+				continue
+			}
+			t.emit(t.sources[m.source].outs, &Record{Key: m.msg.Key, Fields: fields})
+		}
+	}
+}
+
+// offsetBucket is the bucket of the offsets of a source
+func offsetBucket(source string) string {
+	return fmt.Sprintf("__offset_%v__", source)
+}
+
+// load consumes the topic of a table from its oldest messages, returns once
+// the messages present at startup have been read, or once no message came
+// for CatchUpIdle from the partitions whose last offsets are never delivered
+func (t *KTable) load(client sarama.Client, consumer sarama.Consumer) (map[int32]sarama.PartitionConsumer, error) {
+	pending, err := pendingOffsets(client, t.topic, make(Offsets))
+	if err != nil {
+		return nil, err
+	}
+	msgs, pcs, err := ConsumeAll(consumer, t.topic, make(Offsets), sarama.OffsetOldest)
+	if err != nil {
+		return nil, err
+	}
+	catchUp := NewCatchUp(pending, pcs)
+
+	ready := make(chan struct{})
+	go func() {
+		n := 0
+		idle := time.NewTicker(time.Second)
+		defer idle.Stop()
+		idleC := idle.C
+		loaded := func() {
+			log.Println("table loaded:", t.topic, "messages:", n)
+			close(ready)
+			idleC = nil
+		}
+		if catchUp.Len() == 0 {
+			loaded()
+		}
+		for {
+			select {
+			case msg := <-msgs:
+				var row map[string]interface{}
+				if msg.Value == nil || json.Unmarshal(msg.Value, &row) == nil {
+					key := string(msg.Key)
+					if t.key != "" && row != nil {
+						key = fmt.Sprint(expr.Lookup(row, t.key))
+					}
+					t.put(key, row)
+					n++
+				}
+
+				if catchUp.Consumed(msg) && catchUp.Len() == 0 {
+					loaded()
+				}
+			case <-idleC:
+				if settled := catchUp.Settle(); settled != nil {
+					log.Println("table caught up without reaching the high-watermarks:", t.topic, "partitions:", settled)
+					loaded()
+				}
+			}
+		}
+	}()
+	<-ready
+	return pcs, nil
+}
@@ -0,0 +1,232 @@
+// Package tracing traces the messages flowing through the processors with
+// OpenTelemetry: the W3C trace context is extracted from the headers of the
+// kafka messages consumed and injected into the headers of the messages
+// produced, so that the spans of a message in the processors it crosses,
+// e.g. joiner, enricher and the sinks, belong to one trace.
+//
+// The spans are recorded by the global tracer provider, which exports them
+// over OTLP/HTTP to the collector of --otel-endpoint, or is installed by the
+// OpenTelemetry Go auto-instrumentation or by a program embedding the
+// processors with otel.SetTracerProvider; without provider the trace context
+// of the messages is still forwarded.
+package tracing
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/Shopify/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// Flags are the flags of tracing
+var Flags = []cli.Flag{
+	&cli.Float64Flag{
+		Name:  "trace-ratio",
+		Value: 0,
+		Usage: "ratio of the messages without trace context in their headers starting a trace, 0 to 1; messages with a sampled trace context are always traced",
+	},
+	&cli.StringFlag{
+		Name:  "otel-endpoint",
+		Value: "",
+		Usage: "export the spans over OTLP/HTTP to the collector at the url, e.g.: http://localhost:4318",
+	},
+}
+
+// propagator reads and writes the trace context of the w3c
+var propagator = propagation.TraceContext{}
+
+// Tracer starts the spans of the messages of a processor
+type Tracer struct {
+	tracer trace.Tracer
+	ratio  float64
+}
+
+// New creates the tracer of a processor starting traces for a ratio of
+// the messages without trace context
+func New(name string, ratio float64) *Tracer {
+	return &Tracer{tracer: otel.Tracer("github.com/xtaci/sp/" + name), ratio: ratio}
+}
+
+// provider is the tracer provider installed by Export, nil if none
+var provider *sdktrace.TracerProvider
+
+// Setup creates the tracer of a processor with the flags of tracing, the
+// spans are exported to the collector of otel-endpoint if set
+func Setup(c *cli.Context, name string) (*Tracer, error) {
+	if endpoint := c.String("otel-endpoint"); endpoint != "" {
+		if err := Export(name, endpoint); err != nil {
+			return nil, err
+		}
+	}
+	return New(name, c.Float64("trace-ratio")), nil
+}
+
+// Export installs the global tracer provider, which exports the spans of
+// the service name in batches over OTLP/HTTP to the collector at endpoint
+func Export(name, endpoint string) error {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return err
+	}
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+	)
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// Shutdown exports the spans left and stops the provider installed by
+// Export, if any
+func Shutdown() error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(context.Background())
+}
+
+// Start starts the span of a message consumed, continuing the trace of its
+// headers or starting a trace if sampled; the span is not recording if the
+// message is not traced
+func (t *Tracer) Start(msg *sarama.ConsumerMessage, name string) (context.Context, trace.Span) {
+	ctx := Extract(msg)
+	if !trace.SpanContextFromContext(ctx).IsSampled() && (t.ratio <= 0 || rand.Float64() >= t.ratio) {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return t.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int64("messaging.kafka.destination.partition", int64(msg.Partition)),
+			attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+		))
+}
+
+// Stage starts the span of a stage of the processing of a message, e.g.
+// parse, lookup or produce, as a child of the span of ctx; the span is not
+// recording if the message is not traced
+func (t *Tracer) Stage(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsSampled() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// Batch starts the span of a stage handling several messages at once, e.g.
+// a bulk write, continuing the trace of a single message or linked to the
+// traces of the messages; the span is not recording if none is traced
+func (t *Tracer) Batch(traces []context.Context, name string) (context.Context, trace.Span) {
+	if len(traces) == 1 {
+		return t.Stage(traces[0], name)
+	}
+	var links []trace.Link
+	for _, ctx := range traces {
+		if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	if len(links) == 0 {
+		ctx := context.Background()
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return t.tracer.Start(context.Background(), name,
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("messaging.batch.message_count", len(traces))))
+}
+
+// Fail records err on span
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Extract returns the context of the trace context in the headers of msg
+func Extract(msg *sarama.ConsumerMessage) context.Context {
+	if len(msg.Headers) == 0 {
+		return context.Background()
+	}
+	return propagator.Extract(context.Background(), consumerHeaders(msg.Headers))
+}
+
+// Inject writes the trace context of ctx to the headers of out
+func Inject(ctx context.Context, out *sarama.ProducerMessage) {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		propagator.Inject(ctx, &producerHeaders{out})
+	}
+}
+
+// InjectHTTP writes the trace context of ctx to the headers of an http
+// request
+func InjectHTTP(ctx context.Context, header map[string][]string) {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	}
+}
+
+// consumerHeaders are the headers of a message consumed
+type consumerHeaders []*sarama.RecordHeader
+
+func (h consumerHeaders) Get(key string) string {
+	for _, r := range h {
+		if r != nil && string(r.Key) == key {
+			return string(r.Value)
+		}
+	}
+	return ""
+}
+
+func (h consumerHeaders) Set(key, value string) {}
+
+func (h consumerHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for _, r := range h {
+		if r != nil {
+			keys = append(keys, string(r.Key))
+		}
+	}
+	return keys
+}
+
+// producerHeaders are the headers of a message produced
+type producerHeaders struct {
+	msg *sarama.ProducerMessage
+}
+
+func (h *producerHeaders) Get(key string) string {
+	for _, r := range h.msg.Headers {
+		if string(r.Key) == key {
+			return string(r.Value)
+		}
+	}
+	return ""
+}
+
+func (h *producerHeaders) Set(key, value string) {
+	for i, r := range h.msg.Headers {
+		if string(r.Key) == key {
+			h.msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	h.msg.Headers = append(h.msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (h *producerHeaders) Keys() []string {
+	keys := make([]string, 0, len(h.msg.Headers))
+	for _, r := range h.msg.Headers {
+		keys = append(keys, string(r.Key))
+	}
+	return keys
+}